@@ -0,0 +1,568 @@
+// Package anki writes collections in the Anki package (.apkg) format. A
+// package is a zip containing an SQLite collection named collection.anki2,
+// a media manifest, and the media files themselves.
+package anki
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	BASIC_MODEL_ID int64 = 1700000000001
+	CLOZE_MODEL_ID int64 = 1700000000002
+	DECK_ID        int64 = 1700000000100
+
+	FIELD_SEPARATOR = "\x1f"
+)
+
+type ModelType int
+
+const (
+	Basic ModelType = iota
+	Cloze
+)
+
+// Card types and queues share the same numbering in Anki for the states we
+// export.
+const (
+	CardNew        = 0
+	CardLearning   = 1
+	CardReview     = 2
+	CardRelearning = 3
+)
+
+// Review types used in the revlog table.
+const (
+	ReviewLearn   = 0
+	ReviewReview  = 1
+	ReviewRelearn = 2
+)
+
+type Deck struct {
+	Name  string
+	Notes []Note
+	Media []Media
+}
+
+// Note holds the fields for one Anki note. Basic notes use Front, Back and
+// Source fields. Cloze notes use Text, Extra and Source fields and produce one
+// card per cloze index.
+type Note struct {
+	GUID     string
+	Model    ModelType
+	Fields   []string
+	Tags     []string
+	Modified time.Time
+	Cards    []Card
+}
+
+type Card struct {
+	// Ord is the template ordinal: 0 for basic notes, cloze index - 1 for
+	// cloze notes.
+	Ord        int
+	Type       int
+	Due        *time.Time
+	Interval   int
+	Reps       int
+	Lapses     int
+	Stability  float64
+	Difficulty float64
+	Reviews    []Review
+}
+
+type Review struct {
+	Time time.Time
+	// Ease is 1 (again) to 4 (easy).
+	Ease     int
+	Interval int
+	Type     int
+}
+
+type Media struct {
+	Name string
+	Data []byte
+}
+
+// WritePackage builds the collection for the deck and writes the zipped
+// package to w.
+func WritePackage(w io.Writer, deck Deck, now time.Time) error {
+	dir, err := os.MkdirTemp("", "apkg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	collectionPath := filepath.Join(dir, "collection.anki2")
+	if err := writeCollection(collectionPath, deck, now); err != nil {
+		return err
+	}
+	collection, err := os.ReadFile(collectionPath)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	file, err := archive.Create("collection.anki2")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(collection); err != nil {
+		return err
+	}
+
+	manifest := make(map[string]string)
+	for i, media := range deck.Media {
+		key := strconv.Itoa(i)
+		manifest[key] = media.Name
+		file, err := archive.Create(key)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(media.Data); err != nil {
+			return err
+		}
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	file, err = archive.Create("media")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(manifestData); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func writeCollection(path string, deck Deck, now time.Time) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(SCHEMA); err != nil {
+		return fmt.Errorf("unable to create collection: %w", err)
+	}
+
+	created := collectionCreated(deck, now)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertCollection(tx, deck, created, now); err != nil {
+		return err
+	}
+
+	// Anki expects ids to look like millisecond timestamps and to be unique
+	// per table, so they are handed out sequentially from the export time.
+	nextNoteID := now.UnixMilli()
+	nextCardID := now.UnixMilli()
+	usedRevlogIDs := make(map[int64]bool)
+
+	for position, note := range deck.Notes {
+		noteID := nextNoteID
+		nextNoteID++
+		if err := insertNote(tx, noteID, note, now); err != nil {
+			return err
+		}
+		for _, card := range note.Cards {
+			cardID := nextCardID
+			nextCardID++
+			if err := insertCard(tx, cardID, noteID, position, card, created, now); err != nil {
+				return err
+			}
+			for _, review := range card.Reviews {
+				reviewID := review.Time.UnixMilli()
+				for usedRevlogIDs[reviewID] {
+					reviewID++
+				}
+				usedRevlogIDs[reviewID] = true
+				_, err := tx.Exec(`
+				INSERT INTO revlog (id, cid, usn, ease, ivl, lastIvl, factor, time, type)
+				VALUES (?, ?, -1, ?, ?, 0, ?, 0, ?)`,
+					reviewID, cardID, review.Ease, review.Interval, easeFactor(card.Difficulty), review.Type)
+				if err != nil {
+					return fmt.Errorf("unable to insert review: %w", err)
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// collectionCreated is the day the collection starts counting from. Review
+// due dates are stored as days since this point, so it must not be later than
+// any due date in the deck.
+func collectionCreated(deck Deck, now time.Time) time.Time {
+	earliest := now
+	for _, note := range deck.Notes {
+		for _, card := range note.Cards {
+			if card.Due != nil && card.Due.Before(earliest) {
+				earliest = *card.Due
+			}
+		}
+	}
+	earliest = earliest.UTC()
+	return time.Date(earliest.Year(), earliest.Month(), earliest.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func insertCollection(tx *sql.Tx, deck Deck, created, now time.Time) error {
+	models, err := json.Marshal(map[string]interface{}{
+		strconv.FormatInt(BASIC_MODEL_ID, 10): basicModel(now),
+		strconv.FormatInt(CLOZE_MODEL_ID, 10): clozeModel(now),
+	})
+	if err != nil {
+		return err
+	}
+	decks, err := json.Marshal(map[string]interface{}{
+		"1":                            deckConfig(1, "Default", now),
+		strconv.FormatInt(DECK_ID, 10): deckConfig(DECK_ID, deck.Name, now),
+	})
+	if err != nil {
+		return err
+	}
+	conf, err := json.Marshal(map[string]interface{}{
+		"nextPos":       len(deck.Notes) + 1,
+		"estTimes":      true,
+		"activeDecks":   []int64{DECK_ID},
+		"sortType":      "noteFld",
+		"timeLim":       0,
+		"sortBackwards": false,
+		"addToCur":      true,
+		"curDeck":       DECK_ID,
+		"newBury":       true,
+		"newSpread":     0,
+		"dueCounts":     true,
+		"curModel":      strconv.FormatInt(BASIC_MODEL_ID, 10),
+		"collapseTime":  1200,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO col (id, crt, mod, scm, ver, dty, usn, ls, conf, models, decks, dconf, tags)
+	VALUES (1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')`,
+		created.Unix(), now.UnixMilli(), now.UnixMilli(),
+		string(conf), string(models), string(decks), DECK_OPTIONS)
+	if err != nil {
+		return fmt.Errorf("unable to insert collection: %w", err)
+	}
+	return nil
+}
+
+func insertNote(tx *sql.Tx, noteID int64, note Note, now time.Time) error {
+	modelID := BASIC_MODEL_ID
+	if note.Model == Cloze {
+		modelID = CLOZE_MODEL_ID
+	}
+	modified := note.Modified
+	if modified.IsZero() {
+		modified = now
+	}
+	sortField := ""
+	if len(note.Fields) > 0 {
+		sortField = StripHTML(note.Fields[0])
+	}
+	tags := ""
+	if len(note.Tags) > 0 {
+		tags = " " + strings.Join(note.Tags, " ") + " "
+	}
+
+	_, err := tx.Exec(`
+	INSERT INTO notes (id, guid, mid, mod, usn, tags, flds, sfld, csum, flags, data)
+	VALUES (?, ?, ?, ?, -1, ?, ?, ?, ?, 0, '')`,
+		noteID, note.GUID, modelID, modified.Unix(), tags,
+		strings.Join(note.Fields, FIELD_SEPARATOR), sortField, fieldChecksum(sortField))
+	if err != nil {
+		return fmt.Errorf("unable to insert note: %w", err)
+	}
+	return nil
+}
+
+func insertCard(tx *sql.Tx, cardID, noteID int64, position int, card Card, created, now time.Time) error {
+	due := int64(position + 1)
+	queue := card.Type
+	switch card.Type {
+	case CardLearning, CardRelearning:
+		// learning cards are due at a timestamp
+		queue = CardLearning
+		if card.Due != nil {
+			due = card.Due.Unix()
+		} else {
+			due = now.Unix()
+		}
+	case CardReview:
+		if card.Due != nil {
+			due = int64(card.Due.Sub(created).Hours() / 24)
+		} else {
+			due = int64(now.Sub(created).Hours() / 24)
+		}
+	}
+
+	data := ""
+	if card.Stability > 0 {
+		memory, err := json.Marshal(map[string]float64{
+			"s": card.Stability,
+			"d": card.Difficulty,
+		})
+		if err != nil {
+			return err
+		}
+		data = string(memory)
+	}
+
+	_, err := tx.Exec(`
+	INSERT INTO cards
+	(id, nid, did, ord, mod, usn, type, queue, due, ivl, factor, reps, lapses, left, odue, odid, flags, data)
+	VALUES (?, ?, ?, ?, ?, -1, ?, ?, ?, ?, ?, ?, ?, 0, 0, 0, 0, ?)`,
+		cardID, noteID, DECK_ID, card.Ord, now.Unix(), card.Type, queue, due,
+		card.Interval, easeFactor(card.Difficulty), card.Reps, card.Lapses, data)
+	if err != nil {
+		return fmt.Errorf("unable to insert card: %w", err)
+	}
+	return nil
+}
+
+// easeFactor maps an FSRS difficulty (1-10) onto the SM-2 ease factor Anki
+// shows for collections that do not use FSRS.
+func easeFactor(difficulty float64) int {
+	if difficulty <= 0 {
+		return 2500
+	}
+	return int(3000 - (difficulty-1)*(1700.0/9.0))
+}
+
+// fieldChecksum is the first 8 hex digits of the sha1 of the sort field,
+// which Anki uses for duplicate detection.
+func fieldChecksum(field string) int64 {
+	sum := sha1.Sum([]byte(field))
+	value, _ := strconv.ParseInt(hex.EncodeToString(sum[:])[:8], 16, 64)
+	return value
+}
+
+func StripHTML(input string) string {
+	var builder strings.Builder
+	inTag := false
+	for _, r := range input {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+		case !inTag:
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+func fieldDefinitions(names ...string) []map[string]interface{} {
+	fields := []map[string]interface{}{}
+	for i, name := range names {
+		fields = append(fields, map[string]interface{}{
+			"name":   name,
+			"ord":    i,
+			"sticky": false,
+			"rtl":    false,
+			"font":   "Arial",
+			"size":   20,
+			"media":  []string{},
+		})
+	}
+	return fields
+}
+
+func basicModel(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"id":    BASIC_MODEL_ID,
+		"name":  "Zettelgarden Basic",
+		"type":  int(Basic),
+		"mod":   now.Unix(),
+		"usn":   -1,
+		"sortf": 0,
+		"did":   DECK_ID,
+		"tmpls": []map[string]interface{}{{
+			"name":  "Card 1",
+			"ord":   0,
+			"qfmt":  "{{Front}}",
+			"afmt":  "{{FrontSide}}<hr id=answer>{{Back}}<div class=source>{{Source}}</div>",
+			"did":   nil,
+			"bqfmt": "",
+			"bafmt": "",
+		}},
+		"flds":      fieldDefinitions("Front", "Back", "Source"),
+		"css":       MODEL_CSS,
+		"latexPre":  LATEX_PRE,
+		"latexPost": "\\end{document}",
+		"tags":      []string{},
+		"vers":      []string{},
+		"req":       []interface{}{[]interface{}{0, "any", []int{0}}},
+	}
+}
+
+func clozeModel(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"id":    CLOZE_MODEL_ID,
+		"name":  "Zettelgarden Cloze",
+		"type":  int(Cloze),
+		"mod":   now.Unix(),
+		"usn":   -1,
+		"sortf": 0,
+		"did":   DECK_ID,
+		"tmpls": []map[string]interface{}{{
+			"name":  "Cloze",
+			"ord":   0,
+			"qfmt":  "{{cloze:Text}}",
+			"afmt":  "{{cloze:Text}}<br>{{Extra}}<div class=source>{{Source}}</div>",
+			"did":   nil,
+			"bqfmt": "",
+			"bafmt": "",
+		}},
+		"flds":      fieldDefinitions("Text", "Extra", "Source"),
+		"css":       MODEL_CSS,
+		"latexPre":  LATEX_PRE,
+		"latexPost": "\\end{document}",
+		"tags":      []string{},
+		"vers":      []string{},
+	}
+}
+
+func deckConfig(id int64, name string, now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"id":               id,
+		"name":             name,
+		"mod":              now.Unix(),
+		"usn":              -1,
+		"desc":             "",
+		"dyn":              0,
+		"conf":             1,
+		"collapsed":        false,
+		"browserCollapsed": false,
+		"newToday":         []int{0, 0},
+		"revToday":         []int{0, 0},
+		"lrnToday":         []int{0, 0},
+		"timeToday":        []int{0, 0},
+		"extendNew":        10,
+		"extendRev":        50,
+	}
+}
+
+const MODEL_CSS = `.card {
+ font-family: arial;
+ font-size: 20px;
+ text-align: left;
+ color: black;
+ background-color: white;
+}
+.cloze {
+ font-weight: bold;
+ color: blue;
+}
+.source {
+ margin-top: 1em;
+ font-size: 12px;
+ color: gray;
+}`
+
+const LATEX_PRE = "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage[utf8]{inputenc}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\setlength{\\parindent}{0in}\n\\begin{document}\n"
+
+const DECK_OPTIONS = `{"1": {
+	"id": 1, "name": "Default", "mod": 0, "usn": 0, "maxTaken": 60, "autoplay": true,
+	"timer": 0, "replayq": true, "dyn": false,
+	"new": {"bury": true, "delays": [1, 10], "initialFactor": 2500, "ints": [1, 4, 7], "order": 1, "perDay": 20, "separate": true},
+	"lapse": {"delays": [10], "leechAction": 0, "leechFails": 8, "minInt": 1, "mult": 0},
+	"rev": {"bury": true, "ease4": 1.3, "fuzz": 0.05, "ivlFct": 1, "maxIvl": 36500, "minSpace": 1, "perDay": 200}
+}}`
+
+const SCHEMA = `
+CREATE TABLE col (
+	id integer primary key,
+	crt integer not null,
+	mod integer not null,
+	scm integer not null,
+	ver integer not null,
+	dty integer not null,
+	usn integer not null,
+	ls integer not null,
+	conf text not null,
+	models text not null,
+	decks text not null,
+	dconf text not null,
+	tags text not null
+);
+CREATE TABLE notes (
+	id integer primary key,
+	guid text not null,
+	mid integer not null,
+	mod integer not null,
+	usn integer not null,
+	tags text not null,
+	flds text not null,
+	sfld integer not null,
+	csum integer not null,
+	flags integer not null,
+	data text not null
+);
+CREATE TABLE cards (
+	id integer primary key,
+	nid integer not null,
+	did integer not null,
+	ord integer not null,
+	mod integer not null,
+	usn integer not null,
+	type integer not null,
+	queue integer not null,
+	due integer not null,
+	ivl integer not null,
+	factor integer not null,
+	reps integer not null,
+	lapses integer not null,
+	left integer not null,
+	odue integer not null,
+	odid integer not null,
+	flags integer not null,
+	data text not null
+);
+CREATE TABLE revlog (
+	id integer primary key,
+	cid integer not null,
+	usn integer not null,
+	ease integer not null,
+	ivl integer not null,
+	lastIvl integer not null,
+	factor integer not null,
+	time integer not null,
+	type integer not null
+);
+CREATE TABLE graves (
+	usn integer not null,
+	oid integer not null,
+	type integer not null
+);
+CREATE INDEX ix_notes_usn on notes (usn);
+CREATE INDEX ix_cards_usn on cards (usn);
+CREATE INDEX ix_revlog_usn on revlog (usn);
+CREATE INDEX ix_cards_nid on cards (nid);
+CREATE INDEX ix_cards_sched on cards (did, queue, due);
+CREATE INDEX ix_revlog_cid on revlog (cid);
+CREATE INDEX ix_notes_csum on notes (csum);
+`
@@ -0,0 +1,161 @@
+package anki
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openPackage(t *testing.T, data []byte) (*sql.DB, map[string][]byte) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, file := range reader.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = contents
+	}
+	collection, ok := files["collection.anki2"]
+	if !ok {
+		t.Fatal("package is missing collection.anki2")
+	}
+	path := filepath.Join(t.TempDir(), "collection.anki2")
+	if err := os.WriteFile(path, collection, 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, files
+}
+
+func TestWritePackage(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	due := now.AddDate(0, 0, 5)
+	deck := Deck{
+		Name: "Zettelgarden",
+		Notes: []Note{
+			{
+				GUID:   "zettelgarden-1",
+				Model:  Basic,
+				Fields: []string{"Front", "Back", "1"},
+				Tags:   []string{"history"},
+				Cards: []Card{{
+					Ord:        0,
+					Type:       CardReview,
+					Due:        &due,
+					Interval:   5,
+					Reps:       2,
+					Stability:  5.2,
+					Difficulty: 4.1,
+					Reviews: []Review{
+						{Time: now.AddDate(0, 0, -1), Ease: 3, Interval: -600, Type: ReviewLearn},
+						{Time: now, Ease: 3, Interval: 5, Type: ReviewLearn},
+					},
+				}},
+			},
+			{
+				GUID:   "zettelgarden-cloze-2",
+				Model:  Cloze,
+				Fields: []string{"{{c1::Paris}} is in {{c2::France}}", "", "2"},
+				Cards:  []Card{{Ord: 0, Type: CardNew}, {Ord: 1, Type: CardNew}},
+			},
+		},
+		Media: []Media{{Name: "image.png", Data: []byte("png")}},
+	}
+
+	var buffer bytes.Buffer
+	if err := WritePackage(&buffer, deck, now); err != nil {
+		t.Fatal(err)
+	}
+	db, files := openPackage(t, buffer.Bytes())
+
+	var manifest map[string]string
+	if err := json.Unmarshal(files["media"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest["0"] != "image.png" || string(files["0"]) != "png" {
+		t.Errorf("wrong media in package, got %v", manifest)
+	}
+
+	var notes, cards, reviews int
+	_ = db.QueryRow("SELECT count(*) FROM notes").Scan(&notes)
+	_ = db.QueryRow("SELECT count(*) FROM cards").Scan(&cards)
+	_ = db.QueryRow("SELECT count(*) FROM revlog").Scan(&reviews)
+	if notes != 2 || cards != 3 || reviews != 2 {
+		t.Errorf("wrong row counts, got notes %v cards %v reviews %v", notes, cards, reviews)
+	}
+
+	var crt int64
+	_ = db.QueryRow("SELECT crt FROM col").Scan(&crt)
+	var reviewDue int64
+	var data string
+	err := db.QueryRow("SELECT due, data FROM cards WHERE type = ?", CardReview).Scan(&reviewDue, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := int64(due.Sub(time.Unix(crt, 0)).Hours() / 24)
+	if reviewDue != expected {
+		t.Errorf("wrong review due, got %v want %v", reviewDue, expected)
+	}
+	if data != `{"d":4.1,"s":5.2}` {
+		t.Errorf("wrong memory state, got %v", data)
+	}
+
+	var tags string
+	_ = db.QueryRow("SELECT tags FROM notes WHERE guid = 'zettelgarden-1'").Scan(&tags)
+	if tags != " history " {
+		t.Errorf("wrong tags, got %q", tags)
+	}
+}
+
+func TestRevlogIDsAreUnique(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	deck := Deck{
+		Name: "Zettelgarden",
+		Notes: []Note{{
+			GUID:   "zettelgarden-1",
+			Fields: []string{"Front", "Back", "1"},
+			Cards: []Card{{
+				Type: CardLearning,
+				Reviews: []Review{
+					{Time: now, Ease: 1, Type: ReviewLearn},
+					{Time: now, Ease: 3, Type: ReviewLearn},
+				},
+			}},
+		}},
+	}
+	var buffer bytes.Buffer
+	if err := WritePackage(&buffer, deck, now); err != nil {
+		t.Fatal(err)
+	}
+	db, _ := openPackage(t, buffer.Bytes())
+	var reviews int
+	_ = db.QueryRow("SELECT count(*) FROM revlog").Scan(&reviews)
+	if reviews != 2 {
+		t.Errorf("wrong number of reviews, got %v want %v", reviews, 2)
+	}
+}
+
+func TestStripHTML(t *testing.T) {
+	if result := StripHTML("<b>bold</b> text<br>"); result != "bold text" {
+		t.Errorf("wrong result, got %q", result)
+	}
+}
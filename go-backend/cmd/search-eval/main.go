@@ -0,0 +1,116 @@
+// search-eval scores the search paths against a fixture corpus of cards and
+// judged queries, and reports recall@k, MRR and nDCG for each.
+//
+// Embeddings come from the hashing embedder and LLM reranking from a word
+// overlap stand-in served in process, so runs need no model and give the
+// same numbers every time. The fixture is loaded into a scratch database
+// that is wiped first:
+//
+//	DB_HOST=localhost DB_PORT=5432 DB_USER=postgres DB_PASS=postgres \
+//	  go run ./cmd/search-eval -out before.json
+//	... change search ...
+//	go run ./cmd/search-eval -baseline before.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-backend/evaluation"
+	"go-backend/handlers"
+	"go-backend/llms"
+	"go-backend/models"
+	"go-backend/server"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func main() {
+	fixturePath := flag.String("fixture", "testdata/search-eval/fixture.json", "fixture of cards and judged queries")
+	modes := flag.String("modes", strings.Join(evaluation.MODES, ","), "comma separated modes to evaluate")
+	k := flag.Int("k", 10, "number of results to score")
+	databaseName := flag.String("db", "zettelkasten_eval", "scratch database to load the fixture into; must end in _eval")
+	schemaDir := flag.String("schema", "./schema", "directory of migrations")
+	out := flag.String("out", "", "write the report as JSON to this file")
+	baselinePath := flag.String("baseline", "", "report from an earlier run to compare with")
+	verbose := flag.Bool("v", false, "show every query and the server logs")
+	flag.Parse()
+
+	if !strings.HasSuffix(*databaseName, "_eval") {
+		log.Fatalf("refusing to wipe %q, the database name must end in _eval", *databaseName)
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	fixture, err := evaluation.LoadFixture(*fixturePath)
+	if err != nil {
+		fatal(err)
+	}
+	var baseline *evaluation.Report
+	if *baselinePath != "" {
+		report, err := evaluation.ReadReport(*baselinePath)
+		if err != nil {
+			fatal(err)
+		}
+		baseline = &report
+	}
+
+	rerankServer := evaluation.NewRerankServer()
+	defer rerankServer.Close()
+
+	dbConfig := models.DatabaseConfig{}
+	dbConfig.Host = os.Getenv("DB_HOST")
+	dbConfig.Port = os.Getenv("DB_PORT")
+	dbConfig.User = os.Getenv("DB_USER")
+	dbConfig.Password = os.Getenv("DB_PASS")
+	dbConfig.DatabaseName = *databaseName
+	db, err := server.ConnectToDatabase(dbConfig)
+	if err != nil {
+		fatal(err)
+	}
+
+	// testing mode resets the database and keeps card writes from starting
+	// background embedding and entity extraction
+	s := &server.Server{DB: db, Testing: true, SchemaDir: *schemaDir}
+	config := openai.DefaultConfig("search-eval")
+	config.BaseURL = rerankServer.URL
+	s.LLMClient = llms.NewClient(db, config)
+	s.LLMClient.Embedder, err = llms.NewEmbedder(llms.DefaultEmbedderConfig("hash"))
+	if err != nil {
+		fatal(err)
+	}
+	server.RunMigrations(s)
+	defer server.ResetDatabase(s)
+
+	h := &handlers.Handler{Server: s, DB: db}
+	userID, err := evaluation.LoadCorpus(h, fixture)
+	if err != nil {
+		fatal(err)
+	}
+
+	report, err := evaluation.Evaluate(h, userID, fixture, strings.Split(*modes, ","), *k)
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Printf("%d cards, %d queries\n\n", len(fixture.Cards), len(fixture.Queries))
+	evaluation.WriteSummary(os.Stdout, report, baseline)
+	if *verbose {
+		fmt.Println()
+		evaluation.WriteQueries(os.Stdout, report)
+	}
+	if *out != "" {
+		if err := evaluation.WriteReport(*out, report); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
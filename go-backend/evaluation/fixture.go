@@ -0,0 +1,78 @@
+package evaluation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type FixtureEntity struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+type FixtureCard struct {
+	CardID   string          `json:"card_id"`
+	Title    string          `json:"title"`
+	Body     string          `json:"body"`
+	Link     string          `json:"link"`
+	Entities []FixtureEntity `json:"entities"`
+}
+
+// FixtureQuery is a search with the cards judged relevant to it, by card_id.
+// Grades run from 1 (somewhat relevant) to 3 (exactly what was asked for).
+type FixtureQuery struct {
+	ID       string    `json:"id"`
+	Query    string    `json:"query"`
+	Note     string    `json:"note"`
+	Relevant Judgments `json:"relevant"`
+}
+
+type Fixture struct {
+	Cards   []FixtureCard  `json:"cards"`
+	Queries []FixtureQuery `json:"queries"`
+	// Checksum identifies the fixture file, so that reports are only
+	// compared when they were run against the same data.
+	Checksum string `json:"-"`
+}
+
+// LoadFixture reads a fixture file and checks that every judged card exists.
+func LoadFixture(path string) (Fixture, error) {
+	var fixture Fixture
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fixture, err
+	}
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return fixture, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	sum := sha256.Sum256(data)
+	fixture.Checksum = hex.EncodeToString(sum[:])
+
+	cardIDs := make(map[string]bool)
+	for _, card := range fixture.Cards {
+		if cardIDs[card.CardID] {
+			return fixture, fmt.Errorf("duplicate card %q", card.CardID)
+		}
+		cardIDs[card.CardID] = true
+	}
+	queryIDs := make(map[string]bool)
+	for _, query := range fixture.Queries {
+		if query.ID == "" || queryIDs[query.ID] {
+			return fixture, fmt.Errorf("query %q needs a unique id", query.Query)
+		}
+		queryIDs[query.ID] = true
+		if relevantCount(query.Relevant) == 0 {
+			return fixture, fmt.Errorf("query %q has no relevant cards", query.ID)
+		}
+		for cardID := range query.Relevant {
+			if !cardIDs[cardID] {
+				return fixture, fmt.Errorf("query %q judges unknown card %q", query.ID, cardID)
+			}
+		}
+	}
+	return fixture, nil
+}
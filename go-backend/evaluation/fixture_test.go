@@ -0,0 +1,63 @@
+package evaluation
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadFixture(t *testing.T) {
+	fixture, err := LoadFixture("../testdata/search-eval/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixture.Cards) == 0 || len(fixture.Queries) == 0 {
+		t.Errorf("expected cards and queries, got %v and %v", len(fixture.Cards), len(fixture.Queries))
+	}
+	if len(fixture.Checksum) != 64 {
+		t.Errorf("expected a checksum, got %q", fixture.Checksum)
+	}
+
+	invalid := filepath.Join(t.TempDir(), "fixture.json")
+	os.WriteFile(invalid, []byte(`{"cards": [{"card_id": "1"}], "queries": [{"id": "q", "query": "x", "relevant": {"2": 1}}]}`), 0644)
+	if _, err := LoadFixture(invalid); err == nil || !strings.Contains(err.Error(), "unknown card") {
+		t.Errorf("expected an error for an unknown card, got %v", err)
+	}
+}
+
+func TestRerankScores(t *testing.T) {
+	prompt, _ := json.Marshal([]map[string]string{
+		{"id": "1", "title": "Hot compost", "text": "a heap"},
+		{"id": "2", "title": "Roman roads", "text": "gravel"},
+	})
+	response := rerankScores("Given the search query \"compost \\\"heap\\\"\", rate the relevance...\n\nDocuments to rate, as a JSON array:\n" + string(prompt))
+	if response != `{"scores":{"1":5,"2":0}}` {
+		t.Errorf("wrong scores, got %v", response)
+	}
+	if response := rerankScores("something else"); response != "" {
+		t.Errorf("expected no scores for other prompts, got %v", response)
+	}
+}
+
+func TestWriteSummary(t *testing.T) {
+	report := Report{Fixture: "a", K: 10, Modes: []ModeReport{{Mode: "classic", Recall: 0.5, MRR: 0.25, NDCG: 0.4}}}
+	baseline := Report{Fixture: "a", K: 10, Modes: []ModeReport{{Mode: "classic", Recall: 0.4, MRR: 0.25, NDCG: 0.5}}}
+
+	var output bytes.Buffer
+	WriteSummary(&output, report, &baseline)
+	for _, expected := range []string{"recall@10", "0.5000 (+0.1000)", "0.2500 (+0.0000)", "0.4000 (-0.1000)"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("expected %q in the summary, got\n%s", expected, output.String())
+		}
+	}
+
+	baseline.K = 5
+	output.Reset()
+	WriteSummary(&output, report, &baseline)
+	if !strings.Contains(output.String(), "not comparing") || strings.Contains(output.String(), "(+") {
+		t.Errorf("reports with a different k should not be compared, got\n%s", output.String())
+	}
+}
@@ -0,0 +1,108 @@
+package evaluation
+
+import (
+	"math"
+	"sort"
+)
+
+// Judgments maps a card_id to how relevant it is to a query. Anything above
+// zero counts as relevant; higher grades matter more to nDCG.
+type Judgments map[string]int
+
+// dedupe keeps the first occurrence of each result, since semantic search can
+// return several chunks of the same card.
+func dedupe(results []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, result := range results {
+		if seen[result] {
+			continue
+		}
+		seen[result] = true
+		unique = append(unique, result)
+	}
+	return unique
+}
+
+func topK(results []string, k int) []string {
+	results = dedupe(results)
+	if k > 0 && len(results) > k {
+		return results[:k]
+	}
+	return results
+}
+
+func relevantCount(judgments Judgments) int {
+	count := 0
+	for _, grade := range judgments {
+		if grade > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// RecallAtK is the share of relevant cards that appear in the first k
+// results.
+func RecallAtK(results []string, judgments Judgments, k int) float64 {
+	total := relevantCount(judgments)
+	if total == 0 {
+		return 0
+	}
+	found := 0
+	for _, result := range topK(results, k) {
+		if judgments[result] > 0 {
+			found++
+		}
+	}
+	return float64(found) / float64(total)
+}
+
+// ReciprocalRank is one over the position of the first relevant card in the
+// first k results, or zero when there is none. Its mean over queries is MRR.
+func ReciprocalRank(results []string, judgments Judgments, k int) float64 {
+	for i, result := range topK(results, k) {
+		if judgments[result] > 0 {
+			return 1 / float64(i+1)
+		}
+	}
+	return 0
+}
+
+func gain(grade int) float64 {
+	return math.Pow(2, float64(grade)) - 1
+}
+
+func discount(position int) float64 {
+	return math.Log2(float64(position + 2))
+}
+
+// NDCGAtK is the discounted cumulative gain of the first k results divided by
+// that of the best possible ordering, using graded judgments.
+func NDCGAtK(results []string, judgments Judgments, k int) float64 {
+	var dcg float64
+	for i, result := range topK(results, k) {
+		if grade := judgments[result]; grade > 0 {
+			dcg += gain(grade) / discount(i)
+		}
+	}
+
+	var grades []int
+	for _, grade := range judgments {
+		if grade > 0 {
+			grades = append(grades, grade)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(grades)))
+	var ideal float64
+	for i, grade := range grades {
+		if k > 0 && i >= k {
+			break
+		}
+		ideal += gain(grade) / discount(i)
+	}
+	if ideal == 0 {
+		return 0
+	}
+	return dcg / ideal
+}
@@ -0,0 +1,67 @@
+package evaluation
+
+import (
+	"math"
+	"testing"
+)
+
+func approximately(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestRecallAtK(t *testing.T) {
+	judgments := Judgments{"1": 2, "2": 1, "3": 0}
+	testCases := []struct {
+		results  []string
+		k        int
+		expected float64
+	}{
+		{[]string{"1", "2"}, 10, 1},
+		{[]string{"3", "1", "2"}, 2, 0.5},
+		{[]string{"1", "1", "2"}, 2, 1},
+		{[]string{"4", "5"}, 10, 0},
+		{nil, 10, 0},
+	}
+	for _, tc := range testCases {
+		if recall := RecallAtK(tc.results, judgments, tc.k); !approximately(recall, tc.expected) {
+			t.Errorf("wrong recall for %v at %v, got %v want %v", tc.results, tc.k, recall, tc.expected)
+		}
+	}
+	if recall := RecallAtK([]string{"1"}, Judgments{}, 10); recall != 0 {
+		t.Errorf("recall without relevant cards should be 0, got %v", recall)
+	}
+}
+
+func TestReciprocalRank(t *testing.T) {
+	judgments := Judgments{"2": 1}
+	if rr := ReciprocalRank([]string{"1", "2"}, judgments, 10); !approximately(rr, 0.5) {
+		t.Errorf("wrong reciprocal rank, got %v want %v", rr, 0.5)
+	}
+	if rr := ReciprocalRank([]string{"1", "1", "2"}, judgments, 10); !approximately(rr, 0.5) {
+		t.Errorf("duplicates should not take up a rank, got %v want %v", rr, 0.5)
+	}
+	if rr := ReciprocalRank([]string{"1", "3", "2"}, judgments, 2); rr != 0 {
+		t.Errorf("results past k should not count, got %v", rr)
+	}
+}
+
+func TestNDCGAtK(t *testing.T) {
+	judgments := Judgments{"1": 2, "2": 1}
+	if ndcg := NDCGAtK([]string{"1", "2"}, judgments, 10); !approximately(ndcg, 1) {
+		t.Errorf("the ideal order should score 1, got %v", ndcg)
+	}
+
+	// (2^1-1)/log2(2) + (2^2-1)/log2(3) over (2^2-1)/log2(2) + (2^1-1)/log2(3)
+	expected := (1 + 3/math.Log2(3)) / (3 + 1/math.Log2(3))
+	if ndcg := NDCGAtK([]string{"2", "1"}, judgments, 10); !approximately(ndcg, expected) {
+		t.Errorf("wrong nDCG for a swapped order, got %v want %v", ndcg, expected)
+	}
+
+	// with k=1 the ideal list is only the best card
+	if ndcg := NDCGAtK([]string{"2"}, judgments, 1); !approximately(ndcg, 1.0/3) {
+		t.Errorf("wrong nDCG at 1, got %v want %v", ndcg, 1.0/3)
+	}
+	if ndcg := NDCGAtK([]string{"3"}, judgments, 10); ndcg != 0 {
+		t.Errorf("no relevant results should score 0, got %v", ndcg)
+	}
+}
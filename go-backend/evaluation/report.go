@@ -0,0 +1,94 @@
+package evaluation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+func ReadReport(path string) (Report, error) {
+	var report Report
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return report, err
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return report, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return report, nil
+}
+
+func WriteReport(path string, report Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func (r Report) mode(name string) (ModeReport, bool) {
+	for _, mode := range r.Modes {
+		if mode.Mode == name {
+			return mode, true
+		}
+	}
+	return ModeReport{}, false
+}
+
+// comparable reports whether two reports measured the same thing.
+func (r Report) comparable(other Report) bool {
+	return r.Fixture == other.Fixture && r.K == other.K
+}
+
+func formatMetric(value float64, baseline *float64) string {
+	if baseline == nil {
+		return fmt.Sprintf("%.4f", value)
+	}
+	return fmt.Sprintf("%.4f (%+.4f)", value, value-*baseline)
+}
+
+// WriteSummary writes the mean of each metric per mode. With a baseline from
+// the same fixture and k, the change from it is shown next to each value.
+func WriteSummary(w io.Writer, report Report, baseline *Report) error {
+	if baseline != nil && !report.comparable(*baseline) {
+		fmt.Fprintln(w, "baseline was run with a different fixture or k, not comparing")
+		baseline = nil
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "mode\trecall@%d\tmrr\tndcg@%d\n", report.K, report.K)
+	for _, mode := range report.Modes {
+		var recall, mrr, ndcg *float64
+		if baseline != nil {
+			if previous, ok := baseline.mode(mode.Mode); ok {
+				recall, mrr, ndcg = &previous.Recall, &previous.MRR, &previous.NDCG
+			}
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", mode.Mode,
+			formatMetric(mode.Recall, recall),
+			formatMetric(mode.MRR, mrr),
+			formatMetric(mode.NDCG, ndcg),
+		)
+	}
+	return table.Flush()
+}
+
+// WriteQueries writes the metrics of every query in every mode, with the
+// results that were scored.
+func WriteQueries(w io.Writer, report Report) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "mode\tquery\trecall\trr\tndcg\tresults")
+	for _, mode := range report.Modes {
+		for _, query := range mode.Queries {
+			results := fmt.Sprint(query.Results)
+			if query.Error != "" {
+				results = "error: " + query.Error
+			}
+			fmt.Fprintf(table, "%s\t%s\t%.4f\t%.4f\t%.4f\t%s\n",
+				mode.Mode, query.ID, query.Recall, query.ReciprocalRank, query.NDCG, results)
+		}
+	}
+	return table.Flush()
+}
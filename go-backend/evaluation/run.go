@@ -0,0 +1,200 @@
+package evaluation
+
+import (
+	"database/sql"
+	"fmt"
+	"go-backend/handlers"
+	"go-backend/llms"
+	"go-backend/models"
+	"math"
+	"time"
+)
+
+// MODES are the search paths that can be evaluated. reranked uses the LLM
+// reranker and local-reranked the local one.
+var MODES = []string{"classic", "semantic", "hybrid", "reranked", "local-reranked"}
+
+// corpusStart is when the first fixture card was created. Each following
+// card is a minute newer, so ties in rank always break the same way.
+var corpusStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// LoadCorpus creates a user holding the fixture cards, with their chunks,
+// embeddings and entities, and returns the user's id. The embeddings come
+// from the server's embedder.
+func LoadCorpus(h *handlers.Handler, fixture Fixture) (int, error) {
+	var userID int
+	err := h.DB.QueryRow(`
+	INSERT INTO users (username, email, password, created_at, updated_at,
+	stripe_customer_id, stripe_subscription_id, stripe_subscription_status,
+	stripe_subscription_frequency, stripe_current_plan, dashboard_card_pk)
+	VALUES ('search-eval', 'search-eval@localhost', '', NOW(), NOW(), '', '', '', '', '', 0)
+	RETURNING id`).Scan(&userID)
+	if err != nil {
+		return 0, fmt.Errorf("error creating user: %w", err)
+	}
+
+	for i, fixtureCard := range fixture.Cards {
+		card, err := h.CreateCard(userID, models.EditCardParams{
+			CardID: fixtureCard.CardID,
+			Title:  fixtureCard.Title,
+			Body:   fixtureCard.Body,
+			Link:   fixtureCard.Link,
+		})
+		if err != nil {
+			return userID, fmt.Errorf("error creating card %s: %w", fixtureCard.CardID, err)
+		}
+		timestamp := corpusStart.Add(time.Duration(i) * time.Minute)
+		if _, err := h.DB.Exec(`UPDATE cards SET created_at = $1, updated_at = $1 WHERE id = $2`, timestamp, card.ID); err != nil {
+			return userID, err
+		}
+		// embed synchronously rather than waiting on the queue
+		if err := llms.EmbedCard(h.Server.LLMClient, h.DB, userID, card.ID); err != nil {
+			return userID, fmt.Errorf("error embedding card %s: %w", fixtureCard.CardID, err)
+		}
+		for _, entity := range fixtureCard.Entities {
+			if err := linkEntity(h, userID, card.ID, entity); err != nil {
+				return userID, fmt.Errorf("error adding entity %s: %w", entity.Name, err)
+			}
+		}
+	}
+	return userID, nil
+}
+
+func linkEntity(h *handlers.Handler, userID, cardPK int, fixtureEntity FixtureEntity) error {
+	entity := models.Entity{Name: fixtureEntity.Name, Type: fixtureEntity.Type, Description: fixtureEntity.Description}
+	var entityID int
+	err := h.DB.QueryRow(`SELECT id FROM entities WHERE user_id = $1 AND name = $2`, userID, entity.Name).Scan(&entityID)
+	if err == sql.ErrNoRows {
+		embedding, err := llms.GenerateEntityEmbedding(h.Server.LLMClient, entity)
+		if err != nil {
+			return err
+		}
+		err = h.DB.QueryRow(`
+		INSERT INTO entities (user_id, name, description, type, embedding, card_pk, embedding_model)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`, userID, entity.Name, entity.Description, entity.Type, embedding, cardPK,
+			llms.ActiveEmbeddingModel(h.Server.LLMClient)).Scan(&entityID)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	_, err = h.DB.Exec(`
+	INSERT INTO entity_card_junction (user_id, entity_id, card_pk)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (entity_id, card_pk) DO NOTHING`, userID, entityID, cardPK)
+	return err
+}
+
+type QueryResult struct {
+	ID             string   `json:"id"`
+	Query          string   `json:"query"`
+	Results        []string `json:"results"`
+	Recall         float64  `json:"recall"`
+	ReciprocalRank float64  `json:"reciprocal_rank"`
+	NDCG           float64  `json:"ndcg"`
+	Error          string   `json:"error,omitempty"`
+}
+
+type ModeReport struct {
+	Mode    string        `json:"mode"`
+	Recall  float64       `json:"recall"`
+	MRR     float64       `json:"mrr"`
+	NDCG    float64       `json:"ndcg"`
+	Queries []QueryResult `json:"queries"`
+}
+
+// Report holds everything a run measured. It contains nothing that varies
+// between runs of the same code on the same fixture, so reports from two
+// commits can be diffed or compared directly.
+type Report struct {
+	Fixture string       `json:"fixture"`
+	K       int          `json:"k"`
+	Modes   []ModeReport `json:"modes"`
+}
+
+// round keeps reports readable and free of floating point noise.
+func round(value float64) float64 {
+	return math.Round(value*10000) / 10000
+}
+
+type searchRunner struct {
+	h      *handlers.Handler
+	userID int
+}
+
+func (s searchRunner) search(mode, query string) ([]models.SearchResult, error) {
+	ranking := models.DefaultRankingConfig()
+	switch mode {
+	case "classic":
+		return s.h.ClassicSearchResults(s.userID, query)
+	case "semantic":
+		return s.h.SemanticSearchResults(s.userID, query, ranking)
+	case "hybrid":
+		return s.h.HybridSearchResults(s.userID, query, ranking, false)
+	case "reranked", "local-reranked":
+		return s.h.HybridSearchResults(s.userID, query, ranking, true)
+	}
+	return nil, fmt.Errorf("unknown mode %q, expected one of %v", mode, MODES)
+}
+
+// Evaluate runs every fixture query through each mode and scores the first k
+// results. Reranking is only turned on for the reranked modes.
+func Evaluate(h *handlers.Handler, userID int, fixture Fixture, modes []string, k int) (Report, error) {
+	report := Report{Fixture: fixture.Checksum, K: k}
+	runner := searchRunner{h: h, userID: userID}
+	reranker := h.Server.Reranker
+	defer func() { h.Server.Reranker = reranker }()
+
+	for _, mode := range modes {
+		if !contains(MODES, mode) {
+			return report, fmt.Errorf("unknown mode %q, expected one of %v", mode, MODES)
+		}
+		switch mode {
+		case "reranked":
+			h.Server.Reranker = llms.NewLLMReranker(h.Server.LLMClient)
+		case "local-reranked":
+			h.Server.Reranker = llms.NewLocalReranker()
+		default:
+			h.Server.Reranker = nil
+		}
+
+		modeReport := ModeReport{Mode: mode, Queries: []QueryResult{}}
+		for _, query := range fixture.Queries {
+			result := QueryResult{ID: query.ID, Query: query.Query, Results: []string{}}
+			searchResults, err := runner.search(mode, query.Query)
+			if err != nil {
+				result.Error = err.Error()
+			}
+			for _, searchResult := range searchResults {
+				result.Results = append(result.Results, searchResult.ID)
+			}
+			result.Results = append([]string{}, topK(result.Results, k)...)
+			result.Recall = round(RecallAtK(result.Results, query.Relevant, k))
+			result.ReciprocalRank = round(ReciprocalRank(result.Results, query.Relevant, k))
+			result.NDCG = round(NDCGAtK(result.Results, query.Relevant, k))
+
+			modeReport.Recall += result.Recall
+			modeReport.MRR += result.ReciprocalRank
+			modeReport.NDCG += result.NDCG
+			modeReport.Queries = append(modeReport.Queries, result)
+		}
+		if count := float64(len(fixture.Queries)); count > 0 {
+			modeReport.Recall = round(modeReport.Recall / count)
+			modeReport.MRR = round(modeReport.MRR / count)
+			modeReport.NDCG = round(modeReport.NDCG / count)
+		}
+		report.Modes = append(report.Modes, modeReport)
+	}
+	return report, nil
+}
+
+func contains(collection []string, target string) bool {
+	for _, value := range collection {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
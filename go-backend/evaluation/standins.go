@@ -0,0 +1,97 @@
+package evaluation
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+var rerankQueryPattern = regexp.MustCompile(`Given the search query "((?:[^"\\]|\\.)*)", rate`)
+
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// overlap is the share of the query words found in the text.
+func overlap(queryWords []string, text string) float64 {
+	if len(queryWords) == 0 {
+		return 0
+	}
+	present := make(map[string]bool)
+	for _, word := range words(text) {
+		present[word] = true
+	}
+	found := 0
+	for _, word := range queryWords {
+		if present[word] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(queryWords))
+}
+
+// rerankScores answers a rerank prompt, scoring each document by how many
+// query words it contains and weighing the title most, as the prompt asks.
+func rerankScores(prompt string) string {
+	match := rerankQueryPattern.FindStringSubmatch(prompt)
+	if match == nil {
+		return ""
+	}
+	query, err := strconv.Unquote(`"` + match[1] + `"`)
+	if err != nil {
+		return ""
+	}
+	queryWords := words(query)
+	_, encoded, _ := strings.Cut(prompt, "Documents to rate, as a JSON array:\n")
+	var documents []struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+		Text  string `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(encoded), &documents); err != nil {
+		return ""
+	}
+
+	scores := make(map[string]float64)
+	for _, document := range documents {
+		score := 10 * (0.6*overlap(queryWords, document.Title) + 0.4*overlap(queryWords, document.Text))
+		scores[document.ID] = math.Round(score*10) / 10
+	}
+	response, _ := json.Marshal(map[string]interface{}{"scores": scores})
+	return string(response)
+}
+
+// NewRerankServer serves the OpenAI chat completions API and answers rerank
+// prompts with word overlap scores. Like a real model it only sees the
+// prompt, so the reranked mode measures how well the prompt and its parsing
+// hold up.
+func NewRerankServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openai.ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content := ""
+		if len(request.Messages) > 0 {
+			content = rerankScores(request.Messages[len(request.Messages)-1].Content)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Model: request.Model,
+			Choices: []openai.ChatCompletionChoice{{
+				Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content},
+				FinishReason: openai.FinishReasonStop,
+			}},
+		})
+	}))
+}
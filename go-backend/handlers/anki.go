@@ -0,0 +1,393 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"go-backend/anki"
+	"go-backend/models"
+	"go-backend/srs"
+	"html"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type flashcardReviewKey struct {
+	CardPK     int
+	ClozeIndex int
+}
+
+func (s *Handler) QueryAllFlashcards(userID int) ([]models.Flashcard, error) {
+	rows, err := s.DB.Query(`
+	SELECT `+flashcardColumns+`
+	FROM cards
+	WHERE user_id = $1 AND is_deleted = FALSE AND is_flashcard = TRUE
+	ORDER BY id ASC
+	`, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return []models.Flashcard{}, err
+	}
+	defer rows.Close()
+
+	cards := []models.Flashcard{}
+	for rows.Next() {
+		card, err := scanFlashcard(rows)
+		if err != nil {
+			log.Printf("err %v", err)
+			return cards, err
+		}
+		cards = append(cards, card)
+	}
+	return cards, nil
+}
+
+func (s *Handler) QueryAllClozeItems(userID int) ([]models.ClozeItem, error) {
+	rows, err := s.DB.Query(`
+	SELECT `+clozeItemColumns+`
+	FROM cloze_items
+	JOIN cards ON cards.id = cloze_items.card_pk
+	WHERE cloze_items.user_id = $1
+	AND cloze_items.is_deleted = FALSE AND cards.is_deleted = FALSE
+	ORDER BY cloze_items.card_pk ASC, cloze_items.cloze_index ASC
+	`, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return []models.ClozeItem{}, err
+	}
+	defer rows.Close()
+	return scanClozeItems(rows)
+}
+
+// queryReviewHistory returns every review for the user, keyed by card and
+// cloze index. Whole-card reviews use cloze index 0.
+func (s *Handler) queryReviewHistory(userID int) (map[flashcardReviewKey][]models.FlashcardReview, error) {
+	history := make(map[flashcardReviewKey][]models.FlashcardReview)
+	rows, err := s.DB.Query(`
+	SELECT id, card_pk, rating, COALESCE(state, ''), COALESCE(stability, 0),
+	COALESCE(difficulty, 0), COALESCE(elapsed_days, 0), COALESCE(scheduled_days, 0),
+	COALESCE(due, created_at), created_at, cloze_index
+	FROM flashcard_reviews
+	WHERE user_id = $1
+	ORDER BY created_at ASC, id ASC
+	`, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return history, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var review models.FlashcardReview
+		if err := rows.Scan(
+			&review.ID,
+			&review.CardPK,
+			&review.Rating,
+			&review.State,
+			&review.Stability,
+			&review.Difficulty,
+			&review.ElapsedDays,
+			&review.ScheduledDays,
+			&review.Due,
+			&review.CreatedAt,
+			&review.ClozeIndex,
+		); err != nil {
+			log.Printf("err %v", err)
+			return history, err
+		}
+		key := flashcardReviewKey{CardPK: review.CardPK}
+		if review.ClozeIndex != nil {
+			key.ClozeIndex = *review.ClozeIndex
+		}
+		history[key] = append(history[key], review)
+	}
+	return history, nil
+}
+
+func ankiCardType(state string) int {
+	switch srs.State(state) {
+	case srs.Learning:
+		return anki.CardLearning
+	case srs.Review:
+		return anki.CardReview
+	case srs.Relearning:
+		return anki.CardRelearning
+	}
+	return anki.CardNew
+}
+
+func ankiReviewType(state string) int {
+	switch srs.State(state) {
+	case srs.Review:
+		return anki.ReviewReview
+	case srs.Relearning:
+		return anki.ReviewRelearn
+	}
+	return anki.ReviewLearn
+}
+
+func ankiInterval(lastReview, due *time.Time) int {
+	if lastReview == nil || due == nil {
+		return 0
+	}
+	return max(int(math.Round(due.Sub(*lastReview).Hours()/24)), 0)
+}
+
+func ankiReviews(reviews []models.FlashcardReview) []anki.Review {
+	results := []anki.Review{}
+	for _, review := range reviews {
+		// Anki stores intraday intervals as negative seconds
+		interval := review.ScheduledDays
+		if interval == 0 {
+			interval = -int(review.Due.Sub(review.CreatedAt).Seconds())
+		}
+		results = append(results, anki.Review{
+			Time:     review.CreatedAt,
+			Ease:     review.Rating + 1,
+			Interval: interval,
+			Type:     ankiReviewType(review.State),
+		})
+	}
+	return results
+}
+
+func ankiField(text string) string {
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+}
+
+func ankiTags(tags []models.Tag) []string {
+	results := []string{}
+	for _, tag := range tags {
+		results = append(results, strings.ReplaceAll(tag.Name, " ", "_"))
+	}
+	return results
+}
+
+// ankiMedia downloads the images attached to a card and returns them along
+// with the markup that displays them on the back of the note.
+func (s *Handler) ankiMedia(userID, cardPK int) ([]anki.Media, string, error) {
+	files, err := s.getFilesFromCardPK(userID, cardPK)
+	if err != nil {
+		return nil, "", err
+	}
+	media := []anki.Media{}
+	markup := ""
+	for _, file := range files {
+		if !strings.HasPrefix(file.Filetype, "image/") {
+			continue
+		}
+		output, err := s.downloadObject(s.Server.S3, file.Path, "")
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to download file %v: %w", file.ID, err)
+		}
+		if output == nil {
+			continue
+		}
+		data, err := io.ReadAll(output.Body)
+		output.Body.Close()
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to read file %v: %w", file.ID, err)
+		}
+		name := strconv.Itoa(file.ID) + "-" + file.Name
+		media = append(media, anki.Media{Name: name, Data: data})
+		markup += `<br><img src="` + html.EscapeString(name) + `">`
+	}
+	return media, markup, nil
+}
+
+// BuildAnkiDeck converts the user's flashcards and cloze items into notes.
+// Each flashcard becomes a basic note and each card with cloze deletions
+// becomes a single cloze note with one card per cloze index.
+func (s *Handler) BuildAnkiDeck(userID int) (anki.Deck, error) {
+	deck := anki.Deck{Name: "Zettelgarden", Notes: []anki.Note{}, Media: []anki.Media{}}
+
+	history, err := s.queryReviewHistory(userID)
+	if err != nil {
+		return deck, err
+	}
+
+	flashcards, err := s.QueryAllFlashcards(userID)
+	if err != nil {
+		return deck, err
+	}
+	for _, card := range flashcards {
+		tags, err := s.QueryTagsForCard(userID, card.ID)
+		if err != nil {
+			return deck, err
+		}
+		media, markup, err := s.ankiMedia(userID, card.ID)
+		if err != nil {
+			return deck, err
+		}
+		deck.Media = append(deck.Media, media...)
+		deck.Notes = append(deck.Notes, anki.Note{
+			GUID:     fmt.Sprintf("zettelgarden-%d", card.ID),
+			Model:    anki.Basic,
+			Fields:   []string{ankiField(card.Title), ankiField(card.Body) + markup, ankiField(card.CardID)},
+			Tags:     ankiTags(tags),
+			Modified: card.UpdatedAt,
+			Cards: []anki.Card{{
+				Ord:        0,
+				Type:       ankiCardType(card.State),
+				Due:        card.Due,
+				Interval:   ankiInterval(card.LastReview, card.Due),
+				Reps:       card.Reps,
+				Lapses:     card.Lapses,
+				Stability:  card.Stability,
+				Difficulty: card.Difficulty,
+				Reviews:    ankiReviews(history[flashcardReviewKey{CardPK: card.ID}]),
+			}},
+		})
+	}
+
+	items, err := s.QueryAllClozeItems(userID)
+	if err != nil {
+		return deck, err
+	}
+	notes := make(map[int]int)
+	for _, item := range items {
+		index, ok := notes[item.CardPK]
+		if !ok {
+			var body string
+			err := s.DB.QueryRow("SELECT body FROM cards WHERE id = $1 AND user_id = $2", item.CardPK, userID).Scan(&body)
+			if err != nil {
+				log.Printf("err %v", err)
+				return deck, err
+			}
+			tags, err := s.QueryTagsForCard(userID, item.CardPK)
+			if err != nil {
+				return deck, err
+			}
+			deck.Notes = append(deck.Notes, anki.Note{
+				GUID:   fmt.Sprintf("zettelgarden-cloze-%d", item.CardPK),
+				Model:  anki.Cloze,
+				Fields: []string{ankiField(body), ankiField(item.Title), ankiField(item.CardID)},
+				Tags:   ankiTags(tags),
+				Cards:  []anki.Card{},
+			})
+			index = len(deck.Notes) - 1
+			notes[item.CardPK] = index
+		}
+		deck.Notes[index].Cards = append(deck.Notes[index].Cards, anki.Card{
+			Ord:        item.ClozeIndex - 1,
+			Type:       ankiCardType(item.State),
+			Due:        item.Due,
+			Interval:   ankiInterval(item.LastReview, item.Due),
+			Reps:       item.Reps,
+			Lapses:     item.Lapses,
+			Stability:  item.Stability,
+			Difficulty: item.Difficulty,
+			Reviews:    ankiReviews(history[flashcardReviewKey{CardPK: item.CardPK, ClozeIndex: item.ClozeIndex}]),
+		})
+	}
+	return deck, nil
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// WriteFlashcardsCSV writes one row per review item, with clozes rendered as
+// plain prompt and answer text, for SRS tools that cannot read apkg files.
+func (s *Handler) WriteFlashcardsCSV(w io.Writer, userID int) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{
+		"card_id", "type", "cloze_index", "front", "back", "tags",
+		"state", "due", "stability", "difficulty", "reps", "lapses",
+	})
+	if err != nil {
+		return err
+	}
+
+	flashcards, err := s.QueryAllFlashcards(userID)
+	if err != nil {
+		return err
+	}
+	for _, card := range flashcards {
+		tags, err := s.QueryTagsForCard(userID, card.ID)
+		if err != nil {
+			return err
+		}
+		err = writer.Write([]string{
+			card.CardID, "basic", "", card.Title, card.Body, strings.Join(ankiTags(tags), " "),
+			card.State, formatOptionalTime(card.Due),
+			strconv.FormatFloat(card.Stability, 'f', -1, 64),
+			strconv.FormatFloat(card.Difficulty, 'f', -1, 64),
+			strconv.Itoa(card.Reps), strconv.Itoa(card.Lapses),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	items, err := s.QueryAllClozeItems(userID)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		tags, err := s.QueryTagsForCard(userID, item.CardPK)
+		if err != nil {
+			return err
+		}
+		err = writer.Write([]string{
+			item.CardID, "cloze", strconv.Itoa(item.ClozeIndex), item.Prompt, item.Answer,
+			strings.Join(ankiTags(tags), " "),
+			item.State, formatOptionalTime(item.Due),
+			strconv.FormatFloat(item.Stability, 'f', -1, 64),
+			strconv.FormatFloat(item.Difficulty, 'f', -1, 64),
+			strconv.Itoa(item.Reps), strconv.Itoa(item.Lapses),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (s *Handler) ExportFlashcardsRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "apkg"
+	}
+	filename := "zettelgarden-flashcards-" + time.Now().Format("2006-01-02")
+
+	switch format {
+	case "apkg":
+		deck, err := s.BuildAnkiDeck(userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var buffer bytes.Buffer
+		if err := anki.WritePackage(&buffer, deck, time.Now().UTC()); err != nil {
+			log.Printf("err %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.apkg"`)
+		w.Write(buffer.Bytes())
+	case "csv":
+		var buffer bytes.Buffer
+		if err := s.WriteFlashcardsCSV(&buffer, userID); err != nil {
+			log.Printf("err %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		w.Write(buffer.Bytes())
+	default:
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"go-backend/models"
+	"go-backend/tests"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func makeExportFlashcardsRequest(s *Handler, t *testing.T, format string) *httptest.ResponseRecorder {
+	token, _ := tests.GenerateTestJWT(1)
+	req, err := http.NewRequest("GET", "/api/flashcards/export?format="+format, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.JwtMiddleware(s.ExportFlashcardsRoute))
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func setupExportFlashcards(s *Handler, t *testing.T) {
+	makeFlashcard(s, t, 1, 1)
+	if _, err := s.ReviewFlashcard(1, models.FlashcardReviewParams{CardPK: 1, Rating: 2}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.CreateCard(1, models.EditCardParams{
+		CardID: "100",
+		Title:  "cloze card",
+		Body:   "{{c1::Paris}} is the capital of {{c2::France}}.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportFlashcardsApkg(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	setupExportFlashcards(s, t)
+
+	rr := makeExportFlashcardsRequest(s, t, "apkg")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	body := rr.Body.Bytes()
+	reader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, file := range reader.File {
+		names[file.Name] = true
+	}
+	if !names["collection.anki2"] || !names["media"] {
+		t.Errorf("package is missing files, got %v", names)
+	}
+
+	deck, err := s.BuildAnkiDeck(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deck.Notes) != 2 {
+		t.Fatalf("wrong number of notes, got %v want %v", len(deck.Notes), 2)
+	}
+	if len(deck.Notes[0].Cards[0].Reviews) != 1 {
+		t.Errorf("review history was not exported, got %v reviews", len(deck.Notes[0].Cards[0].Reviews))
+	}
+	if len(deck.Notes[1].Cards) != 2 {
+		t.Errorf("wrong number of cloze cards, got %v want %v", len(deck.Notes[1].Cards), 2)
+	}
+}
+
+func TestExportFlashcardsCSV(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	setupExportFlashcards(s, t)
+
+	rr := makeExportFlashcardsRequest(s, t, "csv")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header, one flashcard and two clozes
+	if len(records) != 4 {
+		t.Fatalf("wrong number of rows, got %v want %v", len(records), 4)
+	}
+	if records[2][3] != "[...] is the capital of France." {
+		t.Errorf("wrong cloze prompt, got %q", records[2][3])
+	}
+}
+
+func TestExportFlashcardsInvalidFormat(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	rr := makeExportFlashcardsRequest(s, t, "txt")
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-backend/models"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_AUTOCOMPLETE_LIMIT = 10
+const MAX_AUTOCOMPLETE_LIMIT = 50
+
+// AUTOCOMPLETE_THRESHOLD is the trigram similarity a suggestion needs when it
+// does not start with the query. Prefix matches are always included.
+const AUTOCOMPLETE_THRESHOLD = 0.3
+
+var AUTOCOMPLETE_KINDS = []string{"card", "tag", "entity"}
+
+// autocompleteRequest works out what to suggest. The query may still carry
+// the trigger typed in the editor: "[" for a card link, "#" for a tag and
+// "@[" for an entity, which picks the kind when none is given.
+func autocompleteRequest(query, kind string) (string, []string, error) {
+	query = strings.TrimSpace(query)
+	triggers := []struct {
+		prefix string
+		kind   string
+	}{
+		{"@[", "entity"},
+		{"[", "card"},
+		{"#", "tag"},
+	}
+	for _, trigger := range triggers {
+		if strings.HasPrefix(query, trigger.prefix) {
+			query = strings.TrimPrefix(query, trigger.prefix)
+			if kind == "" {
+				kind = trigger.kind
+			}
+			break
+		}
+	}
+	if kind == "" {
+		return query, AUTOCOMPLETE_KINDS, nil
+	}
+	var kinds []string
+	for _, part := range strings.Split(kind, ",") {
+		part = strings.TrimSpace(part)
+		if !contains(AUTOCOMPLETE_KINDS, part) {
+			return query, nil, fmt.Errorf("unknown kind %q, expected one of %s", part, strings.Join(AUTOCOMPLETE_KINDS, ", "))
+		}
+		if !contains(kinds, part) {
+			kinds = append(kinds, part)
+		}
+	}
+	return query, kinds, nil
+}
+
+// Each query takes the user id, the query text, the escaped prefix pattern and
+// the limit, and selects id, value, label and score. Prefix matches score one
+// higher than fuzzy ones so they always come first. An empty query lists the
+// most recent values.
+var autocompleteQueries = map[string]string{
+	"card": `
+	SELECT id, card_id, title,
+	GREATEST(similarity(card_id, $2), word_similarity($2, title))
+	+ CASE WHEN card_id ILIKE $3 OR title ILIKE $3 THEN 1 ELSE 0 END AS score
+	FROM cards
+	WHERE user_id = $1 AND is_deleted = FALSE
+	AND ($2 = '' OR card_id ILIKE $3 OR title ILIKE $3 OR card_id % $2 OR $2 <% title)
+	ORDER BY score DESC, updated_at DESC
+	LIMIT $4`,
+	"tag": `
+	SELECT id, name, name,
+	similarity(name, $2) + CASE WHEN name ILIKE $3 THEN 1 ELSE 0 END AS score
+	FROM tags
+	WHERE user_id = $1 AND is_deleted = FALSE
+	AND ($2 = '' OR name ILIKE $3 OR name % $2)
+	ORDER BY score DESC, name ASC
+	LIMIT $4`,
+	"entity": `
+	SELECT id, name, COALESCE(type, ''),
+	GREATEST(similarity(name, $2), word_similarity($2, name))
+	+ CASE WHEN name ILIKE $3 THEN 1 ELSE 0 END AS score
+	FROM entities
+	WHERE user_id = $1
+	AND ($2 = '' OR name ILIKE $3 OR name % $2 OR $2 <% name)
+	ORDER BY score DESC, updated_at DESC
+	LIMIT $4`,
+}
+
+// QueryAutocomplete returns up to limit suggestions of the given kinds, best
+// first.
+func (s *Handler) QueryAutocomplete(userID int, query string, kinds []string, limit int) ([]models.AutocompleteSuggestion, error) {
+	suggestions := []models.AutocompleteSuggestion{}
+	prefix := escapeLikePattern(query) + "%"
+
+	err := s.withTrigramThreshold(AUTOCOMPLETE_THRESHOLD, func(tx *sql.Tx) error {
+		for _, kind := range kinds {
+			rows, err := tx.Query(autocompleteQueries[kind], userID, query, prefix, limit)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				suggestion := models.AutocompleteSuggestion{Kind: kind}
+				if err := rows.Scan(&suggestion.ID, &suggestion.Value, &suggestion.Label, &suggestion.Score); err != nil {
+					rows.Close()
+					return err
+				}
+				suggestions = append(suggestions, suggestion)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("err %v", err)
+		return []models.AutocompleteSuggestion{}, err
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Score > suggestions[j].Score
+	})
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions, nil
+}
+
+func (s *Handler) GetAutocompleteRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	query, kinds, err := autocompleteRequest(r.URL.Query().Get("q"), r.URL.Query().Get("kind"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := DEFAULT_AUTOCOMPLETE_LIMIT
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > MAX_AUTOCOMPLETE_LIMIT {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	suggestions, err := s.QueryAutocomplete(userID, query, kinds, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"go-backend/models"
+	"go-backend/tests"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAutocompleteRequest(t *testing.T) {
+	testCases := []struct {
+		query         string
+		kind          string
+		expectedQuery string
+		expectedKinds []string
+	}{
+		{"garden", "", "garden", AUTOCOMPLETE_KINDS},
+		{"#read", "", "read", []string{"tag"}},
+		{"@[John", "", "John", []string{"entity"}},
+		{"[1.2", "", "1.2", []string{"card"}},
+		{"  #read", "card,tag,card", "read", []string{"card", "tag"}},
+	}
+	for _, tc := range testCases {
+		query, kinds, err := autocompleteRequest(tc.query, tc.kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != tc.expectedQuery || !reflect.DeepEqual(kinds, tc.expectedKinds) {
+			t.Errorf("wrong request for %q %q, got %q %v", tc.query, tc.kind, query, kinds)
+		}
+	}
+	if _, _, err := autocompleteRequest("x", "file"); err == nil {
+		t.Errorf("expected an error for an unknown kind")
+	}
+}
+
+func TestQueryAutocomplete(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	_, err := s.CreateCard(1, models.EditCardParams{CardID: "100", Title: "Compost heap", Body: "#composting"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	suggestions, err := s.QueryAutocomplete(1, "comp", []string{"card"}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suggestions) != 1 || suggestions[0].Value != "100" || suggestions[0].Label != "Compost heap" {
+		t.Errorf("wrong prefix suggestions, got %+v", suggestions)
+	}
+
+	// a typo still finds the card
+	suggestions, _ = s.QueryAutocomplete(1, "compots heap", []string{"card"}, 5)
+	if len(suggestions) == 0 || suggestions[0].Value != "100" {
+		t.Errorf("wrong fuzzy suggestions, got %+v", suggestions)
+	}
+
+	suggestions, _ = s.QueryAutocomplete(1, "compo", []string{"tag"}, 5)
+	if len(suggestions) != 1 || suggestions[0].Value != "composting" || suggestions[0].Kind != "tag" {
+		t.Errorf("wrong tag suggestions, got %+v", suggestions)
+	}
+
+	suggestions, _ = s.QueryAutocomplete(1, "Test Ent", []string{"entity"}, 5)
+	if len(suggestions) != 2 {
+		t.Errorf("wrong number of entity suggestions, got %v want %v", len(suggestions), 2)
+	}
+	for _, suggestion := range suggestions {
+		if suggestion.Value == "Other User Entity" {
+			t.Errorf("suggestions should not include other users' entities")
+		}
+	}
+
+	suggestions, _ = s.QueryAutocomplete(1, "", AUTOCOMPLETE_KINDS, 3)
+	if len(suggestions) != 3 {
+		t.Errorf("an empty query should list recent values, got %v", len(suggestions))
+	}
+}
+
+func TestGetAutocompleteRoute(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	token, _ := tests.GenerateTestJWT(1)
+	req, _ := http.NewRequest("GET", "/api/autocomplete?q=%40%5BTest&limit=1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.JwtMiddleware(s.GetAutocompleteRoute)).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var suggestions []models.AutocompleteSuggestion
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &suggestions)
+	if len(suggestions) != 1 || suggestions[0].Kind != "entity" {
+		t.Errorf("wrong suggestions, got %+v", suggestions)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/autocomplete?q=x&limit=1000", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.JwtMiddleware(s.GetAutocompleteRoute)).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
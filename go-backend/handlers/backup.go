@@ -0,0 +1,1109 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-backend/llms"
+	"go-backend/models"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+func (s *Handler) ExportBackupRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	backup, err := s.ExportBackup(userID)
+	if err != nil {
+		log.Printf("error exporting backup for user %v: %v", userID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("zettelgarden-backup-%s.json", backup.ExportedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	json.NewEncoder(w).Encode(backup)
+}
+
+func (s *Handler) ImportBackupRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	var backup models.Backup
+	if err := json.NewDecoder(r.Body).Decode(&backup); err != nil {
+		log.Printf("error decoding backup: %v", err)
+		http.Error(w, "Invalid backup archive", http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.ImportBackup(userID, backup)
+	if err != nil {
+		log.Printf("error importing backup for user %v: %v", userID, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Handler) ExportBackup(userID int) (models.Backup, error) {
+	backup := models.Backup{
+		Version:    models.BACKUP_VERSION,
+		ExportedAt: time.Now().UTC(),
+	}
+
+	user, err := s.QueryUser(userID)
+	if err != nil {
+		return backup, err
+	}
+	backup.Settings = models.BackupSettings{
+		Username:        user.Username,
+		DashboardCardPK: user.DashboardCardPK,
+	}
+	if backup.Settings.SearchRanking, err = s.exportSearchRanking(userID); err != nil {
+		return backup, fmt.Errorf("failed to export search ranking: %w", err)
+	}
+
+	if backup.Cards, err = s.exportCards(userID); err != nil {
+		return backup, fmt.Errorf("failed to export cards: %w", err)
+	}
+	if backup.Backlinks, err = s.exportBacklinks(userID); err != nil {
+		return backup, fmt.Errorf("failed to export backlinks: %w", err)
+	}
+	if backup.Tags, err = s.exportTags(userID); err != nil {
+		return backup, fmt.Errorf("failed to export tags: %w", err)
+	}
+	if backup.CardTags, err = s.exportCardTags(userID); err != nil {
+		return backup, fmt.Errorf("failed to export card tags: %w", err)
+	}
+	if backup.Tasks, err = s.exportTasks(userID); err != nil {
+		return backup, fmt.Errorf("failed to export tasks: %w", err)
+	}
+	if backup.TaskTags, err = s.exportTaskTags(userID); err != nil {
+		return backup, fmt.Errorf("failed to export task tags: %w", err)
+	}
+	if backup.Entities, err = s.exportEntities(userID); err != nil {
+		return backup, fmt.Errorf("failed to export entities: %w", err)
+	}
+	if backup.EntityCards, err = s.exportEntityCards(userID); err != nil {
+		return backup, fmt.Errorf("failed to export entity links: %w", err)
+	}
+	if backup.Conversations, err = s.exportConversations(userID); err != nil {
+		return backup, fmt.Errorf("failed to export chat conversations: %w", err)
+	}
+	if backup.ChatCompletions, err = s.exportChatCompletions(userID); err != nil {
+		return backup, fmt.Errorf("failed to export chat completions: %w", err)
+	}
+	if backup.ChatActions, err = s.exportChatActions(userID); err != nil {
+		return backup, fmt.Errorf("failed to export chat actions: %w", err)
+	}
+	if backup.Files, err = s.exportFiles(userID); err != nil {
+		return backup, fmt.Errorf("failed to export files: %w", err)
+	}
+	if backup.FlashcardReviews, err = s.exportFlashcardReviews(userID); err != nil {
+		return backup, fmt.Errorf("failed to export flashcard reviews: %w", err)
+	}
+	if backup.ClozeItems, err = s.exportClozeItems(userID); err != nil {
+		return backup, fmt.Errorf("failed to export cloze items: %w", err)
+	}
+	if backup.SavedSearches, err = s.exportSavedSearches(userID); err != nil {
+		return backup, fmt.Errorf("failed to export saved searches: %w", err)
+	}
+	return backup, nil
+}
+
+// exportSearchRanking returns the ranking the user saved, or nil when they
+// kept the defaults.
+func (s *Handler) exportSearchRanking(userID int) (*models.RankingConfig, error) {
+	var stored sql.NullString
+	err := s.DB.QueryRow(`SELECT search_ranking FROM users WHERE id = $1`, userID).Scan(&stored)
+	if err != nil || !stored.Valid || stored.String == "" {
+		return nil, err
+	}
+	ranking, err := s.QueryUserRankingConfig(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &ranking, nil
+}
+
+func (s *Handler) exportCards(userID int) ([]models.BackupCard, error) {
+	cards := []models.BackupCard{}
+	rows, err := s.DB.Query(`
+	SELECT id, card_id, title, body, link, parent_id, created_at, updated_at,
+	COALESCE(is_flashcard, FALSE), COALESCE(flashcard_state, ''), COALESCE(flashcard_reps, 0),
+	COALESCE(flashcard_lapses, 0), flashcard_last_review, flashcard_due,
+	COALESCE(flashcard_difficulty, 0), COALESCE(flashcard_stability, 0)
+	FROM cards
+	WHERE user_id = $1 AND is_deleted = FALSE
+	ORDER BY id`, userID)
+	if err != nil {
+		return cards, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var card models.BackupCard
+		if err := rows.Scan(
+			&card.ID,
+			&card.CardID,
+			&card.Title,
+			&card.Body,
+			&card.Link,
+			&card.ParentID,
+			&card.CreatedAt,
+			&card.UpdatedAt,
+			&card.IsFlashcard,
+			&card.FlashcardState,
+			&card.FlashcardReps,
+			&card.FlashcardLapses,
+			&card.FlashcardLastReview,
+			&card.FlashcardDue,
+			&card.FlashcardDifficulty,
+			&card.FlashcardStability,
+		); err != nil {
+			return cards, err
+		}
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
+
+func (s *Handler) exportBacklinks(userID int) ([]models.BackupBacklink, error) {
+	backlinks := []models.BackupBacklink{}
+	rows, err := s.DB.Query(`
+	SELECT b.source_id_int, b.target_id_int, b.created_at, b.updated_at
+	FROM backlinks b
+	JOIN cards source ON b.source_id_int = source.id
+	JOIN cards target ON b.target_id_int = target.id
+	WHERE source.user_id = $1 AND target.user_id = $1
+	AND source.is_deleted = FALSE AND target.is_deleted = FALSE`, userID)
+	if err != nil {
+		return backlinks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var backlink models.BackupBacklink
+		var createdAt, updatedAt sql.NullTime
+		if err := rows.Scan(
+			&backlink.SourcePK,
+			&backlink.TargetPK,
+			&createdAt,
+			&updatedAt,
+		); err != nil {
+			return backlinks, err
+		}
+		backlink.CreatedAt = createdAt.Time
+		backlink.UpdatedAt = updatedAt.Time
+		backlinks = append(backlinks, backlink)
+	}
+	return backlinks, rows.Err()
+}
+
+func (s *Handler) exportTags(userID int) ([]models.BackupTag, error) {
+	tags := []models.BackupTag{}
+	rows, err := s.DB.Query(`
+	SELECT id, name, COALESCE(color, '')
+	FROM tags
+	WHERE user_id = $1 AND is_deleted = FALSE
+	ORDER BY id`, userID)
+	if err != nil {
+		return tags, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag models.BackupTag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Color); err != nil {
+			return tags, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func (s *Handler) exportCardTags(userID int) ([]models.CardTag, error) {
+	cardTags := []models.CardTag{}
+	rows, err := s.DB.Query(`
+	SELECT ct.card_pk, ct.tag_id
+	FROM card_tags ct
+	JOIN cards c ON ct.card_pk = c.id
+	JOIN tags t ON ct.tag_id = t.id
+	WHERE c.user_id = $1 AND c.is_deleted = FALSE AND t.is_deleted = FALSE`, userID)
+	if err != nil {
+		return cardTags, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cardTag models.CardTag
+		if err := rows.Scan(&cardTag.CardPK, &cardTag.TagID); err != nil {
+			return cardTags, err
+		}
+		cardTags = append(cardTags, cardTag)
+	}
+	return cardTags, rows.Err()
+}
+
+func (s *Handler) exportTasks(userID int) ([]models.BackupTask, error) {
+	tasks := []models.BackupTask{}
+	rows, err := s.DB.Query(`
+	SELECT id, COALESCE(card_pk, 0), scheduled_date, due_date, created_at, updated_at,
+	completed_at, title, is_complete
+	FROM tasks
+	WHERE user_id = $1 AND is_deleted = FALSE
+	ORDER BY id`, userID)
+	if err != nil {
+		return tasks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var task models.BackupTask
+		if err := rows.Scan(
+			&task.ID,
+			&task.CardPK,
+			&task.ScheduledDate,
+			&task.DueDate,
+			&task.CreatedAt,
+			&task.UpdatedAt,
+			&task.CompletedAt,
+			&task.Title,
+			&task.IsComplete,
+		); err != nil {
+			return tasks, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func (s *Handler) exportTaskTags(userID int) ([]models.TaskTag, error) {
+	taskTags := []models.TaskTag{}
+	rows, err := s.DB.Query(`
+	SELECT tt.task_pk, tt.tag_id
+	FROM task_tags tt
+	JOIN tasks t ON tt.task_pk = t.id
+	JOIN tags ON tt.tag_id = tags.id
+	WHERE t.user_id = $1 AND t.is_deleted = FALSE AND tags.is_deleted = FALSE`, userID)
+	if err != nil {
+		return taskTags, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var taskTag models.TaskTag
+		if err := rows.Scan(&taskTag.TaskPK, &taskTag.TagID); err != nil {
+			return taskTags, err
+		}
+		taskTags = append(taskTags, taskTag)
+	}
+	return taskTags, rows.Err()
+}
+
+func (s *Handler) exportEntities(userID int) ([]models.BackupEntity, error) {
+	entities := []models.BackupEntity{}
+	rows, err := s.DB.Query(`
+	SELECT id, name, COALESCE(description, ''), COALESCE(type, ''), card_pk, created_at, updated_at
+	FROM entities
+	WHERE user_id = $1
+	ORDER BY id`, userID)
+	if err != nil {
+		return entities, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entity models.BackupEntity
+		if err := rows.Scan(
+			&entity.ID,
+			&entity.Name,
+			&entity.Description,
+			&entity.Type,
+			&entity.CardPK,
+			&entity.CreatedAt,
+			&entity.UpdatedAt,
+		); err != nil {
+			return entities, err
+		}
+		entities = append(entities, entity)
+	}
+	return entities, rows.Err()
+}
+
+func (s *Handler) exportEntityCards(userID int) ([]models.BackupEntityCard, error) {
+	junctions := []models.BackupEntityCard{}
+	rows, err := s.DB.Query(`
+	SELECT ecj.entity_id, ecj.card_pk
+	FROM entity_card_junction ecj
+	JOIN cards c ON ecj.card_pk = c.id
+	WHERE ecj.user_id = $1 AND c.is_deleted = FALSE`, userID)
+	if err != nil {
+		return junctions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var junction models.BackupEntityCard
+		if err := rows.Scan(&junction.EntityID, &junction.CardPK); err != nil {
+			return junctions, err
+		}
+		junctions = append(junctions, junction)
+	}
+	return junctions, rows.Err()
+}
+
+func (s *Handler) exportConversations(userID int) ([]models.BackupConversation, error) {
+	conversations := []models.BackupConversation{}
+	rows, err := s.DB.Query(`
+	SELECT id, COALESCE(title, ''), COALESCE(model, ''), COALESCE(message_count, 0), created_at, updated_at,
+	scope_card_pks, scope_subtree, scope_tag
+	FROM chat_conversations
+	WHERE user_id = $1
+	ORDER BY created_at`, userID)
+	if err != nil {
+		return conversations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var conversation models.BackupConversation
+		var createdAt, updatedAt sql.NullTime
+		var scopeCardPKs []int64
+		if err := rows.Scan(
+			&conversation.ID,
+			&conversation.Title,
+			&conversation.Model,
+			&conversation.MessageCount,
+			&createdAt,
+			&updatedAt,
+			pq.Array(&scopeCardPKs),
+			&conversation.ScopeSubtree,
+			&conversation.ScopeTag,
+		); err != nil {
+			return conversations, err
+		}
+		conversation.CreatedAt = createdAt.Time
+		conversation.UpdatedAt = updatedAt.Time
+		conversation.ScopeCardPKs = make([]int, len(scopeCardPKs))
+		for i, pk := range scopeCardPKs {
+			conversation.ScopeCardPKs[i] = int(pk)
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+func (s *Handler) exportChatCompletions(userID int) ([]models.BackupChatCompletion, error) {
+	completions := []models.BackupChatCompletion{}
+	rows, err := s.DB.Query(`
+	SELECT conversation_id, sequence_number, role, content, refusal,
+	COALESCE(model, ''), COALESCE(tokens, 0), created_at, card_chunks
+	FROM chat_completions
+	WHERE user_id = $1
+	ORDER BY conversation_id, sequence_number`, userID)
+	if err != nil {
+		return completions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var completion models.BackupChatCompletion
+		var cardPKs []int64
+		if err := rows.Scan(
+			&completion.ConversationID,
+			&completion.SequenceNumber,
+			&completion.Role,
+			&completion.Content,
+			&completion.Refusal,
+			&completion.Model,
+			&completion.Tokens,
+			&completion.CreatedAt,
+			pq.Array(&cardPKs),
+		); err != nil {
+			return completions, err
+		}
+		completion.CardPKs = make([]int, len(cardPKs))
+		for i, pk := range cardPKs {
+			completion.CardPKs[i] = int(pk)
+		}
+		completions = append(completions, completion)
+	}
+	return completions, rows.Err()
+}
+
+func (s *Handler) exportChatActions(userID int) ([]models.BackupChatAction, error) {
+	actions := []models.BackupChatAction{}
+	rows, err := s.DB.Query(`
+	SELECT conversation_id, sequence_number, tool, arguments, description, status, result,
+	created_at, resolved_at
+	FROM chat_actions
+	WHERE user_id = $1
+	ORDER BY id`, userID)
+	if err != nil {
+		return actions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var action models.BackupChatAction
+		if err := rows.Scan(
+			&action.ConversationID,
+			&action.SequenceNumber,
+			&action.Tool,
+			&action.Arguments,
+			&action.Description,
+			&action.Status,
+			&action.Result,
+			&action.CreatedAt,
+			&action.ResolvedAt,
+		); err != nil {
+			return actions, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+func (s *Handler) exportFiles(userID int) ([]models.BackupFile, error) {
+	files := []models.BackupFile{}
+	rows, err := s.DB.Query(`
+	SELECT id, name, type, path, size, card_pk, created_at, updated_at, extracted_text
+	FROM files
+	WHERE user_id = $1 AND is_deleted = FALSE
+	ORDER BY id`, userID)
+	if err != nil {
+		return files, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var file models.BackupFile
+		var path string
+		if err := rows.Scan(
+			&file.ID,
+			&file.Name,
+			&file.Filetype,
+			&path,
+			&file.Size,
+			&file.CardPK,
+			&file.CreatedAt,
+			&file.UpdatedAt,
+			&file.ExtractedText,
+		); err != nil {
+			return files, err
+		}
+		files = append(files, file)
+		paths = append(paths, path)
+	}
+	if err := rows.Err(); err != nil {
+		return files, err
+	}
+
+	for i, path := range paths {
+		output, err := s.downloadObject(s.Server.S3, path, "")
+		if err != nil {
+			return files, fmt.Errorf("unable to download file %v: %w", files[i].ID, err)
+		}
+		if output == nil {
+			continue
+		}
+		data, err := io.ReadAll(output.Body)
+		output.Body.Close()
+		if err != nil {
+			return files, fmt.Errorf("unable to read file %v: %w", files[i].ID, err)
+		}
+		files[i].Data = data
+	}
+	return files, nil
+}
+
+func (s *Handler) exportFlashcardReviews(userID int) ([]models.BackupFlashcardReview, error) {
+	reviews := []models.BackupFlashcardReview{}
+	rows, err := s.DB.Query(`
+	SELECT card_pk, cloze_index, COALESCE(rating, 0), COALESCE(state, ''), COALESCE(stability, 0),
+	COALESCE(difficulty, 0), COALESCE(elapsed_days, 0), COALESCE(scheduled_days, 0), due, created_at
+	FROM flashcard_reviews
+	WHERE user_id = $1
+	ORDER BY created_at, id`, userID)
+	if err != nil {
+		return reviews, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var review models.BackupFlashcardReview
+		if err := rows.Scan(
+			&review.CardPK,
+			&review.ClozeIndex,
+			&review.Rating,
+			&review.State,
+			&review.Stability,
+			&review.Difficulty,
+			&review.ElapsedDays,
+			&review.ScheduledDays,
+			&review.Due,
+			&review.CreatedAt,
+		); err != nil {
+			return reviews, err
+		}
+		reviews = append(reviews, review)
+	}
+	return reviews, rows.Err()
+}
+
+func (s *Handler) exportClozeItems(userID int) ([]models.BackupClozeItem, error) {
+	items := []models.BackupClozeItem{}
+	rows, err := s.DB.Query(`
+	SELECT card_pk, cloze_index, COALESCE(state, ''), COALESCE(reps, 0), COALESCE(lapses, 0),
+	last_review, due, COALESCE(difficulty, 0), COALESCE(stability, 0), created_at, updated_at
+	FROM cloze_items
+	WHERE user_id = $1 AND is_deleted = FALSE
+	ORDER BY card_pk, cloze_index`, userID)
+	if err != nil {
+		return items, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.BackupClozeItem
+		if err := rows.Scan(
+			&item.CardPK,
+			&item.ClozeIndex,
+			&item.State,
+			&item.Reps,
+			&item.Lapses,
+			&item.LastReview,
+			&item.Due,
+			&item.Difficulty,
+			&item.Stability,
+			&item.CreatedAt,
+			&item.UpdatedAt,
+		); err != nil {
+			return items, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s *Handler) exportSavedSearches(userID int) ([]models.BackupSavedSearch, error) {
+	searches := []models.BackupSavedSearch{}
+	rows, err := s.DB.Query(`
+	SELECT name, search_term, search_type, result_limit, created_at, updated_at
+	FROM saved_searches
+	WHERE user_id = $1 AND is_deleted = FALSE
+	ORDER BY id`, userID)
+	if err != nil {
+		return searches, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var search models.BackupSavedSearch
+		if err := rows.Scan(
+			&search.Name,
+			&search.SearchTerm,
+			&search.SearchType,
+			&search.ResultLimit,
+			&search.CreatedAt,
+			&search.UpdatedAt,
+		); err != nil {
+			return searches, err
+		}
+		searches = append(searches, search)
+	}
+	return searches, rows.Err()
+}
+
+// checkAccountEmpty makes sure a backup is only ever restored into a fresh
+// account. The welcome card created at signup is allowed and returned so the
+// import can retire it.
+func (s *Handler) checkAccountEmpty(userID int) (int, error) {
+	user, err := s.QueryUser(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = s.DB.QueryRow(`
+	SELECT
+	(SELECT COUNT(*) FROM cards WHERE user_id = $1 AND is_deleted = FALSE AND id != $2) +
+	(SELECT COUNT(*) FROM tasks WHERE user_id = $1 AND is_deleted = FALSE) +
+	(SELECT COUNT(*) FROM entities WHERE user_id = $1) +
+	(SELECT COUNT(*) FROM files WHERE user_id = $1 AND is_deleted = FALSE) +
+	(SELECT COUNT(*) FROM chat_conversations WHERE user_id = $1) +
+	(SELECT COUNT(*) FROM saved_searches WHERE user_id = $1 AND is_deleted = FALSE)
+	`, userID, user.DashboardCardPK).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return 0, fmt.Errorf("backups can only be restored into an empty account")
+	}
+	return user.DashboardCardPK, nil
+}
+
+func remapID(ids map[int]int, id int) (int, bool) {
+	newID, ok := ids[id]
+	return newID, ok
+}
+
+func (s *Handler) ImportBackup(userID int, backup models.Backup) (models.ImportBackupResponse, error) {
+	var response models.ImportBackupResponse
+
+	if backup.Version < 1 || backup.Version > models.BACKUP_VERSION {
+		return response, fmt.Errorf("unsupported backup version %v", backup.Version)
+	}
+
+	welcomeCardPK, err := s.checkAccountEmpty(userID)
+	if err != nil {
+		return response, err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return response, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// file contents go to S3, outside the transaction, so remove them again
+	// if the import does not go through
+	var uploadedKeys []string
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		for _, key := range uploadedKeys {
+			if err := s.deleteObject(s.Server.S3, key); err != nil {
+				log.Printf("error removing file %v of a failed import: %v", key, err)
+			}
+		}
+	}()
+
+	if welcomeCardPK > 0 {
+		_, err = tx.Exec(`UPDATE cards SET is_deleted = TRUE, updated_at = NOW() WHERE id = $1 AND user_id = $2`, welcomeCardPK, userID)
+		if err != nil {
+			return response, fmt.Errorf("failed to retire welcome card: %w", err)
+		}
+	}
+
+	cardIDs := make(map[int]int)
+	for _, card := range backup.Cards {
+		var newID int
+		err = tx.QueryRow(`
+		INSERT INTO cards (card_id, user_id, title, body, link, parent_id, created_at, updated_at,
+		is_flashcard, flashcard_state, flashcard_reps, flashcard_lapses, flashcard_last_review,
+		flashcard_due, flashcard_difficulty, flashcard_stability)
+		VALUES ($1, $2, $3, $4, $5, 0, $6, $7, $8, NULLIF($9, ''), $10, $11, $12, $13, $14, $15)
+		RETURNING id`,
+			card.CardID, userID, card.Title, card.Body, card.Link, card.CreatedAt, card.UpdatedAt,
+			card.IsFlashcard, card.FlashcardState, card.FlashcardReps, card.FlashcardLapses,
+			card.FlashcardLastReview, card.FlashcardDue, card.FlashcardDifficulty, card.FlashcardStability,
+		).Scan(&newID)
+		if err != nil {
+			return response, fmt.Errorf("failed to import card %v: %w", card.CardID, err)
+		}
+		cardIDs[card.ID] = newID
+	}
+	for _, card := range backup.Cards {
+		newID := cardIDs[card.ID]
+		parentID, ok := remapID(cardIDs, card.ParentID)
+		if !ok {
+			// cards without a parent are their own parent
+			parentID = newID
+		}
+		_, err = tx.Exec(`UPDATE cards SET parent_id = $1 WHERE id = $2`, parentID, newID)
+		if err != nil {
+			return response, fmt.Errorf("failed to set parent for card %v: %w", card.CardID, err)
+		}
+	}
+
+	for _, backlink := range backup.Backlinks {
+		sourceID, ok := remapID(cardIDs, backlink.SourcePK)
+		if !ok {
+			continue
+		}
+		targetID, ok := remapID(cardIDs, backlink.TargetPK)
+		if !ok {
+			continue
+		}
+		_, err = tx.Exec(`
+		INSERT INTO backlinks (source_id_int, target_id_int, created_at, updated_at)
+		VALUES ($1, $2, $3, $4)`,
+			sourceID, targetID, backlink.CreatedAt, backlink.UpdatedAt,
+		)
+		if err != nil {
+			return response, fmt.Errorf("failed to import backlink: %w", err)
+		}
+	}
+
+	tagIDs := make(map[int]int)
+	for _, tag := range backup.Tags {
+		var newID int
+		err = tx.QueryRow(`SELECT id FROM tags WHERE user_id = $1 AND name = $2`, userID, tag.Name).Scan(&newID)
+		if err == sql.ErrNoRows {
+			err = tx.QueryRow(`
+			INSERT INTO tags (name, color, user_id, created_at, updated_at)
+			VALUES ($1, $2, $3, NOW(), NOW())
+			RETURNING id`,
+				tag.Name, tag.Color, userID,
+			).Scan(&newID)
+		} else if err == nil {
+			_, err = tx.Exec(`UPDATE tags SET color = $1, is_deleted = FALSE WHERE id = $2`, tag.Color, newID)
+		}
+		if err != nil {
+			return response, fmt.Errorf("failed to import tag %v: %w", tag.Name, err)
+		}
+		tagIDs[tag.ID] = newID
+	}
+
+	for _, cardTag := range backup.CardTags {
+		cardPK, ok := remapID(cardIDs, cardTag.CardPK)
+		if !ok {
+			continue
+		}
+		tagID, ok := remapID(tagIDs, cardTag.TagID)
+		if !ok {
+			continue
+		}
+		_, err = tx.Exec(`INSERT INTO card_tags (card_pk, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, cardPK, tagID)
+		if err != nil {
+			return response, fmt.Errorf("failed to import card tag: %w", err)
+		}
+	}
+
+	taskIDs := make(map[int]int)
+	for _, task := range backup.Tasks {
+		cardPK, ok := remapID(cardIDs, task.CardPK)
+		if !ok {
+			cardPK = 0
+		}
+		var newID int
+		err = tx.QueryRow(`
+		INSERT INTO tasks (card_pk, user_id, scheduled_date, due_date, created_at, updated_at, completed_at, title, is_complete, is_deleted)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, FALSE)
+		RETURNING id`,
+			cardPK, userID, task.ScheduledDate, task.DueDate, task.CreatedAt, task.UpdatedAt,
+			task.CompletedAt, task.Title, task.IsComplete,
+		).Scan(&newID)
+		if err != nil {
+			return response, fmt.Errorf("failed to import task %v: %w", task.Title, err)
+		}
+		taskIDs[task.ID] = newID
+	}
+
+	for _, taskTag := range backup.TaskTags {
+		taskPK, ok := remapID(taskIDs, taskTag.TaskPK)
+		if !ok {
+			continue
+		}
+		tagID, ok := remapID(tagIDs, taskTag.TagID)
+		if !ok {
+			continue
+		}
+		_, err = tx.Exec(`INSERT INTO task_tags (task_pk, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, taskPK, tagID)
+		if err != nil {
+			return response, fmt.Errorf("failed to import task tag: %w", err)
+		}
+	}
+
+	entityIDs := make(map[int]int)
+	for _, entity := range backup.Entities {
+		var cardPK *int
+		if entity.CardPK != nil {
+			if newCardPK, ok := remapID(cardIDs, *entity.CardPK); ok {
+				cardPK = &newCardPK
+			}
+		}
+		var newID int
+		err = tx.QueryRow(`
+		INSERT INTO entities (user_id, name, description, type, card_pk, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`,
+			userID, entity.Name, entity.Description, entity.Type, cardPK, entity.CreatedAt, entity.UpdatedAt,
+		).Scan(&newID)
+		if err != nil {
+			return response, fmt.Errorf("failed to import entity %v: %w", entity.Name, err)
+		}
+		entityIDs[entity.ID] = newID
+	}
+
+	for _, junction := range backup.EntityCards {
+		entityID, ok := remapID(entityIDs, junction.EntityID)
+		if !ok {
+			continue
+		}
+		cardPK, ok := remapID(cardIDs, junction.CardPK)
+		if !ok {
+			continue
+		}
+		_, err = tx.Exec(`
+		INSERT INTO entity_card_junction (user_id, entity_id, card_pk)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (entity_id, card_pk) DO NOTHING`,
+			userID, entityID, cardPK,
+		)
+		if err != nil {
+			return response, fmt.Errorf("failed to import entity link: %w", err)
+		}
+	}
+
+	// conversation ids are UUIDs, regenerate them so a backup can be
+	// restored next to its source account on the same instance
+	conversationIDs := make(map[string]string)
+	for _, conversation := range backup.Conversations {
+		newID := uuid.New().String()
+		scopeCardPKs := []int{}
+		for _, cardPK := range conversation.ScopeCardPKs {
+			if newCardPK, ok := remapID(cardIDs, cardPK); ok {
+				scopeCardPKs = append(scopeCardPKs, newCardPK)
+			}
+		}
+		_, err = tx.Exec(`
+		INSERT INTO chat_conversations (id, title, user_id, model, message_count, created_at, updated_at,
+		scope_card_pks, scope_subtree, scope_tag)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			newID, conversation.Title, userID, conversation.Model, conversation.MessageCount,
+			conversation.CreatedAt, conversation.UpdatedAt,
+			pq.Array(scopeCardPKs), conversation.ScopeSubtree, conversation.ScopeTag,
+		)
+		if err != nil {
+			return response, fmt.Errorf("failed to import conversation %v: %w", conversation.Title, err)
+		}
+		conversationIDs[conversation.ID] = newID
+	}
+
+	for _, completion := range backup.ChatCompletions {
+		conversationID, ok := conversationIDs[completion.ConversationID]
+		if !ok {
+			continue
+		}
+		cardPKs := []int64{}
+		for _, cardPK := range completion.CardPKs {
+			if newCardPK, ok := remapID(cardIDs, cardPK); ok {
+				cardPKs = append(cardPKs, int64(newCardPK))
+			}
+		}
+		_, err = tx.Exec(`
+		INSERT INTO chat_completions
+		(user_id, conversation_id, sequence_number, role, content, refusal, model, tokens, created_at, card_chunks)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			userID, conversationID, completion.SequenceNumber, completion.Role, completion.Content,
+			completion.Refusal, completion.Model, completion.Tokens, completion.CreatedAt, pq.Array(cardPKs),
+		)
+		if err != nil {
+			return response, fmt.Errorf("failed to import chat message: %w", err)
+		}
+	}
+
+	for _, action := range backup.ChatActions {
+		conversationID, ok := conversationIDs[action.ConversationID]
+		if !ok {
+			continue
+		}
+		_, err = tx.Exec(`
+		INSERT INTO chat_actions
+		(user_id, conversation_id, sequence_number, tool, arguments, description, status, result, created_at, resolved_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			userID, conversationID, action.SequenceNumber, action.Tool, action.Arguments,
+			action.Description, action.Status, action.Result, action.CreatedAt, action.ResolvedAt,
+		)
+		if err != nil {
+			return response, fmt.Errorf("failed to import chat action: %w", err)
+		}
+	}
+
+	for _, file := range backup.Files {
+		cardPK, ok := remapID(cardIDs, file.CardPK)
+		if !ok {
+			cardPK = -1
+		}
+		s3Key, err := s.restoreFileData(userID, file)
+		if err != nil {
+			return response, err
+		}
+		uploadedKeys = append(uploadedKeys, s3Key)
+		extractedText := file.ExtractedText
+		if extractedText == nil {
+			text, err := extractFileText(bytes.NewReader(file.Data), file.Name, file.Filetype)
+			if err != nil {
+				return response, fmt.Errorf("failed to read file %v: %w", file.Name, err)
+			}
+			extractedText = &text
+		}
+		_, err = tx.Exec(`
+		INSERT INTO files (name, user_id, type, path, filename, size, card_pk, created_by, updated_by, created_at, updated_at, extracted_text)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+			file.Name, userID, file.Filetype, s3Key, s3Key, file.Size, cardPK, userID, userID,
+			file.CreatedAt, file.UpdatedAt, extractedText,
+		)
+		if err != nil {
+			return response, fmt.Errorf("failed to import file %v: %w", file.Name, err)
+		}
+	}
+
+	for _, review := range backup.FlashcardReviews {
+		cardPK, ok := remapID(cardIDs, review.CardPK)
+		if !ok {
+			continue
+		}
+		_, err = tx.Exec(`
+		INSERT INTO flashcard_reviews
+		(card_pk, user_id, rating, state, stability, difficulty, elapsed_days, scheduled_days, due, created_at, cloze_index)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+			cardPK, userID, review.Rating, review.State, review.Stability, review.Difficulty,
+			review.ElapsedDays, review.ScheduledDays, review.Due, review.CreatedAt, review.ClozeIndex,
+		)
+		if err != nil {
+			return response, fmt.Errorf("failed to import flashcard review: %w", err)
+		}
+	}
+
+	for _, item := range backup.ClozeItems {
+		cardPK, ok := remapID(cardIDs, item.CardPK)
+		if !ok {
+			continue
+		}
+		_, err = tx.Exec(`
+		INSERT INTO cloze_items
+		(card_pk, user_id, cloze_index, state, reps, lapses, last_review, due, difficulty, stability, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+			cardPK, userID, item.ClozeIndex, item.State, item.Reps, item.Lapses, item.LastReview,
+			item.Due, item.Difficulty, item.Stability, item.CreatedAt, item.UpdatedAt,
+		)
+		if err != nil {
+			return response, fmt.Errorf("failed to import cloze item: %w", err)
+		}
+	}
+
+	for _, search := range backup.SavedSearches {
+		_, err = tx.Exec(`
+		INSERT INTO saved_searches (user_id, name, search_term, search_type, result_limit, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			userID, search.Name, search.SearchTerm, search.SearchType, search.ResultLimit,
+			search.CreatedAt, search.UpdatedAt,
+		)
+		if err != nil {
+			return response, fmt.Errorf("failed to import saved search %v: %w", search.Name, err)
+		}
+	}
+
+	if backup.Settings.SearchRanking != nil {
+		if err := backup.Settings.SearchRanking.Validate(); err != nil {
+			return response, fmt.Errorf("invalid search ranking: %w", err)
+		}
+		data, err := json.Marshal(backup.Settings.SearchRanking)
+		if err != nil {
+			return response, fmt.Errorf("invalid search ranking: %w", err)
+		}
+		_, err = tx.Exec(`UPDATE users SET search_ranking = $1 WHERE id = $2`, string(data), userID)
+		if err != nil {
+			return response, fmt.Errorf("failed to restore search ranking: %w", err)
+		}
+	}
+
+	dashboardCardPK, ok := remapID(cardIDs, backup.Settings.DashboardCardPK)
+	if !ok {
+		dashboardCardPK = 0
+	}
+	_, err = tx.Exec(`UPDATE users SET dashboard_card_pk = $1, updated_at = NOW() WHERE id = $2`, dashboardCardPK, userID)
+	if err != nil {
+		return response, fmt.Errorf("failed to restore settings: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return response, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	committed = true
+
+	s.reindexImportedData(userID, cardIDs, entityIDs)
+
+	response = models.ImportBackupResponse{
+		Message:  "Backup restored successfully",
+		Cards:    len(cardIDs),
+		Tasks:    len(taskIDs),
+		Entities: len(entityIDs),
+		Files:    len(backup.Files),
+	}
+	return response, nil
+}
+
+// restoreFileData uploads the archived file contents under a new key for
+// the importing user and returns that key.
+func (s *Handler) restoreFileData(userID int, file models.BackupFile) (string, error) {
+	s3Key := fmt.Sprintf("%s/%s", strconv.Itoa(userID), uuid.New().String())
+
+	tempFile, err := os.CreateTemp("/tmp", "restore-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("unable to create temp file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	if _, err := tempFile.Write(file.Data); err != nil {
+		return "", fmt.Errorf("unable to write file %v: %w", file.Name, err)
+	}
+	if err := s.uploadObject(s.Server.S3, s3Key, tempFile.Name()); err != nil {
+		return "", fmt.Errorf("unable to restore file %v: %w", file.Name, err)
+	}
+	return s3Key, nil
+}
+
+// reindexImportedData rebuilds the derived data that is not part of the
+// archive: chunks, embeddings and entity embeddings.
+func (s *Handler) reindexImportedData(userID int, cardIDs map[int]int, entityIDs map[int]int) {
+	for _, cardPK := range cardIDs {
+		card, err := s.QueryFullCard(userID, cardPK)
+		if err != nil {
+			log.Printf("error loading imported card %v: %v", cardPK, err)
+			continue
+		}
+		if err := s.ChunkCard(card); err != nil {
+			log.Printf("error chunking imported card %v: %v", cardPK, err)
+		}
+	}
+	if s.Server.Testing {
+		return
+	}
+
+	go func() {
+		for _, cardPK := range cardIDs {
+			s.ChunkEmbedCard(userID, cardPK)
+		}
+		for _, entityID := range entityIDs {
+			var entity models.Entity
+			err := s.DB.QueryRow(`
+			SELECT id, name, description, type FROM entities WHERE id = $1 AND user_id = $2`,
+				entityID, userID,
+			).Scan(&entity.ID, &entity.Name, &entity.Description, &entity.Type)
+			if err != nil {
+				log.Printf("error loading imported entity %v: %v", entityID, err)
+				continue
+			}
+			embedding, err := llms.GenerateEntityEmbedding(s.Server.LLMClient, entity)
+			if err != nil {
+				log.Printf("error embedding imported entity %v: %v", entityID, err)
+				continue
+			}
+			_, err = s.DB.Exec(`
+			UPDATE entities SET embedding = $1, embedding_model = $3, next_embedding = NULL, next_embedding_model = NULL
+			WHERE id = $2`, embedding, entityID, llms.ActiveEmbeddingModel(s.Server.LLMClient))
+			if err != nil {
+				log.Printf("error storing imported entity embedding %v: %v", entityID, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-backend/models"
+	"go-backend/tests"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func makeExportBackupRequest(s *Handler, t *testing.T, userID int) models.Backup {
+	token, _ := tests.GenerateTestJWT(userID)
+	req, err := http.NewRequest("GET", "/api/backup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.JwtMiddleware(s.ExportBackupRoute))
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		log.Printf("err %v", rr.Body.String())
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var backup models.Backup
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &backup)
+	return backup
+}
+
+func makeImportBackupRequest(s *Handler, t *testing.T, userID int, backup models.Backup) *httptest.ResponseRecorder {
+	token, _ := tests.GenerateTestJWT(userID)
+	body, _ := json.Marshal(backup)
+	req, err := http.NewRequest("POST", "/api/backup", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.JwtMiddleware(s.ImportBackupRoute))
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestExportBackup(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	backup := makeExportBackupRequest(s, t, 1)
+	if backup.Version != models.BACKUP_VERSION {
+		t.Errorf("wrong backup version, got %v want %v", backup.Version, models.BACKUP_VERSION)
+	}
+	var cardCount int
+	_ = s.DB.QueryRow("SELECT count(*) FROM cards WHERE user_id = 1 AND is_deleted = FALSE").Scan(&cardCount)
+	if len(backup.Cards) != cardCount {
+		t.Errorf("wrong number of cards exported, got %v want %v", len(backup.Cards), cardCount)
+	}
+	if len(backup.Conversations) != 2 {
+		t.Errorf("wrong number of conversations exported, got %v want %v", len(backup.Conversations), 2)
+	}
+	if len(backup.EntityCards) != 4 {
+		t.Errorf("wrong number of entity links exported, got %v want %v", len(backup.EntityCards), 4)
+	}
+	for _, card := range backup.Cards {
+		if card.CardID == "2/A" && card.Title != "test card" {
+			t.Errorf("exported card has wrong title, got %v want %v", card.Title, "test card")
+		}
+	}
+}
+
+func TestImportBackupRemapsIDs(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	backup := makeExportBackupRequest(s, t, 1)
+	rr := makeImportBackupRequest(s, t, 3, backup)
+	if status := rr.Code; status != http.StatusOK {
+		log.Printf("err %v", rr.Body.String())
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var response models.ImportBackupResponse
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &response)
+	if response.Cards != len(backup.Cards) {
+		t.Errorf("wrong number of cards imported, got %v want %v", response.Cards, len(backup.Cards))
+	}
+
+	restored := makeExportBackupRequest(s, t, 3)
+	if len(restored.Cards) != len(backup.Cards) {
+		t.Errorf("wrong number of restored cards, got %v want %v", len(restored.Cards), len(backup.Cards))
+	}
+	if len(restored.Backlinks) != len(backup.Backlinks) {
+		t.Errorf("wrong number of restored backlinks, got %v want %v", len(restored.Backlinks), len(backup.Backlinks))
+	}
+	if len(restored.ChatCompletions) != len(backup.ChatCompletions) {
+		t.Errorf("wrong number of restored messages, got %v want %v", len(restored.ChatCompletions), len(backup.ChatCompletions))
+	}
+
+	// the child card must point at the restored parent, not the original one
+	var parentCardID string
+	err := s.DB.QueryRow(`
+	SELECT parent.card_id FROM cards child
+	JOIN cards parent ON child.parent_id = parent.id
+	WHERE child.user_id = 3 AND child.card_id = '1/A'`).Scan(&parentCardID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parentCardID != "1" {
+		t.Errorf("restored card has wrong parent, got %v want %v", parentCardID, "1")
+	}
+	var parentUserID int
+	_ = s.DB.QueryRow(`
+	SELECT parent.user_id FROM cards child
+	JOIN cards parent ON child.parent_id = parent.id
+	WHERE child.user_id = 3 AND child.card_id = '1/A'`).Scan(&parentUserID)
+	if parentUserID != 3 {
+		t.Errorf("restored card parent belongs to wrong user, got %v want %v", parentUserID, 3)
+	}
+}
+
+func TestImportBackupNonEmptyAccount(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	backup := makeExportBackupRequest(s, t, 1)
+	rr := makeImportBackupRequest(s, t, 1, backup)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestImportBackupUnsupportedVersion(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	backup := models.Backup{Version: models.BACKUP_VERSION + 1}
+	rr := makeImportBackupRequest(s, t, 3, backup)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestImportBackupRestoresStudyAndSearchSettings(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	setupExportFlashcards(s, t)
+
+	if _, err := s.CreateSavedSearch(1, models.EditSavedSearchParams{Name: "reading", SearchTerm: "#to-read", SearchType: "classic", ResultLimit: 10}); err != nil {
+		t.Fatal(err)
+	}
+	ranking := models.DefaultRankingConfig()
+	ranking.SemanticWeight = 0.7
+	ranking.EntityWeight = 0.2
+	ranking.SharedEntitiesWeight = 0.1
+	if err := s.UpdateUserRankingConfig(1, ranking); err != nil {
+		t.Fatal(err)
+	}
+	scope := models.ChatScope{CardPKs: []int{1}, Subtree: "2/A"}
+	if err := s.UpdateConversationScope(1, "550e8400-e29b-41d4-a716-446655440000", scope); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.DB.Exec(`
+	INSERT INTO chat_actions (user_id, conversation_id, sequence_number, tool, arguments, description)
+	VALUES (1, '550e8400-e29b-41d4-a716-446655440000', 2, 'create_card', '{"card_id": "9", "title": "Compost"}', 'Create card 9')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup := makeExportBackupRequest(s, t, 1)
+	if len(backup.FlashcardReviews) == 0 || len(backup.ClozeItems) != 2 || len(backup.SavedSearches) != 1 {
+		t.Fatalf("wrong study data exported, got %v reviews, %v cloze items and %v saved searches",
+			len(backup.FlashcardReviews), len(backup.ClozeItems), len(backup.SavedSearches))
+	}
+	rr := makeImportBackupRequest(s, t, 3, backup)
+	if status := rr.Code; status != http.StatusOK {
+		log.Printf("err %v", rr.Body.String())
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	restored := makeExportBackupRequest(s, t, 3)
+	if len(restored.FlashcardReviews) != len(backup.FlashcardReviews) {
+		t.Errorf("wrong number of restored reviews, got %v want %v", len(restored.FlashcardReviews), len(backup.FlashcardReviews))
+	}
+	if len(restored.ClozeItems) != len(backup.ClozeItems) {
+		t.Errorf("wrong number of restored cloze items, got %v want %v", len(restored.ClozeItems), len(backup.ClozeItems))
+	}
+	if len(restored.SavedSearches) != 1 || restored.SavedSearches[0].SearchTerm != "#to-read" {
+		t.Errorf("wrong restored saved searches, got %+v", restored.SavedSearches)
+	}
+	if len(restored.ChatActions) != 1 || restored.ChatActions[0].Status != models.ChatActionPending ||
+		restored.ChatActions[0].ConversationID == "550e8400-e29b-41d4-a716-446655440000" {
+		t.Errorf("the proposed action should be restored into the new conversation, got %+v", restored.ChatActions)
+	}
+	if restored.Settings.SearchRanking == nil || *restored.Settings.SearchRanking != ranking {
+		t.Errorf("wrong restored search ranking, got %+v want %+v", restored.Settings.SearchRanking, ranking)
+	}
+
+	var flashcard models.BackupCard
+	for _, card := range restored.Cards {
+		if card.CardID == "1" {
+			flashcard = card
+		}
+	}
+	if !flashcard.IsFlashcard || flashcard.FlashcardReps != 1 || flashcard.FlashcardDue == nil {
+		t.Errorf("flashcard state should be restored, got %+v", flashcard)
+	}
+
+	for _, conversation := range restored.Conversations {
+		if conversation.ScopeSubtree == "" {
+			continue
+		}
+		if conversation.ScopeSubtree != "2/A" || len(conversation.ScopeCardPKs) != 1 {
+			t.Errorf("wrong restored scope, got %+v", conversation)
+		}
+		card, err := s.QueryPartialCardByID(3, conversation.ScopeCardPKs[0])
+		if err != nil || card.CardID != "1" {
+			t.Errorf("the pinned card should point at the restored card, got %+v %v", card, err)
+		}
+		return
+	}
+	t.Errorf("the scoped conversation was not restored")
+}
+
+func TestImportBackupExtractsFileText(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	kept := "kept text"
+	backup := models.Backup{
+		Version: models.BACKUP_VERSION,
+		Files: []models.BackupFile{
+			{ID: 1, Name: "old.txt", Filetype: "text/plain", CardPK: -1, Data: []byte("compost notes")},
+			{ID: 2, Name: "new.txt", Filetype: "text/plain", CardPK: -1, Data: []byte("other notes"), ExtractedText: &kept},
+		},
+	}
+	rr := makeImportBackupRequest(s, t, 3, backup)
+	if status := rr.Code; status != http.StatusOK {
+		log.Printf("err %v", rr.Body.String())
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	for name, expected := range map[string]string{"old.txt": "compost notes", "new.txt": kept} {
+		var text string
+		err := s.DB.QueryRow("SELECT COALESCE(extracted_text, '') FROM files WHERE user_id = 3 AND name = $1", name).Scan(&text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text != expected {
+			t.Errorf("wrong extracted text for %v, got %q want %q", name, text, expected)
+		}
+	}
+}
@@ -395,7 +395,7 @@ func (s *Handler) GetCardsRoute(w http.ResponseWriter, r *http.Request) {
 	cards, err := s.ClassicSearch(userID, searchTerm)
 	if err != nil {
 		log.Printf("err %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeSearchError(w, err)
 		return
 	}
 
@@ -636,7 +636,7 @@ func (s *Handler) QueryFullCard(userID int, id int) (models.Card, error) {
 	err := s.DB.QueryRow(`
 	SELECT 
 	id, card_id, user_id, title, body, link, parent_id,
-        created_at, updated_at
+        created_at, updated_at, COALESCE(is_flashcard, FALSE)
 	FROM 
 	cards
 	WHERE id = $1 AND user_id = $2 AND is_deleted = FALSE
@@ -650,6 +650,7 @@ func (s *Handler) QueryFullCard(userID int, id int) (models.Card, error) {
 		&card.ParentID,
 		&card.CreatedAt,
 		&card.UpdatedAt,
+		&card.IsFlashcard,
 	)
 	if err != nil {
 		log.Printf("asdas err %v", err)
@@ -682,24 +683,28 @@ func (s *Handler) UpdateCard(userID int, cardPK int, params models.EditCardParam
 		log.Printf("updatecard err %v", err)
 		return models.Card{}, err
 	}
+	if params.IsFlashcard != nil {
+		if err := s.setFlashcard(userID, cardPK, *params.IsFlashcard); err != nil {
+			return models.Card{}, err
+		}
+	}
 
 	card, err := s.QueryFullCard(userID, cardPK)
 	backlinks := extractBacklinks(card.Body)
 	s.updateBacklinks(card.ID, backlinks)
 
 	s.ChunkCard(card)
+	s.ChunkEmbedCard(userID, card.ID)
 
 	if !s.Server.Testing {
 
 		go func() {
 			s.ExtractSaveCardEntities(userID, card)
 		}()
-		go func() {
-			s.ChunkEmbedCard(userID, card.ID)
-		}()
 	}
 
 	s.AddTagsFromCard(userID, cardPK)
+	s.AddClozesFromCard(userID, cardPK)
 	return s.QueryFullCard(userID, cardPK)
 }
 
@@ -717,6 +722,11 @@ func (s *Handler) CreateCard(userID int, params models.EditCardParams) (models.C
 		log.Printf("updatecard err %v", err)
 		return models.Card{}, err
 	}
+	if params.IsFlashcard != nil && *params.IsFlashcard {
+		if err := s.setFlashcard(userID, id, true); err != nil {
+			return models.Card{}, err
+		}
+	}
 	card, err := s.QueryFullCard(userID, id)
 
 	// set parent id to id if there's no parent
@@ -729,34 +739,26 @@ func (s *Handler) CreateCard(userID int, params models.EditCardParams) (models.C
 	backlinks := extractBacklinks(card.Body)
 	s.updateBacklinks(card.ID, backlinks)
 	s.ChunkCard(card)
+	s.ChunkEmbedCard(userID, card.ID)
 
 	if !s.Server.Testing {
 		go func() {
 			s.ExtractSaveCardEntities(userID, card)
 		}()
-		go func() {
-			s.ChunkEmbedCard(userID, card.ID)
-		}()
 	}
 	s.AddTagsFromCard(userID, id)
+	s.AddClozesFromCard(userID, id)
 	return s.QueryFullCard(userID, id)
 }
 
+// ChunkEmbedCard queues the card's chunks to be embedded. The job is stored
+// in the database, so it is not lost if the server restarts before the
+// worker gets to it.
 func (s *Handler) ChunkEmbedCard(userID, cardPK int) error {
-	chunks, err := s.GetCardChunks(userID, cardPK)
-	if err != nil {
-		log.Printf("error in chunking %v", err)
+	if err := llms.EnqueueEmbedding(s.DB, userID, cardPK); err != nil {
 		return err
 	}
-	for _, chunk := range chunks {
-		log.Printf("push chunk %v", chunk)
-		s.Server.LLMClient.EmbeddingQueue.Push(models.LLMRequest{
-			UserID: userID,
-			CardPK: cardPK,
-			Chunk:  chunk,
-		})
-	}
-	llms.StartProcessingQueue(s.Server.LLMClient)
+	s.Server.LLMClient.EmbeddingQueue.Notify()
 	return nil
 }
 
@@ -764,8 +766,7 @@ func (s *Handler) ChunkCard(card models.Card) error {
 	db := s.DB
 
 	tx, err := db.Begin()
-	textToChunk := "Title: " + card.Title + " - " + card.Body
-	chunks := llms.GenerateChunks(textToChunk)
+	chunks := llms.ChunkMarkdown(card.Title, card.Body, s.Server.Chunker)
 	query := `DELETE FROM card_chunks WHERE card_pk = $1 AND user_id = $2`
 	_, err = tx.Exec(query, card.ID, card.UserID)
 	if err != nil {
@@ -773,9 +774,10 @@ func (s *Handler) ChunkCard(card models.Card) error {
 		tx.Rollback()
 		return fmt.Errorf("error updating card %d: %w", card.ID, err)
 	}
-	query = `INSERT INTO card_chunks (card_pk, user_id, chunk_text, chunk_id) VALUES ($1, $2, $3, $4)`
+	query = `INSERT INTO card_chunks (card_pk, user_id, chunk_text, chunk_id, content_hash) VALUES ($1, $2, $3, $4, $5)`
 	for i, chunk := range chunks {
-		_, err = tx.Exec(query, card.ID, card.UserID, chunk, i)
+		content := chunk.Content()
+		_, err = tx.Exec(query, card.ID, card.UserID, content, i, llms.ChunkHash(content))
 		if err != nil {
 			log.Printf("error %v", err)
 
@@ -9,8 +9,10 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/mux"
@@ -322,6 +324,41 @@ func TestGetCardsSuccessSearch(t *testing.T) {
 	}
 }
 
+func TestGetCardsSearchWithQuote(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	_, err := s.CreateCard(1, models.EditCardParams{CardID: "100", Title: "Notes on O'Brien", Body: "body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := makeCardsRequestSuccess(s, t, "search_term="+url.QueryEscape("O'Brien"))
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var cards []models.Card
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &cards)
+	if len(cards) != 1 {
+		t.Errorf("wrong number of cards returned, got %v want %v", len(cards), 1)
+	}
+}
+
+func TestGetCardsInvalidSearch(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	rr := makeCardsRequestSuccess(s, t, "search_term="+url.QueryEscape("title:(a OR"))
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	if !strings.Contains(rr.Body.String(), "invalid search") {
+		t.Errorf("expected a descriptive parse error, got %v", rr.Body.String())
+	}
+}
+
 func TestGetCardsOtherUsersBodyNoResults(t *testing.T) {
 	s := setup()
 	defer tests.Teardown()
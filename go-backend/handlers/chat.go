@@ -13,8 +13,6 @@ import (
 	"github.com/lib/pq"
 )
 
-const MODEL = "gpt-4"
-
 func (s *Handler) GetChatConversationRoute(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("current_user").(int)
 	vars := mux.Vars(r)
@@ -83,6 +81,19 @@ func (s *Handler) QueryChatConversation(userID int, conversationID string) ([]mo
 		return nil, fmt.Errorf("error processing chat conversation")
 	}
 
+	// attach the actions each answer proposed
+	actions, err := s.QueryChatActions(userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	for _, action := range actions {
+		for i := range messages {
+			if messages[i].SequenceNumber == action.SequenceNumber {
+				messages[i].Actions = append(messages[i].Actions, action)
+			}
+		}
+	}
+
 	return messages, nil
 }
 
@@ -114,13 +125,18 @@ func (s *Handler) PostChatMessageRoute(w http.ResponseWriter, r *http.Request) {
 		newMessage.ConversationID = uuid.String()
 
 	}
+	scope, err := s.chatScopeForMessage(userID, newMessage, newConversation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	// Add the message to the conversation
 	message, err := s.AddChatMessage(userID, newMessage)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	message, err = s.GetChatCompletion(userID, newMessage.ConversationID)
+	message, err = s.GetChatCompletion(userID, newMessage.ConversationID, scope)
 
 	if newConversation {
 		summary, err := llms.CreateConversationSummary(s.Server.LLMClient, message)
@@ -128,7 +144,8 @@ func (s *Handler) PostChatMessageRoute(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		s.WriteConversationSummary(userID, summary)
+		summary.Scope = scope
+		err = s.WriteConversationSummary(userID, summary)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -147,8 +164,11 @@ func (s *Handler) WriteConversationSummary(userID int, summary models.Conversati
             message_count,
             created_at,
             model,
-            title
-        ) VALUES ($1, $2, $3, NOW(), $5, $6)
+            title,
+            scope_card_pks,
+            scope_subtree,
+            scope_tag
+        ) VALUES ($1, $2, $3, NOW(), $4, $5, $6, $7, $8)
     `
 
 	_, err := s.DB.Exec(
@@ -156,9 +176,11 @@ func (s *Handler) WriteConversationSummary(userID int, summary models.Conversati
 		userID,
 		summary.ID,
 		summary.MessageCount,
-		summary.CreatedAt,
 		summary.Model,
 		summary.Title,
+		pq.Array(scopeCardPKs(summary.Scope)),
+		summary.Scope.Subtree,
+		summary.Scope.Tag,
 	)
 
 	if err != nil {
@@ -210,7 +232,7 @@ func (s *Handler) AddChatMessage(userID int, message models.ChatCompletion) (mod
 		nextSequence,
 		"user",
 		message.Content,
-		models.MODEL,
+		"", // no model was used for the user's own message
 		message.Refusal,
 		message.Tokens,
 	).Scan(&insertedMessage.ID, &insertedMessage.CreatedAt)
@@ -227,6 +249,7 @@ func (s *Handler) RouteChatCompletion(
 	userID int,
 	option models.ChatOption,
 	messages []models.ChatCompletion,
+	scope models.ChatScope,
 ) (models.ChatCompletion, error) {
 
 	var completion models.ChatCompletion
@@ -238,28 +261,9 @@ func (s *Handler) RouteChatCompletion(
 		log.Printf("user %v", user)
 		completion, err = llms.AnswerUserInfoQuestion(s.Server.LLMClient, user, lastMessage)
 	} else if option == models.Cards {
-		embedding, _ := llms.GenerateSemanticSearchQuery(s.Server.LLMClient, lastMessage)
-		relatedCards, _ := s.GetRelatedCards(userID, embedding[0])
-
-		scores, err := llms.RerankResults(s.Server.LLMClient, lastMessage, relatedCards)
-		if err != nil {
-			return models.ChatCompletion{}, err
-		}
-		for i, score := range scores {
-			if i == len(scores)-1 {
-				break
-			}
-			relatedCards[i].Ranking = score
-
-		}
-		scoredCards := []models.CardChunk{}
-		for _, card := range relatedCards {
-			if card.Ranking < 1 {
-				continue
-			}
-			scoredCards = append(scoredCards, card)
-		}
-		completion, err = llms.CardSearchChatCompletion(s.Server.LLMClient, messages, scoredCards)
+		completion, err = llms.CardSearchChatCompletion(s.Server.LLMClient, messages, s.scopedRelatedCards(userID, lastMessage, scope))
+	} else if option == models.Tools {
+		completion, err = s.ToolChatCompletion(userID, messages)
 
 	} else {
 		// Create the new completion
@@ -268,34 +272,90 @@ func (s *Handler) RouteChatCompletion(
 	return completion, err
 }
 
-func (s *Handler) GetChatCompletion(userID int, conversationID string) (models.ChatCompletion, error) {
+// chatRelatedCards finds the cards to answer a message from, leaving out
+// those the reranker judged unrelated. A nil cardPKs searches every card.
+func (s *Handler) chatRelatedCards(userID int, lastMessage string, cardPKs []int) []models.CardChunk {
+	embedding, _ := llms.GenerateSemanticSearchQuery(s.Server.LLMClient, lastMessage)
+	if len(embedding) == 0 {
+		return []models.CardChunk{}
+	}
+	relatedCards, _ := s.QueryRelatedCardsIn(userID, embedding[0], models.DefaultRankingConfig(), cardPKs)
+
+	scoredCards := relatedCards
+	if s.rerankingEnabled() {
+		var reranked bool
+		relatedCards, reranked = s.rerankCardChunks(lastMessage, relatedCards)
+		if reranked {
+			scoredCards = relevantCardChunks(s.Server.Reranker, relatedCards)
+		}
+	}
+	return scoredCards
+}
 
-	messages, err := s.GetChatMessagesInConversation(userID, conversationID)
+// relevantCardChunks leaves out the reranked cards scored below the
+// reranker's relevance cutoff.
+func relevantCardChunks(reranker llms.Reranker, cards []models.CardChunk) []models.CardChunk {
+	cutoff := reranker.RelevanceCutoff()
+	relevant := []models.CardChunk{}
+	for _, card := range cards {
+		if card.Ranking < cutoff {
+			continue
+		}
+		relevant = append(relevant, card)
+	}
+	return relevant
+}
 
-	// Get the next sequence number
+// nextChatSequence is the sequence number of the next message in the
+// conversation.
+func (s *Handler) nextChatSequence(conversationID string) (int, error) {
 	var nextSequence int
-	err = s.DB.QueryRow(`
+	err := s.DB.QueryRow(`
         SELECT COALESCE(MAX(sequence_number), 0) + 1
         FROM chat_completions
         WHERE conversation_id = $1
     `, conversationID).Scan(&nextSequence)
 	if err != nil {
 		log.Printf("error getting next sequence: %v", err)
-		return models.ChatCompletion{}, fmt.Errorf("failed to process response")
+		return 0, fmt.Errorf("failed to process response")
+	}
+	return nextSequence, nil
+}
+
+func (s *Handler) GetChatCompletion(userID int, conversationID string, scope models.ChatScope) (models.ChatCompletion, error) {
+
+	messages, err := s.GetChatMessagesInConversation(userID, conversationID)
+
+	nextSequence, err := s.nextChatSequence(conversationID)
+	if err != nil {
+		return models.ChatCompletion{}, err
 	}
 
 	lastMessage := messages[len(messages)-1].Content
 
 	option, err := llms.ChooseOptions(s.Server.LLMClient, lastMessage)
-	completion, err := s.RouteChatCompletion(userID, option, messages)
+	option = scopedChatOption(option, scope)
+	completion, err := s.RouteChatCompletion(userID, option, messages, scope)
 	cards, _ := s.GetPartialCardsFromChunks(userID, completion.ReferencedCardPKs)
 	completion.ReferencedCards = cards
 
 	completion.UserID = userID
 	completion.ConversationID = conversationID
 	completion.SequenceNumber = nextSequence
+	if !scope.IsEmpty() {
+		completion.Scope = &scope
+	}
 
-	s.WriteChatCompletionToDatabase(userID, completion)
+	err = s.WriteChatCompletionToDatabase(userID, completion)
+	if len(completion.Actions) > 0 {
+		// proposed actions that were not saved could never be confirmed
+		if err != nil {
+			return models.ChatCompletion{}, err
+		}
+		if completion.Actions, err = s.saveChatActions(userID, completion); err != nil {
+			return models.ChatCompletion{}, err
+		}
+	}
 
 	return completion, nil
 }
@@ -307,11 +367,15 @@ func (s *Handler) QueryUserConversations(userID int) ([]models.ConversationSumma
             COUNT(m.id) as message_count,
             c.updated_at,
             c.created_at,
-            c.model
+            c.model,
+            c.scope_card_pks,
+            c.scope_subtree,
+            c.scope_tag
         FROM chat_conversations c
         LEFT JOIN chat_completions m ON c.id = m.conversation_id
         WHERE c.user_id = $1
-        GROUP BY c.id, c.title, c.updated_at, c.created_at, c.model
+        GROUP BY c.id, c.title, c.updated_at, c.created_at, c.model,
+            c.scope_card_pks, c.scope_subtree, c.scope_tag
         ORDER BY c.created_at DESC
     `
 
@@ -325,6 +389,7 @@ func (s *Handler) QueryUserConversations(userID int) ([]models.ConversationSumma
 	var conversations []models.ConversationSummary
 	for rows.Next() {
 		var conversation models.ConversationSummary
+		var scopeCardPKs []int64
 		if err := rows.Scan(
 			&conversation.ID,
 			&conversation.Title,
@@ -332,10 +397,16 @@ func (s *Handler) QueryUserConversations(userID int) ([]models.ConversationSumma
 			&conversation.UpdatedAt,
 			&conversation.CreatedAt,
 			&conversation.Model,
+			pq.Array(&scopeCardPKs),
+			&conversation.Scope.Subtree,
+			&conversation.Scope.Tag,
 		); err != nil {
 			log.Printf("err scanning conversation summary: %v", err)
 			return nil, fmt.Errorf("unable to process conversation summary")
 		}
+		for _, pk := range scopeCardPKs {
+			conversation.Scope.CardPKs = append(conversation.Scope.CardPKs, int(pk))
+		}
 		conversations = append(conversations, conversation)
 	}
 
@@ -417,7 +488,7 @@ func (s *Handler) WriteChatCompletionToDatabase(userID int, completion models.Ch
 		completion.Content,
 		completion.Model,
 		completion.Tokens,
-		pq.Array(completion.ReferencedCards), // Convert Go slice to PostgreSQL array
+		pq.Array(completion.ReferencedCardPKs), // Convert Go slice to PostgreSQL array
 
 	).Scan(&completion.ID, &completion.CreatedAt)
 
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"go-backend/models"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// QueryConversationScope returns the scope stored on a conversation, which
+// is empty for conversations that were never scoped or do not exist yet.
+func (s *Handler) QueryConversationScope(userID int, conversationID string) (models.ChatScope, error) {
+	var scope models.ChatScope
+	var cardPKs []int64
+	err := s.DB.QueryRow(`
+	SELECT scope_card_pks, scope_subtree, scope_tag
+	FROM chat_conversations
+	WHERE id = $1 AND user_id = $2
+	`, conversationID, userID).Scan(pq.Array(&cardPKs), &scope.Subtree, &scope.Tag)
+	if err == sql.ErrNoRows {
+		// conversations are only saved after their first answer
+		return models.ChatScope{}, nil
+	} else if err != nil {
+		log.Printf("err querying conversation scope: %v", err)
+		return models.ChatScope{}, fmt.Errorf("unable to retrieve conversation scope")
+	}
+	for _, pk := range cardPKs {
+		scope.CardPKs = append(scope.CardPKs, int(pk))
+	}
+	return scope, nil
+}
+
+func (s *Handler) UpdateConversationScope(userID int, conversationID string, scope models.ChatScope) error {
+	_, err := s.DB.Exec(`
+	UPDATE chat_conversations
+	SET scope_card_pks = $3, scope_subtree = $4, scope_tag = $5, updated_at = NOW()
+	WHERE id = $1 AND user_id = $2
+	`, conversationID, userID, pq.Array(scopeCardPKs(scope)), scope.Subtree, scope.Tag)
+	if err != nil {
+		log.Printf("error updating conversation scope: %v", err)
+		return fmt.Errorf("failed to save conversation scope")
+	}
+	return nil
+}
+
+// scopeCardPKs is never nil, so that it is stored as an empty array.
+func scopeCardPKs(scope models.ChatScope) []int {
+	if scope.CardPKs == nil {
+		return []int{}
+	}
+	return scope.CardPKs
+}
+
+// chatScopeForMessage is the scope to answer a new message with. A scope
+// sent with the message replaces the conversation's, otherwise the
+// conversation keeps the one it has.
+func (s *Handler) chatScopeForMessage(userID int, message models.ChatCompletion, newConversation bool) (models.ChatScope, error) {
+	if message.Scope == nil {
+		if newConversation {
+			return models.ChatScope{}, nil
+		}
+		return s.QueryConversationScope(userID, message.ConversationID)
+	}
+	scope := *message.Scope
+	for _, pk := range scope.CardPKs {
+		if _, err := s.QueryPartialCardByID(userID, pk); err != nil {
+			return scope, fmt.Errorf("pinned card %d not found", pk)
+		}
+	}
+	if !newConversation {
+		if err := s.UpdateConversationScope(userID, message.ConversationID, scope); err != nil {
+			return scope, err
+		}
+	}
+	return scope, nil
+}
+
+// ScopeCardPKs returns the cards in the scope: the pinned cards, the
+// subtree's root and its descendants, and the cards with the tag.
+func (s *Handler) ScopeCardPKs(userID int, scope models.ChatScope) ([]int, error) {
+	subtree := escapeLikePattern(scope.Subtree)
+	rows, err := s.DB.Query(`
+	SELECT c.id
+	FROM cards c
+	WHERE c.user_id = $1 AND c.is_deleted = FALSE AND (
+		c.id = ANY($2::int[])
+		OR ($3 <> '' AND (c.card_id = $3 OR c.card_id LIKE $5 OR c.card_id LIKE $6))
+		OR ($4 <> '' AND c.id IN (
+			SELECT ct.card_pk
+			FROM card_tags ct
+			JOIN tags t ON t.id = ct.tag_id
+			WHERE t.user_id = $1 AND t.name = $4 AND t.is_deleted = FALSE
+		))
+	)
+	`, userID, pq.Array(scopeCardPKs(scope)), scope.Subtree, scope.Tag, subtree+".%", subtree+"/%")
+	if err != nil {
+		log.Printf("err querying scope cards: %v", err)
+		return nil, fmt.Errorf("unable to find the cards in scope")
+	}
+	defer rows.Close()
+
+	cardPKs := []int{}
+	for rows.Next() {
+		var pk int
+		if err := rows.Scan(&pk); err != nil {
+			log.Printf("err scanning scope cards: %v", err)
+			return nil, fmt.Errorf("unable to find the cards in scope")
+		}
+		cardPKs = append(cardPKs, pk)
+	}
+	return cardPKs, rows.Err()
+}
+
+// scopedChatOption answers scoped conversations from their cards, since
+// that is what they are about.
+func scopedChatOption(option models.ChatOption, scope models.ChatScope) models.ChatOption {
+	if option == models.Chat && !scope.IsEmpty() {
+		return models.Cards
+	}
+	return option
+}
+
+// scopedRelatedCards is chatRelatedCards limited to the scope, after the
+// pinned cards in full.
+func (s *Handler) scopedRelatedCards(userID int, lastMessage string, scope models.ChatScope) []models.CardChunk {
+	if scope.IsEmpty() {
+		return s.chatRelatedCards(userID, lastMessage, nil)
+	}
+	cardPKs, err := s.ScopeCardPKs(userID, scope)
+	if err != nil {
+		// answering from outside the scope would be wrong, so answer from
+		// nothing instead
+		cardPKs = []int{}
+	}
+
+	cards := []models.CardChunk{}
+	for _, pk := range scope.CardPKs {
+		card, err := s.QueryFullCard(userID, pk)
+		if err != nil {
+			continue
+		}
+		cards = append(cards, models.CardChunk{
+			ID:        card.ID,
+			CardID:    card.CardID,
+			UserID:    card.UserID,
+			Title:     card.Title,
+			Chunk:     card.Body,
+			ParentID:  card.ParentID,
+			CreatedAt: card.CreatedAt,
+			UpdatedAt: card.UpdatedAt,
+		})
+	}
+	for _, card := range s.chatRelatedCards(userID, lastMessage, cardPKs) {
+		if !contains(scope.CardPKs, card.ID) {
+			cards = append(cards, card)
+		}
+	}
+	return cards
+}
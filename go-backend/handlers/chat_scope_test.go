@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"go-backend/llms"
+	"go-backend/models"
+	"go-backend/tests"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func cardPK(t *testing.T, s *Handler, cardID string) int {
+	card, err := s.QueryPartialCard(1, cardID)
+	if err != nil {
+		t.Fatalf("card %s not found: %v", cardID, err)
+	}
+	return card.ID
+}
+
+func TestScopeCardPKs(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	cardPKs, err := s.ScopeCardPKs(1, models.ChatScope{Subtree: "1", Tag: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{cardPK(t, s, "1"), cardPK(t, s, "1/A"), 2}
+	sort.Ints(cardPKs)
+	sort.Ints(expected)
+	if len(cardPKs) != len(expected) {
+		t.Fatalf("wrong cards in scope, got %v want %v", cardPKs, expected)
+	}
+	for i := range expected {
+		if cardPKs[i] != expected[i] {
+			t.Errorf("wrong cards in scope, got %v want %v", cardPKs, expected)
+			break
+		}
+	}
+
+	pinned := cardPK(t, s, "2/A")
+	cardPKs, err = s.ScopeCardPKs(1, models.ChatScope{CardPKs: []int{pinned}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cardPKs) != 1 || cardPKs[0] != pinned {
+		t.Errorf("wrong cards in scope, got %v want %v", cardPKs, []int{pinned})
+	}
+
+	// wildcards in the subtree are matched literally
+	cardPKs, err = s.ScopeCardPKs(1, models.ChatScope{Subtree: "_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cardPKs) != 0 {
+		t.Errorf("a subtree of _ should have no cards, got %v", cardPKs)
+	}
+
+	cardPKs, err = s.ScopeCardPKs(1, models.ChatScope{Tag: "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cardPKs) != 0 {
+		t.Errorf("an unknown tag should have no cards, got %v", cardPKs)
+	}
+}
+
+// useFakeChatModel points the chat at an OpenAI compatible server that
+// routes every message to plain chat and records the prompts it answers.
+func useFakeChatModel(t *testing.T, s *Handler) *[]openai.ChatCompletionRequest {
+	var answered []openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openai.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		reply := "Chat"
+		if !strings.Contains(request.Messages[0].Content, "command router") {
+			answered = append(answered, request)
+			reply = "An answer"
+		}
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Model:   "fake-model",
+			Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Role: "assistant", Content: reply}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	config := openai.DefaultConfig("test")
+	config.BaseURL = server.URL
+	s.Server.LLMClient = llms.NewClient(s.DB, config)
+	return &answered
+}
+
+func TestChatScopePinnedCards(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	answered := useFakeChatModel(t, s)
+
+	pinned, err := s.QueryFullCard(1, cardPK(t, s, "2/A"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversationID := "550e8400-e29b-41d4-a716-446655440000"
+	scope := models.ChatScope{CardPKs: []int{pinned.ID}}
+	completion := postChatMessage(s, t, models.ChatCompletion{ConversationID: conversationID, Content: "Summarise this", Scope: &scope})
+	if completion.Scope == nil || len(completion.Scope.CardPKs) != 1 {
+		t.Errorf("the answer should report its scope, got %+v", completion.Scope)
+	}
+
+	// a follow-up without a scope keeps the conversation's
+	postChatMessage(s, t, models.ChatCompletion{ConversationID: conversationID, Content: "And in short?"})
+	if len(*answered) != 2 {
+		t.Fatalf("expected two answers, got %v", len(*answered))
+	}
+	for _, request := range *answered {
+		if !strings.Contains(request.Messages[0].Content, pinned.Body) {
+			t.Errorf("the pinned card should be given in full, got %q", request.Messages[0].Content)
+		}
+	}
+	stored, err := s.QueryConversationScope(1, conversationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.CardPKs) != 1 || stored.CardPKs[0] != pinned.ID {
+		t.Errorf("the scope should be stored on the conversation, got %+v", stored)
+	}
+
+	// sending an empty scope clears it
+	postChatMessage(s, t, models.ChatCompletion{ConversationID: conversationID, Content: "Anything else?", Scope: &models.ChatScope{}})
+	if stored, _ := s.QueryConversationScope(1, conversationID); !stored.IsEmpty() {
+		t.Errorf("the scope should be cleared, got %+v", stored)
+	}
+}
+
+func TestChatScopeNewConversation(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	useFakeChatModel(t, s)
+
+	completion := postChatMessage(s, t, models.ChatCompletion{Content: "What is in this subtree?", Scope: &models.ChatScope{Subtree: "1"}})
+
+	conversations, err := s.QueryUserConversations(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conversation := range conversations {
+		if conversation.ID == completion.ConversationID {
+			if conversation.Scope.Subtree != "1" {
+				t.Errorf("the scope should be saved with the conversation, got %+v", conversation.Scope)
+			}
+			return
+		}
+	}
+	t.Errorf("the new conversation should be saved")
+}
+
+func TestChatScopeRejectsOtherUsersCards(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	_, err := s.chatScopeForMessage(1, models.ChatCompletion{
+		ConversationID: "550e8400-e29b-41d4-a716-446655440000",
+		Scope:          &models.ChatScope{CardPKs: []int{999999}},
+	}, false)
+	if err == nil {
+		t.Errorf("pinning a card that is not the user's should fail")
+	}
+}
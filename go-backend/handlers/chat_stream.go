@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-backend/llms"
+	"go-backend/models"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// eventStream writes Server-Sent Events, flushing each one so that the
+// client sees it straight away.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (e *eventStream) send(event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+// PostChatMessageStreamRoute answers a chat message like PostChatMessageRoute,
+// but streams its progress as Server-Sent Events:
+//
+//	conversation  {"conversation_id": "..."}
+//	routing       {"option": "Cards"}
+//	cards         the cards the answer draws on, only when answering from cards
+//	delta         {"content": "..."}, the next piece of the answer. Answers
+//	              that use tools arrive in one piece
+//	done          the saved answer, with any actions it proposed
+//	error         {"error": "..."}, sent in place of done
+func (s *Handler) PostChatMessageStreamRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	var newMessage models.ChatCompletion
+	if err := json.NewDecoder(r.Body).Decode(&newMessage); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if newMessage.Content == "" {
+		http.Error(w, "Content is required", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	newConversation := newMessage.ConversationID == ""
+	if newConversation {
+		uuid, err := uuid.NewRandom()
+		if err != nil {
+			http.Error(w, "Failed to generate conversation ID", http.StatusInternalServerError)
+			return
+		}
+		newMessage.ConversationID = uuid.String()
+	}
+	scope, err := s.chatScopeForMessage(userID, newMessage, newConversation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.AddChatMessage(userID, newMessage); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	events := &eventStream{w: w, flusher: flusher}
+
+	completion, err := s.StreamChatCompletion(r.Context(), userID, newMessage.ConversationID, scope, events)
+	if err != nil {
+		log.Printf("error streaming chat completion: %v", err)
+		events.send("error", map[string]string{"error": err.Error()})
+		return
+	}
+	if newConversation {
+		summary, err := llms.CreateConversationSummary(s.Server.LLMClient, completion)
+		if err == nil {
+			summary.Scope = scope
+			err = s.WriteConversationSummary(userID, summary)
+		}
+		if err != nil {
+			events.send("error", map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	events.send("done", completion)
+}
+
+// StreamChatCompletion answers the last message of the conversation from the
+// cards in scope, sending each stage to the event stream as it happens, and
+// saves the answer once it is complete.
+func (s *Handler) StreamChatCompletion(ctx context.Context, userID int, conversationID string, scope models.ChatScope, events *eventStream) (models.ChatCompletion, error) {
+	messages, err := s.GetChatMessagesInConversation(userID, conversationID)
+	if err != nil {
+		return models.ChatCompletion{}, err
+	}
+	if len(messages) == 0 {
+		return models.ChatCompletion{}, fmt.Errorf("conversation has no messages")
+	}
+	if err := events.send("conversation", map[string]string{"conversation_id": conversationID}); err != nil {
+		return models.ChatCompletion{}, err
+	}
+	nextSequence, err := s.nextChatSequence(conversationID)
+	if err != nil {
+		return models.ChatCompletion{}, err
+	}
+	lastMessage := messages[len(messages)-1].Content
+
+	option, err := llms.ChooseOptions(s.Server.LLMClient, lastMessage)
+	if err != nil {
+		log.Printf("error routing chat message, answering directly: %v", err)
+		option = models.Chat
+	}
+	option = scopedChatOption(option, scope)
+	if err := events.send("routing", map[string]models.ChatOption{"option": option}); err != nil {
+		return models.ChatCompletion{}, err
+	}
+
+	var prompt []openai.ChatCompletionMessage
+	var completion models.ChatCompletion
+	cardPKs := []int{}
+	cards := []models.PartialCard{}
+	switch option {
+	case models.Tools:
+		// tool calls have to finish before there is anything to stream
+		completion, err = s.ToolChatCompletion(userID, messages)
+		if err != nil {
+			return models.ChatCompletion{}, err
+		}
+		if err := events.send("delta", map[string]string{"content": completion.Content}); err != nil {
+			return models.ChatCompletion{}, err
+		}
+	case models.UserInfo:
+		user, _ := s.QueryUser(userID)
+		prompt = llms.UserInfoMessages(user, lastMessage)
+	case models.Cards:
+		relatedCards := s.scopedRelatedCards(userID, lastMessage, scope)
+		for _, card := range relatedCards {
+			cardPKs = append(cardPKs, card.ID)
+		}
+		cards, _ = s.GetPartialCardsFromChunks(userID, cardPKs)
+		if err := events.send("cards", cards); err != nil {
+			return models.ChatCompletion{}, err
+		}
+		prompt = llms.CardSearchMessages(messages, relatedCards)
+	default:
+		prompt = llms.ChatMessages(messages)
+	}
+
+	if prompt != nil {
+		completion, err = llms.StreamChatCompletion(ctx, s.Server.LLMClient, prompt, func(delta string) error {
+			return events.send("delta", map[string]string{"content": delta})
+		})
+		if err != nil {
+			return models.ChatCompletion{}, err
+		}
+	}
+	completion.ReferencedCardPKs = cardPKs
+	completion.ReferencedCards = cards
+	completion.UserID = userID
+	completion.ConversationID = conversationID
+	completion.SequenceNumber = nextSequence
+	if !scope.IsEmpty() {
+		completion.Scope = &scope
+	}
+
+	if err := s.WriteChatCompletionToDatabase(userID, completion); err != nil {
+		return models.ChatCompletion{}, err
+	}
+	if len(completion.Actions) > 0 {
+		if completion.Actions, err = s.saveChatActions(userID, completion); err != nil {
+			return models.ChatCompletion{}, err
+		}
+	}
+	return completion, nil
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go-backend/llms"
+	"go-backend/models"
+	"go-backend/tests"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+type streamEvent struct {
+	name string
+	data string
+}
+
+func parseStreamEvents(t *testing.T, body string) []streamEvent {
+	var events []streamEvent
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var event streamEvent
+		for _, line := range strings.Split(block, "\n") {
+			if name, ok := strings.CutPrefix(line, "event: "); ok {
+				event.name = name
+			} else if data, ok := strings.CutPrefix(line, "data: "); ok {
+				event.data = data
+			}
+		}
+		if event.name == "" {
+			t.Fatalf("malformed event %q", block)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func postChatStream(s *Handler, t *testing.T, message models.ChatCompletion) []streamEvent {
+	token, _ := tests.GenerateTestJWT(1)
+	body, _ := json.Marshal(message)
+	req, _ := http.NewRequest("POST", "/api/chat/stream", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.JwtMiddleware(s.PostChatMessageStreamRoute)).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v, %v", status, http.StatusOK, rr.Body.String())
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("wrong content type, got %v", contentType)
+	}
+	return parseStreamEvents(t, rr.Body.String())
+}
+
+func TestPostChatMessageStream(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	// an OpenAI compatible server that routes to plain chat and streams
+	// its answer in pieces
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openai.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		if !request.Stream {
+			json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+				Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: "Chat"}}},
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, piece := range []string{"Streamed", " answer"} {
+			data, _ := json.Marshal(openai.ChatCompletionStreamResponse{
+				Model:   "fake-model",
+				Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: piece}}},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		data, _ := json.Marshal(openai.ChatCompletionStreamResponse{Model: "fake-model", Usage: &openai.Usage{TotalTokens: 12}})
+		fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", data)
+	}))
+	defer server.Close()
+	config := openai.DefaultConfig("test")
+	config.BaseURL = server.URL
+	s.Server.LLMClient = llms.NewClient(s.DB, config)
+
+	conversationID := "550e8400-e29b-41d4-a716-446655440000"
+	events := postChatStream(s, t, models.ChatCompletion{ConversationID: conversationID, Content: "Tell me something"})
+
+	var names []string
+	var answer string
+	for _, event := range events {
+		names = append(names, event.name)
+		if event.name == "delta" {
+			var delta map[string]string
+			json.Unmarshal([]byte(event.data), &delta)
+			answer += delta["content"]
+		}
+	}
+	expected := "conversation routing delta delta done"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("wrong events, got %v want %v", names, expected)
+	}
+	if answer != "Streamed answer" {
+		t.Errorf("wrong answer, got %q", answer)
+	}
+	if events[1].data != `{"option":"Chat"}` {
+		t.Errorf("wrong routing event, got %v", events[1].data)
+	}
+
+	var done models.ChatCompletion
+	json.Unmarshal([]byte(events[len(events)-1].data), &done)
+	if done.Content != "Streamed answer" || done.Model != "fake-model" || done.Tokens != 12 {
+		t.Errorf("wrong final message, got %+v", done)
+	}
+
+	messages, err := s.GetChatMessagesInConversation(1, conversationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "assistant" || last.Content != "Streamed answer" || last.Model != "fake-model" {
+		t.Errorf("the answer should be saved, got %+v", last)
+	}
+}
+
+func TestPostChatMessageStreamNewConversation(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	events := postChatStream(s, t, models.ChatCompletion{Content: "Hello"})
+	if events[0].name != "conversation" || events[len(events)-1].name != "done" {
+		t.Fatalf("wrong events, got %+v", events)
+	}
+	var started map[string]string
+	json.Unmarshal([]byte(events[0].data), &started)
+
+	conversations, err := s.QueryUserConversations(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, conversation := range conversations {
+		if conversation.ID == started["conversation_id"] {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("the new conversation should be saved with a summary")
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	// "bytes"
 	// "encoding/json"
+	"go-backend/llms"
 	"go-backend/models"
 	"go-backend/tests"
 	"log"
@@ -253,3 +254,31 @@ func TestGetUserConversations(t *testing.T) {
 		}
 	}
 }
+
+func TestRelevantCardChunks(t *testing.T) {
+	candidates := []models.CardChunk{
+		{ID: 1, Title: "Winston Churchill", Chunk: "British prime minister during the Second World War."},
+		{ID: 2, Title: "War cabinet", Chunk: "The ministers who ran the country from 1940."},
+	}
+	reranker := llms.NewLocalReranker()
+	scores, err := reranker.Rerank("Winston Churchill", candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scores[1] >= 1 {
+		t.Fatalf("expected the second card to score below 1, got %v", scores)
+	}
+	for i := range candidates {
+		candidates[i].Ranking = scores[i]
+	}
+	if relevant := relevantCardChunks(reranker, candidates); len(relevant) != 2 {
+		t.Errorf("local reranking should keep every card, got %v", relevant)
+	}
+
+	candidates[0].Ranking = 8
+	candidates[1].Ranking = 0
+	relevant := relevantCardChunks(llms.NewLLMReranker(nil), candidates)
+	if len(relevant) != 1 || relevant[0].ID != 1 {
+		t.Errorf("the card the model rated 0 should be left out, got %v", relevant)
+	}
+}
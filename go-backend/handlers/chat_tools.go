@@ -0,0 +1,572 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backend/llms"
+	"go-backend/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// MAX_TOOL_SEARCH_RESULTS is how many cards the search tool returns.
+const MAX_TOOL_SEARCH_RESULTS = 10
+
+// MAX_ACTION_BODY_PREVIEW is how much of a proposed card's body is shown
+// when asking the user to confirm it.
+const MAX_ACTION_BODY_PREVIEW = 300
+
+var errChatActionNotPending = errors.New("action not found or already resolved")
+
+// chatTool is a function the chat model can call.
+type chatTool struct {
+	definition openai.FunctionDefinition
+	// mutating tools change the zettelkasten. The model can only propose
+	// them, they run once the user confirms.
+	mutating bool
+	// check validates the arguments of a mutating call and describes it for
+	// the user to confirm.
+	check func(s *Handler, userID int, arguments string) (string, error)
+	run   func(s *Handler, userID int, arguments string) (interface{}, error)
+}
+
+var chatTools = []chatTool{
+	{
+		definition: openai.FunctionDefinition{
+			Name:        "search_cards",
+			Description: "Search the user's cards by their title and body.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"query": {Type: jsonschema.String, Description: "The words to search for"},
+				},
+				Required: []string{"query"},
+			},
+		},
+		run: (*Handler).searchCardsTool,
+	},
+	{
+		definition: openai.FunctionDefinition{
+			Name:        "get_card",
+			Description: "Fetch a card and the card_ids of its children.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"card_id": {Type: jsonschema.String, Description: "The card_id, such as 4/2"},
+				},
+				Required: []string{"card_id"},
+			},
+		},
+		run: (*Handler).getCardTool,
+	},
+	{
+		definition: openai.FunctionDefinition{
+			Name:        "create_card",
+			Description: "Propose a new card. The user confirms it before it is created.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"card_id": {Type: jsonschema.String, Description: "An unused card_id under an existing parent, such as 4/2.3 to put the card under 4/2"},
+					"title":   {Type: jsonschema.String},
+					"body":    {Type: jsonschema.String, Description: "The card's Markdown body"},
+				},
+				Required: []string{"card_id", "title"},
+			},
+		},
+		mutating: true,
+		check:    (*Handler).checkCreateCardTool,
+		run:      (*Handler).createCardTool,
+	},
+	{
+		definition: openai.FunctionDefinition{
+			Name:        "create_task",
+			Description: "Propose a new task. The user confirms it before it is created.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"title":          {Type: jsonschema.String},
+					"scheduled_date": {Type: jsonschema.String, Description: "The day to do the task, as YYYY-MM-DD"},
+					"card_id":        {Type: jsonschema.String, Description: "The card_id of a card to attach the task to"},
+				},
+				Required: []string{"title"},
+			},
+		},
+		mutating: true,
+		check:    (*Handler).checkCreateTaskTool,
+		run:      (*Handler).createTaskTool,
+	},
+	{
+		definition: openai.FunctionDefinition{
+			Name:        "list_due_tasks",
+			Description: "List the user's open tasks that are scheduled or due today or earlier.",
+			Parameters:  jsonschema.Definition{Type: jsonschema.Object, Properties: map[string]jsonschema.Definition{}},
+		},
+		run: (*Handler).listDueTasksTool,
+	},
+}
+
+func findChatTool(name string) (chatTool, bool) {
+	for _, tool := range chatTools {
+		if tool.definition.Name == name {
+			return tool, true
+		}
+	}
+	return chatTool{}, false
+}
+
+func chatToolDefinitions() []openai.Tool {
+	tools := make([]openai.Tool, len(chatTools))
+	for i := range chatTools {
+		tools[i] = openai.Tool{Type: openai.ToolTypeFunction, Function: &chatTools[i].definition}
+	}
+	return tools
+}
+
+// toolResult is the JSON shown to the model for a tool call.
+func toolResult(result interface{}, err error) string {
+	if err != nil {
+		result = map[string]string{"error": err.Error()}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return `{"error": "unable to encode the result"}`
+	}
+	return string(data)
+}
+
+func parseToolArguments(arguments string, params interface{}) error {
+	if err := json.Unmarshal([]byte(arguments), params); err != nil {
+		return fmt.Errorf("invalid arguments: %v", err)
+	}
+	return nil
+}
+
+type toolCard struct {
+	CardID   string     `json:"card_id"`
+	Title    string     `json:"title"`
+	Preview  string     `json:"preview,omitempty"`
+	Body     string     `json:"body,omitempty"`
+	Link     string     `json:"link,omitempty"`
+	Children []toolCard `json:"children,omitempty"`
+}
+
+func (s *Handler) searchCardsTool(userID int, arguments string) (interface{}, error) {
+	var params struct {
+		Query string `json:"query"`
+	}
+	if err := parseToolArguments(arguments, &params); err != nil {
+		return nil, err
+	}
+	results, err := s.ClassicSearchResults(userID, params.Query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to search cards")
+	}
+	cards := []toolCard{}
+	for _, result := range results {
+		if len(cards) == MAX_TOOL_SEARCH_RESULTS {
+			break
+		}
+		cards = append(cards, toolCard{CardID: result.ID, Title: result.Title, Preview: result.Preview})
+	}
+	return cards, nil
+}
+
+func (s *Handler) getCardTool(userID int, arguments string) (interface{}, error) {
+	var params struct {
+		CardID string `json:"card_id"`
+	}
+	if err := parseToolArguments(arguments, &params); err != nil {
+		return nil, err
+	}
+	partial, err := s.QueryPartialCard(userID, params.CardID)
+	if err != nil {
+		return nil, fmt.Errorf("card %s not found", params.CardID)
+	}
+	card, err := s.QueryFullCard(userID, partial.ID)
+	if err != nil {
+		return nil, fmt.Errorf("card %s not found", params.CardID)
+	}
+	result := toolCard{CardID: card.CardID, Title: card.Title, Body: card.Body, Link: card.Link}
+	children, _ := s.getChildren(userID, card.CardID)
+	for _, child := range children {
+		result.Children = append(result.Children, toolCard{CardID: child.CardID, Title: child.Title})
+	}
+	return result, nil
+}
+
+// parseCreateCardTool also returns the card the new one would be filed
+// under, which is derived from its card_id. Top level cards have none. The
+// model can only set the fields shown in the confirmation, so anything else
+// in the arguments is ignored.
+func (s *Handler) parseCreateCardTool(userID int, arguments string) (models.EditCardParams, *models.PartialCard, error) {
+	var args struct {
+		CardID string `json:"card_id"`
+		Title  string `json:"title"`
+		Body   string `json:"body"`
+	}
+	if err := parseToolArguments(arguments, &args); err != nil {
+		return models.EditCardParams{}, nil, err
+	}
+	params := models.EditCardParams{CardID: strings.TrimSpace(args.CardID), Title: args.Title, Body: args.Body}
+	if params.CardID == "" {
+		return params, nil, fmt.Errorf("card_id is required")
+	}
+	if strings.TrimSpace(params.Title) == "" {
+		return params, nil, fmt.Errorf("title is required")
+	}
+	if !s.checkIsCardIDUnique(userID, params.CardID) {
+		return params, nil, fmt.Errorf("card_id %s is already in use", params.CardID)
+	}
+	parentID := getParentIdAlternating(params.CardID)
+	if parentID == params.CardID {
+		return params, nil, nil
+	}
+	parent, err := s.QueryPartialCard(userID, parentID)
+	if err != nil {
+		return params, nil, fmt.Errorf("card_id %s would be filed under %s, which does not exist", params.CardID, parentID)
+	}
+	return params, &parent, nil
+}
+
+// bodyPreview is the start of a card body, cut at MAX_ACTION_BODY_PREVIEW
+// characters.
+func bodyPreview(body string) string {
+	runes := []rune(strings.TrimSpace(body))
+	if len(runes) <= MAX_ACTION_BODY_PREVIEW {
+		return string(runes)
+	}
+	return string(runes[:MAX_ACTION_BODY_PREVIEW]) + "…"
+}
+
+func (s *Handler) checkCreateCardTool(userID int, arguments string) (string, error) {
+	params, parent, err := s.parseCreateCardTool(userID, arguments)
+	if err != nil {
+		return "", err
+	}
+	description := fmt.Sprintf("Create card %s %q at the top level", params.CardID, params.Title)
+	if parent != nil {
+		description = fmt.Sprintf("Create card %s %q under %s %q", params.CardID, params.Title, parent.CardID, parent.Title)
+	}
+	if preview := bodyPreview(params.Body); preview != "" {
+		return description + fmt.Sprintf(" with the body %q", preview), nil
+	}
+	return description + " with an empty body", nil
+}
+
+func (s *Handler) createCardTool(userID int, arguments string) (interface{}, error) {
+	params, _, err := s.parseCreateCardTool(userID, arguments)
+	if err != nil {
+		return nil, err
+	}
+	card, err := s.CreateCard(userID, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create card")
+	}
+	return toolCard{CardID: card.CardID, Title: card.Title}, nil
+}
+
+func (s *Handler) parseCreateTaskTool(userID int, arguments string) (models.Task, string, error) {
+	var params struct {
+		Title         string `json:"title"`
+		ScheduledDate string `json:"scheduled_date"`
+		CardID        string `json:"card_id"`
+	}
+	if err := parseToolArguments(arguments, &params); err != nil {
+		return models.Task{}, "", err
+	}
+	task := models.Task{UserID: userID, Title: strings.TrimSpace(params.Title)}
+	if task.Title == "" {
+		return task, "", fmt.Errorf("title is required")
+	}
+	description := fmt.Sprintf("Create task %q", task.Title)
+	if params.ScheduledDate != "" {
+		scheduled, err := time.Parse("2006-01-02", params.ScheduledDate)
+		if err != nil {
+			return task, "", fmt.Errorf("scheduled_date must be YYYY-MM-DD")
+		}
+		task.ScheduledDate = &scheduled
+		description += " for " + params.ScheduledDate
+	}
+	if params.CardID != "" {
+		card, err := s.QueryPartialCard(userID, params.CardID)
+		if err != nil {
+			return task, "", fmt.Errorf("card %s not found", params.CardID)
+		}
+		task.CardPK = card.ID
+		description += " on card " + card.CardID
+	}
+	return task, description, nil
+}
+
+func (s *Handler) checkCreateTaskTool(userID int, arguments string) (string, error) {
+	_, description, err := s.parseCreateTaskTool(userID, arguments)
+	return description, err
+}
+
+func (s *Handler) createTaskTool(userID int, arguments string) (interface{}, error) {
+	task, _, err := s.parseCreateTaskTool(userID, arguments)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.CreateTask(task)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"id": id, "title": task.Title}, nil
+}
+
+func (s *Handler) listDueTasksTool(userID int, arguments string) (interface{}, error) {
+	tasks, err := s.QueryTasks(userID, false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access tasks")
+	}
+	year, month, day := time.Now().Date()
+	tomorrow := time.Date(year, month, day+1, 0, 0, 0, 0, time.Local)
+	due := []map[string]interface{}{}
+	for _, task := range tasks {
+		scheduled := task.ScheduledDate != nil && task.ScheduledDate.Before(tomorrow)
+		overdue := task.DueDate != nil && task.DueDate.Before(tomorrow)
+		if !scheduled && !overdue {
+			continue
+		}
+		item := map[string]interface{}{"id": task.ID, "title": task.Title}
+		if task.ScheduledDate != nil {
+			item["scheduled_date"] = task.ScheduledDate.Format("2006-01-02")
+		}
+		if task.DueDate != nil {
+			item["due_date"] = task.DueDate.Format("2006-01-02")
+		}
+		if task.Card.CardID != "" {
+			item["card_id"] = task.Card.CardID
+		}
+		due = append(due, item)
+	}
+	return due, nil
+}
+
+// ToolChatCompletion answers with the chat tools. Read-only calls run
+// straight away; mutating ones are returned as pending actions for the user
+// to confirm, which ends the answer.
+func (s *Handler) ToolChatCompletion(userID int, messages []models.ChatCompletion) (models.ChatCompletion, error) {
+	var actions []models.ChatAction
+	completion, err := llms.ToolChatCompletion(
+		s.Server.LLMClient,
+		llms.ToolMessages(messages),
+		chatToolDefinitions(),
+		func(call openai.ToolCall) (string, bool) {
+			tool, ok := findChatTool(call.Function.Name)
+			if !ok {
+				return toolResult(nil, fmt.Errorf("unknown tool %s", call.Function.Name)), false
+			}
+			if !tool.mutating {
+				return toolResult(tool.run(s, userID, call.Function.Arguments)), false
+			}
+			description, err := tool.check(s, userID, call.Function.Arguments)
+			if err != nil {
+				return toolResult(nil, err), false
+			}
+			actions = append(actions, models.ChatAction{
+				Tool:        tool.definition.Name,
+				Arguments:   call.Function.Arguments,
+				Description: description,
+				Status:      models.ChatActionPending,
+			})
+			return toolResult(map[string]string{"status": "waiting for the user to confirm"}, nil), true
+		},
+	)
+	if err != nil {
+		return models.ChatCompletion{}, err
+	}
+	if len(actions) > 0 {
+		var content strings.Builder
+		if completion.Content != "" {
+			content.WriteString(completion.Content + "\n\n")
+		}
+		content.WriteString("Please confirm:\n")
+		for _, action := range actions {
+			content.WriteString("- " + action.Description + "\n")
+		}
+		completion.Content = strings.TrimSpace(content.String())
+	}
+	completion.Actions = actions
+	return completion, nil
+}
+
+// saveChatActions stores the actions proposed in a saved answer, so that
+// they can be confirmed later.
+func (s *Handler) saveChatActions(userID int, completion models.ChatCompletion) ([]models.ChatAction, error) {
+	actions := completion.Actions
+	for i := range actions {
+		actions[i].UserID = userID
+		actions[i].ConversationID = completion.ConversationID
+		actions[i].SequenceNumber = completion.SequenceNumber
+		err := s.DB.QueryRow(`
+		INSERT INTO chat_actions (user_id, conversation_id, sequence_number, tool, arguments, description, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+		`, userID, completion.ConversationID, completion.SequenceNumber, actions[i].Tool,
+			actions[i].Arguments, actions[i].Description, actions[i].Status,
+		).Scan(&actions[i].ID, &actions[i].CreatedAt)
+		if err != nil {
+			log.Printf("error saving chat action: %v", err)
+			return actions, fmt.Errorf("failed to save proposed action")
+		}
+	}
+	return actions, nil
+}
+
+const chatActionColumns = `id, user_id, conversation_id, sequence_number, tool, arguments,
+	description, status, result, created_at, resolved_at`
+
+func scanChatAction(row interface{ Scan(...any) error }) (models.ChatAction, error) {
+	var action models.ChatAction
+	err := row.Scan(
+		&action.ID,
+		&action.UserID,
+		&action.ConversationID,
+		&action.SequenceNumber,
+		&action.Tool,
+		&action.Arguments,
+		&action.Description,
+		&action.Status,
+		&action.Result,
+		&action.CreatedAt,
+		&action.ResolvedAt,
+	)
+	return action, err
+}
+
+// QueryChatActions returns the actions proposed in a conversation.
+func (s *Handler) QueryChatActions(userID int, conversationID string) ([]models.ChatAction, error) {
+	rows, err := s.DB.Query(`
+	SELECT `+chatActionColumns+`
+	FROM chat_actions
+	WHERE user_id = $1 AND conversation_id = $2
+	ORDER BY id
+	`, userID, conversationID)
+	if err != nil {
+		log.Printf("err querying chat actions: %v", err)
+		return nil, fmt.Errorf("unable to retrieve chat actions")
+	}
+	defer rows.Close()
+
+	actions := []models.ChatAction{}
+	for rows.Next() {
+		action, err := scanChatAction(rows)
+		if err != nil {
+			log.Printf("err scanning chat action: %v", err)
+			return nil, fmt.Errorf("unable to retrieve chat actions")
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+// ConfirmChatAction applies a pending action and notes the outcome in the
+// conversation, so that the assistant knows about it on the next message.
+func (s *Handler) ConfirmChatAction(userID, id int) (models.ChatAction, error) {
+	// claim the action first so that confirming twice cannot apply it twice
+	action, err := scanChatAction(s.DB.QueryRow(`
+	UPDATE chat_actions SET status = $3
+	WHERE id = $1 AND user_id = $2 AND status = $4
+	RETURNING `+chatActionColumns,
+		id, userID, models.ChatActionApplying, models.ChatActionPending))
+	if err == sql.ErrNoRows {
+		return models.ChatAction{}, errChatActionNotPending
+	} else if err != nil {
+		log.Printf("err claiming chat action: %v", err)
+		return models.ChatAction{}, fmt.Errorf("unable to confirm action")
+	}
+
+	var result interface{}
+	tool, ok := findChatTool(action.Tool)
+	if !ok || !tool.mutating {
+		err = fmt.Errorf("unknown tool %s", action.Tool)
+	} else {
+		result, err = tool.run(s, userID, action.Arguments)
+	}
+	note := "Done: " + action.Description
+	action.Status = models.ChatActionApplied
+	action.Result = toolResult(result, nil)
+	if err != nil {
+		note = fmt.Sprintf("Failed: %s (%v)", action.Description, err)
+		action.Status = models.ChatActionFailed
+		action.Result = err.Error()
+	}
+	err = s.DB.QueryRow(`
+	UPDATE chat_actions SET status = $2, result = $3, resolved_at = NOW()
+	WHERE id = $1
+	RETURNING resolved_at
+	`, action.ID, action.Status, action.Result).Scan(&action.ResolvedAt)
+	if err != nil {
+		log.Printf("err resolving chat action: %v", err)
+		return action, fmt.Errorf("unable to confirm action")
+	}
+
+	sequence, err := s.nextChatSequence(action.ConversationID)
+	if err != nil {
+		return action, err
+	}
+	err = s.WriteChatCompletionToDatabase(userID, models.ChatCompletion{
+		UserID:         userID,
+		ConversationID: action.ConversationID,
+		SequenceNumber: sequence,
+		Role:           openai.ChatMessageRoleAssistant,
+		Content:        note,
+	})
+	return action, err
+}
+
+// RejectChatAction discards a pending action.
+func (s *Handler) RejectChatAction(userID, id int) (models.ChatAction, error) {
+	action, err := scanChatAction(s.DB.QueryRow(`
+	UPDATE chat_actions SET status = $3, resolved_at = NOW()
+	WHERE id = $1 AND user_id = $2 AND status = $4
+	RETURNING `+chatActionColumns,
+		id, userID, models.ChatActionRejected, models.ChatActionPending))
+	if err == sql.ErrNoRows {
+		return models.ChatAction{}, errChatActionNotPending
+	} else if err != nil {
+		log.Printf("err rejecting chat action: %v", err)
+		return models.ChatAction{}, fmt.Errorf("unable to reject action")
+	}
+	return action, nil
+}
+
+func (s *Handler) ConfirmChatActionRoute(w http.ResponseWriter, r *http.Request) {
+	s.resolveChatActionRoute(w, r, s.ConfirmChatAction)
+}
+
+func (s *Handler) RejectChatActionRoute(w http.ResponseWriter, r *http.Request) {
+	s.resolveChatActionRoute(w, r, s.RejectChatAction)
+}
+
+func (s *Handler) resolveChatActionRoute(w http.ResponseWriter, r *http.Request, resolve func(userID, id int) (models.ChatAction, error)) {
+	userID := r.Context().Value("current_user").(int)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	action, err := resolve(userID, id)
+	if err == errChatActionNotPending {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(action)
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go-backend/llms"
+	"go-backend/models"
+	"go-backend/tests"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// useFakeToolModel points the chat at an OpenAI compatible server that
+// routes to the tools, fetches card 1 and then proposes a card under it.
+func useFakeToolModel(t *testing.T, s *Handler) *[]openai.ChatCompletionRequest {
+	var requests []openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openai.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+
+		message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+		results := 0
+		for _, m := range request.Messages {
+			if m.Role == openai.ChatMessageRoleTool {
+				results++
+			}
+		}
+		switch {
+		case len(request.Tools) == 0:
+			message.Content = "Tools"
+		case results == 0:
+			message.ToolCalls = []openai.ToolCall{{ID: "get", Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: "get_card", Arguments: `{"card_id": "1"}`}}}
+		default:
+			message.Content = "I'll add it under card 1."
+			message.ToolCalls = []openai.ToolCall{{ID: "create", Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: "create_card", Arguments: `{"card_id": "1/Z", "title": "Drafted card", "body": "From the chat"}`}}}
+		}
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Model:   "fake-model",
+			Choices: []openai.ChatCompletionChoice{{Message: message}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	config := openai.DefaultConfig("test")
+	config.BaseURL = server.URL
+	s.Server.LLMClient = llms.NewClient(s.DB, config)
+	return &requests
+}
+
+func postChatMessage(s *Handler, t *testing.T, message models.ChatCompletion) models.ChatCompletion {
+	token, _ := tests.GenerateTestJWT(1)
+	body, _ := json.Marshal(message)
+	req, _ := http.NewRequest("POST", "/api/chat", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.JwtMiddleware(s.PostChatMessageRoute)).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v, %v", status, http.StatusOK, rr.Body.String())
+	}
+	var completion models.ChatCompletion
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &completion)
+	return completion
+}
+
+func resolveChatAction(s *Handler, id int, resolution string) *httptest.ResponseRecorder {
+	token, _ := tests.GenerateTestJWT(1)
+	path := fmt.Sprintf("/api/chat/actions/%d/%s", id, resolution)
+	req, _ := http.NewRequest("POST", path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/api/chat/actions/{id}/confirm", s.JwtMiddleware(s.ConfirmChatActionRoute))
+	router.HandleFunc("/api/chat/actions/{id}/reject", s.JwtMiddleware(s.RejectChatActionRoute))
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestChatToolsProposeAndConfirm(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	requests := useFakeToolModel(t, s)
+
+	conversationID := "550e8400-e29b-41d4-a716-446655440000"
+	completion := postChatMessage(s, t, models.ChatCompletion{ConversationID: conversationID, Content: "Make this a card under 1"})
+
+	// the card was fetched and its contents sent back to the model
+	last := (*requests)[len(*requests)-1].Messages
+	if result := last[len(last)-1]; result.ToolCallID != "get" || !strings.Contains(result.Content, `"card_id":"1"`) {
+		t.Errorf("the fetched card should be sent back, got %+v", result)
+	}
+
+	if len(completion.Actions) != 1 {
+		t.Fatalf("expected one proposed action, got %+v", completion.Actions)
+	}
+	action := completion.Actions[0]
+	parent, _ := s.QueryPartialCard(1, "1")
+	description := fmt.Sprintf(`Create card 1/Z "Drafted card" under 1 %q with the body "From the chat"`, parent.Title)
+	if action.ID == 0 || action.Status != models.ChatActionPending || action.Description != description {
+		t.Errorf("wrong action, got %+v", action)
+	}
+	if !strings.Contains(completion.Content, action.Description) {
+		t.Errorf("the answer should ask to confirm the action, got %q", completion.Content)
+	}
+	if _, err := s.QueryPartialCard(1, "1/Z"); err == nil {
+		t.Fatalf("the card should not be created before it is confirmed")
+	}
+
+	rr := resolveChatAction(s, action.ID, "confirm")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v, %v", status, http.StatusOK, rr.Body.String())
+	}
+	var confirmed models.ChatAction
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &confirmed)
+	if confirmed.Status != models.ChatActionApplied || confirmed.ResolvedAt == nil {
+		t.Errorf("the action should be applied, got %+v", confirmed)
+	}
+	card, err := s.QueryPartialCard(1, "1/Z")
+	if err != nil || card.Title != "Drafted card" {
+		t.Errorf("the card should be created, got %+v %v", card, err)
+	}
+
+	if rr := resolveChatAction(s, action.ID, "confirm"); rr.Code != http.StatusNotFound {
+		t.Errorf("confirming twice should fail, got %v", rr.Code)
+	}
+
+	messages, err := s.QueryChatConversation(1, conversationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note := messages[len(messages)-1]; note.Content != "Done: "+action.Description {
+		t.Errorf("the outcome should be noted in the conversation, got %q", note.Content)
+	}
+	if actions := messages[len(messages)-2].Actions; len(actions) != 1 || actions[0].Status != models.ChatActionApplied {
+		t.Errorf("the answer should list its action, got %+v", actions)
+	}
+}
+
+func TestChatToolsReject(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	useFakeToolModel(t, s)
+
+	completion := postChatMessage(s, t, models.ChatCompletion{
+		ConversationID: "550e8400-e29b-41d4-a716-446655440000",
+		Content:        "Make this a card under 1",
+	})
+	if len(completion.Actions) != 1 {
+		t.Fatalf("expected one proposed action, got %+v", completion.Actions)
+	}
+	rr := resolveChatAction(s, completion.Actions[0].ID, "reject")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if rr := resolveChatAction(s, completion.Actions[0].ID, "confirm"); rr.Code != http.StatusNotFound {
+		t.Errorf("a rejected action should not be applied, got %v", rr.Code)
+	}
+	if _, err := s.QueryPartialCard(1, "1/Z"); err == nil {
+		t.Errorf("the card should not be created")
+	}
+}
+
+func TestCheckCreateCardTool(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	parent, _ := s.QueryPartialCard(1, "2/A")
+	description, err := s.checkCreateCardTool(1, `{"card_id": "2/A.7", "title": "Child"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf(`Create card 2/A.7 "Child" under 2/A %q with an empty body`, parent.Title); description != expected {
+		t.Errorf("wrong description, got %q want %q", description, expected)
+	}
+
+	description, err = s.checkCreateCardTool(1, `{"card_id": "500", "title": "Root"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description != `Create card 500 "Root" at the top level with an empty body` {
+		t.Errorf("wrong description, got %q", description)
+	}
+
+	// 99 does not exist, so there is nothing to file 99/A under
+	if _, err := s.checkCreateCardTool(1, `{"card_id": "99/A", "title": "Orphan"}`); err == nil {
+		t.Errorf("a card without a parent should not be proposed")
+	}
+}
+
+func TestCreateCardToolOnlySetsConfirmedFields(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	arguments := `{"card_id": "500", "title": "Root", "body": "Body", "link": "https://example.com", "is_flashcard": true}`
+	description, err := s.checkCreateCardTool(1, arguments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description != `Create card 500 "Root" at the top level with the body "Body"` {
+		t.Errorf("wrong description, got %q", description)
+	}
+	if _, err := s.createCardTool(1, arguments); err != nil {
+		t.Fatal(err)
+	}
+	partial, err := s.QueryPartialCard(1, "500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, _ := s.QueryFullCard(1, partial.ID)
+	if card.Link != "" || card.IsFlashcard {
+		t.Errorf("fields the user did not see should not be set, got link %q and flashcard %v", card.Link, card.IsFlashcard)
+	}
+}
+
+func TestBodyPreview(t *testing.T) {
+	long := strings.Repeat("é", MAX_ACTION_BODY_PREVIEW+1)
+	if preview := bodyPreview(long); preview != strings.Repeat("é", MAX_ACTION_BODY_PREVIEW)+"…" {
+		t.Errorf("long bodies should be cut, got %d runes", len([]rune(preview)))
+	}
+	if preview := bodyPreview("  short  "); preview != "short" {
+		t.Errorf("wrong preview, got %q", preview)
+	}
+}
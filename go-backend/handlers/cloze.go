@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backend/models"
+	"go-backend/srs"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const CLOZE_PLACEHOLDER = "[...]"
+
+var errClozeItemNotFound = errors.New("cloze not found")
+
+var clozeRegex = regexp.MustCompile(`(?s)\{\{c(\d+)::(.*?)(?:::(.*?))?\}\}`)
+
+// ParseClozeDeletions returns every cloze deletion in the body, in the order
+// they appear.
+func ParseClozeDeletions(body string) []models.ClozeDeletion {
+	var results []models.ClozeDeletion
+	for _, match := range clozeRegex.FindAllStringSubmatch(body, -1) {
+		index, err := strconv.Atoi(match[1])
+		if err != nil || index <= 0 {
+			continue
+		}
+		results = append(results, models.ClozeDeletion{
+			Index: index,
+			Text:  match[2],
+			Hint:  match[3],
+		})
+	}
+	return results
+}
+
+// clozeIndexes returns the distinct cloze indexes in the body, sorted.
+func clozeIndexes(body string) []int {
+	seen := make(map[int]bool)
+	indexes := []int{}
+	for _, cloze := range ParseClozeDeletions(body) {
+		if !seen[cloze.Index] {
+			seen[cloze.Index] = true
+			indexes = append(indexes, cloze.Index)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// RenderCloze renders the body for reviewing the given cloze index. The
+// deletions for that index are replaced by a placeholder (or their hint) in the
+// prompt and revealed in the answer. All other deletions show their text.
+func RenderCloze(body string, index int) (prompt string, answer string) {
+	render := func(hide bool) string {
+		return clozeRegex.ReplaceAllStringFunc(body, func(match string) string {
+			parts := clozeRegex.FindStringSubmatch(match)
+			current, _ := strconv.Atoi(parts[1])
+			if current != index || !hide {
+				return parts[2]
+			}
+			if parts[3] != "" {
+				return "[" + parts[3] + "]"
+			}
+			return CLOZE_PLACEHOLDER
+		})
+	}
+	return render(true), render(false)
+}
+
+// AddClozesFromCard creates a review item for every cloze index in the card
+// body. Items whose markup was removed are soft deleted so that their review
+// history survives if the cloze is added back.
+func (s *Handler) AddClozesFromCard(userID, cardPK int) error {
+	var body string
+	err := s.DB.QueryRow(`
+	SELECT body FROM cards WHERE id = $1 AND user_id = $2 AND is_deleted = FALSE
+	`, cardPK, userID).Scan(&body)
+	if err != nil {
+		log.Printf("err %v", err)
+		return err
+	}
+	indexes := clozeIndexes(body)
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, index := range indexes {
+		_, err := tx.Exec(`
+		INSERT INTO cloze_items (card_pk, user_id, cloze_index, state, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, NOW(), NOW())
+		ON CONFLICT (card_pk, cloze_index)
+		DO UPDATE SET is_deleted = FALSE, updated_at = NOW()
+		`, cardPK, userID, index, string(srs.New))
+		if err != nil {
+			log.Printf("err %v", err)
+			return err
+		}
+	}
+	_, err = tx.Exec(`
+	UPDATE cloze_items SET is_deleted = TRUE, updated_at = NOW()
+	WHERE card_pk = $1 AND user_id = $2 AND is_deleted = FALSE
+	AND NOT (cloze_index = ANY($3))
+	`, cardPK, userID, pq.Array(indexes))
+	if err != nil {
+		log.Printf("err %v", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+const clozeItemColumns = `
+	cloze_items.id, cloze_items.card_pk, cards.card_id, cards.title, cards.body,
+	cloze_items.cloze_index, cloze_items.state,
+	COALESCE(cloze_items.reps, 0), COALESCE(cloze_items.lapses, 0),
+	cloze_items.last_review, cloze_items.due,
+	COALESCE(cloze_items.difficulty, 0), COALESCE(cloze_items.stability, 0)
+`
+
+func scanClozeItem(row interface{ Scan(...any) error }) (models.ClozeItem, error) {
+	var item models.ClozeItem
+	var body string
+	var state sql.NullString
+	err := row.Scan(
+		&item.ID,
+		&item.CardPK,
+		&item.CardID,
+		&item.Title,
+		&body,
+		&item.ClozeIndex,
+		&state,
+		&item.Reps,
+		&item.Lapses,
+		&item.LastReview,
+		&item.Due,
+		&item.Difficulty,
+		&item.Stability,
+	)
+	item.State = string(srs.New)
+	if state.Valid && state.String != "" {
+		item.State = state.String
+	}
+	item.Prompt, item.Answer = RenderCloze(body, item.ClozeIndex)
+	return item, err
+}
+
+func (s *Handler) QueryClozeItem(userID, cardPK, clozeIndex int) (models.ClozeItem, error) {
+	row := s.DB.QueryRow(`
+	SELECT `+clozeItemColumns+`
+	FROM cloze_items
+	JOIN cards ON cards.id = cloze_items.card_pk
+	WHERE cloze_items.user_id = $1 AND cloze_items.card_pk = $2 AND cloze_items.cloze_index = $3
+	AND cloze_items.is_deleted = FALSE AND cards.is_deleted = FALSE
+	`, userID, cardPK, clozeIndex)
+	item, err := scanClozeItem(row)
+	if err == sql.ErrNoRows {
+		return models.ClozeItem{}, errClozeItemNotFound
+	} else if err != nil {
+		log.Printf("err %v", err)
+		return models.ClozeItem{}, fmt.Errorf("unable to access cloze")
+	}
+	return item, nil
+}
+
+func (s *Handler) QueryClozeItemsForCard(userID, cardPK int) ([]models.ClozeItem, error) {
+	rows, err := s.DB.Query(`
+	SELECT `+clozeItemColumns+`
+	FROM cloze_items
+	JOIN cards ON cards.id = cloze_items.card_pk
+	WHERE cloze_items.user_id = $1 AND cloze_items.card_pk = $2
+	AND cloze_items.is_deleted = FALSE AND cards.is_deleted = FALSE
+	ORDER BY cloze_items.cloze_index ASC
+	`, userID, cardPK)
+	if err != nil {
+		log.Printf("err %v", err)
+		return []models.ClozeItem{}, err
+	}
+	defer rows.Close()
+	return scanClozeItems(rows)
+}
+
+// QueryDueClozeItems returns the cloze items that are due for review, using
+// the same ordering as QueryDueFlashcards.
+func (s *Handler) QueryDueClozeItems(userID, limit int) ([]models.ClozeItem, error) {
+	rows, err := s.DB.Query(`
+	SELECT `+clozeItemColumns+`
+	FROM cloze_items
+	JOIN cards ON cards.id = cloze_items.card_pk
+	WHERE cloze_items.user_id = $1
+	AND cloze_items.is_deleted = FALSE AND cards.is_deleted = FALSE
+	AND (cloze_items.due IS NULL OR cloze_items.due <= NOW())
+	ORDER BY cloze_items.due ASC NULLS LAST, cloze_items.card_pk ASC, cloze_items.cloze_index ASC
+	LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		log.Printf("err %v", err)
+		return []models.ClozeItem{}, err
+	}
+	defer rows.Close()
+	return scanClozeItems(rows)
+}
+
+func scanClozeItems(rows *sql.Rows) ([]models.ClozeItem, error) {
+	items := []models.ClozeItem{}
+	for rows.Next() {
+		item, err := scanClozeItem(rows)
+		if err != nil {
+			log.Printf("err %v", err)
+			return items, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// ReviewClozeItem records a rating for a single cloze and reschedules it.
+// The review is logged in flashcard_reviews alongside whole-card reviews.
+func (s *Handler) ReviewClozeItem(userID int, params models.ClozeReviewParams) (models.ClozeItem, error) {
+	rating := srs.Rating(params.Rating)
+	if !rating.Valid() {
+		return models.ClozeItem{}, fmt.Errorf("invalid rating")
+	}
+	item, err := s.QueryClozeItem(userID, params.CardPK, params.ClozeIndex)
+	if err != nil {
+		return models.ClozeItem{}, err
+	}
+
+	current := srs.Card{
+		State:      srs.State(item.State),
+		Reps:       item.Reps,
+		Lapses:     item.Lapses,
+		Stability:  item.Stability,
+		Difficulty: item.Difficulty,
+		LastReview: item.LastReview,
+	}
+	now := time.Now().UTC()
+	next, reviewLog := flashcardScheduler.Review(current, rating, now)
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.ClozeItem{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	UPDATE cloze_items SET
+	state = $1, reps = $2, lapses = $3, last_review = $4, due = $5,
+	difficulty = $6, stability = $7, updated_at = NOW()
+	WHERE id = $8 AND user_id = $9
+	`, string(next.State), next.Reps, next.Lapses, next.LastReview, next.Due,
+		next.Difficulty, next.Stability, item.ID, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.ClozeItem{}, err
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO flashcard_reviews
+	(card_pk, user_id, rating, state, stability, difficulty, elapsed_days, scheduled_days, due, created_at, cloze_index)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, item.CardPK, userID, int(reviewLog.Rating), string(reviewLog.State), reviewLog.Stability,
+		reviewLog.Difficulty, reviewLog.ElapsedDays, reviewLog.ScheduledDays, reviewLog.Due, reviewLog.Reviewed,
+		item.ClozeIndex)
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.ClozeItem{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("err %v", err)
+		return models.ClozeItem{}, err
+	}
+	return s.QueryClozeItem(userID, item.CardPK, item.ClozeIndex)
+}
+
+func (s *Handler) GetDueClozeItemsRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	limit := DEFAULT_FLASHCARD_QUEUE_LIMIT
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	items, err := s.QueryDueClozeItems(userID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+func (s *Handler) GetCardClozeItemsRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	items, err := s.QueryClozeItemsForCard(userID, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+func (s *Handler) ReviewClozeItemRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	var params models.ClozeReviewParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !srs.Rating(params.Rating).Valid() {
+		http.Error(w, "Invalid rating", http.StatusBadRequest)
+		return
+	}
+	item, err := s.ReviewClozeItem(userID, params)
+	if err == errClozeItemNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-backend/models"
+	"go-backend/tests"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseClozeDeletions(t *testing.T) {
+	body := "The {{c1::mitochondria}} is the {{c2::powerhouse::function}} of the {{c1::cell}}."
+	clozes := ParseClozeDeletions(body)
+	if len(clozes) != 3 {
+		t.Fatalf("wrong number of clozes, got %v want %v", len(clozes), 3)
+	}
+	if clozes[1].Index != 2 || clozes[1].Text != "powerhouse" || clozes[1].Hint != "function" {
+		t.Errorf("wrong cloze parsed, got %+v", clozes[1])
+	}
+	indexes := clozeIndexes(body)
+	if len(indexes) != 2 || indexes[0] != 1 || indexes[1] != 2 {
+		t.Errorf("wrong cloze indexes, got %v", indexes)
+	}
+	if len(clozeIndexes("no clozes {{here}}")) != 0 {
+		t.Errorf("body without clozes should have no indexes")
+	}
+}
+
+func TestRenderCloze(t *testing.T) {
+	body := "The {{c1::mitochondria}} is the {{c2::powerhouse::function}} of the {{c1::cell}}."
+
+	prompt, answer := RenderCloze(body, 1)
+	expected := "The [...] is the powerhouse of the [...]."
+	if prompt != expected {
+		t.Errorf("wrong prompt, got %q want %q", prompt, expected)
+	}
+	expected = "The mitochondria is the powerhouse of the cell."
+	if answer != expected {
+		t.Errorf("wrong answer, got %q want %q", answer, expected)
+	}
+
+	prompt, _ = RenderCloze(body, 2)
+	expected = "The mitochondria is the [function] of the cell."
+	if prompt != expected {
+		t.Errorf("wrong prompt, got %q want %q", prompt, expected)
+	}
+}
+
+func makeReviewClozeRequest(s *Handler, t *testing.T, params models.ClozeReviewParams) *httptest.ResponseRecorder {
+	token, _ := tests.GenerateTestJWT(1)
+	body, _ := json.Marshal(params)
+	req, err := http.NewRequest("POST", "/api/flashcards/clozes", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.JwtMiddleware(s.ReviewClozeItemRoute))
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestClozeItemsFromCard(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	card, err := s.CreateCard(1, models.EditCardParams{
+		CardID: "100",
+		Title:  "cloze card",
+		Body:   "{{c1::Paris}} is the capital of {{c2::France}}.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := s.QueryClozeItemsForCard(1, card.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("wrong number of cloze items, got %v want %v", len(items), 2)
+	}
+	if items[0].Prompt != "[...] is the capital of France." {
+		t.Errorf("wrong prompt, got %q", items[0].Prompt)
+	}
+
+	_, err = s.UpdateCard(1, card.ID, models.EditCardParams{
+		CardID: card.CardID,
+		Title:  card.Title,
+		Body:   "{{c1::Paris}} is the capital of France.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, _ = s.QueryClozeItemsForCard(1, card.ID)
+	if len(items) != 1 {
+		t.Errorf("removed cloze should no longer be reviewed, got %v items", len(items))
+	}
+}
+
+func TestReviewClozeItem(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	card, err := s.CreateCard(1, models.EditCardParams{
+		CardID: "100",
+		Title:  "cloze card",
+		Body:   "{{c1::Paris}} is the capital of {{c2::France}}.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	due, _ := s.QueryDueClozeItems(1, 10)
+	if len(due) != 2 {
+		t.Fatalf("wrong number of due clozes, got %v want %v", len(due), 2)
+	}
+
+	rr := makeReviewClozeRequest(s, t, models.ClozeReviewParams{CardPK: card.ID, ClozeIndex: 1, Rating: 3})
+	if status := rr.Code; status != http.StatusOK {
+		log.Printf("err %v", rr.Body.String())
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var item models.ClozeItem
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &item)
+	if item.State != "review" || item.Reps != 1 {
+		t.Errorf("cloze was not rescheduled, got %+v", item)
+	}
+
+	// the other cloze on the same card is scheduled separately
+	due, _ = s.QueryDueClozeItems(1, 10)
+	if len(due) != 1 || due[0].ClozeIndex != 2 {
+		t.Errorf("wrong due clozes after review, got %+v", due)
+	}
+
+	rr = makeReviewClozeRequest(s, t, models.ClozeReviewParams{CardPK: card.ID, ClozeIndex: 5, Rating: 3})
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
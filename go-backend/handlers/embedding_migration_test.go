@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"go-backend/llms"
+	"go-backend/models"
+	"go-backend/tests"
+	"testing"
+)
+
+func smallHashEmbedder() models.Embedder {
+	config := llms.DefaultEmbedderConfig("hash")
+	config.Dimensions = 64
+	embedder, _ := llms.NewEmbedder(config)
+	return embedder
+}
+
+func TestSearchOnlyComparesActiveModel(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	client := s.Server.LLMClient
+	client.Embedder, _ = llms.NewEmbedder(llms.DefaultEmbedderConfig("hash"))
+
+	card, err := s.CreateCard(1, models.EditCardParams{CardID: "400", Title: "migrating", Body: "vectors from two models"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.NextEmbedder = smallHashEmbedder()
+	if err := llms.EmbedCard(client, s.DB, 1, card.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var modelCount int
+	s.DB.QueryRow(`SELECT COUNT(DISTINCT model) FROM card_embeddings WHERE card_pk = $1`, card.ID).Scan(&modelCount)
+	if modelCount != 2 {
+		t.Errorf("card should have vectors from both models, got %v", modelCount)
+	}
+
+	// vectors of a different size would fail to compare
+	query, err := llms.GetEmbedding(client, "two models", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := s.QueryRelatedCards(1, query, models.DefaultRankingConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || results[0].ID != card.ID {
+		t.Errorf("expected the card to be found with the active model, got %+v", results)
+	}
+}
+
+func TestMigrateEmbeddings(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	client := s.Server.LLMClient
+	client.Embedder, _ = llms.NewEmbedder(llms.DefaultEmbedderConfig("hash"))
+	oldModel := llms.ActiveEmbeddingModel(client)
+
+	card, err := s.CreateCard(1, models.EditCardParams{CardID: "400", Title: "migrating", Body: "a new model"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := llms.EmbedCard(client, s.DB, 1, card.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	next := smallHashEmbedder()
+	if err := llms.ResolveNextEmbedder(client, s.DB, next); err != nil {
+		t.Fatal(err)
+	}
+	if llms.ActiveEmbeddingModel(client) != oldModel {
+		t.Errorf("searches should keep the old model until the migration is done")
+	}
+
+	switched, err := llms.MigrateEmbeddings(client, s.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newModel := models.EmbeddingModelID(next)
+	if !switched || llms.ActiveEmbeddingModel(client) != newModel || client.NextEmbedding() != nil {
+		t.Fatalf("expected to switch to %v, got %v", newModel, llms.ActiveEmbeddingModel(client))
+	}
+
+	var stale, unmigrated int
+	s.DB.QueryRow(`SELECT COUNT(*) FROM card_embeddings WHERE model <> $1`, newModel).Scan(&stale)
+	s.DB.QueryRow(`
+	SELECT COUNT(*) FROM entities
+	WHERE embedding_model <> $1 OR next_embedding IS NOT NULL`, newModel).Scan(&unmigrated)
+	if stale != 0 || unmigrated != 0 {
+		t.Errorf("old vectors should be gone, %v card vectors and %v entities left", stale, unmigrated)
+	}
+
+	migrations, err := s.QueryEmbeddingMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 1 {
+		t.Fatalf("expected one migration, got %+v", migrations)
+	}
+	migration := migrations[0]
+	if migration.Status != "done" || migration.FromModel != oldModel || migration.ToModel != newModel ||
+		migration.CardsDone != migration.CardsTotal || migration.EntitiesDone != migration.EntitiesTotal {
+		t.Errorf("wrong migration, got %+v", migration)
+	}
+
+	query, _ := llms.GetEmbedding(client, "a new model", true)
+	results, err := s.QueryRelatedCards(1, query, models.DefaultRankingConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Errorf("searches should use the new vectors")
+	}
+
+	// a restart still configured with both models goes straight to the new one
+	restarted := &models.LLMClient{Testing: true}
+	restarted.Embedder, _ = llms.NewEmbedder(llms.DefaultEmbedderConfig("hash"))
+	if err := llms.ResolveNextEmbedder(restarted, s.DB, smallHashEmbedder()); err != nil {
+		t.Fatal(err)
+	}
+	if llms.ActiveEmbeddingModel(restarted) != newModel || restarted.NextEmbedding() != nil {
+		t.Errorf("a finished migration should not run again, got %v", llms.ActiveEmbeddingModel(restarted))
+	}
+}
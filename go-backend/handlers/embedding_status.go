@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-backend/models"
+	"log"
+	"net/http"
+)
+
+var EMBEDDING_STATUSES = []string{
+	models.EmbeddingPending,
+	models.EmbeddingRunning,
+	models.EmbeddingDone,
+	models.EmbeddingFailed,
+	models.EmbeddingMissing,
+}
+
+// QueryEmbeddingStatus returns the embedding state of each of the user's
+// cards, optionally only those with the given status. Cards without a job
+// are done if they have embeddings and missing otherwise.
+func (s *Handler) QueryEmbeddingStatus(userID int, status string) (models.EmbeddingStatusResponse, error) {
+	response := models.EmbeddingStatusResponse{
+		Counts: make(map[string]int),
+		Cards:  []models.CardEmbeddingStatus{},
+	}
+	for _, value := range EMBEDDING_STATUSES {
+		response.Counts[value] = 0
+	}
+
+	rows, err := s.DB.Query(`
+	SELECT c.id, c.card_id, c.title,
+	COALESCE(j.status, CASE
+		WHEN EXISTS (SELECT 1 FROM card_embeddings e WHERE e.card_pk = c.id) THEN 'done'
+		ELSE 'missing'
+	END),
+	COALESCE(j.attempts, 0), COALESCE(j.last_error, ''),
+	CASE WHEN j.status = 'pending' THEN j.run_after END,
+	j.updated_at
+	FROM cards c
+	LEFT JOIN embedding_jobs j ON j.card_pk = c.id
+	WHERE c.user_id = $1 AND c.is_deleted = FALSE
+	ORDER BY c.id`, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return response, fmt.Errorf("unable to retrieve embedding status")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var card models.CardEmbeddingStatus
+		if err := rows.Scan(
+			&card.CardPK,
+			&card.CardID,
+			&card.Title,
+			&card.Status,
+			&card.Attempts,
+			&card.LastError,
+			&card.NextAttempt,
+			&card.UpdatedAt,
+		); err != nil {
+			log.Printf("err %v", err)
+			return response, fmt.Errorf("unable to retrieve embedding status")
+		}
+		response.Counts[card.Status]++
+		if status == "" || card.Status == status {
+			response.Cards = append(response.Cards, card)
+		}
+	}
+	return response, rows.Err()
+}
+
+func (s *Handler) GetEmbeddingStatusRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+	status := r.URL.Query().Get("status")
+	if status != "" && !contains(EMBEDDING_STATUSES, status) {
+		http.Error(w, fmt.Sprintf("unknown status %q", status), http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.QueryEmbeddingStatus(userID, status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// QueryEmbeddingMigrations returns every embedding migration, newest first,
+// with how many cards and entities have vectors from its model so far.
+func (s *Handler) QueryEmbeddingMigrations() ([]models.EmbeddingMigration, error) {
+	rows, err := s.DB.Query(`
+	SELECT m.id, m.from_model, m.to_model, m.status, m.last_error,
+	m.created_at, m.updated_at, m.finished_at,
+	(SELECT COUNT(DISTINCT cc.card_pk) FROM card_chunks cc
+		JOIN cards c ON c.id = cc.card_pk WHERE c.is_deleted = FALSE),
+	(SELECT COUNT(DISTINCT ce.card_pk) FROM card_embeddings ce
+		JOIN cards c ON c.id = ce.card_pk WHERE c.is_deleted = FALSE AND ce.model = m.to_model),
+	(SELECT COUNT(*) FROM entities),
+	(SELECT COUNT(*) FROM entities e
+		WHERE e.next_embedding_model = m.to_model OR e.embedding_model = m.to_model)
+	FROM embedding_migrations m
+	ORDER BY m.id DESC`)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, fmt.Errorf("unable to retrieve embedding migrations")
+	}
+	defer rows.Close()
+
+	migrations := []models.EmbeddingMigration{}
+	for rows.Next() {
+		var migration models.EmbeddingMigration
+		if err := rows.Scan(
+			&migration.ID,
+			&migration.FromModel,
+			&migration.ToModel,
+			&migration.Status,
+			&migration.LastError,
+			&migration.CreatedAt,
+			&migration.UpdatedAt,
+			&migration.FinishedAt,
+			&migration.CardsTotal,
+			&migration.CardsDone,
+			&migration.EntitiesTotal,
+			&migration.EntitiesDone,
+		); err != nil {
+			log.Printf("err %v", err)
+			return nil, fmt.Errorf("unable to retrieve embedding migrations")
+		}
+		migrations = append(migrations, migration)
+	}
+	return migrations, rows.Err()
+}
+
+func (s *Handler) GetEmbeddingMigrationsRoute(w http.ResponseWriter, r *http.Request) {
+	migrations, err := s.QueryEmbeddingMigrations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(migrations)
+}
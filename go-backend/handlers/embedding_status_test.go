@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"errors"
+	"go-backend/llms"
+	"go-backend/models"
+	"go-backend/tests"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pgvector/pgvector-go"
+)
+
+func embeddingJobStatus(s *Handler, t *testing.T, cardPK int) (string, int, string) {
+	var status, lastError string
+	var attempts int
+	err := s.DB.QueryRow(`SELECT status, attempts, last_error FROM embedding_jobs WHERE card_pk = $1`, cardPK).Scan(&status, &attempts, &lastError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, attempts, lastError
+}
+
+func TestCreateCardQueuesEmbedding(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	card, err := s.CreateCard(1, models.EditCardParams{CardID: "300", Title: "queued", Body: "some body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, attempts, _ := embeddingJobStatus(s, t, card.ID); status != models.EmbeddingPending || attempts != 0 {
+		t.Errorf("new card should have a pending job, got %v %v", status, attempts)
+	}
+}
+
+func TestEmbeddingJobRetries(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	if err := llms.EnqueueEmbedding(s.DB, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	job, ok, err := llms.ClaimEmbeddingJob(s.DB)
+	if err != nil || !ok {
+		t.Fatalf("expected to claim a job, got %v %v", ok, err)
+	}
+	if job.CardPK != 1 || job.Attempts != 1 || job.Status != models.EmbeddingRunning {
+		t.Errorf("wrong job claimed, got %+v", job)
+	}
+	if _, ok, _ := llms.ClaimEmbeddingJob(s.DB); ok {
+		t.Errorf("a running job should not be claimed twice")
+	}
+
+	// a failure is retried later rather than straight away
+	if err := llms.FinishEmbeddingJob(s.DB, job, errors.New("embedding server is down")); err != nil {
+		t.Fatal(err)
+	}
+	status, attempts, lastError := embeddingJobStatus(s, t, 1)
+	if status != models.EmbeddingPending || attempts != 1 || lastError != "embedding server is down" {
+		t.Errorf("wrong job after a failure, got %v %v %v", status, attempts, lastError)
+	}
+	if _, ok, _ := llms.ClaimEmbeddingJob(s.DB); ok {
+		t.Errorf("a failed job should wait before it is retried")
+	}
+
+	// the last attempt failing gives up on the job
+	s.DB.Exec(`UPDATE embedding_jobs SET run_after = NOW() WHERE card_pk = 1`)
+	job, _, _ = llms.ClaimEmbeddingJob(s.DB)
+	job.Attempts = llms.EMBEDDING_MAX_ATTEMPTS
+	llms.FinishEmbeddingJob(s.DB, job, errors.New("still down"))
+	if status, _, _ := embeddingJobStatus(s, t, 1); status != models.EmbeddingFailed {
+		t.Errorf("job should have failed, got %v", status)
+	}
+}
+
+func TestEmbeddingJobRequeuedWhileRunning(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	llms.EnqueueEmbedding(s.DB, 1, 1)
+	job, _, _ := llms.ClaimEmbeddingJob(s.DB)
+
+	// the card is edited while the worker embeds the old version
+	llms.EnqueueEmbedding(s.DB, 1, 1)
+	llms.FinishEmbeddingJob(s.DB, job, nil)
+	if status, _, _ := embeddingJobStatus(s, t, 1); status != models.EmbeddingPending {
+		t.Errorf("the newer version should still be pending, got %v", status)
+	}
+
+	job, ok, _ := llms.ClaimEmbeddingJob(s.DB)
+	if !ok {
+		t.Fatal("expected to claim the requeued job")
+	}
+	llms.FinishEmbeddingJob(s.DB, job, nil)
+	if status, _, _ := embeddingJobStatus(s, t, 1); status != models.EmbeddingDone {
+		t.Errorf("job should be done, got %v", status)
+	}
+}
+
+func TestRunEmbeddingJobs(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	embedder, _ := llms.NewEmbedder(llms.DefaultEmbedderConfig("hash"))
+	client := &models.LLMClient{Testing: true, Embedder: embedder, EmbeddingQueue: models.NewEmbeddingQueue(s.DB)}
+
+	card, _ := s.CreateCard(1, models.EditCardParams{CardID: "300", Title: "queued", Body: "some body"})
+	count, err := llms.RunEmbeddingJobs(client)
+	if err != nil || count != 1 {
+		t.Fatalf("expected to run one job, got %v %v", count, err)
+	}
+	var embeddings int
+	s.DB.QueryRow(`SELECT COUNT(*) FROM card_embeddings WHERE card_pk = $1`, card.ID).Scan(&embeddings)
+	if embeddings == 0 {
+		t.Errorf("card should have embeddings")
+	}
+	if status, _, _ := embeddingJobStatus(s, t, card.ID); status != models.EmbeddingDone {
+		t.Errorf("job should be done, got %v", status)
+	}
+}
+
+// countingEmbedder records the texts it is asked to embed.
+type countingEmbedder struct {
+	models.Embedder
+	texts []string
+}
+
+func (e *countingEmbedder) Embed(texts []string, forQuery bool) ([]pgvector.Vector, error) {
+	e.texts = append(e.texts, texts...)
+	return e.Embedder.Embed(texts, forQuery)
+}
+
+func TestEmbedCardOnlyEmbedsChangedChunks(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	hash, _ := llms.NewEmbedder(llms.DefaultEmbedderConfig("hash"))
+	embedder := &countingEmbedder{Embedder: hash}
+	client := &models.LLMClient{Testing: true, Embedder: embedder}
+
+	sections := []string{
+		"# One\n\nThe first part of the card is about one thing.\n\n",
+		"# Two\n\nThe second part of the card is about another.\n\n",
+		"# Three\n\nThe third part of the card closes the card off.",
+	}
+	card, err := s.CreateCard(1, models.EditCardParams{CardID: "300", Title: "long", Body: strings.Join(sections, "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := llms.EmbedCard(client, s.DB, 1, card.ID); err != nil {
+		t.Fatal(err)
+	}
+	chunks := len(embedder.texts)
+	if chunks != 3 {
+		t.Fatalf("expected a chunk for each section, got %v", chunks)
+	}
+
+	embedder.texts = nil
+	if err := llms.EmbedCard(client, s.DB, 1, card.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(embedder.texts) != 0 {
+		t.Errorf("an unchanged card should not be embedded again, got %v", embedder.texts)
+	}
+
+	card.Body = sections[0] + sections[1] + strings.Replace(sections[2], "closes", "finishes", 1)
+	if err := s.ChunkCard(card); err != nil {
+		t.Fatal(err)
+	}
+	if err := llms.EmbedCard(client, s.DB, 1, card.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(embedder.texts) != 1 {
+		t.Errorf("only the changed chunk should be embedded, got %v", embedder.texts)
+	}
+
+	var mismatched int
+	s.DB.QueryRow(`
+	SELECT COUNT(*) FROM card_chunks cc
+	LEFT JOIN card_embeddings ce ON ce.card_pk = cc.card_pk AND ce.chunk = cc.chunk_id
+	WHERE cc.card_pk = $1 AND ce.content_hash IS DISTINCT FROM cc.content_hash`, card.ID).Scan(&mismatched)
+	if mismatched != 0 {
+		t.Errorf("every chunk should have a vector for its text, %v do not", mismatched)
+	}
+
+	embedder.texts = nil
+	if err := llms.ReembedCard(client, s.DB, 1, card.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(embedder.texts) != chunks {
+		t.Errorf("re-embedding should embed every chunk, got %v of %v", len(embedder.texts), chunks)
+	}
+}
+
+func TestGetEmbeddingStatusRoute(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	card, _ := s.CreateCard(1, models.EditCardParams{CardID: "300", Title: "queued", Body: "some body"})
+
+	token, _ := tests.GenerateTestJWT(1)
+	req, _ := http.NewRequest("GET", "/api/embeddings/status?status=pending", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.JwtMiddleware(s.GetEmbeddingStatusRoute)).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var response models.EmbeddingStatusResponse
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &response)
+	if len(response.Cards) != 1 || response.Cards[0].CardPK != card.ID || response.Cards[0].NextAttempt == nil {
+		t.Errorf("expected only the new card, got %+v", response.Cards)
+	}
+	if response.Counts[models.EmbeddingPending] != 1 || response.Counts[models.EmbeddingDone]+response.Counts[models.EmbeddingMissing] == 0 {
+		t.Errorf("wrong counts, got %v", response.Counts)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/embeddings/status?status=unknown", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.JwtMiddleware(s.GetEmbeddingStatusRoute)).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
@@ -66,10 +66,11 @@ func (s *Handler) UpsertEntitiesFromCards(userID int, cardPK int, entities []mod
 		if err == sql.ErrNoRows {
 			// Entity doesn't exist, insert it
 			err = s.DB.QueryRow(`
-                INSERT INTO entities (user_id, name, description, type, embedding, card_pk)
-                VALUES ($1, $2, $3, $4, $5, $6)
+                INSERT INTO entities (user_id, name, description, type, embedding, card_pk, embedding_model)
+                VALUES ($1, $2, $3, $4, $5, $6, $7)
                 RETURNING id
-            `, userID, entity.Name, entity.Description, entity.Type, entity.Embedding, entity.CardPK).Scan(&entityID)
+            `, userID, entity.Name, entity.Description, entity.Type, entity.Embedding, entity.CardPK,
+				llms.ActiveEmbeddingModel(s.Server.LLMClient)).Scan(&entityID)
 			if err != nil {
 				log.Printf("error inserting entity: %v", err)
 				continue
@@ -112,12 +113,12 @@ func (s *Handler) FindPotentialDuplicates(userID int, entity models.Entity) ([]m
 	const query = `
         SELECT id, name, description, type
         FROM entities
-        WHERE user_id = $1 AND (embedding <=> $2) < $3
+        WHERE user_id = $1 AND embedding_model = $4 AND (embedding <=> $2) < $3
         ORDER BY embedding <=> $2
         LIMIT 5;
     `
 
-	rows, err := s.DB.Query(query, userID, entity.Embedding, SIMILARITY_THRESHOLD)
+	rows, err := s.DB.Query(query, userID, entity.Embedding, SIMILARITY_THRESHOLD, llms.ActiveEmbeddingModel(s.Server.LLMClient))
 	if err != nil {
 		return nil, fmt.Errorf("error querying similar entities: %w", err)
 	}
@@ -556,9 +557,13 @@ func (s *Handler) UpdateEntity(userID int, entityID int, params UpdateEntityRequ
 				type = $3,
 				card_pk = $4,
 				embedding = $5,
+				embedding_model = $8,
+				next_embedding = NULL,
+				next_embedding_model = NULL,
 				updated_at = NOW()
 			WHERE id = $6 AND user_id = $7`
-		queryArgs = []interface{}{params.Name, params.Description, params.Type, params.CardPK, embedding, entityID, userID}
+		queryArgs = []interface{}{params.Name, params.Description, params.Type, params.CardPK, embedding, entityID, userID,
+			llms.ActiveEmbeddingModel(s.Server.LLMClient)}
 	}
 
 	// Update the entity
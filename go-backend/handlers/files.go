@@ -12,7 +12,9 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -306,17 +308,24 @@ func (s *Handler) UploadFileRoute(w http.ResponseWriter, r *http.Request) {
 	uuidKey := uuid.New().String()
 	s3Key := fmt.Sprintf("%s/%s", strconv.Itoa(userID), uuidKey)
 
-	s.uploadObject(s.Server.S3, s3Key, tempFile.Name())
+	if err := s.uploadObject(s.Server.S3, s3Key, tempFile.Name()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	fileSize, err := tempFile.Seek(0, io.SeekEnd)
 	if err != nil {
 		http.Error(w, "Unable to determine file size", http.StatusInternalServerError)
 		return
 	}
+	extractedText, err := extractFileText(tempFile, handler.Filename, handler.Header.Get("Content-Type"))
+	if err != nil {
+		log.Printf("unable to extract text from %v: %v", handler.Filename, err)
+	}
 	var lastInsertId int
 	query := `INSERT INTO files (name, user_id, type, path, filename,
-		size, card_pk, created_by, updated_by, updated_at) VALUES
-		($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW()) RETURNING id;`
+		size, card_pk, created_by, updated_by, updated_at, extracted_text) VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW(), $10) RETURNING id;`
 	err = s.DB.QueryRow(query,
 		handler.Filename,
 		userID,
@@ -326,7 +335,8 @@ func (s *Handler) UploadFileRoute(w http.ResponseWriter, r *http.Request) {
 		fileSize,
 		cardPK,
 		userID,
-		userID).Scan(&lastInsertId)
+		userID,
+		extractedText).Scan(&lastInsertId)
 	if err != nil {
 		http.Error(w, "Unable to execute query", http.StatusInternalServerError)
 		return
@@ -345,6 +355,119 @@ func (s *Handler) UploadFileRoute(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(output)
 }
 
+// MAX_EXTRACTED_TEXT_BYTES caps how much of a file is kept for search.
+const MAX_EXTRACTED_TEXT_BYTES = 1 << 20
+
+// FILE_TEXT_BACKFILL_BATCH_SIZE is how many files BackfillFileText reads
+// between queries.
+const FILE_TEXT_BACKFILL_BATCH_SIZE = 50
+
+var textFileExtensions = []string{".txt", ".md", ".markdown", ".org", ".csv", ".tsv", ".json", ".xml", ".html", ".htm", ".yaml", ".yml"}
+
+func isTextFile(filename, contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return strings.HasPrefix(contentType, "text/") ||
+		contentType == "application/json" ||
+		contentType == "application/xml" ||
+		contentType == "application/x-yaml" ||
+		contains(textFileExtensions, strings.ToLower(filepath.Ext(filename)))
+}
+
+// extractFileText returns the searchable text of an uploaded file. Only plain
+// text formats are read, anything else is left out of search and returns "".
+func extractFileText(file io.ReadSeeker, filename, contentType string) (string, error) {
+	if !isTextFile(filename, contentType) {
+		return "", nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(io.LimitReader(file, MAX_EXTRACTED_TEXT_BYTES))
+	if err != nil {
+		return "", err
+	}
+	text := strings.ToValidUTF8(string(data), "")
+	// postgres text columns cannot hold NUL bytes
+	return strings.ReplaceAll(text, "\x00", ""), nil
+}
+
+// storedFileText downloads a file that is already uploaded and returns its
+// searchable text. Files that are not text are not downloaded.
+func (s *Handler) storedFileText(name, contentType, path string) (string, error) {
+	if !isTextFile(name, contentType) {
+		return "", nil
+	}
+	output, err := s.downloadObject(s.Server.S3, path, "")
+	if err != nil {
+		return "", err
+	}
+	if output == nil {
+		return "", nil
+	}
+	defer output.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(output.Body, MAX_EXTRACTED_TEXT_BYTES))
+	if err != nil {
+		return "", err
+	}
+	return extractFileText(bytes.NewReader(data), name, contentType)
+}
+
+// BackfillFileText fills in the searchable text of files uploaded before it
+// was kept. A file that cannot be downloaded is logged and left for the next
+// time this runs.
+func (s *Handler) BackfillFileText() error {
+	type storedFile struct {
+		ID       int
+		Name     string
+		Filetype string
+		Path     string
+	}
+	after, filled := 0, 0
+	for {
+		rows, err := s.DB.Query(`
+		SELECT id, name, type, path FROM files
+		WHERE extracted_text IS NULL AND is_deleted = FALSE AND id > $1
+		ORDER BY id
+		LIMIT $2`, after, FILE_TEXT_BACKFILL_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+		var files []storedFile
+		for rows.Next() {
+			var file storedFile
+			if err := rows.Scan(&file.ID, &file.Name, &file.Filetype, &file.Path); err != nil {
+				rows.Close()
+				return err
+			}
+			files = append(files, file)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+
+		for _, file := range files {
+			text, err := s.storedFileText(file.Name, file.Filetype, file.Path)
+			if err != nil {
+				log.Printf("unable to extract text from file %v: %v", file.ID, err)
+				continue
+			}
+			if _, err := s.DB.Exec(`UPDATE files SET extracted_text = $2 WHERE id = $1`, file.ID, text); err != nil {
+				return err
+			}
+			filled++
+		}
+		after = files[len(files)-1].ID
+	}
+	if filled > 0 {
+		log.Printf("filled in the text of %d files", filled)
+	}
+	return nil
+}
+
 func (s *Handler) DownloadFileRoute(w http.ResponseWriter, r *http.Request) {
 
 	userID := r.Context().Value("current_user").(int)
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/google/uuid"
@@ -326,6 +327,58 @@ func TestUploadFileSuccess(t *testing.T) {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), "File uploaded successfully")
 	}
+
+	var extractedText string
+	s.DB.QueryRow("SELECT COALESCE(extracted_text, '') FROM files WHERE id = $1", response.File.ID).Scan(&extractedText)
+	if strings.TrimSpace(extractedText) != "hello world" {
+		t.Errorf("wrong extracted text, got %q want %q", extractedText, "hello world")
+	}
+}
+
+func TestBackfillFileText(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	if err := s.BackfillFileText(); err != nil {
+		t.Fatal(err)
+	}
+	var missing int
+	s.DB.QueryRow("SELECT COUNT(*) FROM files WHERE extracted_text IS NULL AND is_deleted = FALSE").Scan(&missing)
+	if missing != 0 {
+		t.Errorf("every file should have its text filled in, %v are missing", missing)
+	}
+}
+
+func TestExtractFileText(t *testing.T) {
+	testCases := []struct {
+		filename    string
+		contentType string
+		content     string
+		expected    string
+	}{
+		{"notes.txt", "application/octet-stream", "hello world", "hello world"},
+		{"data", "application/json; charset=utf-8", `{"a": 1}`, `{"a": 1}`},
+		{"README", "text/markdown", "# Title", "# Title"},
+		{"photo.png", "image/png", "\x89PNG", ""},
+		{"broken.txt", "text/plain", "ok\x00\xffdone", "okdone"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.filename, func(t *testing.T) {
+			text, err := extractFileText(strings.NewReader(tc.content), tc.filename, tc.contentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != tc.expected {
+				t.Errorf("wrong text, got %q want %q", text, tc.expected)
+			}
+		})
+	}
+
+	large := strings.Repeat("a", MAX_EXTRACTED_TEXT_BYTES+10)
+	text, _ := extractFileText(strings.NewReader(large), "large.txt", "text/plain")
+	if len(text) != MAX_EXTRACTED_TEXT_BYTES {
+		t.Errorf("text should be truncated, got %v bytes", len(text))
+	}
 }
 
 func TestUploadFileNoFile(t *testing.T) {
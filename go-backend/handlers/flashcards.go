@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backend/models"
+	"go-backend/srs"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const DEFAULT_FLASHCARD_QUEUE_LIMIT = 50
+
+var flashcardScheduler = srs.NewScheduler()
+
+var errFlashcardNotFound = errors.New("flashcard not found")
+
+func scanFlashcard(row interface{ Scan(...any) error }) (models.Flashcard, error) {
+	var card models.Flashcard
+	var state sql.NullString
+	err := row.Scan(
+		&card.ID,
+		&card.CardID,
+		&card.UserID,
+		&card.Title,
+		&card.Body,
+		&card.CreatedAt,
+		&card.UpdatedAt,
+		&state,
+		&card.Reps,
+		&card.Lapses,
+		&card.LastReview,
+		&card.Due,
+		&card.Difficulty,
+		&card.Stability,
+	)
+	card.State = string(srs.New)
+	if state.Valid && state.String != "" {
+		card.State = state.String
+	}
+	return card, err
+}
+
+const flashcardColumns = `
+	id, card_id, user_id, title, body, created_at, updated_at,
+	flashcard_state, COALESCE(flashcard_reps, 0), COALESCE(flashcard_lapses, 0),
+	flashcard_last_review, flashcard_due,
+	COALESCE(flashcard_difficulty, 0), COALESCE(flashcard_stability, 0)
+`
+
+func (s *Handler) QueryFlashcard(userID, cardPK int) (models.Flashcard, error) {
+	row := s.DB.QueryRow(`
+	SELECT `+flashcardColumns+`
+	FROM cards
+	WHERE id = $1 AND user_id = $2 AND is_deleted = FALSE AND is_flashcard = TRUE
+	`, cardPK, userID)
+	card, err := scanFlashcard(row)
+	if err == sql.ErrNoRows {
+		return models.Flashcard{}, errFlashcardNotFound
+	} else if err != nil {
+		log.Printf("err %v", err)
+		return models.Flashcard{}, fmt.Errorf("unable to access flashcard")
+	}
+	return card, nil
+}
+
+// QueryDueFlashcards returns the flashcards that are due for review, oldest
+// due date first. Cards that have never been reviewed come last.
+func (s *Handler) QueryDueFlashcards(userID int, limit int) ([]models.Flashcard, error) {
+	rows, err := s.DB.Query(`
+	SELECT `+flashcardColumns+`
+	FROM cards
+	WHERE user_id = $1 AND is_deleted = FALSE AND is_flashcard = TRUE
+	AND (flashcard_due IS NULL OR flashcard_due <= NOW())
+	ORDER BY flashcard_due ASC NULLS LAST, id ASC
+	LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		log.Printf("err %v", err)
+		return []models.Flashcard{}, err
+	}
+	defer rows.Close()
+
+	cards := []models.Flashcard{}
+	for rows.Next() {
+		card, err := scanFlashcard(rows)
+		if err != nil {
+			log.Printf("err %v", err)
+			return cards, err
+		}
+		cards = append(cards, card)
+	}
+	return cards, nil
+}
+
+// setFlashcard turns a card into a flashcard or back into a regular card.
+// Scheduling state is kept when a card is turned off so that re-enabling it
+// resumes where the user left off.
+func (s *Handler) setFlashcard(userID, cardPK int, enabled bool) error {
+	_, err := s.DB.Exec(`
+	UPDATE cards SET is_flashcard = $1,
+	flashcard_state = CASE WHEN $1 AND flashcard_state IS NULL THEN $2 ELSE flashcard_state END
+	WHERE id = $3 AND user_id = $4
+	`, enabled, string(srs.New), cardPK, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+	}
+	return err
+}
+
+func flashcardToSchedulerCard(card models.Flashcard) srs.Card {
+	result := srs.Card{
+		State:      srs.State(card.State),
+		Reps:       card.Reps,
+		Lapses:     card.Lapses,
+		Stability:  card.Stability,
+		Difficulty: card.Difficulty,
+		LastReview: card.LastReview,
+	}
+	if card.Due != nil {
+		result.Due = *card.Due
+	}
+	return result
+}
+
+// ReviewFlashcard records a rating for a flashcard and reschedules it.
+func (s *Handler) ReviewFlashcard(userID int, params models.FlashcardReviewParams) (models.Flashcard, error) {
+	rating := srs.Rating(params.Rating)
+	if !rating.Valid() {
+		return models.Flashcard{}, fmt.Errorf("invalid rating")
+	}
+	card, err := s.QueryFlashcard(userID, params.CardPK)
+	if err != nil {
+		return models.Flashcard{}, err
+	}
+
+	now := time.Now().UTC()
+	next, reviewLog := flashcardScheduler.Review(flashcardToSchedulerCard(card), rating, now)
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.Flashcard{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	UPDATE cards SET
+	flashcard_state = $1, flashcard_reps = $2, flashcard_lapses = $3,
+	flashcard_last_review = $4, flashcard_due = $5,
+	flashcard_difficulty = $6, flashcard_stability = $7
+	WHERE id = $8 AND user_id = $9
+	`, string(next.State), next.Reps, next.Lapses, next.LastReview, next.Due,
+		next.Difficulty, next.Stability, card.ID, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.Flashcard{}, err
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO flashcard_reviews
+	(card_pk, user_id, rating, state, stability, difficulty, elapsed_days, scheduled_days, due, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, card.ID, userID, int(reviewLog.Rating), string(reviewLog.State), reviewLog.Stability,
+		reviewLog.Difficulty, reviewLog.ElapsedDays, reviewLog.ScheduledDays, reviewLog.Due, reviewLog.Reviewed)
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.Flashcard{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("err %v", err)
+		return models.Flashcard{}, err
+	}
+	return s.QueryFlashcard(userID, card.ID)
+}
+
+// QueryFlashcardReviews returns the reviews of the card as a whole, leaving
+// out the reviews of its cloze deletions.
+func (s *Handler) QueryFlashcardReviews(userID, cardPK int) ([]models.FlashcardReview, error) {
+	rows, err := s.DB.Query(`
+	SELECT id, card_pk, rating, COALESCE(state, ''), COALESCE(stability, 0),
+	COALESCE(difficulty, 0), COALESCE(elapsed_days, 0), COALESCE(scheduled_days, 0),
+	COALESCE(due, created_at), created_at, cloze_index
+	FROM flashcard_reviews
+	WHERE user_id = $1 AND card_pk = $2 AND cloze_index IS NULL
+	ORDER BY created_at ASC, id ASC
+	`, userID, cardPK)
+	if err != nil {
+		log.Printf("err %v", err)
+		return []models.FlashcardReview{}, err
+	}
+	defer rows.Close()
+
+	reviews := []models.FlashcardReview{}
+	for rows.Next() {
+		var review models.FlashcardReview
+		if err := rows.Scan(
+			&review.ID,
+			&review.CardPK,
+			&review.Rating,
+			&review.State,
+			&review.Stability,
+			&review.Difficulty,
+			&review.ElapsedDays,
+			&review.ScheduledDays,
+			&review.Due,
+			&review.CreatedAt,
+			&review.ClozeIndex,
+		); err != nil {
+			log.Printf("err %v", err)
+			return reviews, err
+		}
+		reviews = append(reviews, review)
+	}
+	return reviews, nil
+}
+
+func (s *Handler) GetNextFlashcardRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	cards, err := s.QueryDueFlashcards(userID, 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(cards) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cards[0])
+}
+
+func (s *Handler) GetDueFlashcardsRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	limit := DEFAULT_FLASHCARD_QUEUE_LIMIT
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	cards, err := s.QueryDueFlashcards(userID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cards)
+}
+
+func (s *Handler) ReviewFlashcardRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	var params models.FlashcardReviewParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !srs.Rating(params.Rating).Valid() {
+		http.Error(w, "Invalid rating", http.StatusBadRequest)
+		return
+	}
+	card, err := s.ReviewFlashcard(userID, params)
+	if err == errFlashcardNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(card)
+}
+
+func (s *Handler) GetFlashcardReviewsRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+	cardPK, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.QueryFlashcard(userID, cardPK); err == errFlashcardNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reviews, err := s.QueryFlashcardReviews(userID, cardPK)
+	if err != nil {
+		http.Error(w, "Unable to retrieve reviews", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-backend/models"
+	"go-backend/tests"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func makeFlashcard(s *Handler, t *testing.T, userID, cardPK int) {
+	card, err := s.QueryFullCard(userID, cardPK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isFlashcard := true
+	_, err = s.UpdateCard(userID, cardPK, models.EditCardParams{
+		CardID:      card.CardID,
+		Title:       card.Title,
+		Body:        card.Body,
+		Link:        card.Link,
+		IsFlashcard: &isFlashcard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func makeDueFlashcardsRequest(s *Handler, t *testing.T) []models.Flashcard {
+	token, _ := tests.GenerateTestJWT(1)
+	req, err := http.NewRequest("GET", "/api/flashcards/due", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.JwtMiddleware(s.GetDueFlashcardsRoute))
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var cards []models.Flashcard
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &cards)
+	return cards
+}
+
+func makeReviewFlashcardRequest(s *Handler, t *testing.T, params models.FlashcardReviewParams) *httptest.ResponseRecorder {
+	token, _ := tests.GenerateTestJWT(1)
+	body, _ := json.Marshal(params)
+	req, err := http.NewRequest("POST", "/api/flashcards", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.JwtMiddleware(s.ReviewFlashcardRoute))
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestToggleFlashcard(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	makeFlashcard(s, t, 1, 1)
+	card, err := s.QueryFullCard(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !card.IsFlashcard {
+		t.Errorf("card should be a flashcard")
+	}
+
+	// omitting is_flashcard must leave the flag alone
+	_, err = s.UpdateCard(1, 1, models.EditCardParams{CardID: card.CardID, Title: "new title", Body: card.Body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, _ = s.QueryFullCard(1, 1)
+	if !card.IsFlashcard {
+		t.Errorf("updating a card without is_flashcard should not clear the flag")
+	}
+
+	isFlashcard := false
+	_, err = s.UpdateCard(1, 1, models.EditCardParams{CardID: card.CardID, Title: card.Title, Body: card.Body, IsFlashcard: &isFlashcard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, _ = s.QueryFullCard(1, 1)
+	if card.IsFlashcard {
+		t.Errorf("card should no longer be a flashcard")
+	}
+}
+
+func TestGetDueFlashcards(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	cards := makeDueFlashcardsRequest(s, t)
+	if len(cards) != 0 {
+		t.Errorf("wrong number of due flashcards, got %v want %v", len(cards), 0)
+	}
+
+	makeFlashcard(s, t, 1, 1)
+	makeFlashcard(s, t, 1, 2)
+	cards = makeDueFlashcardsRequest(s, t)
+	if len(cards) != 2 {
+		t.Errorf("wrong number of due flashcards, got %v want %v", len(cards), 2)
+	}
+	if len(cards) > 0 && cards[0].State != "new" {
+		t.Errorf("wrong flashcard state, got %v want %v", cards[0].State, "new")
+	}
+}
+
+func makeFlashcardReviewsRequest(s *Handler, t *testing.T, cardPK int) *httptest.ResponseRecorder {
+	token, _ := tests.GenerateTestJWT(1)
+	req, err := http.NewRequest("GET", "/api/flashcards/"+strconv.Itoa(cardPK)+"/reviews", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/api/flashcards/{id}/reviews", s.JwtMiddleware(s.GetFlashcardReviewsRoute))
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestReviewFlashcard(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	makeFlashcard(s, t, 1, 1)
+	rr := makeReviewFlashcardRequest(s, t, models.FlashcardReviewParams{CardPK: 1, Rating: 3})
+	if status := rr.Code; status != http.StatusOK {
+		log.Printf("err %v", rr.Body.String())
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var card models.Flashcard
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &card)
+	if card.State != "review" {
+		t.Errorf("wrong flashcard state, got %v want %v", card.State, "review")
+	}
+	if card.Reps != 1 {
+		t.Errorf("wrong reps, got %v want %v", card.Reps, 1)
+	}
+	if card.Due == nil || card.LastReview == nil || !card.Due.After(*card.LastReview) {
+		t.Errorf("flashcard should be scheduled in the future, got %v", card.Due)
+	}
+
+	rr = makeFlashcardReviewsRequest(s, t, 1)
+	if status := rr.Code; status != http.StatusOK {
+		log.Printf("err %v", rr.Body.String())
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var reviews []models.FlashcardReview
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &reviews)
+	if len(reviews) != 1 {
+		t.Fatalf("wrong number of reviews, got %v want %v", len(reviews), 1)
+	}
+	if reviews[0].Rating != 3 || reviews[0].State != "new" {
+		t.Errorf("wrong review recorded, got %+v", reviews[0])
+	}
+
+	cards := makeDueFlashcardsRequest(s, t)
+	if len(cards) != 0 {
+		t.Errorf("reviewed flashcard should not be due, got %v cards", len(cards))
+	}
+}
+
+func TestReviewFlashcardInvalid(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	makeFlashcard(s, t, 1, 1)
+	rr := makeReviewFlashcardRequest(s, t, models.FlashcardReviewParams{CardPK: 1, Rating: 7})
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// card 2 has not been turned into a flashcard
+	rr = makeReviewFlashcardRequest(s, t, models.FlashcardReviewParams{CardPK: 2, Rating: 2})
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+	rr = makeFlashcardReviewsRequest(s, t, 2)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"go-backend/llms"
+	"go-backend/models"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pgvector/pgvector-go"
+)
+
+// HYBRID_RRF_K dampens the weight of the top ranks in reciprocal rank fusion.
+// 60 is the value from the original paper and works well without tuning.
+const HYBRID_RRF_K = 60
+
+// hybridCandidate is one card as seen by every retrieval source. The ranks are
+// 1-based and zero when the source did not return the card.
+type hybridCandidate struct {
+	CardPK           int
+	CardID           string
+	Title            string
+	Preview          string
+	ParentID         int
+	Card             models.CardChunk
+	FullTextRank     int
+	FullTextScore    float64
+	SemanticRank     int
+	SemanticScore    float64
+	SharedEntities   int
+	EntitySimilarity float64
+	RerankScore      *float64
+	Score            float64
+}
+
+// reciprocalRankFusion scores every candidate as the sum of 1 / (k + rank)
+// over the sources that returned it, and sorts the best first. Ties keep the
+// full text order, then the semantic order.
+func reciprocalRankFusion(candidates []*hybridCandidate, k int) []*hybridCandidate {
+	for _, candidate := range candidates {
+		candidate.Score = 0
+		if candidate.FullTextRank > 0 {
+			candidate.Score += 1 / float64(k+candidate.FullTextRank)
+		}
+		if candidate.SemanticRank > 0 {
+			candidate.Score += 1 / float64(k+candidate.SemanticRank)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	return candidates
+}
+
+// mergeHybridSources combines the full text and semantic results into one
+// candidate per card. Semantic results come back per chunk, so only the best
+// chunk of each card counts towards its rank.
+func mergeHybridSources(fullText []classicSearchResult, semantic []models.CardChunk) []*hybridCandidate {
+	var candidates []*hybridCandidate
+	byCard := make(map[int]*hybridCandidate)
+
+	for i, result := range fullText {
+		candidate := &hybridCandidate{
+			CardPK:        result.Card.ID,
+			CardID:        result.Card.CardID,
+			Title:         result.Card.Title,
+			Preview:       result.Preview,
+			ParentID:      result.Card.ParentID,
+			Card:          models.ConvertCardToChunk(result.Card),
+			FullTextRank:  i + 1,
+			FullTextScore: result.Rank,
+		}
+		byCard[candidate.CardPK] = candidate
+		candidates = append(candidates, candidate)
+	}
+
+	rank := 0
+	for _, chunk := range semantic {
+		candidate, exists := byCard[chunk.ID]
+		if exists && candidate.SemanticRank > 0 {
+			continue
+		}
+		rank++
+		if !exists {
+			candidate = &hybridCandidate{
+				CardPK:   chunk.ID,
+				CardID:   chunk.CardID,
+				Title:    chunk.Title,
+				Preview:  chunk.Chunk,
+				ParentID: chunk.ParentID,
+				Card:     chunk,
+			}
+			byCard[candidate.CardPK] = candidate
+			candidates = append(candidates, candidate)
+		}
+		candidate.SemanticRank = rank
+		candidate.SemanticScore = chunk.CombinedScore
+		candidate.SharedEntities = chunk.SharedEntities
+		candidate.EntitySimilarity = chunk.EntitySimilarity
+	}
+	return candidates
+}
+
+func (c *hybridCandidate) toSearchResult() models.SearchResult {
+	metadata := map[string]interface{}{
+		"id":              c.CardPK,
+		"parent_id":       c.ParentID,
+		"rrf_score":       c.Score,
+		"full_text_rank":  nil,
+		"full_text_score": nil,
+		"semantic_rank":   nil,
+		"semantic_score":  nil,
+		"reranker_score":  nil,
+	}
+	if c.FullTextRank > 0 {
+		metadata["full_text_rank"] = c.FullTextRank
+		metadata["full_text_score"] = c.FullTextScore
+	}
+	if c.SemanticRank > 0 {
+		metadata["semantic_rank"] = c.SemanticRank
+		metadata["semantic_score"] = c.SemanticScore
+		metadata["shared_entities"] = c.SharedEntities
+		metadata["entity_similarity"] = c.EntitySimilarity
+		metadata["explanation"] = c.Card.Explanation
+	}
+	score := c.Score
+	if c.RerankScore != nil {
+		metadata["reranker_score"] = *c.RerankScore
+		score = *c.RerankScore
+	}
+	return models.SearchResult{
+		ID:        c.CardID,
+		Type:      "card",
+		Title:     c.Title,
+		Preview:   c.Preview,
+		Score:     score,
+		CreatedAt: c.Card.CreatedAt,
+		UpdatedAt: c.Card.UpdatedAt,
+		Metadata:  metadata,
+	}
+}
+
+// searchEmbeddingText is the text embedded for the semantic half of a hybrid
+// search. Filters, tags and negated terms would only add noise to the vector.
+func searchEmbeddingText(node SearchNode) string {
+	return strings.ReplaceAll(strings.Join(searchRankTerms(node), " "), `"`, "")
+}
+
+// rerankingEnabled reports whether search results can be reranked.
+func (s *Handler) rerankingEnabled() bool {
+	return s.Server.Reranker != nil && !s.Server.DisableReranking
+}
+
+// HybridSearch runs the full text and vector searches in parallel and fuses
+// them with reciprocal rank fusion. The ranking config scores the vector
+// search and caps the fused list. An empty embedding skips the vector search,
+// so the results degrade to full text ranking when embeddings are unavailable.
+func (s *Handler) HybridSearch(userID int, searchTerm string, embedding pgvector.Vector, ranking models.RankingConfig, rerank bool) ([]models.SearchResult, error) {
+	node, err := ParseSearchQuery(searchTerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// the vector search does not match on words, but has to leave out the
+	// cards the rest of the query excludes
+	cardPKs, err := s.searchFilterCardPKs(userID, node)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	var fullText []classicSearchResult
+	var semantic []models.CardChunk
+	var fullTextErr, semanticErr error
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fullText, fullTextErr = s.queryClassicSearch(userID, searchTerm)
+	}()
+	if len(embedding.Slice()) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semantic, semanticErr = s.QueryRelatedCardsIn(userID, embedding, ranking, cardPKs)
+		}()
+	}
+	wg.Wait()
+
+	if fullTextErr != nil {
+		return nil, fullTextErr
+	}
+	if semanticErr != nil {
+		log.Printf("hybrid search semantic error, using full text only: %v", semanticErr)
+		semantic = nil
+	}
+
+	candidates := reciprocalRankFusion(mergeHybridSources(fullText, semantic), HYBRID_RRF_K)
+	if len(candidates) > ranking.ResultLimit {
+		candidates = candidates[:ranking.ResultLimit]
+	}
+
+	if rerank && len(candidates) > 0 {
+		s.rerankHybridCandidates(searchEmbeddingText(node), candidates)
+	}
+
+	results := make([]models.SearchResult, len(candidates))
+	for i, candidate := range candidates {
+		results[i] = candidate.toSearchResult()
+	}
+	return results, nil
+}
+
+// rerankHybridCandidates scores the fused candidates with the reranker and
+// sorts them by that score. On failure the fused order is kept.
+func (s *Handler) rerankHybridCandidates(query string, candidates []*hybridCandidate) {
+	chunks := make([]models.CardChunk, len(candidates))
+	for i, candidate := range candidates {
+		chunks[i] = candidate.Card
+		chunks[i].Chunk = candidate.Preview
+	}
+	scores, err := s.Server.Reranker.Rerank(query, chunks)
+	if err != nil {
+		log.Printf("hybrid search rerank error, keeping fused order: %v", err)
+		return
+	}
+	for i := range candidates {
+		score := scores[i]
+		candidates[i].RerankScore = &score
+		if candidates[i].Card.Explanation != nil {
+			candidates[i].Card.Explanation.RerankerScore = &score
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].RerankScore == nil || candidates[j].RerankScore == nil {
+			return candidates[i].RerankScore != nil
+		}
+		return *candidates[i].RerankScore > *candidates[j].RerankScore
+	})
+}
+
+// HybridSearchResults embeds the free text of the query and runs HybridSearch.
+// If the embedding cannot be generated the search still runs on full text.
+func (s *Handler) HybridSearchResults(userID int, searchTerm string, ranking models.RankingConfig, rerank bool) ([]models.SearchResult, error) {
+	node, err := ParseSearchQuery(searchTerm)
+	if err != nil {
+		return nil, err
+	}
+	var embedding pgvector.Vector
+	if text := searchEmbeddingText(node); text != "" {
+		embeddings, err := llms.GenerateChunkEmbeddings(s.Server.LLMClient, models.CardChunk{Chunk: text}, true)
+		if err != nil {
+			log.Printf("hybrid search embedding error, using full text only: %v", err)
+		} else if len(embeddings) > 0 {
+			embedding = embeddings[0]
+		}
+	}
+	return s.HybridSearch(userID, searchTerm, embedding, ranking, rerank && s.rerankingEnabled())
+}
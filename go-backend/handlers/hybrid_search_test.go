@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"go-backend/llms"
+	"go-backend/models"
+	"go-backend/tests"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pgvector/pgvector-go"
+)
+
+func TestMergeHybridSources(t *testing.T) {
+	fullText := []classicSearchResult{
+		{Card: models.Card{ID: 1, CardID: "1", Title: "exact title"}, Rank: 0.5, Preview: "**exact** title"},
+		{Card: models.Card{ID: 2, CardID: "2", Title: "second"}, Rank: 0.1},
+	}
+	semantic := []models.CardChunk{
+		{ID: 3, CardID: "3", Title: "paraphrase", Chunk: "chunk a", CombinedScore: 0.9},
+		{ID: 3, CardID: "3", Title: "paraphrase", Chunk: "chunk b", CombinedScore: 0.8},
+		{ID: 1, CardID: "1", Title: "exact title", Chunk: "chunk c", CombinedScore: 0.7, SharedEntities: 2},
+	}
+	candidates := mergeHybridSources(fullText, semantic)
+	if len(candidates) != 3 {
+		t.Fatalf("wrong number of candidates, got %v want %v", len(candidates), 3)
+	}
+
+	byCard := make(map[int]*hybridCandidate)
+	for _, candidate := range candidates {
+		byCard[candidate.CardPK] = candidate
+	}
+	if c := byCard[1]; c.FullTextRank != 1 || c.SemanticRank != 2 || c.SharedEntities != 2 || c.Preview != "**exact** title" {
+		t.Errorf("wrong candidate for card 1, got %+v", c)
+	}
+	if c := byCard[2]; c.FullTextRank != 2 || c.SemanticRank != 0 {
+		t.Errorf("wrong candidate for card 2, got %+v", c)
+	}
+	// the second chunk of card 3 should not take up a rank
+	if c := byCard[3]; c.FullTextRank != 0 || c.SemanticRank != 1 || c.Preview != "chunk a" {
+		t.Errorf("wrong candidate for card 3, got %+v", c)
+	}
+}
+
+func TestReciprocalRankFusion(t *testing.T) {
+	candidates := []*hybridCandidate{
+		{CardPK: 1, FullTextRank: 1},
+		{CardPK: 2, FullTextRank: 2, SemanticRank: 2},
+		{CardPK: 3, SemanticRank: 1},
+	}
+	fused := reciprocalRankFusion(candidates, HYBRID_RRF_K)
+
+	// found by both sources beats first place in either one
+	expectedOrder := []int{2, 1, 3}
+	for i, candidate := range fused {
+		if candidate.CardPK != expectedOrder[i] {
+			t.Errorf("wrong order at %v, got %v want %v", i, candidate.CardPK, expectedOrder[i])
+		}
+	}
+	expectedScore := 2.0 / float64(HYBRID_RRF_K+2)
+	if math.Abs(fused[0].Score-expectedScore) > 1e-9 {
+		t.Errorf("wrong score, got %v want %v", fused[0].Score, expectedScore)
+	}
+	// ties keep the full text order
+	if fused[1].Score != fused[2].Score {
+		t.Errorf("expected a tie between the single source results")
+	}
+}
+
+func TestHybridCandidateMetadata(t *testing.T) {
+	rerank := 8.5
+	result := (&hybridCandidate{CardPK: 1, CardID: "1", FullTextRank: 1, FullTextScore: 0.5, Score: 0.1, RerankScore: &rerank}).toSearchResult()
+	metadata := result.Metadata.(map[string]interface{})
+	if metadata["full_text_rank"] != 1 || metadata["semantic_rank"] != nil {
+		t.Errorf("wrong source ranks, got %v", metadata)
+	}
+	if metadata["reranker_score"] != 8.5 || result.Score != 8.5 {
+		t.Errorf("reranker score should be used when present, got %v", result.Score)
+	}
+}
+
+func TestSearchEmbeddingText(t *testing.T) {
+	node, _ := ParseSearchQuery(`"winston churchill" speeches #history !draft title:war`)
+	if text := searchEmbeddingText(node); text != "winston churchill speeches" {
+		t.Errorf("wrong embedding text, got %q", text)
+	}
+}
+
+func TestCompileSearchFilters(t *testing.T) {
+	node, _ := ParseSearchQuery(`speeches title:war !draft`)
+	output, args := compileSearchFilters(node, []interface{}{1})
+	expected := " AND (TRUE AND (cards.title ILIKE $2) AND NOT (numnode(plainto_tsquery('english', $3)) > 0 AND (cards.search_vector @@ plainto_tsquery('english', $3) OR cards.card_id ILIKE $4 OR cards.title ILIKE $4)))"
+	if output != expected {
+		t.Errorf("wrong filters, got %v want %v", output, expected)
+	}
+	if len(args) != 4 {
+		t.Errorf("wrong args, got %v", args)
+	}
+
+	for query, expected := range map[string]bool{
+		"speeches":                false,
+		`"winston churchill" war`: false,
+		"war OR peace":            false,
+		"speeches #history":       true,
+		"speeches !draft":         true,
+		"created:>2024-01-01":     true,
+	} {
+		node, _ := ParseSearchQuery(query)
+		if hasSearchFilters(node) != expected {
+			t.Errorf("wrong filters for %q, expected %v", query, expected)
+		}
+	}
+}
+
+func TestHybridSearchWithoutEmbedding(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	classic, err := s.ClassicSearchResults(1, "test card")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := s.HybridSearch(1, "test card", pgvector.Vector{}, models.DefaultRankingConfig(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || len(results) != len(classic) {
+		t.Fatalf("wrong number of results, got %v want %v", len(results), len(classic))
+	}
+	for i := range results {
+		if results[i].ID != classic[i].ID {
+			t.Errorf("hybrid without embeddings should keep the full text order, got %v want %v", results[i].ID, classic[i].ID)
+		}
+	}
+	metadata := results[0].Metadata.(map[string]interface{})
+	if metadata["full_text_rank"] != 1 || metadata["semantic_rank"] != nil {
+		t.Errorf("wrong metadata, got %v", metadata)
+	}
+}
+
+func TestHybridSearchLocalRerank(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	s.Server.Reranker = llms.NewLocalReranker()
+
+	results, err := s.HybridSearch(1, "test card", pgvector.Vector{}, models.DefaultRankingConfig(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatal("expected results")
+	}
+	if results[0].ID != "2/A" {
+		t.Errorf("the card titled after the query should come first, got %v", results[0].ID)
+	}
+	for i, result := range results {
+		metadata := result.Metadata.(map[string]interface{})
+		if metadata["reranker_score"] == nil {
+			t.Errorf("result %v should have a reranker score", result.ID)
+		}
+		if i > 0 && result.Score > results[i-1].Score {
+			t.Errorf("results should be sorted by reranker score")
+		}
+	}
+}
+
+func TestHybridSearchRouteInvalidQuery(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	token, _ := tests.GenerateTestJWT(1)
+	req, err := http.NewRequest("GET", "/api/search?type=hybrid&search_term=%28unbalanced", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.JwtMiddleware(s.SemanticSearchCardsRoute))
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
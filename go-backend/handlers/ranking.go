@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-backend/models"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// QueryUserRankingConfig returns the user's semantic ranking settings. Fields
+// the user never set keep their defaults.
+func (s *Handler) QueryUserRankingConfig(userID int) (models.RankingConfig, error) {
+	ranking := models.DefaultRankingConfig()
+	var stored sql.NullString
+	err := s.DB.QueryRow(`SELECT search_ranking FROM users WHERE id = $1`, userID).Scan(&stored)
+	if err != nil {
+		log.Printf("err %v", err)
+		return ranking, err
+	}
+	if !stored.Valid || stored.String == "" {
+		return ranking, nil
+	}
+	if err := json.Unmarshal([]byte(stored.String), &ranking); err != nil {
+		log.Printf("invalid search ranking for user %v: %v", userID, err)
+		return models.DefaultRankingConfig(), nil
+	}
+	if err := ranking.Validate(); err != nil {
+		log.Printf("invalid search ranking for user %v: %v", userID, err)
+		return models.DefaultRankingConfig(), nil
+	}
+	return ranking, nil
+}
+
+func (s *Handler) UpdateUserRankingConfig(userID int, ranking models.RankingConfig) error {
+	if err := ranking.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ranking)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec(`UPDATE users SET search_ranking = $1, updated_at = NOW() WHERE id = $2`, string(data), userID)
+	if err != nil {
+		log.Printf("err %v", err)
+	}
+	return err
+}
+
+// rankingConfigFromRequest applies any ranking parameters in the query string
+// on top of the given config.
+func rankingConfigFromRequest(r *http.Request, ranking models.RankingConfig) (models.RankingConfig, error) {
+	query := r.URL.Query()
+	floats := map[string]*float64{
+		"semantic_weight":        &ranking.SemanticWeight,
+		"entity_weight":          &ranking.EntityWeight,
+		"shared_entities_weight": &ranking.SharedEntitiesWeight,
+	}
+	for name, field := range floats {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return ranking, fmt.Errorf("invalid %s", name)
+			}
+			*field = parsed
+		}
+	}
+	ints := map[string]*int{
+		"candidates": &ranking.CandidateCount,
+		"limit":      &ranking.ResultLimit,
+	}
+	for name, field := range ints {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return ranking, fmt.Errorf("invalid %s", name)
+			}
+			*field = parsed
+		}
+	}
+	// a larger limit on its own should not trip over the default candidate count
+	if query.Get("limit") != "" && query.Get("candidates") == "" && ranking.CandidateCount > 0 && ranking.ResultLimit > ranking.CandidateCount {
+		ranking.CandidateCount = ranking.ResultLimit
+	}
+	return ranking, ranking.Validate()
+}
+
+// requestRankingConfig is the user's ranking with the request's overrides.
+func (s *Handler) requestRankingConfig(userID int, r *http.Request) (models.RankingConfig, error) {
+	ranking, err := s.QueryUserRankingConfig(userID)
+	if err != nil {
+		return ranking, err
+	}
+	return rankingConfigFromRequest(r, ranking)
+}
+
+func (s *Handler) GetRankingConfigRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	ranking, err := s.QueryUserRankingConfig(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ranking)
+}
+
+func (s *Handler) UpdateRankingConfigRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	ranking := models.DefaultRankingConfig()
+	if err := json.NewDecoder(r.Body).Decode(&ranking); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := ranking.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.UpdateUserRankingConfig(userID, ranking); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ranking)
+}
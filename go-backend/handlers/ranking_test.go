@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-backend/models"
+	"go-backend/tests"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pgvector/pgvector-go"
+)
+
+func TestRankingConfigValidate(t *testing.T) {
+	if err := models.DefaultRankingConfig().Validate(); err != nil {
+		t.Errorf("default config should be valid: %v", err)
+	}
+	// by default every chunk is scored before the best are kept, so entity
+	// matches can lift a card whose vector is further away
+	if models.DefaultRankingConfig().CandidateCount != 0 {
+		t.Errorf("the default config should not limit the candidates")
+	}
+	if err := (models.RankingConfig{SemanticWeight: 1, CandidateCount: 0, ResultLimit: 100}).Validate(); err != nil {
+		t.Errorf("a config without a candidate limit should be valid: %v", err)
+	}
+	invalid := []models.RankingConfig{
+		{SemanticWeight: -1, CandidateCount: 10, ResultLimit: 10},
+		{CandidateCount: 10, ResultLimit: 10},
+		{SemanticWeight: 1, CandidateCount: 0, ResultLimit: 0},
+		{SemanticWeight: 1, CandidateCount: -1, ResultLimit: 10},
+		{SemanticWeight: 1, CandidateCount: models.MAX_RANKING_CANDIDATES + 1, ResultLimit: 10},
+		{SemanticWeight: 1, CandidateCount: 10, ResultLimit: 11},
+	}
+	for _, config := range invalid {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestRankingConfigFromRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/search?semantic_weight=1&entity_weight=0&candidates=100&limit=5", nil)
+	ranking, err := rankingConfigFromRequest(req, models.DefaultRankingConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := models.RankingConfig{
+		SemanticWeight:       1,
+		EntityWeight:         0,
+		SharedEntitiesWeight: 0.2,
+		CandidateCount:       100,
+		ResultLimit:          5,
+	}
+	if ranking != expected {
+		t.Errorf("wrong config, got %+v want %+v", ranking, expected)
+	}
+
+	// raising the limit alone raises a candidate count with it
+	limited := models.DefaultRankingConfig()
+	limited.CandidateCount = 50
+	req = httptest.NewRequest("GET", "/api/search?limit=80", nil)
+	ranking, err = rankingConfigFromRequest(req, limited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranking.CandidateCount != 80 || ranking.ResultLimit != 80 {
+		t.Errorf("wrong config, got %+v", ranking)
+	}
+	ranking, err = rankingConfigFromRequest(req, models.DefaultRankingConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranking.CandidateCount != 0 || ranking.ResultLimit != 80 {
+		t.Errorf("an unlimited candidate count should stay unlimited, got %+v", ranking)
+	}
+
+	for _, params := range []string{"semantic_weight=abc", "candidates=x", "limit=10&candidates=5", "semantic_weight=-1"} {
+		req = httptest.NewRequest("GET", "/api/search?"+params, nil)
+		if _, err := rankingConfigFromRequest(req, models.DefaultRankingConfig()); err == nil {
+			t.Errorf("expected an error for %v", params)
+		}
+	}
+}
+
+func TestUserRankingConfig(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	ranking, err := s.QueryUserRankingConfig(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranking != models.DefaultRankingConfig() {
+		t.Errorf("expected the default config, got %+v", ranking)
+	}
+
+	custom := models.RankingConfig{SemanticWeight: 1, CandidateCount: 20, ResultLimit: 10}
+	body, _ := json.Marshal(custom)
+	token, _ := tests.GenerateTestJWT(1)
+	req, _ := http.NewRequest("PUT", "/api/search/ranking", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.JwtMiddleware(s.UpdateRankingConfigRoute)).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	ranking, _ = s.QueryUserRankingConfig(1)
+	if ranking != custom {
+		t.Errorf("config not saved, got %+v want %+v", ranking, custom)
+	}
+	ranking, _ = s.QueryUserRankingConfig(2)
+	if ranking != models.DefaultRankingConfig() {
+		t.Errorf("other users should keep the default, got %+v", ranking)
+	}
+
+	body, _ = json.Marshal(models.RankingConfig{CandidateCount: 20, ResultLimit: 10})
+	req, _ = http.NewRequest("PUT", "/api/search/ranking", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.JwtMiddleware(s.UpdateRankingConfigRoute)).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestQueryRelatedCardsExplanation(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	for _, cardPK := range []int{1, 3} {
+		_, err := s.DB.Exec(`INSERT INTO card_chunks (card_pk, user_id, chunk_text, chunk_id) VALUES ($1, 1, $2, 1)`, cardPK, "chunk text")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	vectorData := make([]float32, 1024)
+	for i := range vectorData {
+		vectorData[i] = float32(i + 1)
+	}
+	embedding := pgvector.NewVector(vectorData)
+
+	ranking := models.RankingConfig{SemanticWeight: 0.5, EntityWeight: 0, SharedEntitiesWeight: 0.5, CandidateCount: 10, ResultLimit: 1}
+	results, err := s.QueryRelatedCards(1, embedding, ranking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("wrong number of results, got %v want %v", len(results), 1)
+	}
+
+	// both chunks are equally close, so the card with an entity wins
+	result := results[0]
+	if result.ID != 1 {
+		t.Errorf("wrong card ranked first, got %v want %v", result.ID, 1)
+	}
+	explanation := result.Explanation
+	if explanation == nil {
+		t.Fatal("expected an explanation")
+	}
+	if explanation.ChunkID != 1 || explanation.Chunk != "chunk text" {
+		t.Errorf("wrong matched chunk, got %+v", explanation)
+	}
+	if len(explanation.SharedEntities) == 0 || explanation.SharedEntities[0] != "Test Entity 1" {
+		t.Errorf("wrong shared entities, got %v", explanation.SharedEntities)
+	}
+	sum := explanation.SemanticScore + explanation.EntityScore + explanation.SharedEntityScore
+	if math.Abs(sum-explanation.CombinedScore) > 1e-9 {
+		t.Errorf("score parts should add up to the combined score, got %v want %v", sum, explanation.CombinedScore)
+	}
+	if explanation.RerankerScore != nil {
+		t.Errorf("reranker score should be empty without reranking")
+	}
+}
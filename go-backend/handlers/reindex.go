@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-backend/llms"
+	"go-backend/models"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+var REINDEX_SCOPES = []string{"all", "user", "card"}
+var REINDEX_PARTS = []string{"chunks", "embeddings", "entities"}
+
+// DEFAULT_REINDEX_PARTS leaves out entities, since extracting them costs a
+// chat completion per chunk.
+var DEFAULT_REINDEX_PARTS = []string{"chunks", "embeddings"}
+
+const (
+	DEFAULT_REINDEX_CONCURRENCY = 4
+	MAX_REINDEX_CONCURRENCY     = 16
+	// REINDEX_BATCH_SIZE is how many cards are done between saving the
+	// position of a run. A resumed run repeats at most one batch.
+	REINDEX_BATCH_SIZE = 50
+	// REINDEX_STALE_AFTER is how long a running run can go without progress
+	// before it is taken to have died and can be resumed.
+	REINDEX_STALE_AFTER = 10 * time.Minute
+)
+
+const reindexRunColumns = `
+id, requested_by, scope, user_id, card_pk, parts, concurrency, status, total,
+processed, failed_card_pks, last_card_pk, last_error, created_at, updated_at, finished_at`
+
+func validateReindexParams(params *models.ReindexParams) error {
+	if params.Scope == "" {
+		params.Scope = "all"
+	}
+	if !contains(REINDEX_SCOPES, params.Scope) {
+		return fmt.Errorf("unknown scope %q, expected one of %v", params.Scope, REINDEX_SCOPES)
+	}
+	switch params.Scope {
+	case "all":
+		if params.UserID != 0 || params.CardPK != 0 {
+			return fmt.Errorf("user_id and card_pk cannot be given with scope all")
+		}
+	case "user":
+		if params.UserID <= 0 || params.CardPK != 0 {
+			return fmt.Errorf("scope user needs a user_id and no card_pk")
+		}
+	case "card":
+		if params.CardPK <= 0 {
+			return fmt.Errorf("scope card needs a card_pk")
+		}
+	}
+
+	if len(params.Parts) == 0 {
+		params.Parts = DEFAULT_REINDEX_PARTS
+	}
+	// keep the parts in the order they have to run in
+	var parts []string
+	for _, part := range REINDEX_PARTS {
+		if contains(params.Parts, part) {
+			parts = append(parts, part)
+		}
+	}
+	for _, part := range params.Parts {
+		if !contains(REINDEX_PARTS, part) {
+			return fmt.Errorf("unknown part %q, expected some of %v", part, REINDEX_PARTS)
+		}
+	}
+	params.Parts = parts
+
+	if params.Concurrency == 0 {
+		params.Concurrency = DEFAULT_REINDEX_CONCURRENCY
+	}
+	if params.Concurrency < 1 || params.Concurrency > MAX_REINDEX_CONCURRENCY {
+		return fmt.Errorf("concurrency must be between 1 and %d", MAX_REINDEX_CONCURRENCY)
+	}
+	return nil
+}
+
+func scanReindexRun(row interface{ Scan(...interface{}) error }) (models.ReindexRun, error) {
+	var run models.ReindexRun
+	var failed []int64
+	err := row.Scan(
+		&run.ID,
+		&run.RequestedBy,
+		&run.Scope,
+		&run.UserID,
+		&run.CardPK,
+		pq.Array(&run.Parts),
+		&run.Concurrency,
+		&run.Status,
+		&run.Total,
+		&run.Processed,
+		pq.Array(&failed),
+		&run.LastCardPK,
+		&run.LastError,
+		&run.CreatedAt,
+		&run.UpdatedAt,
+		&run.FinishedAt,
+	)
+	run.FailedCardPKs = make([]int, len(failed))
+	for i, cardPK := range failed {
+		run.FailedCardPKs[i] = int(cardPK)
+	}
+	return run, err
+}
+
+// CreateReindexRun records a run without starting it. requestedBy is nil
+// for runs started from the command line.
+func (s *Handler) CreateReindexRun(requestedBy *int, params models.ReindexParams) (models.ReindexRun, error) {
+	if err := validateReindexParams(&params); err != nil {
+		return models.ReindexRun{}, err
+	}
+	switch params.Scope {
+	case "user":
+		if _, err := s.QueryUser(params.UserID); err != nil {
+			return models.ReindexRun{}, fmt.Errorf("user %d not found", params.UserID)
+		}
+	case "card":
+		err := s.DB.QueryRow(`SELECT user_id FROM cards WHERE id = $1 AND is_deleted = FALSE`, params.CardPK).Scan(&params.UserID)
+		if err != nil {
+			return models.ReindexRun{}, fmt.Errorf("card %d not found", params.CardPK)
+		}
+	}
+
+	run, err := scanReindexRun(s.DB.QueryRow(`
+	INSERT INTO reindex_runs (requested_by, scope, user_id, card_pk, parts, concurrency)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING`+reindexRunColumns,
+		requestedBy, params.Scope, params.UserID, params.CardPK, pq.Array(params.Parts), params.Concurrency,
+	))
+	if err != nil {
+		log.Printf("err %v", err)
+		return run, fmt.Errorf("unable to create reindex run")
+	}
+	return run, nil
+}
+
+func (s *Handler) QueryReindexRun(id int) (models.ReindexRun, error) {
+	run, err := scanReindexRun(s.DB.QueryRow(`SELECT`+reindexRunColumns+` FROM reindex_runs WHERE id = $1`, id))
+	if err != nil {
+		return run, fmt.Errorf("reindex run %d not found", id)
+	}
+	return run, nil
+}
+
+func (s *Handler) QueryReindexRuns() ([]models.ReindexRun, error) {
+	rows, err := s.DB.Query(`SELECT` + reindexRunColumns + ` FROM reindex_runs ORDER BY id DESC LIMIT 50`)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, fmt.Errorf("unable to retrieve reindex runs")
+	}
+	defer rows.Close()
+
+	runs := []models.ReindexRun{}
+	for rows.Next() {
+		run, err := scanReindexRun(rows)
+		if err != nil {
+			log.Printf("err %v", err)
+			return nil, fmt.Errorf("unable to retrieve reindex runs")
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+type reindexCard struct {
+	CardPK int
+	UserID int
+}
+
+// reindexCards returns the cards in the run's scope after the given card,
+// in id order.
+func (s *Handler) reindexCards(run models.ReindexRun, after, limit int) ([]reindexCard, error) {
+	rows, err := s.DB.Query(`
+	SELECT id, user_id FROM cards
+	WHERE is_deleted = FALSE AND id > $1
+	AND ($2 = 0 OR user_id = $2) AND ($3 = 0 OR id = $3)
+	ORDER BY id
+	LIMIT $4`, after, run.UserID, run.CardPK, limit)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cards []reindexCard
+	for rows.Next() {
+		var card reindexCard
+		if err := rows.Scan(&card.CardPK, &card.UserID); err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
+
+// countReindexCards counts the cards in the run's scope, up to and including
+// upTo when it is not 0.
+func (s *Handler) countReindexCards(run models.ReindexRun, upTo int) (int, error) {
+	var count int
+	err := s.DB.QueryRow(`
+	SELECT COUNT(*) FROM cards
+	WHERE is_deleted = FALSE
+	AND ($1 = 0 OR user_id = $1) AND ($2 = 0 OR id = $2) AND ($3 = 0 OR id <= $3)`,
+		run.UserID, run.CardPK, upTo).Scan(&count)
+	return count, err
+}
+
+// startReindexRun marks a run as running and winds its progress back to the
+// last saved position, since cards after it will be done again. A run that
+// is already running can only be taken over once it has gone quiet.
+func (s *Handler) startReindexRun(id int) (models.ReindexRun, error) {
+	result, err := s.DB.Exec(`
+	UPDATE reindex_runs SET status = 'running', finished_at = NULL, updated_at = NOW()
+	WHERE id = $1 AND (status IN ('pending', 'failed')
+	OR (status = 'running' AND updated_at < NOW() - make_interval(secs => $2)))`,
+		id, REINDEX_STALE_AFTER.Seconds())
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.ReindexRun{}, err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return models.ReindexRun{}, fmt.Errorf("reindex run %d is not found, already running or done", id)
+	}
+
+	run, err := s.QueryReindexRun(id)
+	if err != nil {
+		return run, err
+	}
+	if run.Total, err = s.countReindexCards(run, 0); err != nil {
+		return run, err
+	}
+	run.Processed = 0
+	if run.LastCardPK > 0 {
+		if run.Processed, err = s.countReindexCards(run, run.LastCardPK); err != nil {
+			return run, err
+		}
+	}
+	var failed []int
+	for _, cardPK := range run.FailedCardPKs {
+		if cardPK <= run.LastCardPK {
+			failed = append(failed, cardPK)
+		}
+	}
+	run.FailedCardPKs = failed
+	_, err = s.DB.Exec(`
+	UPDATE reindex_runs SET total = $2, processed = $3, failed_card_pks = $4, updated_at = NOW()
+	WHERE id = $1`, id, run.Total, run.Processed, pq.Array(run.FailedCardPKs))
+	return run, err
+}
+
+// reindexCard rebuilds the chosen parts of one card. Rebuilt chunks without
+// new embeddings are queued for embedding, so the two never drift apart.
+func (s *Handler) reindexCard(userID, cardPK int, parts []string) error {
+	card, err := s.QueryFullCard(userID, cardPK)
+	if err != nil {
+		return err
+	}
+	if contains(parts, "chunks") {
+		if err := s.ChunkCard(card); err != nil {
+			return err
+		}
+	}
+	if contains(parts, "embeddings") {
+		if err := llms.ReembedCard(s.Server.LLMClient, s.DB, userID, cardPK); err != nil {
+			return fmt.Errorf("error embedding: %w", err)
+		}
+	} else if contains(parts, "chunks") {
+		if err := s.ChunkEmbedCard(userID, cardPK); err != nil {
+			return err
+		}
+	}
+	if contains(parts, "entities") {
+		if err := s.ExtractSaveCardEntities(userID, card); err != nil {
+			return fmt.Errorf("error extracting entities: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Handler) recordReindexedCard(runID, cardPK int, err error) {
+	var dbErr error
+	if err == nil {
+		_, dbErr = s.DB.Exec(`
+		UPDATE reindex_runs SET processed = processed + 1, updated_at = NOW()
+		WHERE id = $1`, runID)
+	} else {
+		log.Printf("reindex run %d failed on card %d: %v", runID, cardPK, err)
+		_, dbErr = s.DB.Exec(`
+		UPDATE reindex_runs SET
+			processed = processed + 1,
+			failed_card_pks = array_append(failed_card_pks, $2),
+			last_error = $3,
+			updated_at = NOW()
+		WHERE id = $1`, runID, cardPK, fmt.Sprintf("card %d: %v", cardPK, err))
+	}
+	if dbErr != nil {
+		log.Printf("err %v", dbErr)
+	}
+}
+
+// RunReindex starts or resumes a run and works through its cards,
+// Concurrency at a time, calling progress after every batch. A card that
+// fails is recorded and skipped rather than stopping the run.
+func (s *Handler) RunReindex(id int, progress func(models.ReindexRun)) (models.ReindexRun, error) {
+	run, err := s.startReindexRun(id)
+	if err != nil {
+		return run, err
+	}
+	return s.continueReindexRun(run, progress)
+}
+
+func (s *Handler) continueReindexRun(run models.ReindexRun, progress func(models.ReindexRun)) (models.ReindexRun, error) {
+	id := run.ID
+	for {
+		cards, err := s.reindexCards(run, run.LastCardPK, REINDEX_BATCH_SIZE)
+		if err != nil {
+			s.DB.Exec(`
+			UPDATE reindex_runs SET status = 'failed', last_error = $2, updated_at = NOW()
+			WHERE id = $1`, id, err.Error())
+			return run, err
+		}
+		if len(cards) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		limit := make(chan struct{}, run.Concurrency)
+		for _, card := range cards {
+			wg.Add(1)
+			limit <- struct{}{}
+			go func(card reindexCard) {
+				defer wg.Done()
+				defer func() { <-limit }()
+				s.recordReindexedCard(id, card.CardPK, s.reindexCard(card.UserID, card.CardPK, run.Parts))
+			}(card)
+		}
+		wg.Wait()
+
+		lastCardPK := cards[len(cards)-1].CardPK
+		if _, err := s.DB.Exec(`UPDATE reindex_runs SET last_card_pk = $2 WHERE id = $1`, id, lastCardPK); err != nil {
+			log.Printf("err %v", err)
+			return run, err
+		}
+		if run, err = s.QueryReindexRun(id); err != nil {
+			return run, err
+		}
+		log.Printf("reindex run %d: %d of %d cards, %d failed", id, run.Processed, run.Total, len(run.FailedCardPKs))
+		if progress != nil {
+			progress(run)
+		}
+	}
+
+	_, err := s.DB.Exec(`
+	UPDATE reindex_runs SET status = 'done', finished_at = NOW(), updated_at = NOW()
+	WHERE id = $1`, id)
+	if err != nil {
+		log.Printf("err %v", err)
+		return run, err
+	}
+	return s.QueryReindexRun(id)
+}
+
+// startReindexInBackground claims the run and works through it outside the
+// request, except in testing where it finishes before the response so the
+// result can be checked.
+func (s *Handler) startReindexInBackground(id int) (models.ReindexRun, error) {
+	run, err := s.startReindexRun(id)
+	if err != nil {
+		return run, err
+	}
+	if s.Server.Testing {
+		return s.continueReindexRun(run, nil)
+	}
+	go func() {
+		if _, err := s.continueReindexRun(run, nil); err != nil {
+			log.Printf("reindex run %d stopped: %v", id, err)
+		}
+	}()
+	return run, nil
+}
+
+func (s *Handler) CreateReindexRunRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	var params models.ReindexParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	run, err := s.CreateReindexRun(&userID, params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	run, err = s.startReindexInBackground(run.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+}
+
+func (s *Handler) GetReindexRunsRoute(w http.ResponseWriter, r *http.Request) {
+	runs, err := s.QueryReindexRuns()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+func (s *Handler) GetReindexRunRoute(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	run, err := s.QueryReindexRun(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+func (s *Handler) ResumeReindexRunRoute(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.QueryReindexRun(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	run, err := s.startReindexInBackground(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-backend/llms"
+	"go-backend/models"
+	"go-backend/tests"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidateReindexParams(t *testing.T) {
+	params := models.ReindexParams{Parts: []string{"embeddings", "chunks"}}
+	if err := validateReindexParams(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.Scope != "all" || params.Concurrency != DEFAULT_REINDEX_CONCURRENCY {
+		t.Errorf("defaults not applied, got %+v", params)
+	}
+	if !reflect.DeepEqual(params.Parts, []string{"chunks", "embeddings"}) {
+		t.Errorf("parts should be in run order, got %v", params.Parts)
+	}
+
+	invalid := []models.ReindexParams{
+		{Scope: "everything"},
+		{Scope: "all", UserID: 1},
+		{Scope: "user"},
+		{Scope: "card"},
+		{Parts: []string{"tags"}},
+		{Concurrency: MAX_REINDEX_CONCURRENCY + 1},
+	}
+	for _, params := range invalid {
+		if err := validateReindexParams(&params); err == nil {
+			t.Errorf("expected an error for %+v", params)
+		}
+	}
+}
+
+func userCardCount(s *Handler, t *testing.T, userID int) int {
+	var count int
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM cards WHERE user_id = $1 AND is_deleted = FALSE`, userID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestRunReindex(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	s.Server.LLMClient.Embedder, _ = llms.NewEmbedder(llms.DefaultEmbedderConfig("hash"))
+
+	run, err := s.CreateReindexRun(nil, models.ReindexParams{Scope: "user", UserID: 1, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batches int
+	run, err = s.RunReindex(run.ID, func(models.ReindexRun) { batches++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := userCardCount(s, t, 1)
+	if run.Status != "done" || run.Total != total || run.Processed != total || len(run.FailedCardPKs) != 0 {
+		t.Errorf("wrong run, got %+v", run)
+	}
+	if batches == 0 {
+		t.Errorf("progress should be reported")
+	}
+
+	var unembedded int
+	s.DB.QueryRow(`
+	SELECT COUNT(*) FROM cards c
+	WHERE c.user_id = 1 AND c.is_deleted = FALSE
+	AND NOT EXISTS (SELECT 1 FROM card_embeddings e WHERE e.card_pk = c.id)`).Scan(&unembedded)
+	if unembedded != 0 {
+		t.Errorf("every card should have embeddings, %v have none", unembedded)
+	}
+
+	if _, err := s.RunReindex(run.ID, nil); err == nil {
+		t.Errorf("a finished run should not start again")
+	}
+}
+
+func TestRunReindexContinuesPastFailures(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	// without an embedder every card fails to embed
+	run, _ := s.CreateReindexRun(nil, models.ReindexParams{Scope: "user", UserID: 1, Parts: []string{"embeddings"}})
+	run, err := s.RunReindex(run.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := userCardCount(s, t, 1)
+	if run.Status != "done" || run.Processed != total || len(run.FailedCardPKs) != total || run.LastError == "" {
+		t.Errorf("wrong run, got %+v", run)
+	}
+}
+
+func TestResumeReindex(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	s.Server.LLMClient.Embedder, _ = llms.NewEmbedder(llms.DefaultEmbedderConfig("hash"))
+
+	run, _ := s.CreateReindexRun(nil, models.ReindexParams{Scope: "user", UserID: 1})
+	var firstCard int
+	s.DB.QueryRow(`SELECT MIN(id) FROM cards WHERE user_id = 1 AND is_deleted = FALSE`).Scan(&firstCard)
+
+	// the run died after its first card, partway through the batch
+	_, err := s.DB.Exec(`
+	UPDATE reindex_runs SET status = 'running', processed = 7, last_card_pk = $2, failed_card_pks = $3,
+	updated_at = NOW() - INTERVAL '1 hour'
+	WHERE id = $1`, run.ID, firstCard, "{1000}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.DB.Exec(`DELETE FROM card_embeddings WHERE card_pk = $1`, firstCard)
+
+	run, err = s.RunReindex(run.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := userCardCount(s, t, 1)
+	if run.Status != "done" || run.Processed != total || len(run.FailedCardPKs) != 0 {
+		t.Errorf("wrong run, got %+v", run)
+	}
+	var embedded int
+	s.DB.QueryRow(`SELECT COUNT(*) FROM card_embeddings WHERE card_pk = $1`, firstCard).Scan(&embedded)
+	if embedded != 0 {
+		t.Errorf("cards before the saved position should not be done again")
+	}
+}
+
+func TestReindexRoutes(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	s.Server.LLMClient.Embedder, _ = llms.NewEmbedder(llms.DefaultEmbedderConfig("hash"))
+
+	makeRequest := func(userID int, method, path string, body interface{}) *httptest.ResponseRecorder {
+		token, _ := tests.GenerateTestJWT(userID)
+		var payload bytes.Buffer
+		json.NewEncoder(&payload).Encode(body)
+		req, _ := http.NewRequest(method, path, &payload)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+		router.HandleFunc("/api/admin/reindex", s.JwtMiddleware(s.Admin(s.CreateReindexRunRoute))).Methods("POST")
+		router.HandleFunc("/api/admin/reindex/{id}", s.JwtMiddleware(s.Admin(s.GetReindexRunRoute))).Methods("GET")
+		router.HandleFunc("/api/admin/reindex/{id}/resume", s.JwtMiddleware(s.Admin(s.ResumeReindexRunRoute))).Methods("POST")
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := makeRequest(1, "POST", "/api/admin/reindex", models.ReindexParams{Scope: "card", CardPK: 1})
+	if status := rr.Code; status != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v, %v", status, http.StatusAccepted, rr.Body.String())
+	}
+	var run models.ReindexRun
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &run)
+	if run.Status != "done" || run.Total != 1 || run.UserID != 1 {
+		t.Errorf("wrong run, got %+v", run)
+	}
+
+	rr = makeRequest(1, "POST", "/api/admin/reindex/"+strconv.Itoa(run.ID)+"/resume", nil)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	rr = makeRequest(2, "POST", "/api/admin/reindex", models.ReindexParams{})
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("non admins should be refused, got %v", status)
+	}
+}
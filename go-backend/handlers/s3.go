@@ -62,16 +62,17 @@ func (s *Handler) listObjects(client *s3.Client) {
 		fmt.Printf("Name: %s, Size: %d\n", *item.Key, item.Size)
 	}
 }
-func (s *Handler) uploadObject(client *s3.Client, key, filePath string) {
+func (s *Handler) uploadObject(client *s3.Client, key, filePath string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
-		log.Fatalf("unable to open file %q, %v", filePath, err)
+		log.Printf("unable to open file %q, %v", filePath, err)
+		return fmt.Errorf("unable to read file")
 	}
 	defer file.Close()
 
 	if s.Server.Testing {
 		s.Server.TestInspector.FilesUploaded += 1
-		return
+		return nil
 	}
 	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
 		Bucket: aws.String(bucketName),
@@ -79,8 +80,10 @@ func (s *Handler) uploadObject(client *s3.Client, key, filePath string) {
 		Body:   file,
 	})
 	if err != nil {
-		log.Fatalf("unable to upload %q to %q, %v", filePath, bucketName, err)
+		log.Printf("unable to upload %q to %q, %v", filePath, bucketName, err)
+		return fmt.Errorf("unable to upload file")
 	}
+	return nil
 }
 
 func (s *Handler) downloadObject(client *s3.Client, key, filePath string) (*s3.GetObjectOutput, error) {
@@ -120,7 +123,7 @@ func (s *Handler) deleteObject(client *s3.Client, key string) error {
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		log.Fatalf("unable to delete item %q, %v", key, err)
+		log.Printf("unable to delete item %q, %v", key, err)
 		return err
 	}
 	//	fmt.Printf("Successfully deleted %q from %q\n", key, bucketName)
@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-backend/models"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const DEFAULT_SAVED_SEARCH_LIMIT = 20
+const MAX_SAVED_SEARCH_LIMIT = 100
+
+var SAVED_SEARCH_TYPES = []string{"classic", "semantic"}
+
+// savedSearchEmbedRegex matches {{search:Name}} in a card body. The dashboard
+// card uses these to show the live results of a saved search.
+var savedSearchEmbedRegex = regexp.MustCompile(`\{\{search:\s*([^{}]+?)\s*\}\}`)
+
+// ParseSavedSearchEmbeds returns the distinct saved search names embedded in
+// the body, in the order they first appear.
+func ParseSavedSearchEmbeds(body string) []string {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, match := range savedSearchEmbedRegex.FindAllStringSubmatch(body, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// validateSavedSearch fills in defaults and checks the params. Classic
+// searches are parsed up front so a bad query is rejected when it is saved
+// instead of every time it runs.
+func validateSavedSearch(params *models.EditSavedSearchParams) error {
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" {
+		return fmt.Errorf("name is blank")
+	}
+	if strings.ContainsAny(params.Name, "{}") {
+		return fmt.Errorf("name cannot contain braces")
+	}
+	if params.SearchType == "" {
+		params.SearchType = "classic"
+	}
+	if !contains(SAVED_SEARCH_TYPES, params.SearchType) {
+		return fmt.Errorf("invalid search type %q", params.SearchType)
+	}
+	if params.ResultLimit == 0 {
+		params.ResultLimit = DEFAULT_SAVED_SEARCH_LIMIT
+	}
+	if params.ResultLimit < 0 || params.ResultLimit > MAX_SAVED_SEARCH_LIMIT {
+		return fmt.Errorf("result limit must be between 1 and %d", MAX_SAVED_SEARCH_LIMIT)
+	}
+	if params.SearchType == "classic" {
+		if _, err := ParseSearchQuery(params.SearchTerm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const savedSearchColumns = `id, user_id, name, search_term, search_type, result_limit, created_at, updated_at`
+
+func scanSavedSearch(row interface{ Scan(...any) error }) (models.SavedSearch, error) {
+	var search models.SavedSearch
+	err := row.Scan(
+		&search.ID,
+		&search.UserID,
+		&search.Name,
+		&search.SearchTerm,
+		&search.SearchType,
+		&search.ResultLimit,
+		&search.CreatedAt,
+		&search.UpdatedAt,
+	)
+	return search, err
+}
+
+func (s *Handler) QuerySavedSearch(userID, id int) (models.SavedSearch, error) {
+	row := s.DB.QueryRow(`
+	SELECT `+savedSearchColumns+`
+	FROM saved_searches
+	WHERE id = $1 AND user_id = $2 AND is_deleted = FALSE
+	`, id, userID)
+	search, err := scanSavedSearch(row)
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.SavedSearch{}, fmt.Errorf("unable to access saved search")
+	}
+	return search, nil
+}
+
+func (s *Handler) QuerySavedSearchByName(userID int, name string) (models.SavedSearch, error) {
+	row := s.DB.QueryRow(`
+	SELECT `+savedSearchColumns+`
+	FROM saved_searches
+	WHERE name = $1 AND user_id = $2 AND is_deleted = FALSE
+	`, name, userID)
+	search, err := scanSavedSearch(row)
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.SavedSearch{}, fmt.Errorf("unable to access saved search %q", name)
+	}
+	return search, nil
+}
+
+func (s *Handler) QuerySavedSearches(userID int) ([]models.SavedSearch, error) {
+	rows, err := s.DB.Query(`
+	SELECT `+savedSearchColumns+`
+	FROM saved_searches
+	WHERE user_id = $1 AND is_deleted = FALSE
+	ORDER BY name ASC
+	`, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return []models.SavedSearch{}, err
+	}
+	defer rows.Close()
+
+	searches := []models.SavedSearch{}
+	for rows.Next() {
+		search, err := scanSavedSearch(rows)
+		if err != nil {
+			log.Printf("err %v", err)
+			return searches, err
+		}
+		searches = append(searches, search)
+	}
+	return searches, nil
+}
+
+func (s *Handler) savedSearchNameTaken(userID int, name string, excludeID int) bool {
+	var count int
+	err := s.DB.QueryRow(`
+	SELECT COUNT(*) FROM saved_searches
+	WHERE user_id = $1 AND name = $2 AND id <> $3 AND is_deleted = FALSE
+	`, userID, name, excludeID).Scan(&count)
+	return err == nil && count > 0
+}
+
+func (s *Handler) CreateSavedSearch(userID int, params models.EditSavedSearchParams) (models.SavedSearch, error) {
+	if err := validateSavedSearch(&params); err != nil {
+		return models.SavedSearch{}, err
+	}
+	if s.savedSearchNameTaken(userID, params.Name, 0) {
+		return models.SavedSearch{}, fmt.Errorf("a saved search named %q already exists", params.Name)
+	}
+	var id int
+	err := s.DB.QueryRow(`
+	INSERT INTO saved_searches (user_id, name, search_term, search_type, result_limit, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
+	RETURNING id
+	`, userID, params.Name, params.SearchTerm, params.SearchType, params.ResultLimit).Scan(&id)
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.SavedSearch{}, err
+	}
+	return s.QuerySavedSearch(userID, id)
+}
+
+func (s *Handler) UpdateSavedSearch(userID, id int, params models.EditSavedSearchParams) (models.SavedSearch, error) {
+	if _, err := s.QuerySavedSearch(userID, id); err != nil {
+		return models.SavedSearch{}, err
+	}
+	if err := validateSavedSearch(&params); err != nil {
+		return models.SavedSearch{}, err
+	}
+	if s.savedSearchNameTaken(userID, params.Name, id) {
+		return models.SavedSearch{}, fmt.Errorf("a saved search named %q already exists", params.Name)
+	}
+	_, err := s.DB.Exec(`
+	UPDATE saved_searches SET
+	name = $1, search_term = $2, search_type = $3, result_limit = $4, updated_at = NOW()
+	WHERE id = $5 AND user_id = $6
+	`, params.Name, params.SearchTerm, params.SearchType, params.ResultLimit, id, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.SavedSearch{}, err
+	}
+	return s.QuerySavedSearch(userID, id)
+}
+
+func (s *Handler) DeleteSavedSearch(userID, id int) error {
+	result, err := s.DB.Exec(`
+	UPDATE saved_searches SET is_deleted = TRUE, updated_at = NOW()
+	WHERE id = $1 AND user_id = $2 AND is_deleted = FALSE
+	`, id, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("unable to access saved search")
+	}
+	return nil
+}
+
+// ExecuteSavedSearch runs the saved search through the same search path as
+// /api/search and trims the results to its limit.
+func (s *Handler) ExecuteSavedSearch(userID int, search models.SavedSearch) ([]models.SearchResult, error) {
+	var results []models.SearchResult
+	var err error
+	if search.SearchType == "semantic" {
+		var ranking models.RankingConfig
+		ranking, err = s.QueryUserRankingConfig(userID)
+		if err == nil {
+			results, err = s.SemanticSearchResults(userID, search.SearchTerm, ranking)
+		}
+	} else {
+		results, err = s.ClassicSearchResults(userID, search.SearchTerm)
+	}
+	if err != nil {
+		return []models.SearchResult{}, err
+	}
+	if search.ResultLimit > 0 && len(results) > search.ResultLimit {
+		results = results[:search.ResultLimit]
+	}
+	return results, nil
+}
+
+// QueryDashboard returns the user's dashboard card along with the results of
+// every saved search embedded in it. A search that is missing or fails is
+// reported on its own entry so the rest of the dashboard still renders.
+func (s *Handler) QueryDashboard(userID int) (models.Dashboard, error) {
+	var dashboardCardPK sql.NullInt64
+	err := s.DB.QueryRow(`SELECT dashboard_card_pk FROM users WHERE id = $1`, userID).Scan(&dashboardCardPK)
+	if err != nil {
+		log.Printf("err %v", err)
+		return models.Dashboard{}, err
+	}
+	if !dashboardCardPK.Valid || dashboardCardPK.Int64 == 0 {
+		return models.Dashboard{}, fmt.Errorf("no dashboard card set")
+	}
+	card, err := s.QueryFullCard(userID, int(dashboardCardPK.Int64))
+	if err != nil {
+		return models.Dashboard{}, err
+	}
+
+	dashboard := models.Dashboard{Card: card, Searches: []models.SavedSearchResults{}}
+	for _, name := range ParseSavedSearchEmbeds(card.Body) {
+		entry := models.SavedSearchResults{
+			SavedSearch: models.SavedSearch{Name: name},
+			Results:     []models.SearchResult{},
+		}
+		search, err := s.QuerySavedSearchByName(userID, name)
+		if err != nil {
+			entry.Error = err.Error()
+			dashboard.Searches = append(dashboard.Searches, entry)
+			continue
+		}
+		entry.SavedSearch = search
+		results, err := s.ExecuteSavedSearch(userID, search)
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Results = results
+		}
+		dashboard.Searches = append(dashboard.Searches, entry)
+	}
+	return dashboard, nil
+}
+
+func (s *Handler) GetSavedSearchesRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	searches, err := s.QuerySavedSearches(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(searches)
+}
+
+func (s *Handler) GetSavedSearchRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	search, err := s.QuerySavedSearch(userID, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(search)
+}
+
+func (s *Handler) CreateSavedSearchRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	var params models.EditSavedSearchParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	search, err := s.CreateSavedSearch(userID, params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(search)
+}
+
+func (s *Handler) UpdateSavedSearchRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.QuerySavedSearch(userID, id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var params models.EditSavedSearchParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	search, err := s.UpdateSavedSearch(userID, id, params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(search)
+}
+
+func (s *Handler) DeleteSavedSearchRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.DeleteSavedSearch(userID, id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Handler) ExecuteSavedSearchRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	search, err := s.QuerySavedSearch(userID, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	results, err := s.ExecuteSavedSearch(userID, search)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SavedSearchResults{SavedSearch: search, Results: results})
+}
+
+func (s *Handler) GetDashboardRoute(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("current_user").(int)
+
+	dashboard, err := s.QueryDashboard(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dashboard)
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-backend/models"
+	"go-backend/tests"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseSavedSearchEmbeds(t *testing.T) {
+	body := "# Dashboard\n{{search:Inbox}}\n\nsome text {{search: Reading list }} {{search:Inbox}} {{c1::cloze}}"
+	names := ParseSavedSearchEmbeds(body)
+	expected := []string{"Inbox", "Reading list"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("wrong names returned, got %v want %v", names, expected)
+	}
+	if names := ParseSavedSearchEmbeds("nothing here"); len(names) != 0 {
+		t.Errorf("expected no names, got %v", names)
+	}
+}
+
+func TestValidateSavedSearch(t *testing.T) {
+	params := models.EditSavedSearchParams{Name: " Inbox ", SearchTerm: "#inbox"}
+	if err := validateSavedSearch(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.Name != "Inbox" || params.SearchType != "classic" || params.ResultLimit != DEFAULT_SAVED_SEARCH_LIMIT {
+		t.Errorf("defaults not applied, got %+v", params)
+	}
+
+	invalid := []models.EditSavedSearchParams{
+		{Name: "", SearchTerm: "hello"},
+		{Name: "{{x}}", SearchTerm: "hello"},
+		{Name: "bad type", SearchType: "fuzzy"},
+		{Name: "bad limit", ResultLimit: MAX_SAVED_SEARCH_LIMIT + 1},
+		{Name: "bad query", SearchTerm: "(unbalanced"},
+	}
+	for _, params := range invalid {
+		if err := validateSavedSearch(&params); err == nil {
+			t.Errorf("expected an error for %+v", params)
+		}
+	}
+
+	// semantic searches are free text and are not parsed
+	params = models.EditSavedSearchParams{Name: "semantic", SearchType: "semantic", SearchTerm: "(unbalanced"}
+	if err := validateSavedSearch(&params); err != nil {
+		t.Errorf("unexpected error for semantic search: %v", err)
+	}
+}
+
+func makeSavedSearchRequest(s *Handler, t *testing.T, method, path string, body interface{}) *httptest.ResponseRecorder {
+	token, _ := tests.GenerateTestJWT(1)
+
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	req, err := http.NewRequest(method, path, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/api/saved-searches", s.JwtMiddleware(s.GetSavedSearchesRoute)).Methods("GET")
+	router.HandleFunc("/api/saved-searches", s.JwtMiddleware(s.CreateSavedSearchRoute)).Methods("POST")
+	router.HandleFunc("/api/saved-searches/{id}", s.JwtMiddleware(s.UpdateSavedSearchRoute)).Methods("PUT")
+	router.HandleFunc("/api/saved-searches/{id}", s.JwtMiddleware(s.DeleteSavedSearchRoute)).Methods("DELETE")
+	router.HandleFunc("/api/saved-searches/{id}/results", s.JwtMiddleware(s.ExecuteSavedSearchRoute)).Methods("GET")
+	router.HandleFunc("/api/dashboard", s.JwtMiddleware(s.GetDashboardRoute)).Methods("GET")
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCreateAndExecuteSavedSearch(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	params := models.EditSavedSearchParams{Name: "Test cards", SearchTerm: `title:"test card"`}
+	rr := makeSavedSearchRequest(s, t, "POST", "/api/saved-searches", params)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v, %v", status, http.StatusCreated, rr.Body.String())
+	}
+	var search models.SavedSearch
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &search)
+	if search.Name != "Test cards" || search.SearchType != "classic" {
+		t.Errorf("wrong saved search returned, got %+v", search)
+	}
+
+	rr = makeSavedSearchRequest(s, t, "POST", "/api/saved-searches", params)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("duplicate name should be rejected, got %v", status)
+	}
+
+	rr = makeSavedSearchRequest(s, t, "GET", "/api/saved-searches", nil)
+	var searches []models.SavedSearch
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &searches)
+	if len(searches) != 1 {
+		t.Errorf("wrong number of saved searches, got %v want %v", len(searches), 1)
+	}
+
+	rr = makeSavedSearchRequest(s, t, "GET", "/api/saved-searches/"+strconv.Itoa(search.ID)+"/results", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var results models.SavedSearchResults
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &results)
+	expected, _ := s.ClassicSearchResults(1, `title:"test card"`)
+	if len(results.Results) == 0 || len(results.Results) != len(expected) {
+		t.Errorf("wrong number of results, got %v want %v", len(results.Results), len(expected))
+	}
+}
+
+func TestSavedSearchResultLimit(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	search, err := s.CreateSavedSearch(1, models.EditSavedSearchParams{Name: "Everything", ResultLimit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := s.ExecuteSavedSearch(1, search)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Errorf("wrong number of results, got %v want %v", len(results), 3)
+	}
+}
+
+func TestUpdateAndDeleteSavedSearch(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	search, err := s.CreateSavedSearch(1, models.EditSavedSearchParams{Name: "Old", SearchTerm: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/saved-searches/" + strconv.Itoa(search.ID)
+
+	rr := makeSavedSearchRequest(s, t, "PUT", path, models.EditSavedSearchParams{Name: "New", SearchTerm: "world"})
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	updated, _ := s.QuerySavedSearch(1, search.ID)
+	if updated.Name != "New" || updated.SearchTerm != "world" {
+		t.Errorf("saved search not updated, got %+v", updated)
+	}
+
+	rr = makeSavedSearchRequest(s, t, "DELETE", path, nil)
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+	if _, err := s.QuerySavedSearch(1, search.ID); err == nil {
+		t.Errorf("saved search should be deleted")
+	}
+
+	// the name is free to use again once deleted
+	if _, err := s.CreateSavedSearch(1, models.EditSavedSearchParams{Name: "New"}); err != nil {
+		t.Errorf("unable to reuse deleted name: %v", err)
+	}
+}
+
+func TestSavedSearchOtherUser(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	search, err := s.CreateSavedSearch(2, models.EditSavedSearchParams{Name: "Private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := makeSavedSearchRequest(s, t, "GET", "/api/saved-searches/"+strconv.Itoa(search.ID)+"/results", nil)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestGetDashboardWithSavedSearches(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	if _, err := s.CreateSavedSearch(1, models.EditSavedSearchParams{Name: "Test cards", SearchTerm: `title:"test card"`}); err != nil {
+		t.Fatal(err)
+	}
+	card, err := s.CreateCard(1, models.EditCardParams{
+		CardID: "100",
+		Title:  "Dashboard",
+		Body:   "# Today\n{{search:Test cards}}\n{{search:Missing}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DB.Exec("UPDATE users SET dashboard_card_pk = $1 WHERE id = 1", card.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := makeSavedSearchRequest(s, t, "GET", "/api/dashboard", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var dashboard models.Dashboard
+	tests.ParseJsonResponse(t, rr.Body.Bytes(), &dashboard)
+	if dashboard.Card.ID != card.ID {
+		t.Errorf("wrong dashboard card, got %v want %v", dashboard.Card.ID, card.ID)
+	}
+	if len(dashboard.Searches) != 2 {
+		t.Fatalf("wrong number of searches, got %v want %v", len(dashboard.Searches), 2)
+	}
+	if len(dashboard.Searches[0].Results) == 0 || dashboard.Searches[0].Error != "" {
+		t.Errorf("expected results for the saved search, got %+v", dashboard.Searches[0])
+	}
+	if dashboard.Searches[1].Error == "" {
+		t.Errorf("expected an error for the missing saved search")
+	}
+}
+
+func TestGetDashboardNotSet(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	rr := makeSavedSearchRequest(s, t, "GET", "/api/dashboard", nil)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
@@ -3,7 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"go-backend/llms"
 	"go-backend/models"
 	"log"
@@ -14,18 +14,10 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 	"github.com/pgvector/pgvector-go"
 )
 
-type SearchParams struct {
-	Tags           []string
-	Terms          []string
-	NegateTags     []string
-	NegateTerms    []string
-	Entities       []string
-	NegateEntities []string
-}
-
 func contains[T comparable](collection []T, target T) bool {
 	for _, v := range collection {
 		if v == target {
@@ -34,184 +26,195 @@ func contains[T comparable](collection []T, target T) bool {
 	}
 	return false
 }
-func ParseSearchText(input string) SearchParams {
-	var searchParams SearchParams
-	var currentEntity strings.Builder
-	inEntity := false
-
-	// Split the input string by spaces, but preserve spaces within @[...]
-	parts := strings.Fields(input)
-
-	for i := 0; i < len(parts); i++ {
-		part := parts[i]
-
-		// Handle entity start
-		if strings.HasPrefix(part, "@[") {
-			inEntity = true
-			// Remove @[ prefix
-			currentEntity.WriteString(strings.TrimPrefix(part, "@["))
-
-			// If the entity name ends in this part
-			if strings.HasSuffix(part, "]") {
-				entityName := currentEntity.String()
-				entityName = strings.TrimSuffix(entityName, "]")
-				searchParams.Entities = append(searchParams.Entities, entityName)
-				currentEntity.Reset()
-				inEntity = false
-				continue
-			}
-			continue
-		}
-
-		// Handle entity start with negation
-		if strings.HasPrefix(part, "!@[") {
-			inEntity = true
-			// Remove !@[ prefix
-			currentEntity.WriteString(strings.TrimPrefix(part, "!@["))
-
-			// If the entity name ends in this part
-			if strings.HasSuffix(part, "]") {
-				entityName := currentEntity.String()
-				entityName = strings.TrimSuffix(entityName, "]")
-				searchParams.NegateEntities = append(searchParams.NegateEntities, entityName)
-				currentEntity.Reset()
-				inEntity = false
-				continue
-			}
-			continue
-		}
 
-		// Handle middle or end of entity name
-		if inEntity {
-			if strings.HasSuffix(part, "]") {
-				currentEntity.WriteString(" ")
-				currentEntity.WriteString(strings.TrimSuffix(part, "]"))
-				entityName := currentEntity.String()
-				if strings.HasPrefix(parts[i-1], "!") {
-					searchParams.NegateEntities = append(searchParams.NegateEntities, entityName)
-				} else {
-					searchParams.Entities = append(searchParams.Entities, entityName)
-				}
-				currentEntity.Reset()
-				inEntity = false
-				continue
-			}
-			currentEntity.WriteString(" ")
-			currentEntity.WriteString(part)
-			continue
-		}
+// SEARCH_LANGUAGE is the text search configuration used to build
+// cards.search_vector. Queries must use the same one to match it.
+const SEARCH_LANGUAGE = "english"
 
-		// Handle existing conditions
-		if strings.HasPrefix(part, "#") {
-			searchParams.Tags = append(searchParams.Tags, strings.TrimPrefix(part, "#"))
-		} else if strings.HasPrefix(part, "!#") {
-			searchParams.NegateTags = append(searchParams.NegateTags, strings.TrimPrefix(part, "!#"))
-		} else if strings.HasPrefix(part, "!") {
-			searchParams.NegateTerms = append(searchParams.NegateTerms, strings.TrimPrefix(part, "!"))
-		} else {
-			searchParams.Terms = append(searchParams.Terms, part)
-		}
-	}
+const SEARCH_HEADLINE_OPTIONS = "StartSel=**, StopSel=**, MaxWords=35, MinWords=15, MaxFragments=2"
 
-	return searchParams
+// escapeLikePattern escapes the LIKE metacharacters in a user supplied term so
+// that it only ever matches literally.
+func escapeLikePattern(term string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return replacer.Replace(term)
 }
-func BuildPartialCardSqlSearchTermString(searchString string, fullText bool) string {
-	searchParams := ParseSearchText(searchString)
 
-	var result string
-	var termConditions []string
-	var tagConditions []string
-	var negateTagsConditions []string
-	var excludeTerms []string
-	var entityConditions []string
-	var negateEntityConditions []string
-
-	// Add conditions for terms that search both card_id and title
-	for _, term := range searchParams.Terms {
-		// Use ILIKE for case-insensitive pattern matching
-		var termCondition string
-		if fullText {
-			termCondition = fmt.Sprintf("(card_id ILIKE '%%%s%%' OR title ILIKE '%%%s%%' OR body ILIKE '%%%s%%')", term, term, term)
+// searchQueryBuilder collects conditions and the positional arguments they
+// refer to. Placeholders continue numbering after the arguments the caller
+// already has, so the fragment can be appended to an existing query.
+type searchQueryBuilder struct {
+	args []interface{}
+	// fuzzy matches terms by trigram similarity instead of full text
+	fuzzy bool
+	// filtersOnly leaves out the terms that are not negated, keeping the
+	// tags, entities, field filters and exclusions
+	filtersOnly bool
+	negated     bool
+}
 
-		} else {
-			termCondition = fmt.Sprintf("(card_id ILIKE '%%%s%%' OR title ILIKE '%%%s%%')", term, term)
+func (b *searchQueryBuilder) addArg(value interface{}) string {
+	b.args = append(b.args, value)
+	return "$" + strconv.Itoa(len(b.args))
+}
 
-		}
-		termConditions = append(termConditions, termCondition)
+// textSearchCondition matches the search_vector against a tsquery, or any of
+// the other conditions. Terms that are only stopwords, such as "the", compile
+// to an empty tsquery that matches nothing, so they are skipped instead: they
+// match every card, and under a negation they exclude none. Every condition
+// is one an index can answer, so that the planner can combine the indexes
+// instead of scanning all of the cards.
+func (b *searchQueryBuilder) textSearchCondition(tsquery string, conditions ...string) string {
+	match := strings.Join(append([]string{"cards.search_vector @@ " + tsquery}, conditions...), " OR ")
+	if b.negated {
+		return "(numnode(" + tsquery + ") > 0 AND (" + match + "))"
 	}
+	return "(numnode(" + tsquery + ") = 0 OR " + match + ")"
+}
 
-	for _, term := range searchParams.NegateTerms {
-		var excludeCondition string
-		if fullText {
-			excludeCondition = fmt.Sprintf("NOT (card_id ILIKE '%%%s%%' OR title ILIKE '%%%s%%' OR body ILIKE '%%%s%%')", term, term, term)
-		} else {
-			excludeCondition = fmt.Sprintf("NOT (card_id ILIKE '%%%s%%' OR title ILIKE '%%%s%%')", term, term)
-		}
-		excludeTerms = append(excludeTerms, excludeCondition)
+// termCondition matches a term against the card. Full text searches use the
+// search_vector column, with card_id and title still matched as substrings
+// since ids like 1/A do not survive tokenizing and titles are matched as
+// typed; the trigram indexes of schema/0042-trigram-search.sql cover those
+// substring matches. Terms are read as plain words, so a term like -foo is
+// not negated.
+func (b *searchQueryBuilder) termCondition(term string, fullText bool) string {
+	if b.filtersOnly && !b.negated {
+		return "TRUE"
 	}
-
-	// Add conditions for tags
-	for _, tag := range searchParams.Tags {
-		tagCondition := fmt.Sprintf(`EXISTS (
-            SELECT 1 FROM card_tags
-            JOIN tags ON card_tags.tag_id = tags.id
-            WHERE card_tags.card_pk = cards.id AND tags.name = '%s' AND tags.is_deleted = FALSE
-        )`, tag)
-		tagConditions = append(tagConditions, tagCondition)
+	if b.fuzzy {
+		return b.fuzzyCondition(term)
 	}
-	// Build SQL for tags that should NOT exist
-	for _, tag := range searchParams.NegateTags {
-		tagCondition := fmt.Sprintf(`NOT EXISTS (
+	if fullText {
+		tsquery := "plainto_tsquery('" + SEARCH_LANGUAGE + "', " + b.addArg(term) + ")"
+		pattern := b.addArg("%" + escapeLikePattern(term) + "%")
+		return b.textSearchCondition(tsquery, "cards.card_id ILIKE "+pattern, "cards.title ILIKE "+pattern)
+	}
+	placeholder := b.addArg("%" + escapeLikePattern(term) + "%")
+	return "(cards.card_id ILIKE " + placeholder + " OR cards.title ILIKE " + placeholder + ")"
+}
+
+func (b *searchQueryBuilder) tagCondition(tag string) string {
+	return `EXISTS (
             SELECT 1 FROM card_tags
             JOIN tags ON card_tags.tag_id = tags.id
-            WHERE card_tags.card_pk = cards.id AND tags.name = '%s' AND tags.is_deleted = FALSE
-        )`, tag)
-		negateTagsConditions = append(negateTagsConditions, tagCondition)
-	}
+            WHERE card_tags.card_pk = cards.id AND tags.name = ` + b.addArg(tag) + ` AND tags.is_deleted = FALSE
+        )`
+}
 
-	log.Printf("searchParams %v", searchParams.Entities)
-	// Add conditions for entities
-	for _, entity := range searchParams.Entities {
-		entityCondition := fmt.Sprintf(`EXISTS (
+func (b *searchQueryBuilder) entityCondition(entity string) string {
+	return `EXISTS (
             SELECT 1 FROM entity_card_junction ecj
             JOIN entities e ON ecj.entity_id = e.id
-            WHERE ecj.card_pk = cards.id AND e.name = '%s'
-        )`, entity)
-		entityConditions = append(entityConditions, entityCondition)
+            WHERE ecj.card_pk = cards.id AND e.name = ` + b.addArg(entity) + `
+        )`
+}
+
+func (b *searchQueryBuilder) phraseCondition(phrase string, fullText bool) string {
+	if b.filtersOnly && !b.negated {
+		return "TRUE"
+	}
+	if b.fuzzy {
+		return b.fuzzyCondition(phrase)
+	}
+	if fullText {
+		return b.textSearchCondition("phraseto_tsquery('" + SEARCH_LANGUAGE + "', " + b.addArg(phrase) + ")")
 	}
+	return "(cards.title ILIKE " + b.addArg("%"+escapeLikePattern(phrase)+"%") + ")"
+}
 
-	// Add conditions for negated entities
-	for _, entity := range searchParams.NegateEntities {
-		entityCondition := fmt.Sprintf(`NOT EXISTS (
-            SELECT 1 FROM entity_card_junction ecj
-            JOIN entities e ON ecj.entity_id = e.id
-            WHERE ecj.card_pk = cards.id AND e.name = '%s'
-        )`, entity)
-		negateEntityConditions = append(negateEntityConditions, entityCondition)
+// fuzzyCondition matches a term that is close to the card_id or to a word in
+// the title, which catches typos. It relies on the pg_trgm thresholds set by
+// withTrigramThreshold.
+func (b *searchQueryBuilder) fuzzyCondition(term string) string {
+	placeholder := b.addArg(term)
+	return "(cards.card_id % " + placeholder + " OR " + placeholder + " <% cards.title)"
+}
+
+// compileSearchQuery turns a parsed query into a WHERE clause fragment over
+// the cards table. The fragment starts with " AND " when it is not empty, and
+// its placeholders are numbered after the given args. The returned args are
+// the given args followed by the values for the fragment.
+func compileSearchQuery(node SearchNode, fullText bool, args []interface{}) (string, []interface{}) {
+	builder := searchQueryBuilder{args: append([]interface{}{}, args...)}
+	if node == nil {
+		return "", builder.args
 	}
+	return " AND " + node.compile(&builder, fullText), builder.args
+}
 
-	if len(tagConditions) > 0 {
-		result = " AND (" + strings.Join(tagConditions, " AND ") + ")"
+// compileSearchFilters is compileSearchQuery without the search terms, so
+// that searches which do not match on words, such as the vector search, can
+// still honour the rest of the query.
+func compileSearchFilters(node SearchNode, args []interface{}) (string, []interface{}) {
+	builder := searchQueryBuilder{args: append([]interface{}{}, args...), filtersOnly: true}
+	if node == nil {
+		return "", builder.args
 	}
+	return " AND " + node.compile(&builder, true), builder.args
+}
 
-	if len(termConditions) > 0 {
-		result += " AND (" + strings.Join(termConditions, " AND ") + ")"
+// hasSearchFilters reports whether the query has anything besides terms
+// that all have to match.
+func hasSearchFilters(node SearchNode) bool {
+	switch n := node.(type) {
+	case *searchAndNode:
+		for _, child := range n.Children {
+			if hasSearchFilters(child) {
+				return true
+			}
+		}
+		return false
+	case *searchOrNode:
+		for _, child := range n.Children {
+			if hasSearchFilters(child) {
+				return true
+			}
+		}
+		return false
+	case *searchTermNode, nil:
+		return false
 	}
-	if len(excludeTerms) > 0 {
-		excludeClause := strings.Join(excludeTerms, " AND ")
-		result += " AND (" + excludeClause + ")"
+	return true
+}
+
+// searchFilterCardPKs returns the cards allowed by the query's filters, or
+// nil when it has none.
+func (s *Handler) searchFilterCardPKs(userID int, node SearchNode) ([]int, error) {
+	if !hasSearchFilters(node) {
+		return nil, nil
 	}
-	if len(negateTagsConditions) > 0 {
-		negateTagClause := strings.Join(negateTagsConditions, " AND ")
-		result += " AND (" + negateTagClause + ")"
+	filterString, args := compileSearchFilters(node, []interface{}{userID})
+	rows, err := s.DB.Query(`
+		SELECT cards.id FROM cards
+		WHERE cards.user_id = $1 AND cards.is_deleted = FALSE`+filterString, args...)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, err
 	}
-	if len(entityConditions) > 0 {
-		result += " AND (" + strings.Join(entityConditions, " AND ") + ")"
+	defer rows.Close()
+
+	cardPKs := []int{}
+	for rows.Next() {
+		var cardPK int
+		if err := rows.Scan(&cardPK); err != nil {
+			log.Printf("err %v", err)
+			return nil, err
+		}
+		cardPKs = append(cardPKs, cardPK)
 	}
-	if len(negateEntityConditions) > 0 {
-		result += " AND (" + strings.Join(negateEntityConditions, " AND ") + ")"
+	return cardPKs, rows.Err()
+}
+
+// BuildPartialCardSqlSearchQuery parses the search string and compiles it
+// with compileSearchQuery. Parse errors are returned as *SearchQueryError.
+func BuildPartialCardSqlSearchQuery(searchString string, fullText bool, args []interface{}) (string, []interface{}, error) {
+	node, err := ParseSearchQuery(searchString)
+	if err != nil {
+		return "", args, err
 	}
-	return result
+	searchSql, searchArgs := compileSearchQuery(node, fullText, args)
+	return searchSql, searchArgs, nil
 }
 
 func (s *Handler) GetRelatedChunksFromEntity(userID int, embedding pgvector.Vector) ([]models.CardChunk, error) {
@@ -232,6 +235,7 @@ FROM
     INNER JOIN cards c ON ecj.card_pk = c.id
 WHERE
     e.user_id = $1
+    AND e.embedding_model = $3
     AND c.is_deleted = FALSE
 GROUP BY
     c.id,
@@ -247,7 +251,7 @@ LIMIT 50;
 `
 	var rows *sql.Rows
 	var err error
-	rows, err = s.DB.Query(query, userID, embedding)
+	rows, err = s.DB.Query(query, userID, embedding, llms.ActiveEmbeddingModel(s.Server.LLMClient))
 	if err != nil {
 		log.Printf("err related chunks %v", err)
 		return []models.CardChunk{}, err
@@ -272,8 +276,25 @@ LIMIT 50;
 
 }
 
+// GetRelatedCards returns the chunks closest to the embedding, scored with
+// the default ranking.
 func (s *Handler) GetRelatedCards(userID int, embedding pgvector.Vector) ([]models.CardChunk, error) {
-	// Combine results from both semantic and entity-based searches
+	return s.QueryRelatedCards(userID, embedding, models.DefaultRankingConfig())
+}
+
+// QueryRelatedCards scores the ranking.CandidateCount chunks closest to the
+// embedding, or all of them, by blending their distance with the entities of their card, and
+// returns the best ranking.ResultLimit with an explanation of their score.
+func (s *Handler) QueryRelatedCards(userID int, embedding pgvector.Vector, ranking models.RankingConfig) ([]models.CardChunk, error) {
+	return s.QueryRelatedCardsIn(userID, embedding, ranking, nil)
+}
+
+// QueryRelatedCardsIn is QueryRelatedCards over only the given cards, or
+// over every card when cardPKs is nil.
+func (s *Handler) QueryRelatedCardsIn(userID int, embedding pgvector.Vector, ranking models.RankingConfig, cardPKs []int) ([]models.CardChunk, error) {
+	if err := ranking.Validate(); err != nil {
+		return []models.CardChunk{}, err
+	}
 	query := `
 	WITH semantic_scores AS (
 		SELECT 
@@ -282,6 +303,7 @@ func (s *Handler) GetRelatedCards(userID int, embedding pgvector.Vector) ([]mode
 			c.user_id,
 			c.title,
 			cc.chunk_text as chunk,
+			cc.chunk_id,
 			c.created_at,
 			c.updated_at,
 			c.parent_id,
@@ -292,15 +314,21 @@ func (s *Handler) GetRelatedCards(userID int, embedding pgvector.Vector) ([]mode
 			INNER JOIN card_chunks cc ON ce.card_pk = cc.card_pk AND ce.chunk = cc.chunk_id
 		WHERE 
 			ce.user_id = $1 
+			AND ce.model = $8
 			AND c.is_deleted = FALSE
+			AND ($9::int[] IS NULL OR c.id = ANY($9::int[]))
 		GROUP BY 
-			c.id, c.card_id, c.user_id, c.title, cc.chunk_text, c.created_at, c.updated_at, c.parent_id
+			c.id, c.card_id, c.user_id, c.title, cc.chunk_text, cc.chunk_id, c.created_at, c.updated_at, c.parent_id
+		ORDER BY
+			semantic_score ASC
+		LIMIT NULLIF($3, 0)
 	),
 	entity_scores AS (
 		SELECT 
 			c.id,
 			COUNT(DISTINCT e.id) as shared_entities,
-			AVG(e.embedding <=> $2) as entity_similarity
+			AVG(e.embedding <=> $2) FILTER (WHERE e.embedding_model = $8) as entity_similarity,
+			ARRAY_AGG(DISTINCT e.name) FILTER (WHERE e.name IS NOT NULL) as entity_names
 		FROM 
 			cards c
 			INNER JOIN entity_card_junction ecj ON c.id = ecj.card_pk
@@ -308,148 +336,404 @@ func (s *Handler) GetRelatedCards(userID int, embedding pgvector.Vector) ([]mode
 		WHERE 
 			c.user_id = $1 
 			AND c.is_deleted = FALSE
+			AND c.id IN (SELECT id FROM semantic_scores)
 		GROUP BY 
 			c.id
+	),
+	components AS (
+		SELECT 
+			s.*,
+			COALESCE(es.shared_entities, 0) as shared_entities,
+			COALESCE(es.entity_similarity, 1) as entity_similarity,
+			COALESCE(es.entity_names, ARRAY[]::text[]) as entity_names,
+			$4 * (1 - LEAST(s.semantic_score, 1)) as semantic_component,
+			$5 * (1 - LEAST(COALESCE(es.entity_similarity, 1), 1)) as entity_component,
+			$6 * (LEAST(COALESCE(es.shared_entities, 0) / 5.0, 1)) as shared_component
+		FROM 
+			semantic_scores s
+			LEFT JOIN entity_scores es ON s.id = es.id
 	)
-	SELECT 
-		s.*,
-		COALESCE(es.shared_entities, 0) as shared_entities,
-		COALESCE(es.entity_similarity, 1) as entity_similarity,
-		(
-			0.4 * (1 - LEAST(s.semantic_score, 1)) + 
-			0.4 * (1 - LEAST(COALESCE(es.entity_similarity, 1), 1)) +
-			0.2 * (LEAST(COALESCE(es.shared_entities, 0) / 5.0, 1))
-		) as combined_score
-	FROM 
-		semantic_scores s
-		LEFT JOIN entity_scores es ON s.id = es.id
+	SELECT
+		id, card_id, user_id, title, chunk, chunk_id, created_at, updated_at, parent_id,
+		semantic_score, shared_entities, entity_similarity, entity_names,
+		semantic_component, entity_component, shared_component,
+		semantic_component + entity_component + shared_component as combined_score
+	FROM
+		components
 	ORDER BY 
 		combined_score DESC
-	LIMIT 50;
+	LIMIT $7;
 	`
 
-	var rows *sql.Rows
-	var err error
-	rows, err = s.DB.Query(query, userID, embedding)
+	rows, err := s.DB.Query(query, userID, embedding, ranking.CandidateCount,
+		ranking.SemanticWeight, ranking.EntityWeight, ranking.SharedEntitiesWeight, ranking.ResultLimit,
+		llms.ActiveEmbeddingModel(s.Server.LLMClient), pq.Array(cardPKs))
 	if err != nil {
 		log.Printf("err %v", err)
 		return []models.CardChunk{}, err
 	}
+	defer rows.Close()
 
-	cards, err := models.ScanCardChunks(rows)
-	log.Printf("err %v", err)
+	cards := []models.CardChunk{}
+	for rows.Next() {
+		var card models.CardChunk
+		var explanation models.RankingExplanation
+		if err := rows.Scan(
+			&card.ID,
+			&card.CardID,
+			&card.UserID,
+			&card.Title,
+			&card.Chunk,
+			&explanation.ChunkID,
+			&card.CreatedAt,
+			&card.UpdatedAt,
+			&card.ParentID,
+			&explanation.Distance,
+			&card.SharedEntities,
+			&card.EntitySimilarity,
+			pq.Array(&explanation.SharedEntities),
+			&explanation.SemanticScore,
+			&explanation.EntityScore,
+			&explanation.SharedEntityScore,
+			&card.CombinedScore,
+		); err != nil {
+			log.Printf("err %v", err)
+			return cards, err
+		}
+		explanation.Chunk = card.Chunk
+		explanation.EntitySimilarity = card.EntitySimilarity
+		explanation.CombinedScore = card.CombinedScore
+		card.Explanation = &explanation
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
 
-	return cards, err
+type classicSearchResult struct {
+	Card    models.Card
+	Rank    float64
+	Preview string
+	// Fuzzy is set when the result came from the trigram fallback
+	Fuzzy bool
 }
 
-func (s *Handler) ClassicSearch(userID int, searchTerm string) ([]models.Card, error) {
-	searchString := BuildPartialCardSqlSearchTermString(searchTerm, true)
+// searchRankQuery is the websearch_to_tsquery text the results are ranked
+// and highlighted against. Any matching term counts towards the rank, and
+// tags, entities and filters are left out.
+func searchRankQuery(node SearchNode) string {
+	return strings.Join(searchRankTerms(node), " or ")
+}
+
+func (s *Handler) queryClassicSearch(userID int, searchTerm string) ([]classicSearchResult, error) {
+	node, err := ParseSearchQuery(searchTerm)
+	if err != nil {
+		return nil, err
+	}
+	searchString, args := compileSearchQuery(node, true, []interface{}{userID, searchRankQuery(node), SEARCH_HEADLINE_OPTIONS})
 	query := `
 		SELECT 
-			c.id, c.card_id, c.user_id, c.title, c.body, c.link, c.parent_id, c.created_at, c.updated_at
-		FROM cards c
-		WHERE c.user_id = $1 AND c.is_deleted = FALSE` + searchString
+			cards.id, cards.card_id, cards.user_id, cards.title, cards.body, cards.link,
+			cards.parent_id, cards.created_at, cards.updated_at,
+			ts_rank_cd(cards.search_vector, websearch_to_tsquery('` + SEARCH_LANGUAGE + `', $2)) AS rank,
+			CASE WHEN $2 = '' THEN LEFT(cards.body, 300)
+			ELSE ts_headline('` + SEARCH_LANGUAGE + `', cards.body, websearch_to_tsquery('` + SEARCH_LANGUAGE + `', $2), $3)
+			END AS preview
+		FROM cards
+		WHERE cards.user_id = $1 AND cards.is_deleted = FALSE` + searchString + `
+		ORDER BY rank DESC, cards.updated_at DESC`
+
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, err
+	}
+	results, err := scanClassicSearchResults(rows)
+	if err != nil || len(results) > 0 || searchRankQuery(node) == "" {
+		return results, err
+	}
+	return s.queryFuzzyClassicSearch(userID, node)
+}
 
-	rows, err := s.DB.Query(query, userID)
+// queryFuzzyClassicSearch reruns a search that found nothing with its terms
+// matched by trigram similarity, so that a typo still finds the card. Tags,
+// entities and filters still apply exactly.
+func (s *Handler) queryFuzzyClassicSearch(userID int, node SearchNode) ([]classicSearchResult, error) {
+	builder := searchQueryBuilder{args: []interface{}{userID, searchEmbeddingText(node)}, fuzzy: true}
+	searchString := " AND " + node.compile(&builder, true)
+	query := `
+		SELECT 
+			cards.id, cards.card_id, cards.user_id, cards.title, cards.body, cards.link,
+			cards.parent_id, cards.created_at, cards.updated_at,
+			GREATEST(word_similarity($2, cards.title), similarity(cards.card_id, $2)) AS rank,
+			LEFT(cards.body, 300) AS preview
+		FROM cards
+		WHERE cards.user_id = $1 AND cards.is_deleted = FALSE` + searchString + `
+		ORDER BY rank DESC, cards.updated_at DESC`
+
+	var results []classicSearchResult
+	err := s.withTrigramThreshold(FUZZY_SEARCH_THRESHOLD, func(tx *sql.Tx) error {
+		rows, err := tx.Query(query, builder.args...)
+		if err != nil {
+			return err
+		}
+		results, err = scanClassicSearchResults(rows)
+		return err
+	})
 	if err != nil {
+		log.Printf("err %v", err)
 		return nil, err
 	}
+	for i := range results {
+		results[i].Fuzzy = true
+	}
+	return results, nil
+}
+
+// FUZZY_SEARCH_THRESHOLD is the trigram similarity a term needs to match in
+// the fuzzy fallback. For titles it is looser than the pg_trgm default word
+// similarity of 0.6, so that a single transposition in a short word still
+// matches; for card ids it is stricter than the default similarity of 0.3,
+// since short ids share trigrams with many unrelated ones.
+const FUZZY_SEARCH_THRESHOLD = 0.4
+
+// withTrigramThreshold runs fn in a transaction with the pg_trgm similarity
+// thresholds used by the % and <% operators set to threshold.
+func (s *Handler) withTrigramThreshold(threshold float64, fn func(tx *sql.Tx) error) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	setting := strconv.FormatFloat(threshold, 'f', 2, 64)
+	if _, err := tx.Exec("SET LOCAL pg_trgm.similarity_threshold = " + setting); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("SET LOCAL pg_trgm.word_similarity_threshold = " + setting); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func scanClassicSearchResults(rows *sql.Rows) ([]classicSearchResult, error) {
 	defer rows.Close()
 
-	return models.ScanCards(rows)
+	results := []classicSearchResult{}
+	for rows.Next() {
+		var result classicSearchResult
+		if err := rows.Scan(
+			&result.Card.ID,
+			&result.Card.CardID,
+			&result.Card.UserID,
+			&result.Card.Title,
+			&result.Card.Body,
+			&result.Card.Link,
+			&result.Card.ParentID,
+			&result.Card.CreatedAt,
+			&result.Card.UpdatedAt,
+			&result.Rank,
+			&result.Preview,
+		); err != nil {
+			log.Printf("err %v", err)
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
 }
 
-func (s *Handler) SemanticSearchCardsRoute(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
+// ClassicSearch returns the cards matching the search, best match first.
+func (s *Handler) ClassicSearch(userID int, searchTerm string) ([]models.Card, error) {
+	results, err := s.queryClassicSearch(userID, searchTerm)
+	if err != nil {
+		return nil, err
+	}
+	cards := make([]models.Card, len(results))
+	for i, result := range results {
+		cards[i] = result.Card
+	}
+	return cards, nil
+}
+
+// ClassicSearchResults is ClassicSearch with the rank as the score and a
+// highlighted snippet of the body as the preview.
+func (s *Handler) ClassicSearchResults(userID int, searchTerm string) ([]models.SearchResult, error) {
+	results, err := s.queryClassicSearch(userID, searchTerm)
+	if err != nil {
+		return nil, err
+	}
+	searchResults := make([]models.SearchResult, len(results))
+	for i, result := range results {
+		searchResults[i] = models.SearchResult{
+			ID:        result.Card.CardID,
+			Type:      "card",
+			Title:     result.Card.Title,
+			Preview:   result.Preview,
+			Score:     result.Rank,
+			CreatedAt: result.Card.CreatedAt,
+			UpdatedAt: result.Card.UpdatedAt,
+			Metadata: map[string]interface{}{
+				"id":        result.Card.ID,
+				"parent_id": result.Card.ParentID,
+				"fuzzy":     result.Fuzzy,
+			},
+		}
+	}
+	return searchResults, nil
+}
 
+func (s *Handler) SemanticSearchCardsRoute(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("current_user").(int)
 	searchTerm := r.URL.Query().Get("search_term")
 	searchType := r.URL.Query().Get("type")
+	types, err := parseSearchTypes(r.URL.Query().Get("types"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	if searchType == "classic" {
-		// Handle classic search using shared function
-		cards, err := s.ClassicSearch(userID, searchTerm)
+		var searchResults []models.SearchResult
+		if onlyCards(types) {
+			searchResults, err = s.ClassicSearchResults(userID, searchTerm)
+		} else {
+			searchResults, err = s.UnifiedSearch(userID, searchTerm, types)
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeSearchError(w, err)
 			return
 		}
 
-		// Convert to SearchResults
-		searchResults := make([]models.SearchResult, len(cards))
-		for i, card := range cards {
-			searchResults[i] = models.SearchResult{
-				ID:        card.CardID,
-				Type:      "card",
-				Title:     card.Title,
-				Preview:   card.Body,
-				Score:     1.0, // Classic search doesn't have scoring
-				CreatedAt: card.CreatedAt,
-				UpdatedAt: card.UpdatedAt,
-				Metadata: map[string]interface{}{
-					"id":        card.ID,
-					"parent_id": card.ParentID,
-				},
-			}
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(searchResults)
+		s.writeSearchResults(w, r, userID, searchResults)
 		return
 	}
 
-	// Handle semantic search (existing code)
-	chunk := models.CardChunk{
-		Chunk: searchTerm,
+	// other types are only ranked by full text, so they cannot be mixed
+	// into semantic results
+	if !onlyCards(types) {
+		http.Error(w, "types other than card are only supported by classic search", http.StatusBadRequest)
+		return
 	}
 
-	embeddings, err := llms.GenerateChunkEmbeddings(chunk, true)
-	elapsed := time.Since(start)
-	start = time.Now()
-	fmt.Printf("embedding took %.2f seconds\n", elapsed.Seconds())
-
+	ranking, err := s.requestRankingConfig(userID, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if len(embeddings) == 0 {
-		http.Error(w, "search query not entered", http.StatusBadRequest)
+
+	if searchType == "hybrid" {
+		rerank := r.URL.Query().Get("rerank") != "false"
+		searchResults, err := s.HybridSearchResults(userID, searchTerm, ranking, rerank)
+		if err != nil {
+			writeSearchError(w, err)
+			return
+		}
+
+		s.writeSearchResults(w, r, userID, searchResults)
 		return
 	}
-	relatedCards, err := s.GetRelatedCards(userID, embeddings[0])
+
+	searchResults, err := s.SemanticSearchResults(userID, searchTerm, ranking)
 	if err != nil {
+		if err == errEmptySearch {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	elapsed = time.Since(start)
-	fmt.Printf("related cards took %.2f seconds\n", elapsed.Seconds())
 
-	start = time.Now()
+	s.writeSearchResults(w, r, userID, searchResults)
+}
 
-	scores, err := llms.RerankResults(s.Server.LLMClient, searchTerm, relatedCards)
+// writeSearchResults writes the results as a list, or with facets=true as an
+// object holding the results and their facets.
+func (s *Handler) writeSearchResults(w http.ResponseWriter, r *http.Request, userID int, searchResults []models.SearchResult) {
+	if r.URL.Query().Get("facets") != "true" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(searchResults)
+		return
+	}
+
+	facets, err := s.QuerySearchFacets(userID, searchResults)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	for i, score := range scores {
-		if i == len(scores)-1 {
-			break
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.FacetedSearchResults{Results: searchResults, Facets: facets})
+}
+
+// rerankCardChunks scores the cards with the reranker, stores the score as
+// their ranking and sorts them by it. It reports whether the cards were
+// reranked; on failure they are returned in their original order.
+func (s *Handler) rerankCardChunks(query string, cards []models.CardChunk) ([]models.CardChunk, bool) {
+	if len(cards) == 0 {
+		return cards, false
+	}
+	scores, err := s.Server.Reranker.Rerank(query, cards)
+	if err != nil {
+		log.Printf("rerank error, keeping the original order: %v", err)
+		return cards, false
+	}
+	for i := range cards {
+		cards[i].Ranking = scores[i]
+		if cards[i].Explanation != nil {
+			rerankerScore := scores[i]
+			cards[i].Explanation.RerankerScore = &rerankerScore
 		}
-		relatedCards[i].Ranking = score
 	}
-	sort.Slice(relatedCards, func(i, j int) bool {
-		return relatedCards[i].Ranking > relatedCards[j].Ranking
+	sort.SliceStable(cards, func(i, j int) bool {
+		return cards[i].Ranking > cards[j].Ranking
 	})
+	return cards, true
+}
+
+var errEmptySearch = errors.New("search query not entered")
+
+// SemanticSearchResults embeds the search term, finds the closest cards with
+// the given ranking and reranks them with the LLM.
+func (s *Handler) SemanticSearchResults(userID int, searchTerm string, ranking models.RankingConfig) ([]models.SearchResult, error) {
+	start := time.Now()
+
+	chunk := models.CardChunk{
+		Chunk: searchTerm,
+	}
+
+	embeddings, err := llms.GenerateChunkEmbeddings(s.Server.LLMClient, chunk, true)
+	elapsed := time.Since(start)
+	start = time.Now()
+	log.Printf("embedding took %.2f seconds", elapsed.Seconds())
+
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) == 0 {
+		return nil, errEmptySearch
+	}
+	relatedCards, err := s.QueryRelatedCards(userID, embeddings[0], ranking)
+	if err != nil {
+		return nil, err
+	}
 	elapsed = time.Since(start)
-	fmt.Printf("reranking cards took %.2f seconds\n", elapsed.Seconds())
+	log.Printf("related cards took %.2f seconds", elapsed.Seconds())
+
+	if s.rerankingEnabled() {
+		start = time.Now()
+		relatedCards, _ = s.rerankCardChunks(searchTerm, relatedCards)
+		elapsed = time.Since(start)
+		log.Printf("reranking cards took %.2f seconds", elapsed.Seconds())
+	}
 
 	// Convert CardChunks to SearchResults
 	searchResults := make([]models.SearchResult, len(relatedCards))
 	for i, card := range relatedCards {
 		searchResults[i] = models.CardChunkToSearchResult(card)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(searchResults)
+	return searchResults, nil
 }
 
 func (s *Handler) GetRelatedCardsRoute(w http.ResponseWriter, r *http.Request) {
@@ -468,8 +752,8 @@ func (s *Handler) GetRelatedCardsRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var embedding pgvector.Vector
-	query := "SELECT avg(embedding) FROM card_embeddings WHERE card_pk = $1"
-	err = s.DB.QueryRow(query, originalCard.ID).Scan(&embedding)
+	query := "SELECT avg(embedding) FROM card_embeddings WHERE card_pk = $1 AND model = $2"
+	err = s.DB.QueryRow(query, originalCard.ID, llms.ActiveEmbeddingModel(s.Server.LLMClient)).Scan(&embedding)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
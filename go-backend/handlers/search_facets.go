@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"go-backend/models"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// MAX_FACET_VALUES is the number of values returned for each facet, most
+// common first.
+const MAX_FACET_VALUES = 20
+
+// searchResultCardPKs returns the primary keys of the cards in the results.
+func searchResultCardPKs(results []models.SearchResult) []int {
+	var cardPKs []int
+	for _, result := range results {
+		if result.Type != "card" {
+			continue
+		}
+		metadata, ok := result.Metadata.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if id, ok := metadata["id"].(int); ok {
+			cardPKs = append(cardPKs, id)
+		}
+	}
+	return cardPKs
+}
+
+// quoteFilterValue quotes a filter value when it would otherwise end the
+// filter early.
+func quoteFilterValue(value string) string {
+	if strings.ContainsAny(value, " \t\n()") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// facetFilter returns filter if it parses on its own, and an empty string for
+// values the query language cannot express, such as an entity with a "]" in
+// its name.
+func facetFilter(filter string) string {
+	if _, err := ParseSearchQuery(filter); err != nil {
+		return ""
+	}
+	return filter
+}
+
+func tagFacetFilter(name string) string {
+	if strings.ContainsAny(name, " \t\n()\"") {
+		return ""
+	}
+	return facetFilter("#" + name)
+}
+
+func entityFacetFilter(name string) string {
+	if strings.Contains(name, "]") {
+		return ""
+	}
+	return facetFilter("@[" + name + "]")
+}
+
+func entityTypeFacetFilter(entityType string) string {
+	if strings.Contains(entityType, `"`) {
+		return ""
+	}
+	return facetFilter("type:" + quoteFilterValue(entityType))
+}
+
+func branchFacetFilter(branch string) string {
+	if strings.ContainsAny(branch, " \t\n()\"") {
+		return ""
+	}
+	return facetFilter("branch:" + branch)
+}
+
+func yearFacetFilter(year int) string {
+	return "created:>=" + strconv.Itoa(year) + "-01-01 created:<" + strconv.Itoa(year+1) + "-01-01"
+}
+
+// The queries below take the user id, the card primary keys and the maximum
+// number of values, and select value, label and the number of cards.
+var facetQueries = map[string]string{
+	"tags": `
+	SELECT tags.name, tags.name, COUNT(DISTINCT card_tags.card_pk) AS count
+	FROM card_tags
+	JOIN tags ON card_tags.tag_id = tags.id
+	WHERE tags.user_id = $1 AND tags.is_deleted = FALSE AND card_tags.card_pk = ANY($2)
+	GROUP BY tags.name
+	ORDER BY count DESC, tags.name ASC
+	LIMIT $3`,
+	"entities": `
+	SELECT e.name, COALESCE(MAX(e.type), ''), COUNT(DISTINCT ecj.card_pk) AS count
+	FROM entity_card_junction ecj
+	JOIN entities e ON ecj.entity_id = e.id
+	WHERE e.user_id = $1 AND ecj.card_pk = ANY($2)
+	GROUP BY e.name
+	ORDER BY count DESC, e.name ASC
+	LIMIT $3`,
+	"entity_types": `
+	SELECT LOWER(e.type), LOWER(e.type), COUNT(DISTINCT ecj.card_pk) AS count
+	FROM entity_card_junction ecj
+	JOIN entities e ON ecj.entity_id = e.id
+	WHERE e.user_id = $1 AND ecj.card_pk = ANY($2) AND COALESCE(e.type, '') <> ''
+	GROUP BY LOWER(e.type)
+	ORDER BY count DESC, LOWER(e.type) ASC
+	LIMIT $3`,
+	"branches": `
+	SELECT branch, branch, COUNT(*) AS count
+	FROM (
+		SELECT regexp_replace(cards.card_id, '[/.].*$', '') AS branch
+		FROM cards
+		WHERE cards.user_id = $1 AND cards.id = ANY($2)
+	) branches
+	WHERE branch <> ''
+	GROUP BY branch
+	ORDER BY count DESC, branch ASC
+	LIMIT $3`,
+	"years": `
+	SELECT EXTRACT(YEAR FROM cards.created_at)::int::text AS year, EXTRACT(YEAR FROM cards.created_at)::int::text, COUNT(*) AS count
+	FROM cards
+	WHERE cards.user_id = $1 AND cards.id = ANY($2)
+	GROUP BY year
+	ORDER BY year DESC
+	LIMIT $3`,
+}
+
+func (s *Handler) queryFacet(userID int, facet string, cardPKs []int) ([]models.SearchFacet, error) {
+	facets := []models.SearchFacet{}
+	rows, err := s.DB.Query(facetQueries[facet], userID, pq.Array(cardPKs), MAX_FACET_VALUES)
+	if err != nil {
+		log.Printf("err %v", err)
+		return facets, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value models.SearchFacet
+		if err := rows.Scan(&value.Value, &value.Label, &value.Count); err != nil {
+			log.Printf("err %v", err)
+			return facets, err
+		}
+		switch facet {
+		case "tags":
+			value.Filter = tagFacetFilter(value.Value)
+		case "entities":
+			value.Filter = entityFacetFilter(value.Value)
+		case "entity_types":
+			value.Filter = entityTypeFacetFilter(value.Value)
+		case "branches":
+			value.Filter = branchFacetFilter(value.Value)
+		case "years":
+			year, _ := strconv.Atoi(value.Value)
+			value.Filter = yearFacetFilter(year)
+		}
+		facets = append(facets, value)
+	}
+	return facets, rows.Err()
+}
+
+// QuerySearchFacets counts the tags, entities, entity types, top level
+// branches and creation years of the cards in the results. Results that are
+// not cards are ignored.
+func (s *Handler) QuerySearchFacets(userID int, results []models.SearchResult) (models.SearchFacets, error) {
+	facets := models.SearchFacets{
+		Tags:        []models.SearchFacet{},
+		Entities:    []models.SearchFacet{},
+		EntityTypes: []models.SearchFacet{},
+		Branches:    []models.SearchFacet{},
+		Years:       []models.SearchFacet{},
+	}
+	cardPKs := searchResultCardPKs(results)
+	if len(cardPKs) == 0 {
+		return facets, nil
+	}
+
+	var err error
+	targets := map[string]*[]models.SearchFacet{
+		"tags":         &facets.Tags,
+		"entities":     &facets.Entities,
+		"entity_types": &facets.EntityTypes,
+		"branches":     &facets.Branches,
+		"years":        &facets.Years,
+	}
+	for facet, target := range targets {
+		if *target, err = s.queryFacet(userID, facet, cardPKs); err != nil {
+			return facets, err
+		}
+	}
+	return facets, nil
+}
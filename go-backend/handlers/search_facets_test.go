@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/json"
+	"go-backend/models"
+	"go-backend/tests"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFacetFilters(t *testing.T) {
+	testCases := []struct {
+		filter   string
+		expected string
+	}{
+		{tagFacetFilter("to-read"), "#to-read"},
+		{entityFacetFilter("John Smith"), "@[John Smith]"},
+		{entityFacetFilter("odd ] name"), ""},
+		{entityTypeFacetFilter("person"), "type:person"},
+		{entityTypeFacetFilter("art work"), `type:"art work"`},
+		{branchFacetFilter("12"), "branch:12"},
+		{yearFacetFilter(2024), "created:>=2024-01-01 created:<2025-01-01"},
+	}
+	for _, tc := range testCases {
+		if tc.filter != tc.expected {
+			t.Errorf("wrong filter, got %q want %q", tc.filter, tc.expected)
+		}
+		if tc.filter == "" {
+			continue
+		}
+		if _, err := ParseSearchQuery(tc.filter); err != nil {
+			t.Errorf("filter %q should parse: %v", tc.filter, err)
+		}
+	}
+}
+
+func TestBranchAndTypeFilters(t *testing.T) {
+	output, args, err := BuildPartialCardSqlSearchQuery("branch:1_2 type:Person", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "AND((cards.card_id=$1ORcards.card_idLIKE$2ORcards.card_idLIKE$3)ANDEXISTS(SELECT1FROMentity_card_junctionecjJOINentitieseONecj.entity_id=e.idWHEREecj.card_pk=cards.idANDLOWER(e.type)=LOWER($4)))"
+	if normalizeSql(output) != expected {
+		t.Errorf("wrong string returned, got %v", normalizeSql(output))
+	}
+	if !reflect.DeepEqual(args, []interface{}{"1_2", `1\_2/%`, `1\_2.%`, "Person"}) {
+		t.Errorf("wrong args returned, got %v", args)
+	}
+
+	if _, err := ParseSearchQuery("branch:1/A"); err == nil {
+		t.Errorf("expected an error for a branch below the top level")
+	}
+}
+
+func TestSearchResultCardPKs(t *testing.T) {
+	results := []models.SearchResult{
+		{Type: "card", Metadata: map[string]interface{}{"id": 4}},
+		{Type: "task", Metadata: map[string]interface{}{"card_pk": int64(5)}},
+		{Type: "card", Metadata: map[string]interface{}{"id": 6}},
+	}
+	if pks := searchResultCardPKs(results); !reflect.DeepEqual(pks, []int{4, 6}) {
+		t.Errorf("wrong card pks, got %v", pks)
+	}
+}
+
+func TestQuerySearchFacets(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	for _, cardID := range []string{"300", "300/A", "301"} {
+		_, err := s.CreateCard(1, models.EditCardParams{CardID: cardID, Title: "faceted", Body: "#facetcheck"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := s.ClassicSearchResults(1, "#facetcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	facets, err := s.QuerySearchFacets(1, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTags := []models.SearchFacet{{Value: "facetcheck", Label: "facetcheck", Count: 3, Filter: "#facetcheck"}}
+	if !reflect.DeepEqual(facets.Tags, expectedTags) {
+		t.Errorf("wrong tag facets, got %+v", facets.Tags)
+	}
+	expectedBranches := []models.SearchFacet{
+		{Value: "300", Label: "300", Count: 2, Filter: "branch:300"},
+		{Value: "301", Label: "301", Count: 1, Filter: "branch:301"},
+	}
+	if !reflect.DeepEqual(facets.Branches, expectedBranches) {
+		t.Errorf("wrong branch facets, got %+v", facets.Branches)
+	}
+	year := strconv.Itoa(time.Now().Year())
+	if len(facets.Years) != 1 || facets.Years[0].Value != year || facets.Years[0].Count != 3 {
+		t.Errorf("wrong year facets, got %+v", facets.Years)
+	}
+
+	// every facet narrows the search to the cards it counted
+	for _, facet := range append(facets.Branches, facets.Years...) {
+		narrowed, err := s.ClassicSearchResults(1, "#facetcheck "+facet.Filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(narrowed) != facet.Count {
+			t.Errorf("filter %q found %v cards, want %v", facet.Filter, len(narrowed), facet.Count)
+		}
+	}
+}
+
+func TestQuerySearchFacetsEntities(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	results := []models.SearchResult{
+		{Type: "card", Metadata: map[string]interface{}{"id": 1}},
+		{Type: "card", Metadata: map[string]interface{}{"id": 2}},
+	}
+	facets, err := s.QuerySearchFacets(1, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(facets.Entities) == 0 || facets.Entities[0].Filter != "@["+facets.Entities[0].Value+"]" {
+		t.Errorf("wrong entity facets, got %+v", facets.Entities)
+	}
+	if len(facets.EntityTypes) != 1 || facets.EntityTypes[0].Value != "person" || facets.EntityTypes[0].Filter != "type:person" {
+		t.Errorf("wrong entity type facets, got %+v", facets.EntityTypes)
+	}
+
+	narrowed, err := s.ClassicSearchResults(1, "type:person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(narrowed) != facets.EntityTypes[0].Count {
+		t.Errorf("type filter found %v cards, want %v", len(narrowed), facets.EntityTypes[0].Count)
+	}
+}
+
+func TestSearchRouteWithFacets(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	token, _ := tests.GenerateTestJWT(1)
+	req, _ := http.NewRequest("GET", "/api/search?type=classic&search_term=test&facets=true", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.JwtMiddleware(s.SemanticSearchCardsRoute)).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var response models.FacetedSearchResults
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) == 0 {
+		t.Fatalf("expected results")
+	}
+	total := 0
+	for _, year := range response.Facets.Years {
+		total += year.Count
+	}
+	if total != len(response.Results) {
+		t.Errorf("year facets should cover every result, got %v want %v", total, len(response.Results))
+	}
+}
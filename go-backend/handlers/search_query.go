@@ -0,0 +1,584 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The search query language:
+//
+//	hello world          cards matching both terms
+//	"exact phrase"       words in this order
+//	a OR b               either side; binds looser than the implicit AND
+//	(a OR b) c           groups
+//	!term, !#tag, !(..)  negation of any expression
+//	#tag, @[entity]      tag and entity filters
+//	field:value          title:, id:, created:, updated:, has:, is:, parent:, link:,
+//	                     branch:, type:
+//
+// Queries are tokenized, parsed into a tree of SearchNodes and compiled into
+// a parameterized WHERE clause fragment.
+
+type SearchQueryError struct {
+	Message  string
+	Position int
+}
+
+func (e *SearchQueryError) Error() string {
+	return fmt.Sprintf("invalid search at position %d: %s", e.Position+1, e.Message)
+}
+
+func searchQueryError(position int, format string, args ...interface{}) *SearchQueryError {
+	return &SearchQueryError{Message: fmt.Sprintf(format, args...), Position: position}
+}
+
+type searchTokenKind int
+
+const (
+	tokenWord searchTokenKind = iota
+	tokenPhrase
+	tokenTag
+	tokenEntity
+	tokenFilter
+	tokenOr
+	tokenAnd
+	tokenNot
+	tokenOpenParen
+	tokenCloseParen
+)
+
+type searchToken struct {
+	Kind     searchTokenKind
+	Text     string
+	Field    string
+	Position int
+}
+
+var SEARCH_FILTERS = []string{"title", "id", "created", "updated", "has", "is", "parent", "link", "branch", "type"}
+
+func isSearchFilter(field string) bool {
+	return contains(SEARCH_FILTERS, field)
+}
+
+func isSearchDelimiter(r rune) bool {
+	return unicode.IsSpace(r) || r == '(' || r == ')'
+}
+
+// readQuoted reads a double quoted string starting at runes[start] and
+// returns its contents and the index just past the closing quote.
+func readQuoted(runes []rune, start int) (string, int, error) {
+	for i := start + 1; i < len(runes); i++ {
+		if runes[i] == '"' {
+			return string(runes[start+1 : i]), i + 1, nil
+		}
+	}
+	return "", 0, searchQueryError(start, "unterminated quote")
+}
+
+func tokenizeSearchQuery(input string) ([]searchToken, error) {
+	var tokens []searchToken
+	runes := []rune(input)
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, searchToken{Kind: tokenOpenParen, Position: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, searchToken{Kind: tokenCloseParen, Position: i})
+			i++
+		case r == '!':
+			tokens = append(tokens, searchToken{Kind: tokenNot, Position: i})
+			i++
+		case r == '"':
+			text, next, err := readQuoted(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, searchToken{Kind: tokenPhrase, Text: text, Position: i})
+			i = next
+		case r == '@' && i+1 < len(runes) && runes[i+1] == '[':
+			end := -1
+			for j := i + 2; j < len(runes); j++ {
+				if runes[j] == ']' {
+					end = j
+					break
+				}
+			}
+			if end == -1 {
+				return nil, searchQueryError(i, "unterminated entity, expected \"]\"")
+			}
+			name := strings.TrimSpace(string(runes[i+2 : end]))
+			if name == "" {
+				return nil, searchQueryError(i, "empty entity name")
+			}
+			tokens = append(tokens, searchToken{Kind: tokenEntity, Text: name, Position: i})
+			i = end + 1
+		default:
+			start := i
+			for i < len(runes) && !isSearchDelimiter(runes[i]) && runes[i] != '"' {
+				i++
+			}
+			word := string(runes[start:i])
+
+			// anything else with a colon, such as a url or TODO:fix, is a word
+			if field, value, found := strings.Cut(word, ":"); found && isSearchFilter(strings.ToLower(field)) {
+				// filter values may be quoted, as in title:"two words"
+				if value == "" && i < len(runes) && runes[i] == '"' {
+					text, next, err := readQuoted(runes, i)
+					if err != nil {
+						return nil, err
+					}
+					value = text
+					i = next
+				}
+				if value == "" {
+					return nil, searchQueryError(start, "missing value for %s:", field)
+				}
+				tokens = append(tokens, searchToken{Kind: tokenFilter, Field: strings.ToLower(field), Text: value, Position: start})
+				continue
+			}
+
+			switch {
+			case word == "OR":
+				tokens = append(tokens, searchToken{Kind: tokenOr, Position: start})
+			case word == "AND":
+				tokens = append(tokens, searchToken{Kind: tokenAnd, Position: start})
+			case strings.HasPrefix(word, "#"):
+				if len(word) == 1 {
+					return nil, searchQueryError(start, "missing tag name after \"#\"")
+				}
+				tokens = append(tokens, searchToken{Kind: tokenTag, Text: word[1:], Position: start})
+			default:
+				tokens = append(tokens, searchToken{Kind: tokenWord, Text: word, Position: start})
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// writeSearchError reports parse errors to the client as a bad request and
+// anything else as a server error.
+func writeSearchError(w http.ResponseWriter, err error) {
+	var queryErr *SearchQueryError
+	if errors.As(err, &queryErr) {
+		http.Error(w, queryErr.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+type SearchNode interface {
+	compile(b *searchQueryBuilder, fullText bool) string
+}
+
+type searchAndNode struct{ Children []SearchNode }
+type searchOrNode struct{ Children []SearchNode }
+type searchNotNode struct{ Child SearchNode }
+type searchTermNode struct {
+	Text   string
+	Phrase bool
+}
+type searchTagNode struct{ Name string }
+type searchEntityNode struct{ Name string }
+type searchFilterNode struct {
+	Field    string
+	Operator string
+	Value    string
+	Date     time.Time
+}
+
+type searchParser struct {
+	tokens   []searchToken
+	position int
+	length   int
+}
+
+// ParseSearchQuery parses a search string into a tree. An empty query
+// returns a nil node.
+func ParseSearchQuery(input string) (SearchNode, error) {
+	tokens, err := tokenizeSearchQuery(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	parser := searchParser{tokens: tokens, length: len([]rune(input))}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(tokens) {
+		token := tokens[parser.position]
+		if token.Kind == tokenCloseParen {
+			return nil, searchQueryError(token.Position, "unexpected \")\" without matching \"(\"")
+		}
+		return nil, searchQueryError(token.Position, "unexpected %s", describeToken(token))
+	}
+	return node, nil
+}
+
+func describeToken(token searchToken) string {
+	switch token.Kind {
+	case tokenOr:
+		return "OR"
+	case tokenAnd:
+		return "AND"
+	case tokenNot:
+		return "\"!\""
+	case tokenOpenParen:
+		return "\"(\""
+	case tokenCloseParen:
+		return "\")\""
+	case tokenFilter:
+		return fmt.Sprintf("%q", token.Field+":"+token.Text)
+	}
+	return fmt.Sprintf("%q", token.Text)
+}
+
+func (p *searchParser) peek() (searchToken, bool) {
+	if p.position >= len(p.tokens) {
+		return searchToken{}, false
+	}
+	return p.tokens[p.position], true
+}
+
+func (p *searchParser) parseOr() (SearchNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []SearchNode{first}
+	for {
+		token, ok := p.peek()
+		if !ok || token.Kind != tokenOr {
+			break
+		}
+		p.position++
+		if next, ok := p.peek(); !ok || next.Kind == tokenCloseParen || next.Kind == tokenOr {
+			return nil, searchQueryError(token.Position, "OR must be followed by a search term")
+		}
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &searchOrNode{Children: children}, nil
+}
+
+func (p *searchParser) parseAnd() (SearchNode, error) {
+	var children []SearchNode
+	for {
+		token, ok := p.peek()
+		if !ok || token.Kind == tokenOr || token.Kind == tokenCloseParen {
+			break
+		}
+		if token.Kind == tokenAnd {
+			if len(children) == 0 {
+				return nil, searchQueryError(token.Position, "AND must come between two search terms")
+			}
+			p.position++
+			if next, ok := p.peek(); !ok || next.Kind == tokenCloseParen || next.Kind == tokenOr || next.Kind == tokenAnd {
+				return nil, searchQueryError(token.Position, "AND must be followed by a search term")
+			}
+			continue
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	if len(children) == 0 {
+		token, ok := p.peek()
+		if !ok {
+			return nil, searchQueryError(p.length, "expected a search term")
+		}
+		if token.Kind == tokenOr {
+			return nil, searchQueryError(token.Position, "OR must come between two search terms")
+		}
+		return nil, searchQueryError(token.Position, "expected a search term before %s", describeToken(token))
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &searchAndNode{Children: children}, nil
+}
+
+func (p *searchParser) parseUnary() (SearchNode, error) {
+	token, _ := p.peek()
+	if token.Kind != tokenNot {
+		return p.parseAtom()
+	}
+	p.position++
+	if next, ok := p.peek(); !ok || next.Kind == tokenCloseParen || next.Kind == tokenOr || next.Kind == tokenAnd {
+		return nil, searchQueryError(token.Position, "\"!\" must be followed by a search term")
+	}
+	child, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &searchNotNode{Child: child}, nil
+}
+
+func (p *searchParser) parseAtom() (SearchNode, error) {
+	token, _ := p.peek()
+	p.position++
+	switch token.Kind {
+	case tokenOpenParen:
+		if next, ok := p.peek(); ok && next.Kind == tokenCloseParen {
+			return nil, searchQueryError(token.Position, "empty parentheses")
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing, ok := p.peek()
+		if !ok || closing.Kind != tokenCloseParen {
+			return nil, searchQueryError(token.Position, "missing \")\" to close \"(\"")
+		}
+		p.position++
+		return node, nil
+	case tokenWord:
+		return &searchTermNode{Text: token.Text}, nil
+	case tokenPhrase:
+		if strings.TrimSpace(token.Text) == "" {
+			return nil, searchQueryError(token.Position, "empty quoted phrase")
+		}
+		return &searchTermNode{Text: token.Text, Phrase: true}, nil
+	case tokenTag:
+		return &searchTagNode{Name: token.Text}, nil
+	case tokenEntity:
+		return &searchEntityNode{Name: token.Text}, nil
+	case tokenFilter:
+		return parseSearchFilter(token)
+	}
+	return nil, searchQueryError(token.Position, "unexpected %s", describeToken(token))
+}
+
+var SEARCH_HAS_VALUES = []string{"file", "task", "tag", "link"}
+var SEARCH_IS_VALUES = []string{"literature", "flashcard"}
+
+func parseSearchFilter(token searchToken) (SearchNode, error) {
+	node := &searchFilterNode{Field: token.Field, Value: token.Text}
+	switch token.Field {
+	case "created", "updated":
+		value := token.Text
+		for _, operator := range []string{">=", "<=", ">", "<", "="} {
+			if strings.HasPrefix(value, operator) {
+				node.Operator = operator
+				value = strings.TrimPrefix(value, operator)
+				break
+			}
+		}
+		if node.Operator == "" {
+			node.Operator = "="
+		}
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return nil, searchQueryError(token.Position, "invalid date %q for %s:, expected a date like 2024-01-31", value, token.Field)
+		}
+		node.Value = value
+		node.Date = date
+	case "has":
+		node.Value = strings.ToLower(token.Text)
+		if !contains(SEARCH_HAS_VALUES, node.Value) {
+			return nil, searchQueryError(token.Position, "unknown value %q for has:, expected one of %s", token.Text, strings.Join(SEARCH_HAS_VALUES, ", "))
+		}
+	case "is":
+		node.Value = strings.ToLower(token.Text)
+		if !contains(SEARCH_IS_VALUES, node.Value) {
+			return nil, searchQueryError(token.Position, "unknown value %q for is:, expected one of %s", token.Text, strings.Join(SEARCH_IS_VALUES, ", "))
+		}
+	case "id":
+		if strings.HasSuffix(token.Text, "*") {
+			node.Operator = "prefix"
+			node.Value = strings.TrimSuffix(token.Text, "*")
+		}
+		if node.Value == "" || strings.Contains(node.Value, "*") {
+			return nil, searchQueryError(token.Position, "invalid id %q, only a trailing * is allowed", token.Text)
+		}
+	case "branch":
+		if strings.ContainsAny(token.Text, "/.") {
+			return nil, searchQueryError(token.Position, "invalid branch %q, expected a top level id like 12", token.Text)
+		}
+	}
+	return node, nil
+}
+
+func (n *searchAndNode) compile(b *searchQueryBuilder, fullText bool) string {
+	var conditions []string
+	for _, child := range n.Children {
+		conditions = append(conditions, child.compile(b, fullText))
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")"
+}
+
+func (n *searchOrNode) compile(b *searchQueryBuilder, fullText bool) string {
+	var conditions []string
+	for _, child := range n.Children {
+		conditions = append(conditions, child.compile(b, fullText))
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+func (n *searchNotNode) compile(b *searchQueryBuilder, fullText bool) string {
+	b.negated = !b.negated
+	defer func() { b.negated = !b.negated }()
+	return "NOT " + n.Child.compile(b, fullText)
+}
+
+func (n *searchTermNode) compile(b *searchQueryBuilder, fullText bool) string {
+	if n.Phrase {
+		return b.phraseCondition(n.Text, fullText)
+	}
+	return b.termCondition(n.Text, fullText)
+}
+
+func (n *searchTagNode) compile(b *searchQueryBuilder, fullText bool) string {
+	return b.tagCondition(n.Name)
+}
+
+func (n *searchEntityNode) compile(b *searchQueryBuilder, fullText bool) string {
+	return b.entityCondition(n.Name)
+}
+
+func (n *searchFilterNode) compile(b *searchQueryBuilder, fullText bool) string {
+	switch n.Field {
+	case "title":
+		return "(cards.title ILIKE " + b.addArg("%"+escapeLikePattern(n.Value)+"%") + ")"
+	case "id":
+		if n.Operator == "prefix" {
+			return "(cards.card_id LIKE " + b.addArg(escapeLikePattern(n.Value)+"%") + ")"
+		}
+		return "(cards.card_id = " + b.addArg(n.Value) + ")"
+	case "created", "updated":
+		column := "cards." + n.Field + "_at"
+		switch n.Operator {
+		case ">":
+			return "(" + column + " >= " + b.addArg(n.Date.AddDate(0, 0, 1)) + ")"
+		case ">=":
+			return "(" + column + " >= " + b.addArg(n.Date) + ")"
+		case "<":
+			return "(" + column + " < " + b.addArg(n.Date) + ")"
+		case "<=":
+			return "(" + column + " < " + b.addArg(n.Date.AddDate(0, 0, 1)) + ")"
+		}
+		return "(" + column + " >= " + b.addArg(n.Date) + " AND " + column + " < " + b.addArg(n.Date.AddDate(0, 0, 1)) + ")"
+	case "has":
+		switch n.Value {
+		case "file":
+			return "EXISTS (SELECT 1 FROM files WHERE files.card_pk = cards.id AND files.is_deleted = FALSE)"
+		case "task":
+			return "EXISTS (SELECT 1 FROM tasks WHERE tasks.card_pk = cards.id AND tasks.is_deleted = FALSE)"
+		case "tag":
+			return "EXISTS (SELECT 1 FROM card_tags JOIN tags ON card_tags.tag_id = tags.id WHERE card_tags.card_pk = cards.id AND tags.is_deleted = FALSE)"
+		case "link":
+			empty := b.addArg("")
+			return "(COALESCE(cards.link, " + empty + ") <> " + empty + ")"
+		}
+	case "is":
+		switch n.Value {
+		case "literature":
+			return "(COALESCE(cards.is_literature_card, FALSE) = TRUE)"
+		case "flashcard":
+			return "(cards.is_flashcard = TRUE)"
+		}
+	case "parent":
+		return `EXISTS (
+            SELECT 1 FROM cards parent_card
+            WHERE parent_card.id = cards.parent_id AND parent_card.id <> cards.id
+            AND parent_card.card_id = ` + b.addArg(n.Value) + `
+        )`
+	case "branch":
+		// the card itself and everything filed under it
+		return "(cards.card_id = " + b.addArg(n.Value) +
+			" OR cards.card_id LIKE " + b.addArg(escapeLikePattern(n.Value)+"/%") +
+			" OR cards.card_id LIKE " + b.addArg(escapeLikePattern(n.Value)+".%") + ")"
+	case "type":
+		return `EXISTS (
+            SELECT 1 FROM entity_card_junction ecj
+            JOIN entities e ON ecj.entity_id = e.id
+            WHERE ecj.card_pk = cards.id AND LOWER(e.type) = LOWER(` + b.addArg(n.Value) + `)
+        )`
+	case "link":
+		return `EXISTS (
+            SELECT 1 FROM backlinks
+            JOIN cards target_card ON backlinks.target_id_int = target_card.id
+            WHERE backlinks.source_id_int = cards.id AND target_card.card_id = ` + b.addArg(n.Value) + `
+        )`
+	}
+	return "FALSE"
+}
+
+// searchRankTerms returns the positive terms and phrases in the tree, written
+// so that websearch_to_tsquery treats phrases as phrases.
+func searchRankTerms(node SearchNode) []string {
+	var terms []string
+	switch n := node.(type) {
+	case *searchAndNode:
+		for _, child := range n.Children {
+			terms = append(terms, searchRankTerms(child)...)
+		}
+	case *searchOrNode:
+		for _, child := range n.Children {
+			terms = append(terms, searchRankTerms(child)...)
+		}
+	case *searchTermNode:
+		if n.Phrase {
+			terms = append(terms, `"`+n.Text+`"`)
+		} else {
+			terms = append(terms, n.Text)
+		}
+	}
+	return terms
+}
+
+// tsQuery compiles the terms of the tree into one tsquery expression, keeping
+// its AND, OR and NOT. Tags, entities and filters only apply to cards, so
+// they are left out, and an empty string means there was nothing to match.
+func (b *searchQueryBuilder) tsQuery(node SearchNode) string {
+	switch n := node.(type) {
+	case *searchAndNode:
+		return b.joinTsQueries(n.Children, " && ")
+	case *searchOrNode:
+		return b.joinTsQueries(n.Children, " || ")
+	case *searchNotNode:
+		child := b.tsQuery(n.Child)
+		if child == "" {
+			return ""
+		}
+		return "(!! " + child + ")"
+	case *searchTermNode:
+		if n.Phrase {
+			return "phraseto_tsquery('" + SEARCH_LANGUAGE + "', " + b.addArg(n.Text) + ")"
+		}
+		return "plainto_tsquery('" + SEARCH_LANGUAGE + "', " + b.addArg(n.Text) + ")"
+	}
+	return ""
+}
+
+func (b *searchQueryBuilder) joinTsQueries(children []SearchNode, operator string) string {
+	var queries []string
+	for _, child := range children {
+		if query := b.tsQuery(child); query != "" {
+			queries = append(queries, query)
+		}
+	}
+	if len(queries) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(queries, operator) + ")"
+}
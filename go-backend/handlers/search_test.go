@@ -1,113 +1,302 @@
 package handlers
 
 import (
+	"errors"
+	"go-backend/models"
+	"go-backend/tests"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 )
 
-func TestParseSearchText(t *testing.T) {
-	var output SearchParams
-	input := "hello #test"
-	output = ParseSearchText(input)
+func TestParseSearchQuery(t *testing.T) {
+	node, err := ParseSearchQuery("hello #test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &searchAndNode{Children: []SearchNode{
+		&searchTermNode{Text: "hello"},
+		&searchTagNode{Name: "test"},
+	}}
+	if !reflect.DeepEqual(node, expected) {
+		t.Errorf("wrong tree returned, got %#v want %#v", node, expected)
+	}
 
-	if len(output.Terms) != 1 {
-		t.Errorf("wrong number of search terms returned, got %v want %v", len(output.Terms), 0)
+	node, err = ParseSearchQuery("hello #test world #another")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if output.Terms[0] != "hello" {
-		t.Errorf("wrong term returned, got %v want %v", output.Terms[0], "hello")
+	expected = &searchAndNode{Children: []SearchNode{
+		&searchTermNode{Text: "hello"},
+		&searchTagNode{Name: "test"},
+		&searchTermNode{Text: "world"},
+		&searchTagNode{Name: "another"},
+	}}
+	if !reflect.DeepEqual(node, expected) {
+		t.Errorf("wrong tree returned, got %#v want %#v", node, expected)
+	}
+
+	node, err = ParseSearchQuery("")
+	if err != nil || node != nil {
+		t.Errorf("empty query should return no tree, got %#v %v", node, err)
 	}
-	if len(output.Tags) != 1 {
-		t.Errorf("wrong number of search tags returned, got %v want %v", len(output.Tags), 0)
+}
+
+func TestParseSearchQueryOperators(t *testing.T) {
+	node, err := ParseSearchQuery(`"zettel kasten" a OR !(b c) !@[John Smith] !#draft`)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if output.Tags[0] != "test" {
-		t.Errorf("wrong tag returned, got %v want %v", output.Tags[0], "test")
+	expected := &searchOrNode{Children: []SearchNode{
+		&searchAndNode{Children: []SearchNode{
+			&searchTermNode{Text: "zettel kasten", Phrase: true},
+			&searchTermNode{Text: "a"},
+		}},
+		&searchAndNode{Children: []SearchNode{
+			&searchNotNode{Child: &searchAndNode{Children: []SearchNode{
+				&searchTermNode{Text: "b"},
+				&searchTermNode{Text: "c"},
+			}}},
+			&searchNotNode{Child: &searchEntityNode{Name: "John Smith"}},
+			&searchNotNode{Child: &searchTagNode{Name: "draft"}},
+		}},
+	}}
+	if !reflect.DeepEqual(node, expected) {
+		t.Errorf("wrong tree returned, got %#v want %#v", node, expected)
 	}
+}
 
-	input = "hello #test world #another"
-	output = ParseSearchText(input)
+func TestParseSearchQueryFilters(t *testing.T) {
+	node, err := ParseSearchQuery(`title:"two words" id:1.2* created:>2024-01-01 has:file is:literature parent:1 link:2/A`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	and := node.(*searchAndNode)
+	if len(and.Children) != 7 {
+		t.Fatalf("wrong number of filters, got %v want %v", len(and.Children), 7)
+	}
+	title := and.Children[0].(*searchFilterNode)
+	if title.Field != "title" || title.Value != "two words" {
+		t.Errorf("wrong title filter, got %+v", title)
+	}
+	id := and.Children[1].(*searchFilterNode)
+	if id.Operator != "prefix" || id.Value != "1.2" {
+		t.Errorf("wrong id filter, got %+v", id)
+	}
+	created := and.Children[2].(*searchFilterNode)
+	if created.Operator != ">" || created.Date.Format("2006-01-02") != "2024-01-01" {
+		t.Errorf("wrong created filter, got %+v", created)
+	}
+}
 
-	if len(output.Terms) != 2 {
-		t.Errorf("wrong number of search terms returned, got %v want %v", len(output.Terms), 0)
+func TestParseSearchQueryErrors(t *testing.T) {
+	testCases := []struct {
+		input   string
+		message string
+	}{
+		{`"unclosed`, "unterminated quote"},
+		{"(a OR b", `missing ")"`},
+		{"a)", `unexpected ")"`},
+		{"a OR", "OR must be followed"},
+		{"OR a", "OR must come between"},
+		{"()", "empty parentheses"},
+		{"created:yesterday", `invalid date "yesterday"`},
+		{"has:kitten", `unknown value "kitten" for has:`},
+		{"is:", "missing value for is:"},
+		{"@[John", "unterminated entity"},
+		{"id:1*2", "only a trailing *"},
+		{"a !", `"!" must be followed`},
 	}
-	if output.Terms[0] != "hello" {
-		t.Errorf("wrong term returned, got %v want %v", output.Terms[0], "hello")
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			_, err := ParseSearchQuery(tc.input)
+			var queryErr *SearchQueryError
+			if !errors.As(err, &queryErr) {
+				t.Fatalf("expected a search query error, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tc.message) {
+				t.Errorf("wrong error, got %q want it to contain %q", err.Error(), tc.message)
+			}
+		})
+	}
+}
+
+func TestParseSearchQueryLeavesUrlsAlone(t *testing.T) {
+	node, err := ParseSearchQuery("https://example.com Re: meeting")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if output.Terms[1] != "world" {
-		t.Errorf("wrong term returned, got %v want %v", output.Terms[1], "world")
+	if len(node.(*searchAndNode).Children) != 3 {
+		t.Errorf("wrong tree returned, got %#v", node)
 	}
-	if len(output.Tags) != 2 {
-		t.Errorf("wrong number of search tags returned, got %v want %v", len(output.Tags), 0)
+}
+
+func TestParseSearchQueryUnknownFieldsAreWords(t *testing.T) {
+	for _, input := range []string{"TODO:fix", "note:important", "ratio:2", "titel:foo"} {
+		node, err := ParseSearchQuery(input)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", input, err)
+			continue
+		}
+		expected := &searchTermNode{Text: input}
+		if !reflect.DeepEqual(node, expected) {
+			t.Errorf("wrong tree for %q, got %#v want %#v", input, node, expected)
+		}
 	}
-	if output.Tags[0] != "test" {
-		t.Errorf("wrong tag returned, got %v want %v", output.Tags[0], "test")
+
+	node, err := ParseSearchQuery("note:important title:compost")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if output.Tags[1] != "another" {
-		t.Errorf("wrong tag returned, got %v want %v", output.Tags[1], "another")
+	and := node.(*searchAndNode)
+	if _, ok := and.Children[1].(*searchFilterNode); !ok || len(and.Children) != 2 {
+		t.Errorf("known filters should still be parsed, got %#v", node)
 	}
 }
 
-func TestBuildPartialCardSqlSearchTermString(t *testing.T) {
+func normalizeSql(input string) string {
+	input = strings.ReplaceAll(input, " ", "")
+	input = strings.ReplaceAll(input, "\n", "")
+	return strings.ReplaceAll(input, "\t", "")
+}
+
+func TestBuildPartialCardSqlSearchQuery(t *testing.T) {
 	input := "hello world"
-	expectedOutput := " AND ((card_id ILIKE '%hello%' OR title ILIKE '%hello%') AND (card_id ILIKE '%world%' OR title ILIKE '%world%'))"
-	output := BuildPartialCardSqlSearchTermString(input, false)
+	expectedOutput := " AND ((cards.card_id ILIKE $2 OR cards.title ILIKE $2) AND (cards.card_id ILIKE $3 OR cards.title ILIKE $3))"
+	output, args, err := BuildPartialCardSqlSearchQuery(input, false, []interface{}{1})
+	if err != nil {
+		t.Fatal(err)
+	}
 	if output != expectedOutput {
 		t.Errorf("wrong string returned, got %v want %v", output, expectedOutput)
 	}
+	expectedArgs := []interface{}{1, "%hello%", "%world%"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("wrong args returned, got %v want %v", args, expectedArgs)
+	}
 
 	input = "hello #world"
-	expectedOutput = `
-	AND (EXISTS (
+	expectedOutput = normalizeSql(`
+	AND ((card_id ILIKE $1 OR cards.title ILIKE $1) AND EXISTS (
 	            SELECT 1 FROM card_tags
 	            JOIN tags ON card_tags.tag_id = tags.id
-	            WHERE card_tags.card_pk = cards.id AND tags.name = 'world' AND tags.is_deleted = FALSE
-	        )) AND ((card_id ILIKE '%hello%' OR title ILIKE '%hello%'))
-			`
-	expectedOutput = strings.ReplaceAll(expectedOutput, " ", "")
-	expectedOutput = strings.ReplaceAll(expectedOutput, "\n", "")
-	expectedOutput = strings.ReplaceAll(expectedOutput, "\t", "")
-	output = BuildPartialCardSqlSearchTermString(input, false)
-	output = strings.ReplaceAll(output, " ", "")
-	output = strings.ReplaceAll(output, "\n", "")
+	            WHERE card_tags.card_pk = cards.id AND tags.name = $2 AND tags.is_deleted = FALSE
+	        ))
+			`)
+	expectedOutput = strings.Replace(expectedOutput, "card_id", "cards.card_id", 1)
+	output, args, _ = BuildPartialCardSqlSearchQuery(input, false, nil)
+	if normalizeSql(output) != expectedOutput {
+		t.Errorf("wrong string returned, got %v want %v", normalizeSql(output), expectedOutput)
+	}
+	expectedArgs = []interface{}{"%hello%", "world"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("wrong args returned, got %v want %v", args, expectedArgs)
+	}
+
+	input = "hello"
+	expectedOutput = " AND (numnode(plainto_tsquery('english', $2)) = 0 OR cards.search_vector @@ plainto_tsquery('english', $2) OR cards.card_id ILIKE $3 OR cards.title ILIKE $3)"
+	output, args, _ = BuildPartialCardSqlSearchQuery(input, true, []interface{}{1})
 	if output != expectedOutput {
 		t.Errorf("wrong string returned, got %v want %v", output, expectedOutput)
 	}
+	expectedArgs = []interface{}{1, "hello", "%hello%"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("wrong args returned, got %v want %v", args, expectedArgs)
+	}
 
-}
+	output, args, _ = BuildPartialCardSqlSearchQuery("", true, []interface{}{1})
+	if output != "" || len(args) != 1 {
+		t.Errorf("empty search should not add conditions, got %v %v", output, args)
+	}
 
-func TestBuildPartialCardSqlSearchTermStringNegate(t *testing.T) {
+	_, _, err = BuildPartialCardSqlSearchQuery("(unbalanced", true, nil)
+	if err == nil {
+		t.Errorf("invalid search should return an error")
+	}
+}
 
+func TestBuildPartialCardSqlSearchQueryNegate(t *testing.T) {
 	input := "hello !world"
-	expectedOutput := " AND ((card_id ILIKE '%hello%' OR title ILIKE '%hello%')) AND (NOT (card_id ILIKE '%world%' OR title ILIKE '%world%'))"
-	output := BuildPartialCardSqlSearchTermString(input, false)
+	expectedOutput := " AND ((cards.card_id ILIKE $1 OR cards.title ILIKE $1) AND NOT (cards.card_id ILIKE $2 OR cards.title ILIKE $2))"
+	output, _, _ := BuildPartialCardSqlSearchQuery(input, false, nil)
 	if output != expectedOutput {
 		t.Errorf("wrong string returned, got %v want %v", output, expectedOutput)
 	}
 
 	input = "hello !#world"
-	expectedOutput = `
-AND ((card_id ILIKE '%hello%' OR title ILIKE '%hello%')) AND (NOT EXISTS (
+	expectedOutput = normalizeSql(`
+AND ((cards.card_id ILIKE $1 OR cards.title ILIKE $1) AND NOT EXISTS (
             SELECT 1 FROM card_tags
             JOIN tags ON card_tags.tag_id = tags.id
-            WHERE card_tags.card_pk = cards.id AND tags.name = 'world' AND tags.is_deleted = FALSE
+            WHERE card_tags.card_pk = cards.id AND tags.name = $2 AND tags.is_deleted = FALSE
         ))
-`
-	expectedOutput = strings.ReplaceAll(expectedOutput, " ", "")
-	expectedOutput = strings.ReplaceAll(expectedOutput, "\n", "")
-	expectedOutput = strings.ReplaceAll(expectedOutput, "\t", "")
-	output = BuildPartialCardSqlSearchTermString(input, false)
-	output = strings.ReplaceAll(output, " ", "")
-	output = strings.ReplaceAll(output, "\n", "")
-	if output != expectedOutput {
-		t.Errorf("wrong string returned, got %v want %v", output, expectedOutput)
+`)
+	output, args, _ := BuildPartialCardSqlSearchQuery(input, false, nil)
+	if normalizeSql(output) != expectedOutput {
+		t.Errorf("wrong string returned, got %v want %v", normalizeSql(output), expectedOutput)
+	}
+	if args[1] != "world" {
+		t.Errorf("wrong tag arg, got %v want %v", args[1], "world")
+	}
+}
+
+func TestBuildPartialCardSqlSearchQueryOr(t *testing.T) {
+	output, args, err := BuildPartialCardSqlSearchQuery("(a OR b) #tag", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(output, " AND (((cards.card_id ILIKE $1 OR cards.title ILIKE $1) OR (cards.card_id ILIKE $2 OR cards.title ILIKE $2)) AND EXISTS") {
+		t.Errorf("wrong string returned, got %v", output)
+	}
+	if len(args) != 3 {
+		t.Errorf("wrong number of args, got %v want %v", len(args), 3)
+	}
+}
+
+func TestBuildPartialCardSqlSearchQueryFilters(t *testing.T) {
+	testCases := []struct {
+		input    string
+		contains []string
+		args     []interface{}
+	}{
+		{"title:garden", []string{"(cards.titleILIKE$1)"}, []interface{}{"%garden%"}},
+		{"id:1.2", []string{"(cards.card_id=$1)"}, []interface{}{"1.2"}},
+		{"id:1_2*", []string{"(cards.card_idLIKE$1)"}, []interface{}{`1\_2%`}},
+		{"has:file", []string{"EXISTS(SELECT1FROMfilesWHEREfiles.card_pk=cards.id"}, nil},
+		{"has:task", []string{"EXISTS(SELECT1FROMtasksWHEREtasks.card_pk=cards.id"}, nil},
+		{"is:literature", []string{"(COALESCE(cards.is_literature_card,FALSE)=TRUE)"}, nil},
+		{"parent:1", []string{"parent_card.id=cards.parent_id", "parent_card.card_id=$1"}, []interface{}{"1"}},
+		{"link:2/A", []string{"backlinks.source_id_int=cards.id", "target_card.card_id=$1"}, []interface{}{"2/A"}},
+		{"created:<2024-02-01", []string{"(cards.created_at<$1)"}, nil},
+		{"updated:2024-02-01", []string{"(cards.updated_at>=$1ANDcards.updated_at<$2)"}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			output, args, err := BuildPartialCardSqlSearchQuery(tc.input, true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, str := range tc.contains {
+				if !strings.Contains(normalizeSql(output), str) {
+					t.Errorf("Expected SQL to contain '%s', but it didn't.\nGot: %s", str, output)
+				}
+			}
+			if tc.args != nil && !reflect.DeepEqual(args, tc.args) {
+				t.Errorf("wrong args returned, got %v want %v", args, tc.args)
+			}
+		})
 	}
 }
 
-func TestBuildPartialCardSqlSearchTermStringWithEntities(t *testing.T) {
+func TestBuildPartialCardSqlSearchQueryWithEntities(t *testing.T) {
 	testCases := []struct {
 		name     string
 		input    string
 		fullText bool
 		contains []string // Strings that should be present in the output
+		args     []interface{}
 	}{
 		{
 			name:     "single entity",
@@ -116,8 +305,9 @@ func TestBuildPartialCardSqlSearchTermStringWithEntities(t *testing.T) {
 			contains: []string{
 				"EXISTS(SELECT1FROMentity_card_junctionecj",
 				"JOINentitieseONecj.entity_id=e.id",
-				"WHEREecj.card_pk=cards.idANDe.name='JohnSmith'",
+				"WHEREecj.card_pk=cards.idANDe.name=$1",
 			},
+			args: []interface{}{"John Smith"},
 		},
 		{
 			name:     "negated entity",
@@ -126,31 +316,33 @@ func TestBuildPartialCardSqlSearchTermStringWithEntities(t *testing.T) {
 			contains: []string{
 				"NOTEXISTS(SELECT1FROMentity_card_junctionecj",
 				"JOINentitieseONecj.entity_id=e.id",
-				"WHEREecj.card_pk=cards.idANDe.name='ProjectAlpha'",
+				"WHEREecj.card_pk=cards.idANDe.name=$1",
 			},
+			args: []interface{}{"Project Alpha"},
 		},
 		{
 			name:     "mixed entities and terms",
 			input:    "hello @[John Smith] !@[Project Beta]",
 			fullText: false,
 			contains: []string{
-				"card_idILIKE'%hello%'ORtitleILIKE'%hello%'",
+				"cards.card_idILIKE$1ORcards.titleILIKE$1",
 				"EXISTS(SELECT1FROMentity_card_junctionecj",
-				"WHEREecj.card_pk=cards.idANDe.name='JohnSmith'",
+				"WHEREecj.card_pk=cards.idANDe.name=$2",
 				"NOTEXISTS(SELECT1FROMentity_card_junctionecj",
-				"WHEREecj.card_pk=cards.idANDe.name='ProjectBeta'",
+				"WHEREecj.card_pk=cards.idANDe.name=$3",
 			},
+			args: []interface{}{"%hello%", "John Smith", "Project Beta"},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := BuildPartialCardSqlSearchTermString(tc.input, tc.fullText)
+			result, args, err := BuildPartialCardSqlSearchQuery(tc.input, tc.fullText, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-			// Normalize the result by removing all whitespace
-			normalizedResult := strings.ReplaceAll(result, " ", "")
-			normalizedResult = strings.ReplaceAll(normalizedResult, "\n", "")
-			normalizedResult = strings.ReplaceAll(normalizedResult, "\t", "")
+			normalizedResult := normalizeSql(result)
 			t.Logf("Normalized SQL: %s", normalizedResult)
 
 			// Check that all expected strings are present in the result
@@ -159,6 +351,186 @@ func TestBuildPartialCardSqlSearchTermStringWithEntities(t *testing.T) {
 					t.Errorf("Expected SQL to contain '%s', but it didn't.\nGot: %s", str, result)
 				}
 			}
+			if !reflect.DeepEqual(args, tc.args) {
+				t.Errorf("wrong args returned, got %v want %v", args, tc.args)
+			}
 		})
 	}
 }
+
+func TestBuildPartialCardSqlSearchQueryEscaping(t *testing.T) {
+	output, args, err := BuildPartialCardSqlSearchQuery("O'Brien 100%_done #it's", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, "O'Brien") || strings.Contains(output, "it's") {
+		t.Errorf("user input should not be spliced into the sql, got %v", output)
+	}
+	expectedArgs := []interface{}{"O'Brien", "%O'Brien%", "100%_done", `%100\%\_done%`, "it's"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("wrong args returned, got %v want %v", args, expectedArgs)
+	}
+}
+
+var placeholderRegex = regexp.MustCompile(`\$(\d+)`)
+
+func FuzzParseSearchQuery(f *testing.F) {
+	f.Add("hello #test world")
+	f.Add("!@[Project Alpha] @[John")
+	f.Add(`(a OR "b c") !(d) title:"x y" id:1.2* created:>2024-01-01`)
+	f.Add("@[ ] !# ! # ) (")
+	f.Fuzz(func(t *testing.T, input string) {
+		node, err := ParseSearchQuery(input)
+		if err != nil {
+			var queryErr *SearchQueryError
+			if !errors.As(err, &queryErr) {
+				t.Errorf("parse errors should be search query errors, got %T", err)
+			}
+			return
+		}
+		if node == nil && strings.TrimSpace(input) != "" {
+			t.Errorf("non empty query %q parsed to nothing", input)
+		}
+	})
+}
+
+func FuzzBuildPartialCardSqlSearchQuery(f *testing.F) {
+	f.Add("hello #test world", true)
+	f.Add("O'Brien'); DROP TABLE cards; --", false)
+	f.Add("!@[Project 'Alpha'] (a OR title:\"it's\")", true)
+	f.Fuzz(func(t *testing.T, input string, fullText bool) {
+		output, args, err := BuildPartialCardSqlSearchQuery(input, fullText, []interface{}{1})
+		if err != nil {
+			return
+		}
+		if len(args) < 1 || args[0] != 1 {
+			t.Fatalf("existing args were not preserved: %v", args)
+		}
+		// the only values in the fragment are placeholders, never user input
+		if strings.Contains(strings.ReplaceAll(output, "'"+SEARCH_LANGUAGE+"'", ""), "'") {
+			t.Errorf("fragment contains a quote: %q", output)
+		}
+		if strings.Count(output, "(") != strings.Count(output, ")") {
+			t.Errorf("fragment has unbalanced parentheses: %q", output)
+		}
+		for _, match := range placeholderRegex.FindAllStringSubmatch(output, -1) {
+			index, _ := strconv.Atoi(match[1])
+			if index < 2 || index > len(args) {
+				t.Errorf("placeholder %v out of range for %v args", index, len(args))
+			}
+		}
+		if output != "" && !strings.HasPrefix(output, " AND ") {
+			t.Errorf("fragment should start with AND: %q", output)
+		}
+	})
+}
+
+func TestSearchRankQuery(t *testing.T) {
+	node, _ := ParseSearchQuery(`hello #tag !skip @[John Smith] "two words" title:x`)
+	output := searchRankQuery(node)
+	if output != `hello or "two words"` {
+		t.Errorf("wrong rank query, got %q want %q", output, `hello or "two words"`)
+	}
+}
+
+func TestFuzzySearchCondition(t *testing.T) {
+	node, _ := ParseSearchQuery("compsot #garden")
+	builder := searchQueryBuilder{args: []interface{}{1}, fuzzy: true}
+	output := node.compile(&builder, true)
+	if !strings.HasPrefix(output, "((cards.card_id % $2 OR $2 <% cards.title) AND EXISTS") {
+		t.Errorf("wrong fuzzy condition, got %v", output)
+	}
+	if !reflect.DeepEqual(builder.args, []interface{}{1, "compsot", "garden"}) {
+		t.Errorf("wrong args, got %v", builder.args)
+	}
+}
+
+func TestBuildPartialCardSqlSearchQueryNegatedStopword(t *testing.T) {
+	output, _, _ := BuildPartialCardSqlSearchQuery("hello !the", true, []interface{}{1})
+	expectedOutput := " AND ((numnode(plainto_tsquery('english', $2)) = 0 OR cards.search_vector @@ plainto_tsquery('english', $2) OR cards.card_id ILIKE $3 OR cards.title ILIKE $3) AND NOT (numnode(plainto_tsquery('english', $4)) > 0 AND (cards.search_vector @@ plainto_tsquery('english', $4) OR cards.card_id ILIKE $5 OR cards.title ILIKE $5)))"
+	if output != expectedOutput {
+		t.Errorf("wrong string returned, got %v want %v", output, expectedOutput)
+	}
+}
+
+func TestClassicSearchNegatedStopword(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	_, err := s.CreateCard(1, models.EditCardParams{CardID: "100", Title: "Compost heap", Body: "the compost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// excluding a stopword excludes nothing, like searching for one matches
+	// everything
+	results, err := s.ClassicSearchResults(1, "compost !the")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != "100" {
+		t.Errorf("a negated stopword should be ignored, got %+v", results)
+	}
+}
+
+func TestClassicSearchFuzzyFallback(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	_, err := s.CreateCard(1, models.EditCardParams{CardID: "100", Title: "Compost heap", Body: "body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := s.ClassicSearchResults(1, "compsot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != "100" {
+		t.Fatalf("expected the fuzzy fallback to find the card, got %+v", results)
+	}
+	if results[0].Metadata.(map[string]interface{})["fuzzy"] != true {
+		t.Errorf("fallback results should be marked as fuzzy")
+	}
+
+	results, _ = s.ClassicSearchResults(1, "compost")
+	if len(results) != 1 || results[0].Metadata.(map[string]interface{})["fuzzy"] != false {
+		t.Errorf("exact hits should not use the fallback, got %+v", results)
+	}
+
+	results, _ = s.ClassicSearchResults(1, "zzzzqqqq")
+	if len(results) != 0 {
+		t.Errorf("unrelated terms should not match, got %+v", results)
+	}
+}
+
+func TestClassicSearchResultsRanking(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+
+	_, err := s.CreateCard(1, models.EditCardParams{CardID: "100", Title: "Gardening", Body: "Notes about composting and soil."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateCard(1, models.EditCardParams{CardID: "101", Title: "Composting", Body: "Composting kitchen scraps."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := s.ClassicSearchResults(1, "compost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("wrong number of results, got %v want %v", len(results), 2)
+	}
+	// the title match is weighted above the body match
+	if results[0].ID != "101" {
+		t.Errorf("wrong top result, got %v want %v", results[0].ID, "101")
+	}
+	if !strings.Contains(results[0].Preview, "**Composting**") {
+		t.Errorf("preview should highlight the match, got %q", results[0].Preview)
+	}
+	if results[0].Score <= 0 {
+		t.Errorf("result should have a rank, got %v", results[0].Score)
+	}
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"go-backend/models"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SEARCH_RESULT_TYPES are the values of SearchResult.Type that unified search
+// can return, and the values accepted by the types= parameter.
+var SEARCH_RESULT_TYPES = []string{"card", "task", "entity", "file", "chat"}
+
+// The documents searched for each type. The indexes in
+// schema/0041-unified-search.sql are built on the same expressions, so these
+// must be kept in sync with them.
+const (
+	taskSearchDocument   = `to_tsvector('english', COALESCE(tasks.title, ''))`
+	entitySearchDocument = `(setweight(to_tsvector('english', COALESCE(entities.name, '')), 'A') || setweight(to_tsvector('english', COALESCE(entities.description, '')), 'B'))`
+	fileSearchDocument   = `(setweight(to_tsvector('english', COALESCE(files.name, '')), 'A') || setweight(to_tsvector('english', COALESCE(files.extracted_text, '')), 'B'))`
+)
+
+// parseSearchTypes parses a comma separated types= value. An empty value
+// searches cards only, which is what /api/search has always done.
+func parseSearchTypes(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return []string{"card"}, nil
+	}
+	var types []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if part == "all" {
+			return SEARCH_RESULT_TYPES, nil
+		}
+		if !contains(SEARCH_RESULT_TYPES, part) {
+			return nil, fmt.Errorf("unknown type %q, expected one of %v", part, strings.Join(SEARCH_RESULT_TYPES, ", "))
+		}
+		if !contains(types, part) {
+			types = append(types, part)
+		}
+	}
+	if len(types) == 0 {
+		return []string{"card"}, nil
+	}
+	return types, nil
+}
+
+// onlyCards reports whether the types are just cards.
+func onlyCards(types []string) bool {
+	return len(types) == 1 && types[0] == "card"
+}
+
+// scanSearchResults reads rows of id, title, preview, rank, created_at,
+// updated_at, card_pk and a type specific detail, which is stored in the
+// metadata under detailKey.
+func scanSearchResults(rows *sql.Rows, resultType, detailKey string) ([]models.SearchResult, error) {
+	results := []models.SearchResult{}
+	for rows.Next() {
+		var result models.SearchResult
+		var detail sql.NullString
+		var cardPK sql.NullInt64
+		if err := rows.Scan(
+			&result.ID,
+			&result.Title,
+			&result.Preview,
+			&result.Score,
+			&result.CreatedAt,
+			&result.UpdatedAt,
+			&cardPK,
+			&detail,
+		); err != nil {
+			log.Printf("err %v", err)
+			return results, err
+		}
+		result.Type = resultType
+		metadata := map[string]interface{}{"card_pk": nil}
+		if cardPK.Valid && cardPK.Int64 > 0 {
+			metadata["card_pk"] = cardPK.Int64
+		}
+		if detailKey != "" {
+			metadata[detailKey] = detail.String
+		}
+		result.Metadata = metadata
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// UNIFIED_SEARCH_TYPE_LIMIT is how many of the best matches of each type
+// besides cards a unified search returns.
+const UNIFIED_SEARCH_TYPE_LIMIT = 50
+
+// unifiedSearchQuery compiles the terms of the query into a tsquery
+// expression for the types besides cards, after the given args.
+func unifiedSearchQuery(node SearchNode, args ...interface{}) (string, []interface{}) {
+	builder := searchQueryBuilder{args: append([]interface{}{}, args...)}
+	return builder.tsQuery(node), builder.args
+}
+
+// The queries below take the user id and, when they highlight a preview, the
+// headline options, followed by the terms of the query.
+
+func (s *Handler) searchTasks(userID int, node SearchNode) ([]models.SearchResult, error) {
+	tsquery, args := unifiedSearchQuery(node, userID)
+	rows, err := s.DB.Query(`
+	SELECT tasks.id::text, tasks.title, tasks.title,
+	ts_rank_cd(`+taskSearchDocument+`, search.query) AS rank,
+	tasks.created_at, tasks.updated_at, tasks.card_pk,
+	CASE WHEN tasks.is_complete THEN 'complete' ELSE 'open' END
+	FROM tasks, (SELECT `+tsquery+` AS query) search
+	WHERE tasks.user_id = $1 AND tasks.is_deleted = FALSE
+	AND `+taskSearchDocument+` @@ search.query
+	ORDER BY rank DESC, tasks.updated_at DESC
+	LIMIT `+strconv.Itoa(UNIFIED_SEARCH_TYPE_LIMIT), args...)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSearchResults(rows, "task", "status")
+}
+
+func (s *Handler) searchEntities(userID int, node SearchNode) ([]models.SearchResult, error) {
+	tsquery, args := unifiedSearchQuery(node, userID, SEARCH_HEADLINE_OPTIONS)
+	rows, err := s.DB.Query(`
+	SELECT entities.id::text, entities.name,
+	ts_headline('english', COALESCE(entities.description, ''), search.query, $2),
+	ts_rank_cd(`+entitySearchDocument+`, search.query) AS rank,
+	entities.created_at, entities.updated_at, NULL::int, COALESCE(entities.type, '')
+	FROM entities, (SELECT `+tsquery+` AS query) search
+	WHERE entities.user_id = $1
+	AND `+entitySearchDocument+` @@ search.query
+	ORDER BY rank DESC, entities.updated_at DESC
+	LIMIT `+strconv.Itoa(UNIFIED_SEARCH_TYPE_LIMIT), args...)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSearchResults(rows, "entity", "entity_type")
+}
+
+func (s *Handler) searchFiles(userID int, node SearchNode) ([]models.SearchResult, error) {
+	tsquery, args := unifiedSearchQuery(node, userID, SEARCH_HEADLINE_OPTIONS)
+	rows, err := s.DB.Query(`
+	SELECT files.id::text, files.name,
+	CASE WHEN COALESCE(files.extracted_text, '') = '' THEN ''
+	ELSE ts_headline('english', files.extracted_text, search.query, $2)
+	END,
+	ts_rank_cd(`+fileSearchDocument+`, search.query) AS rank,
+	files.created_at, files.updated_at, files.card_pk, COALESCE(files.type, '')
+	FROM files, (SELECT `+tsquery+` AS query) search
+	WHERE files.user_id = $1 AND files.is_deleted = FALSE
+	AND `+fileSearchDocument+` @@ search.query
+	ORDER BY rank DESC, files.updated_at DESC
+	LIMIT `+strconv.Itoa(UNIFIED_SEARCH_TYPE_LIMIT), args...)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSearchResults(rows, "file", "filetype")
+}
+
+// searchChats matches conversations on their title and the text of their
+// user and assistant messages.
+func (s *Handler) searchChats(userID int, node SearchNode) ([]models.SearchResult, error) {
+	tsquery, args := unifiedSearchQuery(node, userID, SEARCH_HEADLINE_OPTIONS)
+	rows, err := s.DB.Query(`
+	WITH conversations AS (
+		SELECT
+			c.id,
+			COALESCE(c.title, '') as title,
+			c.created_at,
+			c.updated_at,
+			COALESCE(STRING_AGG(m.content, ' ' ORDER BY m.sequence_number), '') as body
+		FROM chat_conversations c
+		LEFT JOIN chat_completions m ON c.id = m.conversation_id AND m.role IN ('user', 'assistant')
+		WHERE c.user_id = $1
+		GROUP BY c.id, c.title, c.created_at, c.updated_at
+	), documents AS (
+		SELECT *,
+		setweight(to_tsvector('english', title), 'A') || setweight(to_tsvector('english', body), 'B') as document
+		FROM conversations
+	)
+	SELECT id::text, title,
+	ts_headline('english', body, search.query, $2),
+	ts_rank_cd(document, search.query) AS rank,
+	created_at, updated_at, NULL::int, ''
+	FROM documents, (SELECT `+tsquery+` AS query) search
+	WHERE document @@ search.query
+	ORDER BY rank DESC, updated_at DESC
+	LIMIT `+strconv.Itoa(UNIFIED_SEARCH_TYPE_LIMIT), args...)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSearchResults(rows, "chat", "")
+}
+
+// fuseSearchResultTypes mixes the results of each type into one list with
+// reciprocal rank fusion, since the scores of different types, or of the
+// trigram fallback for cards, are not comparable. Each list must already be
+// ordered best first; the score of a result becomes 1 / (k + its rank in its
+// own type), and ties go to the most recently updated.
+func fuseSearchResultTypes(lists [][]models.SearchResult, k int) []models.SearchResult {
+	results := []models.SearchResult{}
+	for _, list := range lists {
+		for i, result := range list {
+			result.Score = 1 / float64(k+i+1)
+			results = append(results, result)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].UpdatedAt.After(results[j].UpdatedAt)
+	})
+	return results
+}
+
+// UnifiedSearch runs a full text search over every requested type and mixes
+// the results into one list with fuseSearchResultTypes. Cards support the
+// whole query language; the other types match its terms with their AND, OR
+// and NOT, but not its tags, entities or filters, so a query without any
+// terms to match returns cards alone.
+func (s *Handler) UnifiedSearch(userID int, searchTerm string, types []string) ([]models.SearchResult, error) {
+	node, err := ParseSearchQuery(searchTerm)
+	if err != nil {
+		return nil, err
+	}
+	hasTerms := len(searchRankTerms(node)) > 0
+
+	searchers := map[string]func(int, SearchNode) ([]models.SearchResult, error){
+		"task":   s.searchTasks,
+		"entity": s.searchEntities,
+		"file":   s.searchFiles,
+		"chat":   s.searchChats,
+	}
+
+	var lists [][]models.SearchResult
+	for _, resultType := range types {
+		var typeResults []models.SearchResult
+		if resultType == "card" {
+			typeResults, err = s.ClassicSearchResults(userID, searchTerm)
+		} else if hasTerms {
+			typeResults, err = searchers[resultType](userID, node)
+		}
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, typeResults)
+	}
+	return fuseSearchResultTypes(lists, HYBRID_RRF_K), nil
+}
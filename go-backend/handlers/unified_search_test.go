@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"go-backend/models"
+	"go-backend/tests"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestParseSearchTypes(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected []string
+	}{
+		{"", []string{"card"}},
+		{"card", []string{"card"}},
+		{"task, entity,task", []string{"task", "entity"}},
+		{"all", SEARCH_RESULT_TYPES},
+		{",", []string{"card"}},
+	}
+	for _, tc := range testCases {
+		types, err := parseSearchTypes(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(types, tc.expected) {
+			t.Errorf("wrong types for %q, got %v want %v", tc.input, types, tc.expected)
+		}
+	}
+
+	if _, err := parseSearchTypes("card,notes"); err == nil {
+		t.Errorf("expected an error for an unknown type")
+	}
+}
+
+func setupUnifiedSearch(s *Handler, t *testing.T) {
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO tasks (card_pk, user_id, title) VALUES (1, 1, 'water the compost heap')`, nil},
+		{`UPDATE entities SET description = 'An expert on compost' WHERE id = 1`, nil},
+		{`INSERT INTO files (name, user_id, type, path, filename, size, created_by, updated_by, card_pk, extracted_text)
+		VALUES ('notes.txt', 1, 'text/plain', 'x', 'x', 10, 1, 1, 1, 'a long note about compost')`, nil},
+		{`INSERT INTO chat_conversations (id, user_id, title, message_count) VALUES ($1, 1, 'Garden questions', 1)`, []interface{}{uuid.New()}},
+		{`INSERT INTO chat_completions (user_id, conversation_id, sequence_number, role, content)
+		SELECT 1, id, 1, 'user', 'how do I start compost?' FROM chat_conversations WHERE title = 'Garden questions'`, nil},
+		{`INSERT INTO tasks (card_pk, user_id, title) VALUES (1, 2, 'other user compost')`, nil},
+	}
+	for _, statement := range statements {
+		if _, err := s.DB.Exec(statement.query, statement.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := s.CreateCard(1, models.EditCardParams{CardID: "100", Title: "Compost", Body: "compost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnifiedSearchQuery(t *testing.T) {
+	node, _ := ParseSearchQuery(`(compost OR "worm bin") !heap #garden`)
+	output, args := unifiedSearchQuery(node, 1)
+	expected := "((plainto_tsquery('english', $2) || phraseto_tsquery('english', $3)) && (!! plainto_tsquery('english', $4)))"
+	if output != expected {
+		t.Errorf("wrong tsquery, got %v want %v", output, expected)
+	}
+	if !reflect.DeepEqual(args, []interface{}{1, "compost", "worm bin", "heap"}) {
+		t.Errorf("wrong args, got %v", args)
+	}
+
+	node, _ = ParseSearchQuery(`#garden title:compost`)
+	if output, _ := unifiedSearchQuery(node, 1); output != "" {
+		t.Errorf("a query of only filters should have no tsquery, got %v", output)
+	}
+}
+
+func TestFuseSearchResultTypes(t *testing.T) {
+	now := time.Now()
+	cards := []models.SearchResult{
+		{ID: "1", Type: "card", Score: 0.9, UpdatedAt: now},
+		{ID: "2", Type: "card", Score: 0.8, UpdatedAt: now},
+	}
+	tasks := []models.SearchResult{
+		{ID: "3", Type: "task", Score: 0.01, UpdatedAt: now.Add(time.Hour)},
+	}
+	results := fuseSearchResultTypes([][]models.SearchResult{cards, tasks}, HYBRID_RRF_K)
+	var ids []string
+	for _, result := range results {
+		ids = append(ids, result.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"3", "1", "2"}) {
+		t.Errorf("wrong order, got %v", ids)
+	}
+	if results[2].Score != 1/float64(HYBRID_RRF_K+2) {
+		t.Errorf("wrong score, got %v", results[2].Score)
+	}
+}
+
+func TestUnifiedSearch(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	setupUnifiedSearch(s, t)
+
+	results, err := s.UnifiedSearch(1, "compost", SEARCH_RESULT_TYPES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]int)
+	for i, result := range results {
+		found[result.Type]++
+		if i > 0 && result.Score > results[i-1].Score {
+			t.Errorf("results should be ordered by score")
+		}
+	}
+	for _, resultType := range SEARCH_RESULT_TYPES {
+		if found[resultType] != 1 {
+			t.Errorf("wrong number of %v results, got %v want %v", resultType, found[resultType], 1)
+		}
+	}
+
+	results, err = s.UnifiedSearch(1, "compost", []string{"task"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Type != "task" || results[0].Title != "water the compost heap" {
+		t.Errorf("wrong task results, got %+v", results)
+	}
+	metadata := results[0].Metadata.(map[string]interface{})
+	if metadata["card_pk"] != int64(1) || metadata["status"] != "open" {
+		t.Errorf("wrong task metadata, got %v", metadata)
+	}
+}
+
+func TestUnifiedSearchFiltersOnlyMatchCards(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	setupUnifiedSearch(s, t)
+
+	results, err := s.UnifiedSearch(1, "title:compost", SEARCH_RESULT_TYPES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Type != "card" {
+			t.Errorf("a query of only filters should only return cards, got %v", result.Type)
+		}
+	}
+}
+
+func TestSearchRouteTypes(t *testing.T) {
+	s := setup()
+	defer tests.Teardown()
+	setupUnifiedSearch(s, t)
+
+	token, _ := tests.GenerateTestJWT(1)
+	testCases := []struct {
+		params string
+		status int
+	}{
+		{"type=classic&search_term=compost&types=card,task,chat", http.StatusOK},
+		{"type=classic&search_term=compost&types=bogus", http.StatusBadRequest},
+		{"type=semantic&search_term=compost&types=task", http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", "/api/search?"+tc.params, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.JwtMiddleware(s.SemanticSearchCardsRoute)).ServeHTTP(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("wrong status for %v, got %v want %v", tc.params, rr.Code, tc.status)
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		var results []models.SearchResult
+		tests.ParseJsonResponse(t, rr.Body.Bytes(), &results)
+		if len(results) != 3 {
+			t.Errorf("wrong number of results, got %v want %v", len(results), 3)
+		}
+	}
+}
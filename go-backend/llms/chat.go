@@ -1,6 +1,7 @@
 package llms
 
 import (
+	"context"
 	"fmt"
 	"go-backend/models"
 	"log"
@@ -9,29 +10,35 @@ import (
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// ChatMessages is the prompt for a plain chat answer: the conversation so
+// far.
+func ChatMessages(pastMessages []models.ChatCompletion) []openai.ChatCompletionMessage {
+	var messages []openai.ChatCompletionMessage
+	for _, message := range pastMessages {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    message.Role,
+			Content: message.Content,
+		})
+	}
+	return messages
+}
+
 func ChatCompletion(c *models.LLMClient, pastMessages []models.ChatCompletion) (models.ChatCompletion, error) {
 	if c.Testing {
 		// Return mock response
 		return models.ChatCompletion{
 			Role:    "assistant",
 			Content: "This is a mock response for testing",
-			Model:   models.MODEL,
+			Model:   c.ModelFor(models.AnsweringTask).Model,
 			Tokens:  100,
 		}, nil
 	}
-	var messages []openai.ChatCompletionMessage
-
-	for _, message := range pastMessages {
-		messages = append(messages, openai.ChatCompletionMessage{
-			Role:    message.Role,
-			Content: message.Content,
-		})
-	}
+	messages := ChatMessages(pastMessages)
 	log.Printf("messages %v", messages)
 
 	// Create the OpenAI request
 
-	resp, err := ExecuteLLMRequest(c, messages)
+	resp, err := ExecuteLLMRequest(c, models.AnsweringTask, messages)
 	if err != nil {
 		log.Printf("error getting completion: %v", err)
 		return models.ChatCompletion{}, fmt.Errorf("failed to get AI response")
@@ -44,7 +51,7 @@ func ChatCompletion(c *models.LLMClient, pastMessages []models.ChatCompletion) (
 	completion := models.ChatCompletion{
 		Role:    resp.Choices[0].Message.Role,
 		Content: resp.Choices[0].Message.Content,
-		Model:   models.MODEL,
+		Model:   responseModel(c, models.AnsweringTask, resp),
 		Tokens:  resp.Usage.TotalTokens,
 	}
 	return completion, err
@@ -59,7 +66,7 @@ func CreateConversationSummary(c *models.LLMClient, message models.ChatCompletio
 			ID:        message.ConversationID,
 			Title:     "🤖 Mock Summary Title",
 			CreatedAt: message.CreatedAt,
-			Model:     models.MODEL,
+			Model:     message.Model,
 		}, nil
 	}
 
@@ -73,16 +80,21 @@ func CreateConversationSummary(c *models.LLMClient, message models.ChatCompletio
 			Content: fmt.Sprintf("Please generate a few words a title that summarizes the following quesiton and answer. Please start with an emoji that you think covers the topic as well. Respond only in the format: Emoji Title, nothing else. Please no quotation marks. Content: %v", content),
 		},
 	}
-	resp, err := ExecuteLLMRequest(c, new)
+	resp, err := ExecuteLLMRequest(c, models.TitlingTask, new)
 	if err != nil {
 		log.Printf("error getting completion: %v", err)
 		return models.ConversationSummary{}, fmt.Errorf("failed to get AI response")
 	}
+	if len(resp.Choices) == 0 {
+		return models.ConversationSummary{}, fmt.Errorf("no response from AI")
+	}
+	// the conversation is shown with the model that answered, not the one
+	// that wrote its title
 	result := models.ConversationSummary{
 		ID:        id,
 		Title:     resp.Choices[0].Message.Content,
 		CreatedAt: created,
-		Model:     models.MODEL,
+		Model:     message.Model,
 	}
 	return result, nil
 }
@@ -92,6 +104,7 @@ func ChooseOptions(c *models.LLMClient, userInput string) (models.ChatOption, er
 You are a command router for a zettelkasten. Your only job is to analyze user input and return exactly one of these values:
 - "Cards" - This probably is the main thing the user will be asking about. Any time the user is asking you to look up information, this is probably what you want to be doing.
 - "UserInfo" - if the user is asking about themselves, their information, their account, their settings, or their preferences
+- "Tools" - if the user is asking you to do something in their zettelkasten, such as creating a card or a task, looking up a card by its id, or listing the tasks they have due
 - "Chat" - for all other queries
 Respond with only one of these exact strings, nothing else. If you are not sure, ask the user to select one of the options.
 `
@@ -106,7 +119,7 @@ Respond with only one of these exact strings, nothing else. If you are not sure,
 		},
 	}
 
-	resp, err := ExecuteLLMRequest(c, messages)
+	resp, err := ExecuteLLMRequest(c, models.RoutingTask, messages)
 	if err != nil {
 		log.Printf("error getting completion: %v", err)
 		return "", fmt.Errorf("failed to get AI response: %w", err)
@@ -121,7 +134,7 @@ Respond with only one of these exact strings, nothing else. If you are not sure,
 
 	// Validate the response
 	switch result {
-	case string(models.Chat), string(models.UserInfo), string(models.Cards):
+	case string(models.Chat), string(models.UserInfo), string(models.Cards), string(models.Tools):
 		return models.ChatOption(result), nil
 	default:
 		log.Printf("unexpected routing response: %s, defaulting to Chat", result)
@@ -129,8 +142,9 @@ Respond with only one of these exact strings, nothing else. If you are not sure,
 	}
 }
 
-func AnswerUserInfoQuestion(c *models.LLMClient, userData models.User, lastMessage string) (models.ChatCompletion, error) {
-
+// UserInfoMessages is the prompt for answering a question about the user's
+// own account.
+func UserInfoMessages(userData models.User, lastMessage string) []openai.ChatCompletionMessage {
 	prompt := `
 You are a helpful assistant. Your job is to take a go struct of user data and use it to answer the user's question. If you don't have the information you need, say you can't answer the question. Be brief. Never give out the user's password':
 
@@ -166,8 +180,13 @@ The user data is this: %v'
 			Content: lastMessage,
 		},
 	}
+	return messages
+}
+
+func AnswerUserInfoQuestion(c *models.LLMClient, userData models.User, lastMessage string) (models.ChatCompletion, error) {
+	messages := UserInfoMessages(userData, lastMessage)
 
-	resp, err := ExecuteLLMRequest(c, messages)
+	resp, err := ExecuteLLMRequest(c, models.AnsweringTask, messages)
 	if err != nil {
 		log.Printf("error getting completion: %v", err)
 		return models.ChatCompletion{}, fmt.Errorf("failed to get AI response: %w", err)
@@ -180,13 +199,15 @@ The user data is this: %v'
 	completion := models.ChatCompletion{
 		Role:    resp.Choices[0].Message.Role,
 		Content: resp.Choices[0].Message.Content,
-		Model:   models.MODEL,
+		Model:   responseModel(c, models.AnsweringTask, resp),
 		Tokens:  resp.Usage.TotalTokens,
 	}
 	return completion, err
 
 }
-func CardSearchChatCompletion(c *models.LLMClient, messages []models.ChatCompletion, relatedCards []models.CardChunk) (models.ChatCompletion, error) {
+
+// CardSearchMessages is the prompt for answering from the related cards.
+func CardSearchMessages(messages []models.ChatCompletion, relatedCards []models.CardChunk) []openai.ChatCompletionMessage {
 	// Create a string representation of the cards for the context
 	var cardContext strings.Builder
 	cardContext.WriteString("Here are the relevant cards from the knowledge base:\n\n")
@@ -223,10 +244,15 @@ Context: %s`
 			Content: msg.Content,
 		})
 	}
+	return openAIMessages
+}
+
+func CardSearchChatCompletion(c *models.LLMClient, messages []models.ChatCompletion, relatedCards []models.CardChunk) (models.ChatCompletion, error) {
+	openAIMessages := CardSearchMessages(messages, relatedCards)
 
 	// Get completion from OpenAI
 
-	resp, err := ExecuteLLMRequest(c, openAIMessages)
+	resp, err := ExecuteLLMRequest(c, models.AnsweringTask, openAIMessages)
 	if err != nil {
 		log.Printf("error getting completion: %v", err)
 		return models.ChatCompletion{}, fmt.Errorf("failed to get AI response: %w", err)
@@ -240,7 +266,7 @@ Context: %s`
 	completion := models.ChatCompletion{
 		Role:    resp.Choices[0].Message.Role,
 		Content: resp.Choices[0].Message.Content,
-		Model:   models.MODEL,
+		Model:   responseModel(c, models.AnsweringTask, resp),
 		Tokens:  resp.Usage.TotalTokens,
 	}
 
@@ -253,3 +279,22 @@ Context: %s`
 
 	return completion, nil
 }
+
+// StreamChatCompletion answers from the prompt with the answering model,
+// passing each piece of the answer to onDelta as it arrives. The returned
+// completion holds the whole answer.
+func StreamChatCompletion(ctx context.Context, c *models.LLMClient, messages []openai.ChatCompletionMessage, onDelta func(string) error) (models.ChatCompletion, error) {
+	if c.Testing {
+		completion, err := ChatCompletion(c, nil)
+		if err == nil {
+			err = onDelta(completion.Content)
+		}
+		return completion, err
+	}
+	completion, err := StreamLLMRequest(ctx, c, models.AnsweringTask, messages, onDelta)
+	if err != nil {
+		log.Printf("error streaming completion: %v", err)
+		return models.ChatCompletion{}, fmt.Errorf("failed to get AI response: %w", err)
+	}
+	return completion, nil
+}
@@ -1,46 +1,425 @@
 package llms
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-func GenerateChunks(input string) []string {
-	results := []string{}
-	current := ""
+const (
+	DEFAULT_CHUNK_TARGET_TOKENS     = 200
+	DEFAULT_CHUNK_MAX_TOKENS        = 400
+	DEFAULT_CHUNK_OVERLAP_SENTENCES = 1
+)
 
-	// Only trim leading/trailing spaces
-	input = strings.TrimSpace(input)
+// ChunkerConfig sizes chunks in tokens, as estimated by EstimateTokens.
+type ChunkerConfig struct {
+	// TargetTokens is the size chunks are filled up to.
+	TargetTokens int `json:"target_tokens"`
+	// MaxTokens is the most a chunk can hold. Sentences, list items and
+	// code blocks are only split when they are longer than this.
+	MaxTokens int `json:"max_tokens"`
+	// OverlapSentences is how many sentences from the end of a chunk are
+	// repeated at the start of the next one in the same section.
+	OverlapSentences int `json:"overlap_sentences"`
+}
 
-	// Regular expression to match reference patterns that end in a line break
-	refPattern := regexp.MustCompile(`(?m)\[[A-Z]\.\d+\].*$`)
+func DefaultChunkerConfig() ChunkerConfig {
+	return ChunkerConfig{
+		TargetTokens:     DEFAULT_CHUNK_TARGET_TOKENS,
+		MaxTokens:        DEFAULT_CHUNK_MAX_TOKENS,
+		OverlapSentences: DEFAULT_CHUNK_OVERLAP_SENTENCES,
+	}
+}
 
-	// Remove the references that end in line breaks
-	input = refPattern.ReplaceAllString(input, "")
+// ChunkerConfigFromEnv reads ZETTEL_CHUNK_TARGET_TOKENS,
+// ZETTEL_CHUNK_MAX_TOKENS and ZETTEL_CHUNK_OVERLAP_SENTENCES, keeping the
+// defaults for those that are unset.
+func ChunkerConfigFromEnv() (ChunkerConfig, error) {
+	config := DefaultChunkerConfig()
+	for name, target := range map[string]*int{
+		"ZETTEL_CHUNK_TARGET_TOKENS":     &config.TargetTokens,
+		"ZETTEL_CHUNK_MAX_TOKENS":        &config.MaxTokens,
+		"ZETTEL_CHUNK_OVERLAP_SENTENCES": &config.OverlapSentences,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return config, fmt.Errorf("invalid %s %q", name, value)
+		}
+		*target = parsed
+	}
+	if config.TargetTokens == 0 || config.MaxTokens < config.TargetTokens {
+		return config, fmt.Errorf("chunk max tokens %d must be at least the target %d, which must be above 0",
+			config.MaxTokens, config.TargetTokens)
+	}
+	return config, nil
+}
 
-	// Split by periods but add them back
-	sentences := strings.Split(input+".", ".")
-	for i, sentence := range sentences {
-		// Skip the last empty element caused by our added period
-		if i == len(sentences)-1 && sentence == "" {
-			break
+// EstimateTokens approximates how many tokens a text is, at about four
+// characters to a token for English.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// ChunkHash identifies the text of a chunk. Embeddings are stored with the
+// hash of their chunk, so a chunk that did not change keeps its vector.
+func ChunkHash(chunk string) string {
+	sum := sha256.Sum256([]byte(chunk))
+	return hex.EncodeToString(sum[:])
+}
+
+// Chunk is a piece of a card along with the headings it sits under, starting
+// with the card title.
+type Chunk struct {
+	HeadingPath []string
+	Text        string
+}
+
+// Content is the text that is stored and embedded for the chunk, with its
+// heading path in front so that it keeps the context it was written in.
+func (c Chunk) Content() string {
+	if len(c.HeadingPath) == 0 {
+		return c.Text
+	}
+	return strings.Join(c.HeadingPath, " > ") + "\n\n" + c.Text
+}
+
+type chunkUnitKind int
+
+const (
+	sentenceUnit chunkUnitKind = iota
+	lineUnit
+	blockUnit
+)
+
+// chunkUnit is the smallest piece a chunk is made of: a sentence, a list
+// item or table row, or a whole code block. Units of the same paragraph,
+// list or block share a block number.
+type chunkUnit struct {
+	text   string
+	tokens int
+	kind   chunkUnitKind
+	block  int
+}
+
+type chunkSection struct {
+	path  []string
+	units []chunkUnit
+}
+
+var (
+	// references such as "[A.1] - Source" are links to other cards
+	referencePattern = regexp.MustCompile(`(?m)\[[A-Z]\.\d+\].*$`)
+	headingPattern   = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	listItemPattern  = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+`)
+)
+
+// ChunkMarkdown splits a card into chunks that follow its Markdown
+// structure. A heading always starts a new chunk, code blocks are kept
+// whole, list items and table rows are not split, and paragraphs are split
+// between sentences. Zero sizes in the config use the defaults.
+func ChunkMarkdown(title, body string, config ChunkerConfig) []Chunk {
+	if config.TargetTokens <= 0 {
+		config.TargetTokens = DEFAULT_CHUNK_TARGET_TOKENS
+	}
+	if config.MaxTokens < config.TargetTokens {
+		config.MaxTokens = config.TargetTokens
+	}
+
+	var root []string
+	if title = strings.TrimSpace(title); title != "" {
+		root = []string{title}
+	}
+	chunks := []Chunk{}
+	for _, section := range markdownSections(root, body, config.MaxTokens) {
+		chunks = append(chunks, packSection(section, config)...)
+	}
+	if len(chunks) == 0 && title != "" {
+		chunks = append(chunks, Chunk{Text: title})
+	}
+	return chunks
+}
+
+// markdownSections breaks the body into the units under each heading.
+func markdownSections(root []string, body string, maxTokens int) []chunkSection {
+	body = referencePattern.ReplaceAllString(body, "")
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+
+	headings := []string{}
+	sections := []chunkSection{{path: root}}
+	block := 0
+	var paragraph []string
+	var item []string
+
+	add := func(text string, kind chunkUnitKind) {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return
+		}
+		unit := chunkUnit{text: text, tokens: EstimateTokens(text), kind: kind, block: block}
+		current := &sections[len(sections)-1]
+		current.units = append(current.units, splitUnit(unit, maxTokens)...)
+	}
+	flushItem := func() {
+		if len(item) > 0 {
+			add(strings.Join(item, " "), lineUnit)
+			item = nil
+		}
+	}
+	flush := func() {
+		if len(paragraph) > 0 {
+			for _, sentence := range splitSentences(strings.Join(paragraph, " ")) {
+				add(sentence, sentenceUnit)
+			}
+			paragraph = nil
 		}
+		flushItem()
+		block++
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
 
-		// Only trim leading spaces, preserve newlines and trailing spaces
-		sentence = strings.TrimLeft(sentence, " ")
-		if sentence == "" || strings.TrimSpace(sentence) == "" {
+		if fence := codeFence(trimmed); fence != "" {
+			flush()
+			code := []string{line}
+			for i+1 < len(lines) {
+				i++
+				code = append(code, lines[i])
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+					break
+				}
+			}
+			add(strings.Join(code, "\n"), blockUnit)
+			block++
 			continue
 		}
-		current += sentence
-		if len(current) >= 300 {
-			results = append(results, current+".")
-			current = ""
+		if match := headingPattern.FindStringSubmatch(trimmed); match != nil {
+			flush()
+			level := len(match[1])
+			for len(headings) < level {
+				headings = append(headings, "")
+			}
+			headings = append(headings[:level-1], match[2])
+			path := append([]string{}, root...)
+			for _, heading := range headings {
+				if heading != "" {
+					path = append(path, heading)
+				}
+			}
+			sections = append(sections, chunkSection{path: path})
+			continue
+		}
+		switch {
+		case trimmed == "":
+			flush()
+		case listItemPattern.MatchString(line):
+			if len(paragraph) > 0 {
+				flush()
+			}
+			flushItem()
+			item = []string{trimmed}
+		case len(item) > 0 && line != trimmed:
+			// an indented line continues the list item
+			item = append(item, trimmed)
+		case strings.HasPrefix(trimmed, "|"):
+			if len(paragraph) > 0 {
+				flush()
+			}
+			flushItem()
+			add(trimmed, lineUnit)
+		default:
+			if len(item) > 0 {
+				flush()
+			}
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flush()
+	return sections
+}
+
+// codeFence returns the fence a line opens a code block with, if any.
+func codeFence(line string) string {
+	for _, fence := range []string{"```", "~~~"} {
+		if strings.HasPrefix(line, fence) {
+			return fence
 		}
+	}
+	return ""
+}
 
+// packSection fills chunks with the section's units up to the target size,
+// repeating the last sentences of each chunk at the start of the next.
+func packSection(section chunkSection, config ChunkerConfig) []Chunk {
+	var chunks []Chunk
+	var current []chunkUnit
+	tokens, fresh := 0, 0
+	for _, unit := range section.units {
+		if fresh > 0 && tokens+unit.tokens > config.TargetTokens {
+			chunks = append(chunks, Chunk{HeadingPath: section.path, Text: joinUnits(current)})
+			current = overlapUnits(current, config)
+			tokens = 0
+			for _, carried := range current {
+				tokens += carried.tokens
+			}
+			if tokens+unit.tokens > config.MaxTokens {
+				current, tokens = nil, 0
+			}
+			fresh = 0
+		}
+		current = append(current, unit)
+		tokens += unit.tokens
+		fresh++
 	}
-	if current != "" {
-		results = append(results, current+".")
+	if fresh > 0 {
+		chunks = append(chunks, Chunk{HeadingPath: section.path, Text: joinUnits(current)})
 	}
+	return chunks
+}
+
+// overlapUnits returns the sentences at the end of a chunk to carry into
+// the next, as long as they take up no more than half of it.
+func overlapUnits(units []chunkUnit, config ChunkerConfig) []chunkUnit {
+	start, tokens := len(units), 0
+	for start > 0 && len(units)-start < config.OverlapSentences {
+		unit := units[start-1]
+		if unit.kind != sentenceUnit || tokens+unit.tokens > config.TargetTokens/2 {
+			break
+		}
+		tokens += unit.tokens
+		start--
+	}
+	return append([]chunkUnit{}, units[start:]...)
+}
 
+func joinUnits(units []chunkUnit) string {
+	var builder strings.Builder
+	for i, unit := range units {
+		if i > 0 {
+			switch {
+			case unit.block != units[i-1].block:
+				builder.WriteString("\n\n")
+			case unit.kind == sentenceUnit:
+				builder.WriteString(" ")
+			default:
+				builder.WriteString("\n")
+			}
+		}
+		builder.WriteString(unit.text)
+	}
+	return builder.String()
+}
+
+// splitUnit breaks a unit that is over the limit on lines, or on words when
+// it is a single line. A single word over the limit is left as it is.
+func splitUnit(unit chunkUnit, maxTokens int) []chunkUnit {
+	if unit.tokens <= maxTokens {
+		return []chunkUnit{unit}
+	}
+	separator := "\n"
+	pieces := strings.Split(unit.text, "\n")
+	if len(pieces) == 1 {
+		separator = " "
+		pieces = strings.Fields(unit.text)
+	}
+	if len(pieces) <= 1 {
+		return []chunkUnit{unit}
+	}
+
+	var results []chunkUnit
+	part := func(text string) []chunkUnit {
+		return splitUnit(chunkUnit{text: text, tokens: EstimateTokens(text), kind: unit.kind, block: unit.block}, maxTokens)
+	}
+	current := ""
+	for _, piece := range pieces {
+		if current != "" && EstimateTokens(current+separator+piece) > maxTokens {
+			results = append(results, part(current)...)
+			current = ""
+		}
+		if current == "" {
+			current = piece
+		} else {
+			current += separator + piece
+		}
+	}
+	if current != "" {
+		results = append(results, part(current)...)
+	}
 	return results
 }
+
+// abbreviations end in a period without ending the sentence.
+var abbreviations = map[string]bool{
+	"e.g": true, "i.e": true, "etc": true, "vs": true, "cf": true, "al": true,
+	"dr": true, "mr": true, "mrs": true, "ms": true, "prof": true, "st": true,
+	"no": true, "fig": true, "vol": true, "ed": true, "p": true, "pp": true,
+	"approx": true, "ca": true,
+}
+
+// splitSentences splits text after a full stop, question or exclamation
+// mark that is followed by a space and does not end an abbreviation or
+// initial, so that decimals, URLs and "e.g." stay in one sentence.
+func splitSentences(text string) []string {
+	runes := []rune(text)
+	var sentences []string
+	start := 0
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '.' && runes[i] != '!' && runes[i] != '?' {
+			continue
+		}
+		end := i + 1
+		for end < len(runes) && strings.ContainsRune(`.!?"')]”’`, runes[end]) {
+			end++
+		}
+		if end < len(runes) && !unicode.IsSpace(runes[end]) {
+			i = end - 1
+			continue
+		}
+		if runes[i] == '.' && endsWithAbbreviation(runes[start:i]) {
+			continue
+		}
+		next := end
+		for next < len(runes) && unicode.IsSpace(runes[next]) {
+			next++
+		}
+		if next < len(runes) && unicode.IsLower(runes[next]) {
+			i = end - 1
+			continue
+		}
+		if sentence := strings.TrimSpace(string(runes[start:end])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start = end
+		i = end - 1
+	}
+	if sentence := strings.TrimSpace(string(runes[start:])); sentence != "" {
+		sentences = append(sentences, sentence)
+	}
+	return sentences
+}
+
+// endsWithAbbreviation reports whether the word before a period is a known
+// abbreviation or a single capital letter, as in "J. Smith".
+func endsWithAbbreviation(text []rune) bool {
+	wordStart := len(text)
+	for wordStart > 0 && !unicode.IsSpace(text[wordStart-1]) {
+		wordStart--
+	}
+	word := strings.TrimLeft(string(text[wordStart:]), `("'[`)
+	if utf8.RuneCountInString(word) == 1 {
+		return unicode.IsUpper([]rune(word)[0])
+	}
+	return abbreviations[strings.ToLower(word)]
+}
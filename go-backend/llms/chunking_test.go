@@ -1,81 +1,156 @@
 package llms
 
 import (
-	"log"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
 )
 
-func TestChunkCardBody(t *testing.T) {
-	input := `Lorem ipsum odor amet, consectetuer adipiscing elit. Luctus egestas lobortis cursus mollis facilisi. Scelerisque vel litora rhoncus porttitor eros. Lacus orci morbi a varius lobortis rutrum interdum per. Nostra commodo phasellus etiam morbi metus porttitor. Mauris a fermentum habitasse sollicitudin semper porta. Fermentum phasellus hendrerit purus, etiam erat litora.
+func TestSplitSentences(t *testing.T) {
+	input := `Tools such as grep, e.g. ripgrep, are fast. Pi is about 3.14 and the docs live at https://example.com/docs.html for now! Did J. Smith agree? He did.`
+	expected := []string{
+		"Tools such as grep, e.g. ripgrep, are fast.",
+		"Pi is about 3.14 and the docs live at https://example.com/docs.html for now!",
+		"Did J. Smith agree?",
+		"He did.",
+	}
+	if results := splitSentences(input); !reflect.DeepEqual(results, expected) {
+		t.Errorf("wrong sentences, got %q want %q", results, expected)
+	}
+}
 
-Lorem cubilia cubilia dis iaculis, odio vivamus interdum adipiscing dolor.`
+func TestChunkMarkdownHeadingPath(t *testing.T) {
+	input := `Intro paragraph.
 
-	results := GenerateChunks(input)
-	for _, result := range results {
-		log.Printf(result)
-	}
+# Methods
 
-	if len(results) != 2 {
-		t.Errorf("wrong number of chunks returned, got %v want %v", len(results), 2)
-	}
-	string := `Fermentum phasellus hendrerit purus, etiam erat litora
+## Sampling
+
+How the samples were taken.
 
-Lorem cubilia cubilia dis iaculis, odio vivamus interdum adipiscing dolor.`
+# Results
 
-	if len(results) > 1 && results[1] != string {
-		t.Errorf("wrong chunk return, %v, got %v want %v", results[1] == string, results[1], string)
+What was found.`
 
+	results := ChunkMarkdown("Study", input, DefaultChunkerConfig())
+	expected := []Chunk{
+		{HeadingPath: []string{"Study"}, Text: "Intro paragraph."},
+		{HeadingPath: []string{"Study", "Methods", "Sampling"}, Text: "How the samples were taken."},
+		{HeadingPath: []string{"Study", "Results"}, Text: "What was found."},
 	}
-}
-func TestChunkCardMultiChunkLength(t *testing.T) {
-	input := `012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789.`
-	input += input
-	input += input
-	if len(input) != 1204 {
-		t.Errorf("wrong length of input, got %v want %v", len(input), 1204)
-	}
-	results := GenerateChunks(input)
-	if len(results) != 4 {
-		t.Errorf("wrong number of chunks returned, got %v want %v", len(results), 4)
-	}
-	input += "hello world"
-	results = GenerateChunks(input)
-	if len(results) != 5 {
-		t.Errorf("wrong number of chunks returned, got %v want %v", len(results), 5)
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("wrong chunks, got %+v want %+v", results, expected)
+	}
+	if content := results[1].Content(); content != "Study > Methods > Sampling\n\nHow the samples were taken." {
+		t.Errorf("wrong content, got %q", content)
 	}
 }
 
-func TestChunkCardBodyRemoveBacklinks(t *testing.T) {
+func TestChunkMarkdownKeepsBlocksWhole(t *testing.T) {
+	input := "Steps to follow.\n\n- first step\n- second step\n  continued here\n\n```go\nfunc main() {\n\n\tfmt.Println(\"hi. there\")\n}\n```"
+	results := ChunkMarkdown("", input, DefaultChunkerConfig())
+	if len(results) != 1 {
+		t.Fatalf("expected one chunk, got %+v", results)
+	}
+	expected := "Steps to follow.\n\n- first step\n- second step continued here\n\n```go\nfunc main() {\n\n\tfmt.Println(\"hi. there\")\n}\n```"
+	if results[0].Text != expected {
+		t.Errorf("wrong chunk, got %q want %q", results[0].Text, expected)
+	}
+}
 
-	input := `Lorem ipsum odor amet, consectetuer adipiscing elit. Luctus egestas lobortis cursus mollis facilisi. 
+func TestChunkMarkdownTokenBudget(t *testing.T) {
+	inputBytes, err := os.ReadFile("../testdata/long_text.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ChunkerConfig{TargetTokens: 100, MaxTokens: 150, OverlapSentences: 1}
+	results := ChunkMarkdown("Long", string(inputBytes), config)
+	if len(results) < 5 {
+		t.Fatalf("expected the text to be split into several chunks, got %v", len(results))
+	}
+	for i, chunk := range results {
+		if tokens := EstimateTokens(chunk.Text); tokens > config.MaxTokens {
+			t.Errorf("chunk %v is over the limit with %v tokens", i, tokens)
+		}
+	}
+}
 
-[A.1] - Test`
-	results := GenerateChunks(input)
-	if strings.Contains(results[0], "[A.1]") {
-		t.Errorf("string still contains reference %v", "[A.1]")
+func TestChunkMarkdownOverlap(t *testing.T) {
+	input := "The first sentence is here. The second sentence is here. The third sentence is here. The fourth sentence is here."
+	results := ChunkMarkdown("", input, ChunkerConfig{TargetTokens: 16, MaxTokens: 32, OverlapSentences: 1})
+	expected := []string{
+		"The first sentence is here. The second sentence is here.",
+		"The second sentence is here. The third sentence is here.",
+		"The third sentence is here. The fourth sentence is here.",
 	}
-	if strings.Contains(results[0], "Test") {
-		t.Errorf("string still contains reference %v", "bit longer")
+	var texts []string
+	for _, chunk := range results {
+		texts = append(texts, chunk.Text)
 	}
+	if !reflect.DeepEqual(texts, expected) {
+		t.Errorf("wrong chunks, got %q want %q", texts, expected)
+	}
+}
 
-	if len(results) != 1 {
-		t.Errorf("wrong number of chunks returned, got %v want %v", len(results), 2)
+func TestChunkMarkdownSplitsLongSentences(t *testing.T) {
+	input := strings.Repeat("word ", 1000)
+	results := ChunkMarkdown("", input, ChunkerConfig{TargetTokens: 100, MaxTokens: 200})
+	if len(results) < 5 {
+		t.Errorf("expected a long sentence to be split, got %v chunks", len(results))
+	}
+	for _, chunk := range results {
+		if EstimateTokens(chunk.Text) > 200 {
+			t.Errorf("chunk is over the limit, %v tokens", EstimateTokens(chunk.Text))
+		}
 	}
-	input = `Lorem ipsum odor amet, consectetuer adipiscing elit. Luctus egestas lobortis cursus mollis facilisi. 
+}
+
+func TestChunkMarkdownRemovesReferences(t *testing.T) {
+	input := `Lorem ipsum odor amet, consectetuer adipiscing elit. Luctus egestas lobortis cursus mollis facilisi.
 
 [A.1] - Test
 
 [B.1] - Another test, this one a bit longer`
-	results = GenerateChunks(input)
+	results := ChunkMarkdown("", input, DefaultChunkerConfig())
 	if len(results) != 1 {
-		t.Errorf("wrong number of chunks returned, got %v want %v", len(results), 2)
+		t.Fatalf("wrong number of chunks returned, got %v want %v", len(results), 1)
 	}
-	if strings.Contains(results[0], "[B.1]") {
-		t.Errorf("string still contains reference %v", "[B.1]")
+	for _, reference := range []string{"[A.1]", "[B.1]", "Test", "bit longer"} {
+		if strings.Contains(results[0].Text, reference) {
+			t.Errorf("chunk still contains reference %v", reference)
+		}
 	}
-	if strings.Contains(results[0], "but longer") {
-		t.Errorf("string still contains reference %v", "bit longer")
+}
+
+func TestChunkMarkdownTitleOnly(t *testing.T) {
+	results := ChunkMarkdown("Just a title", "  ", DefaultChunkerConfig())
+	if len(results) != 1 || results[0].Content() != "Just a title" {
+		t.Errorf("a card without a body should be chunked by its title, got %+v", results)
 	}
+}
 
+func TestChunkerConfigFromEnv(t *testing.T) {
+	t.Setenv("ZETTEL_CHUNK_TARGET_TOKENS", "450")
+	t.Setenv("ZETTEL_CHUNK_MAX_TOKENS", "")
+	if _, err := ChunkerConfigFromEnv(); err == nil {
+		t.Errorf("expected an error for a target over the max")
+	}
+	t.Setenv("ZETTEL_CHUNK_MAX_TOKENS", "500")
+	t.Setenv("ZETTEL_CHUNK_OVERLAP_SENTENCES", "0")
+	config, err := ChunkerConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != (ChunkerConfig{TargetTokens: 450, MaxTokens: 500, OverlapSentences: 0}) {
+		t.Errorf("wrong config, got %+v", config)
+	}
+}
+
+func TestChunkHash(t *testing.T) {
+	// the schema computes the same hash for existing chunks
+	expected := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if hash := ChunkHash("abc"); hash != expected {
+		t.Errorf("wrong hash, got %v", hash)
+	}
 }
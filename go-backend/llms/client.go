@@ -3,7 +3,14 @@ package llms
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"go-backend/models"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
 
 	openai "github.com/sashabaranov/go-openai"
 )
@@ -11,19 +18,143 @@ import (
 func NewClient(db *sql.DB, config openai.ClientConfig) *models.LLMClient {
 	return &models.LLMClient{
 		Client:         openai.NewClientWithConfig(config),
+		Models:         map[models.ChatTask]models.ChatModelConfig{},
 		Testing:        false,
 		EmbeddingQueue: models.NewEmbeddingQueue(db),
 	}
 }
 
-func ExecuteLLMRequest(c *models.LLMClient, messages []openai.ChatCompletionMessage) (openai.ChatCompletionResponse, error) {
+// ChatModelsFromEnv reads the chat model settings for each task:
+//
+//	ZETTEL_LLM_MODEL        model name, DEFAULT_CHAT_MODEL when unset
+//	ZETTEL_LLM_TEMPERATURE  sampling temperature, from 0 to 2
+//	ZETTEL_LLM_MAX_TOKENS   most tokens to generate
+//
+// These apply to every task and can be overridden for one task by adding
+// its name, such as ZETTEL_LLM_ROUTING_MODEL or ZETTEL_LLM_ANSWERING_MAX_TOKENS.
+func ChatModelsFromEnv() (map[models.ChatTask]models.ChatModelConfig, error) {
+	defaults, err := chatModelFromEnv("ZETTEL_LLM_", models.ChatModelConfig{Model: models.DEFAULT_CHAT_MODEL})
+	if err != nil {
+		return nil, err
+	}
+	configs := make(map[models.ChatTask]models.ChatModelConfig)
+	for _, task := range models.CHAT_TASKS {
+		prefix := "ZETTEL_LLM_" + strings.ToUpper(string(task)) + "_"
+		configs[task], err = chatModelFromEnv(prefix, defaults)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return configs, nil
+}
+
+func chatModelFromEnv(prefix string, config models.ChatModelConfig) (models.ChatModelConfig, error) {
+	if value := os.Getenv(prefix + "MODEL"); value != "" {
+		config.Model = value
+	}
+	if value := os.Getenv(prefix + "TEMPERATURE"); value != "" {
+		temperature, err := strconv.ParseFloat(value, 32)
+		if err != nil || temperature < 0 || temperature > 2 {
+			return config, fmt.Errorf("invalid %sTEMPERATURE %q, expected a number from 0 to 2", prefix, value)
+		}
+		config.Temperature = float32(temperature)
+		if config.Temperature == 0 {
+			// the client leaves out a temperature of 0, which would use the
+			// provider's default, so send the closest value it keeps instead
+			config.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
+	if value := os.Getenv(prefix + "MAX_TOKENS"); value != "" {
+		maxTokens, err := strconv.Atoi(value)
+		if err != nil || maxTokens < 0 {
+			return config, fmt.Errorf("invalid %sMAX_TOKENS %q", prefix, value)
+		}
+		config.MaxTokens = maxTokens
+	}
+	return config, nil
+}
+
+// ExecuteLLMRequest sends the messages to the model configured for the task.
+func ExecuteLLMRequest(c *models.LLMClient, task models.ChatTask, messages []openai.ChatCompletionMessage) (openai.ChatCompletionResponse, error) {
+	return executeRequest(c, task, openai.ChatCompletionRequest{Messages: messages})
+}
+
+// ExecuteToolRequest is ExecuteLLMRequest offering the model tools to call.
+// toolChoice is "auto" to let the model decide or "none" to make it answer.
+func ExecuteToolRequest(c *models.LLMClient, task models.ChatTask, messages []openai.ChatCompletionMessage, tools []openai.Tool, toolChoice string) (openai.ChatCompletionResponse, error) {
+	return executeRequest(c, task, openai.ChatCompletionRequest{
+		Messages:   messages,
+		Tools:      tools,
+		ToolChoice: toolChoice,
+	})
+}
+
+func executeRequest(c *models.LLMClient, task models.ChatTask, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	if c.Client == nil {
+		return openai.ChatCompletionResponse{}, errors.New("no chat model configured")
+	}
+	config := c.ModelFor(task)
+	request.Model = config.Model
+	request.Temperature = config.Temperature
+	request.MaxTokens = config.MaxTokens
+	return c.Client.CreateChatCompletion(context.Background(), request)
+}
 
-	resp, err := c.Client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model:    models.MODEL,
-			Messages: messages,
-		},
-	)
-	return resp, err
+// StreamLLMRequest sends the messages to the model configured for the task
+// and calls onDelta with each piece of the answer as it arrives. It stops
+// early if onDelta fails, such as when the reader went away.
+func StreamLLMRequest(ctx context.Context, c *models.LLMClient, task models.ChatTask, messages []openai.ChatCompletionMessage, onDelta func(string) error) (models.ChatCompletion, error) {
+	if c.Client == nil {
+		return models.ChatCompletion{}, errors.New("no chat model configured")
+	}
+	config := c.ModelFor(task)
+	stream, err := c.Client.CreateChatCompletionStream(ctx, openai.ChatCompletionRequest{
+		Model:         config.Model,
+		Messages:      messages,
+		Temperature:   config.Temperature,
+		MaxTokens:     config.MaxTokens,
+		Stream:        true,
+		StreamOptions: &openai.StreamOptions{IncludeUsage: true},
+	})
+	if err != nil {
+		return models.ChatCompletion{}, err
+	}
+	defer stream.Close()
+
+	completion := models.ChatCompletion{Role: openai.ChatMessageRoleAssistant, Model: config.Model}
+	var content strings.Builder
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return completion, err
+		}
+		if chunk.Model != "" {
+			completion.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			completion.Tokens = chunk.Usage.TotalTokens
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		content.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return completion, err
+		}
+	}
+	completion.Content = content.String()
+	return completion, nil
+}
+
+// responseModel is the model that answered. Providers report the exact
+// version used, which can differ from the alias that was asked for.
+func responseModel(c *models.LLMClient, task models.ChatTask, resp openai.ChatCompletionResponse) string {
+	if resp.Model != "" {
+		return resp.Model
+	}
+	return c.ModelFor(task).Model
 }
@@ -0,0 +1,186 @@
+package llms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backend/models"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestChatModelsFromEnv(t *testing.T) {
+	t.Setenv("ZETTEL_LLM_MODEL", "")
+	configs, err := ChatModelsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range models.CHAT_TASKS {
+		if configs[task] != (models.ChatModelConfig{Model: models.DEFAULT_CHAT_MODEL}) {
+			t.Errorf("wrong default for %v, got %+v", task, configs[task])
+		}
+	}
+
+	t.Setenv("ZETTEL_LLM_MODEL", "gpt-4o")
+	t.Setenv("ZETTEL_LLM_TEMPERATURE", "0.7")
+	t.Setenv("ZETTEL_LLM_ROUTING_MODEL", "gpt-4o-mini")
+	t.Setenv("ZETTEL_LLM_ROUTING_TEMPERATURE", "0.1")
+	t.Setenv("ZETTEL_LLM_TITLING_MAX_TOKENS", "20")
+	configs, err = ChatModelsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[models.ChatTask]models.ChatModelConfig{
+		models.RoutingTask:   {Model: "gpt-4o-mini", Temperature: 0.1},
+		models.AnsweringTask: {Model: "gpt-4o", Temperature: 0.7},
+		models.TitlingTask:   {Model: "gpt-4o", Temperature: 0.7, MaxTokens: 20},
+	}
+	for task, config := range expected {
+		if configs[task] != config {
+			t.Errorf("wrong config for %v, got %+v want %+v", task, configs[task], config)
+		}
+	}
+
+	t.Setenv("ZETTEL_LLM_ROUTING_TEMPERATURE", "0")
+	configs, err = ChatModelsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configs[models.RoutingTask].Temperature != math.SmallestNonzeroFloat32 {
+		t.Errorf("a temperature of 0 should be sent, got %v", configs[models.RoutingTask].Temperature)
+	}
+
+	t.Setenv("ZETTEL_LLM_ANSWERING_TEMPERATURE", "hot")
+	if _, err := ChatModelsFromEnv(); err == nil {
+		t.Errorf("expected an error for an invalid temperature")
+	}
+}
+
+func TestExecuteLLMRequestUsesTaskModel(t *testing.T) {
+	var requests []openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openai.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Model: request.Model + "-2024-08-06",
+			Choices: []openai.ChatCompletionChoice{{
+				Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "Cards"},
+			}},
+		})
+	}))
+	defer server.Close()
+	config := openai.DefaultConfig("test")
+	config.BaseURL = server.URL
+	client := NewClient(nil, config)
+	client.Models = map[models.ChatTask]models.ChatModelConfig{
+		models.RoutingTask:   {Model: "small", Temperature: 0.2, MaxTokens: 5},
+		models.AnsweringTask: {Model: "large"},
+	}
+
+	option, err := ChooseOptions(client, "what do my cards say about compost?")
+	if err != nil || option != models.Cards {
+		t.Fatalf("wrong option, got %v %v", option, err)
+	}
+	completion, err := ChatCompletion(client, []models.ChatCompletion{{Role: "user", Content: "hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateConversationSummary(client, completion); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %v", len(requests))
+	}
+	routing := requests[0]
+	if routing.Model != "small" || routing.Temperature != 0.2 || routing.MaxTokens != 5 {
+		t.Errorf("routing should use its own settings, got %v %v %v", routing.Model, routing.Temperature, routing.MaxTokens)
+	}
+	if requests[1].Model != "large" || requests[1].MaxTokens != 0 {
+		t.Errorf("answering should use its own settings, got %v %v", requests[1].Model, requests[1].MaxTokens)
+	}
+	if requests[2].Model != models.DEFAULT_CHAT_MODEL {
+		t.Errorf("unconfigured tasks should use the default model, got %v", requests[2].Model)
+	}
+	if completion.Model != "large-2024-08-06" {
+		t.Errorf("completion should record the model that answered, got %v", completion.Model)
+	}
+}
+
+// fakeStreamingServer answers streamed requests with the chunks as
+// Server-Sent Events, and other requests with reply.
+func fakeStreamingServer(t *testing.T, reply string, chunks []string) (*httptest.Server, *[]openai.ChatCompletionRequest) {
+	var requests []openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openai.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+		if !request.Stream {
+			json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+				Model: request.Model,
+				Choices: []openai.ChatCompletionChoice{{
+					Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reply},
+				}},
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			data, _ := json.Marshal(openai.ChatCompletionStreamResponse{
+				Model:   request.Model + "-2024-08-06",
+				Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: chunk}}},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		data, _ := json.Marshal(openai.ChatCompletionStreamResponse{
+			Model:   request.Model + "-2024-08-06",
+			Choices: []openai.ChatCompletionStreamChoice{},
+			Usage:   &openai.Usage{TotalTokens: 42},
+		})
+		fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", data)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestStreamLLMRequest(t *testing.T) {
+	server, requests := fakeStreamingServer(t, "", []string{"Hello", ", ", "world"})
+	config := openai.DefaultConfig("test")
+	config.BaseURL = server.URL
+	client := NewClient(nil, config)
+	client.Models = map[models.ChatTask]models.ChatModelConfig{models.AnsweringTask: {Model: "large"}}
+
+	var deltas []string
+	completion, err := StreamLLMRequest(context.Background(), client, models.AnsweringTask,
+		[]openai.ChatCompletionMessage{{Role: "user", Content: "hi"}},
+		func(delta string) error {
+			deltas = append(deltas, delta)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deltas) != 3 || completion.Content != "Hello, world" {
+		t.Errorf("wrong answer, got %q from %q", completion.Content, deltas)
+	}
+	if completion.Model != "large-2024-08-06" || completion.Tokens != 42 || completion.Role != openai.ChatMessageRoleAssistant {
+		t.Errorf("wrong completion, got %+v", completion)
+	}
+	request := (*requests)[0]
+	if !request.Stream || request.Model != "large" || request.StreamOptions == nil || !request.StreamOptions.IncludeUsage {
+		t.Errorf("wrong request, got %+v", request)
+	}
+
+	// a failing reader stops the stream
+	stop := errors.New("client went away")
+	_, err = StreamLLMRequest(context.Background(), client, models.AnsweringTask, nil, func(string) error { return stop })
+	if !errors.Is(err, stop) {
+		t.Errorf("expected the reader's error, got %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package llms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backend/models"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pgvector/pgvector-go"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// MXBAI_QUERY_PREFIX is the instruction mxbai-embed-large expects in front of
+// search queries.
+const MXBAI_QUERY_PREFIX = "Represent this sentence for searching relevant passages:"
+
+var EMBEDDING_PROVIDERS = []string{"ollama", "openai", "hash"}
+
+type EmbedderConfig struct {
+	Provider string
+	// URL is the full embeddings endpoint for ollama and the API base URL,
+	// such as https://api.openai.com/v1, for openai.
+	URL        string
+	APIKey     string
+	Model      string
+	Dimensions int
+	// QueryPrefix and DocumentPrefix are prepended to the text before it is
+	// embedded, for models trained with instructions.
+	QueryPrefix    string
+	DocumentPrefix string
+	// BatchSize is the most texts sent in one request, where the API takes
+	// more than one.
+	BatchSize int
+}
+
+// DefaultEmbedderConfig returns the defaults for a provider. Every provider
+// defaults to EMBEDDING_DIMENSIONS.
+func DefaultEmbedderConfig(provider string) EmbedderConfig {
+	config := EmbedderConfig{Provider: provider, Dimensions: EMBEDDING_DIMENSIONS, BatchSize: 1}
+	switch provider {
+	case "ollama":
+		config.Model = "mxbai-embed-large"
+		config.QueryPrefix = MXBAI_QUERY_PREFIX
+	case "openai":
+		config.URL = "https://api.openai.com/v1"
+		config.Model = string(openai.SmallEmbedding3)
+		config.BatchSize = 64
+	case "hash":
+		config.Model = "hash"
+	}
+	return config
+}
+
+// EmbedderConfigFromEnv reads the embedding configuration:
+//
+//	ZETTEL_EMBEDDING_PROVIDER         ollama (default), openai or hash
+//	ZETTEL_EMBEDDING_API              endpoint, see EmbedderConfig.URL
+//	ZETTEL_EMBEDDING_KEY              API key for openai
+//	ZETTEL_EMBEDDING_MODEL            model name
+//	ZETTEL_EMBEDDING_DIMENSIONS       vector size
+//	ZETTEL_EMBEDDING_QUERY_PREFIX     text put before queries
+//	ZETTEL_EMBEDDING_DOCUMENT_PREFIX  text put before documents
+//	ZETTEL_EMBEDDING_BATCH_SIZE       texts per request
+//
+// Unset values keep the provider's defaults.
+func EmbedderConfigFromEnv() (EmbedderConfig, error) {
+	return embedderConfigFromEnv("ZETTEL_EMBEDDING_", "ollama")
+}
+
+// NextEmbedderConfigFromEnv reads the model to migrate to from the same
+// settings with a ZETTEL_EMBEDDING_NEXT_ prefix, such as
+// ZETTEL_EMBEDDING_NEXT_PROVIDER. ok is false when no provider is set.
+func NextEmbedderConfigFromEnv() (config EmbedderConfig, ok bool, err error) {
+	if os.Getenv("ZETTEL_EMBEDDING_NEXT_PROVIDER") == "" {
+		return config, false, nil
+	}
+	config, err = embedderConfigFromEnv("ZETTEL_EMBEDDING_NEXT_", "")
+	return config, true, err
+}
+
+func embedderConfigFromEnv(prefix, defaultProvider string) (EmbedderConfig, error) {
+	provider := os.Getenv(prefix + "PROVIDER")
+	if provider == "" {
+		provider = defaultProvider
+	}
+	config := DefaultEmbedderConfig(provider)
+	if value := os.Getenv(prefix + "API"); value != "" {
+		config.URL = value
+	}
+	config.APIKey = os.Getenv(prefix + "KEY")
+	if value := os.Getenv(prefix + "MODEL"); value != "" {
+		config.Model = value
+	}
+	if value, ok := os.LookupEnv(prefix + "QUERY_PREFIX"); ok {
+		config.QueryPrefix = value
+	}
+	if value, ok := os.LookupEnv(prefix + "DOCUMENT_PREFIX"); ok {
+		config.DocumentPrefix = value
+	}
+	for name, target := range map[string]*int{
+		prefix + "DIMENSIONS": &config.Dimensions,
+		prefix + "BATCH_SIZE": &config.BatchSize,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return config, fmt.Errorf("invalid %s %q", name, value)
+		}
+		*target = parsed
+	}
+	return config, nil
+}
+
+// NewEmbedder creates the embedder for the configured provider.
+func NewEmbedder(config EmbedderConfig) (models.Embedder, error) {
+	if config.Dimensions <= 0 {
+		return nil, errors.New("embedding dimensions must be positive")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1
+	}
+	switch config.Provider {
+	case "ollama":
+		if config.URL == "" {
+			return nil, errors.New("no embedding url given - set ZETTEL_EMBEDDING_API")
+		}
+		return &OllamaEmbedder{config: config, client: &http.Client{}}, nil
+	case "openai":
+		clientConfig := openai.DefaultConfig(config.APIKey)
+		clientConfig.BaseURL = strings.TrimSuffix(config.URL, "/")
+		return &OpenAIEmbedder{config: config, client: openai.NewClientWithConfig(clientConfig)}, nil
+	case "hash":
+		return &HashEmbedder{config: config}, nil
+	}
+	return nil, fmt.Errorf("unknown embedding provider %q, expected one of %s", config.Provider, strings.Join(EMBEDDING_PROVIDERS, ", "))
+}
+
+func (config EmbedderConfig) prefixed(text string, forQuery bool) string {
+	if forQuery {
+		return config.QueryPrefix + text
+	}
+	return config.DocumentPrefix + text
+}
+
+// checkDimensions makes sure a vector fits the configured size, since
+// pgvector rejects vectors that do not match the column.
+func (config EmbedderConfig) checkDimensions(vector []float32) error {
+	if len(vector) != config.Dimensions {
+		return fmt.Errorf("%s returned %d dimensions, expected %d", config.Model, len(vector), config.Dimensions)
+	}
+	return nil
+}
+
+// OllamaEmbedder posts each text to Ollama's /api/embeddings endpoint, which
+// takes one prompt at a time.
+type OllamaEmbedder struct {
+	config EmbedderConfig
+	client *http.Client
+}
+
+func (e *OllamaEmbedder) Model() string   { return e.config.Model }
+func (e *OllamaEmbedder) Dimensions() int { return e.config.Dimensions }
+
+func (e *OllamaEmbedder) Embed(texts []string, forQuery bool) ([]pgvector.Vector, error) {
+	vectors := make([]pgvector.Vector, len(texts))
+	for i, text := range texts {
+		payload := map[string]string{
+			"model":  e.config.Model,
+			"prompt": e.config.prefixed(text, forQuery),
+		}
+		jsonData, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("error creating JSON payload: %w", err)
+		}
+
+		req, err := http.NewRequest("POST", e.config.URL, bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := e.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error communicating with the embedding API: %w", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("error generating embeddings: %d - %s", resp.StatusCode, resp.Status)
+		}
+		var response struct {
+			Embedding []float32 `json:"embedding"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.New("error decoding the embedding API response")
+		}
+		if err := e.config.checkDimensions(response.Embedding); err != nil {
+			return nil, err
+		}
+		vectors[i] = pgvector.NewVector(response.Embedding)
+	}
+	return vectors, nil
+}
+
+// OpenAIEmbedder uses an OpenAI compatible /v1/embeddings endpoint, sending
+// up to BatchSize texts per request.
+type OpenAIEmbedder struct {
+	config EmbedderConfig
+	client *openai.Client
+}
+
+func (e *OpenAIEmbedder) Model() string   { return e.config.Model }
+func (e *OpenAIEmbedder) Dimensions() int { return e.config.Dimensions }
+
+func (e *OpenAIEmbedder) Embed(texts []string, forQuery bool) ([]pgvector.Vector, error) {
+	vectors := make([]pgvector.Vector, 0, len(texts))
+	for start := 0; start < len(texts); start += e.config.BatchSize {
+		end := start + e.config.BatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+		batch := make([]string, end-start)
+		for i, text := range texts[start:end] {
+			batch[i] = e.config.prefixed(text, forQuery)
+		}
+
+		resp, err := e.client.CreateEmbeddings(context.Background(), openai.EmbeddingRequestStrings{
+			Input:      batch,
+			Model:      openai.EmbeddingModel(e.config.Model),
+			Dimensions: e.config.Dimensions,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error generating embeddings: %w", err)
+		}
+		if len(resp.Data) != len(batch) {
+			return nil, fmt.Errorf("embedding API returned %d embeddings for %d inputs", len(resp.Data), len(batch))
+		}
+		// the data is not guaranteed to be in input order
+		sort.Slice(resp.Data, func(i, j int) bool {
+			return resp.Data[i].Index < resp.Data[j].Index
+		})
+		for _, data := range resp.Data {
+			if err := e.config.checkDimensions(data.Embedding); err != nil {
+				return nil, err
+			}
+			vectors = append(vectors, pgvector.NewVector(data.Embedding))
+		}
+	}
+	return vectors, nil
+}
+
+// HashEmbedder embeds with HashEmbedding. It needs no model or network, so it
+// suits tests and installs without an embedding server, though it only
+// captures shared words rather than meaning.
+type HashEmbedder struct {
+	config EmbedderConfig
+}
+
+func (e *HashEmbedder) Model() string   { return e.config.Model }
+func (e *HashEmbedder) Dimensions() int { return e.config.Dimensions }
+
+func (e *HashEmbedder) Embed(texts []string, forQuery bool) ([]pgvector.Vector, error) {
+	vectors := make([]pgvector.Vector, len(texts))
+	for i, text := range texts {
+		vectors[i] = pgvector.NewVector(HashEmbedding(e.config.prefixed(text, forQuery), e.config.Dimensions))
+	}
+	return vectors, nil
+}
@@ -0,0 +1,211 @@
+package llms
+
+import (
+	"encoding/json"
+	"go-backend/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestEmbedderConfigFromEnv(t *testing.T) {
+	t.Setenv("ZETTEL_EMBEDDING_PROVIDER", "")
+	config, err := EmbedderConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Provider != "ollama" || config.Model != "mxbai-embed-large" || config.QueryPrefix != MXBAI_QUERY_PREFIX {
+		t.Errorf("wrong default config, got %+v", config)
+	}
+
+	t.Setenv("ZETTEL_EMBEDDING_PROVIDER", "openai")
+	t.Setenv("ZETTEL_EMBEDDING_MODEL", "nomic-embed-text")
+	t.Setenv("ZETTEL_EMBEDDING_QUERY_PREFIX", "search_query: ")
+	t.Setenv("ZETTEL_EMBEDDING_DOCUMENT_PREFIX", "search_document: ")
+	t.Setenv("ZETTEL_EMBEDDING_DIMENSIONS", "768")
+	t.Setenv("ZETTEL_EMBEDDING_BATCH_SIZE", "16")
+	config, err = EmbedderConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := EmbedderConfig{
+		Provider:       "openai",
+		URL:            "https://api.openai.com/v1",
+		Model:          "nomic-embed-text",
+		Dimensions:     768,
+		QueryPrefix:    "search_query: ",
+		DocumentPrefix: "search_document: ",
+		BatchSize:      16,
+	}
+	if config != expected {
+		t.Errorf("wrong config, got %+v want %+v", config, expected)
+	}
+
+	t.Setenv("ZETTEL_EMBEDDING_DIMENSIONS", "many")
+	if _, err := EmbedderConfigFromEnv(); err == nil {
+		t.Errorf("expected an error for invalid dimensions")
+	}
+}
+
+func TestNextEmbedderConfigFromEnv(t *testing.T) {
+	t.Setenv("ZETTEL_EMBEDDING_NEXT_PROVIDER", "")
+	if _, ok, err := NextEmbedderConfigFromEnv(); ok || err != nil {
+		t.Errorf("no migration should be configured, got %v %v", ok, err)
+	}
+
+	t.Setenv("ZETTEL_EMBEDDING_MODEL", "mxbai-embed-large")
+	t.Setenv("ZETTEL_EMBEDDING_NEXT_PROVIDER", "hash")
+	t.Setenv("ZETTEL_EMBEDDING_NEXT_DIMENSIONS", "64")
+	config, ok, err := NextEmbedderConfigFromEnv()
+	if !ok || err != nil {
+		t.Fatalf("expected a migration, got %v %v", ok, err)
+	}
+	if config.Provider != "hash" || config.Model != "hash" || config.Dimensions != 64 {
+		t.Errorf("wrong config, got %+v", config)
+	}
+}
+
+func TestSwitchEmbedder(t *testing.T) {
+	old, _ := NewEmbedder(DefaultEmbedderConfig("hash"))
+	config := DefaultEmbedderConfig("hash")
+	config.Dimensions = 64
+	next, _ := NewEmbedder(config)
+	c := &models.LLMClient{Embedder: old, NextEmbedder: next}
+
+	if ActiveEmbeddingModel(c) != "hash@1024" || models.EmbeddingModelID(c.NextEmbedding()) != "hash@64" {
+		t.Errorf("wrong models, got %v and %v", ActiveEmbeddingModel(c), models.EmbeddingModelID(c.NextEmbedding()))
+	}
+	c.SwitchEmbedder()
+	if ActiveEmbeddingModel(c) != "hash@64" || c.NextEmbedding() != nil {
+		t.Errorf("next embedder should be active, got %v", ActiveEmbeddingModel(c))
+	}
+	if ActiveEmbeddingModel(&models.LLMClient{}) != "" {
+		t.Errorf("no embedder should have no model")
+	}
+}
+
+func TestNewEmbedderErrors(t *testing.T) {
+	if _, err := NewEmbedder(DefaultEmbedderConfig("word2vec")); err == nil {
+		t.Errorf("expected an error for an unknown provider")
+	}
+	if _, err := NewEmbedder(DefaultEmbedderConfig("ollama")); err == nil {
+		t.Errorf("expected an error for ollama without a url")
+	}
+}
+
+func TestOllamaEmbedder(t *testing.T) {
+	var prompts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		if request["model"] != "test-model" {
+			t.Errorf("wrong model, got %v", request["model"])
+		}
+		prompts = append(prompts, request["prompt"])
+		json.NewEncoder(w).Encode(map[string]interface{}{"embedding": []float32{1, 2, 3}})
+	}))
+	defer server.Close()
+
+	config := EmbedderConfig{Provider: "ollama", URL: server.URL, Model: "test-model", Dimensions: 3, QueryPrefix: "query: "}
+	embedder, err := NewEmbedder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors, err := embedder.Embed([]string{"a", "b"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) != 2 || !reflect.DeepEqual(vectors[1].Slice(), []float32{1, 2, 3}) {
+		t.Errorf("wrong vectors, got %v", vectors)
+	}
+	if !reflect.DeepEqual(prompts, []string{"query: a", "query: b"}) {
+		t.Errorf("wrong prompts, got %v", prompts)
+	}
+
+	config.Dimensions = 4
+	embedder, _ = NewEmbedder(config)
+	if _, err := embedder.Embed([]string{"a"}, false); err == nil {
+		t.Errorf("expected an error when the dimensions do not match")
+	}
+}
+
+func TestOpenAIEmbedder(t *testing.T) {
+	var batches [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			t.Errorf("wrong path, got %v", r.URL.Path)
+		}
+		var request struct {
+			Input      []string `json:"input"`
+			Dimensions int      `json:"dimensions"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.Dimensions != 2 {
+			t.Errorf("dimensions should be requested, got %v", request.Dimensions)
+		}
+		batches = append(batches, request.Input)
+
+		// answer in reverse to check the embeddings are put back in order
+		var data []map[string]interface{}
+		for i := len(request.Input) - 1; i >= 0; i-- {
+			value := float32(len(request.Input[i]))
+			data = append(data, map[string]interface{}{"object": "embedding", "index": i, "embedding": []float32{value, value}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "list", "data": data})
+	}))
+	defer server.Close()
+
+	embedder, err := NewEmbedder(EmbedderConfig{Provider: "openai", URL: server.URL + "/v1/", Model: "test", Dimensions: 2, DocumentPrefix: "d:", BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors, err := embedder.Embed([]string{"a", "bb", "ccc"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(batches, [][]string{{"d:a", "d:bb"}, {"d:ccc"}}) {
+		t.Errorf("wrong batches, got %v", batches)
+	}
+	for i, expected := range []float32{3, 4, 5} {
+		if vectors[i].Slice()[0] != expected {
+			t.Errorf("wrong vector at %v, got %v want %v", i, vectors[i].Slice()[0], expected)
+		}
+	}
+}
+
+func TestHashEmbedder(t *testing.T) {
+	config := DefaultEmbedderConfig("hash")
+	config.QueryPrefix = "query "
+	embedder, err := NewEmbedder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if embedder.Model() != "hash" || embedder.Dimensions() != EMBEDDING_DIMENSIONS {
+		t.Errorf("wrong model or dimensions, got %v %v", embedder.Model(), embedder.Dimensions())
+	}
+	documents, _ := embedder.Embed([]string{"compost"}, false)
+	queries, _ := embedder.Embed([]string{"compost"}, true)
+	if !reflect.DeepEqual(documents[0].Slice(), HashEmbedding("compost", EMBEDDING_DIMENSIONS)) {
+		t.Errorf("documents should be embedded without the query prefix")
+	}
+	if reflect.DeepEqual(documents[0].Slice(), queries[0].Slice()) {
+		t.Errorf("queries should be embedded with the query prefix")
+	}
+}
+
+func TestGenerateEmbeddingsFromCard(t *testing.T) {
+	embedder, _ := NewEmbedder(DefaultEmbedderConfig("hash"))
+	client := &models.LLMClient{Testing: true, Embedder: embedder}
+	embeddings, err := GenerateEmbeddingsFromCard(client, []models.CardChunk{{Chunk: "one"}, {Chunk: "two"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embeddings) != 2 || len(embeddings[1]) != 1 {
+		t.Errorf("expected one vector per chunk, got %v", len(embeddings))
+	}
+
+	if _, err := GetEmbedding(&models.LLMClient{Testing: true}, "text", true); err == nil {
+		t.Errorf("expected an error without an embedder")
+	}
+}
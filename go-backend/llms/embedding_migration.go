@@ -0,0 +1,314 @@
+package llms
+
+import (
+	"database/sql"
+	"fmt"
+	"go-backend/models"
+	"log"
+	"time"
+
+	"github.com/pgvector/pgvector-go"
+)
+
+const (
+	EMBEDDING_MIGRATION_BATCH_SIZE = 20
+	// EMBEDDING_MIGRATION_RETRY is the wait before another pass when cards or
+	// entities failed to embed.
+	EMBEDDING_MIGRATION_RETRY = 5 * time.Minute
+)
+
+// missingCardsQuery selects the cards that have chunks but no vectors from
+// the model in $1.
+const missingCardsQuery = `
+	FROM card_chunks cc
+	JOIN cards c ON c.id = cc.card_pk
+	WHERE c.is_deleted = FALSE
+	AND NOT EXISTS (
+		SELECT 1 FROM card_embeddings ce
+		WHERE ce.card_pk = cc.card_pk AND ce.model = $1
+	)`
+
+// ResolveNextEmbedder sets the embedder to migrate to. If a migration to it
+// has already finished it is made the active embedder straight away, since
+// the old model's vectors are gone.
+func ResolveNextEmbedder(c *models.LLMClient, db *sql.DB, next models.Embedder) error {
+	nextModel := models.EmbeddingModelID(next)
+	if nextModel == ActiveEmbeddingModel(c) {
+		return nil
+	}
+	var done bool
+	err := db.QueryRow(`
+	SELECT EXISTS (SELECT 1 FROM embedding_migrations WHERE to_model = $1 AND status = 'done')`,
+		nextModel).Scan(&done)
+	if err != nil {
+		log.Printf("err %v", err)
+		return err
+	}
+	c.NextEmbedder = next
+	if done {
+		log.Printf("embeddings were already migrated to %s, move the ZETTEL_EMBEDDING_NEXT_ settings to ZETTEL_EMBEDDING_", nextModel)
+		c.SwitchEmbedder()
+	}
+	return nil
+}
+
+// StartEmbeddingMigration returns the running migration to the next
+// embedder's model, recording a new one if there is none.
+func StartEmbeddingMigration(c *models.LLMClient, db *sql.DB) (models.EmbeddingMigration, error) {
+	var migration models.EmbeddingMigration
+	toModel := models.EmbeddingModelID(c.NextEmbedding())
+	err := db.QueryRow(`
+	SELECT id, from_model, to_model, status, last_error, created_at, updated_at
+	FROM embedding_migrations
+	WHERE to_model = $1 AND status = 'running'
+	ORDER BY id DESC LIMIT 1`, toModel).Scan(
+		&migration.ID, &migration.FromModel, &migration.ToModel, &migration.Status,
+		&migration.LastError, &migration.CreatedAt, &migration.UpdatedAt,
+	)
+	if err == nil {
+		return migration, nil
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("err %v", err)
+		return migration, err
+	}
+	err = db.QueryRow(`
+	INSERT INTO embedding_migrations (from_model, to_model)
+	VALUES ($1, $2)
+	RETURNING id, from_model, to_model, status, last_error, created_at, updated_at`,
+		ActiveEmbeddingModel(c), toModel,
+	).Scan(
+		&migration.ID, &migration.FromModel, &migration.ToModel, &migration.Status,
+		&migration.LastError, &migration.CreatedAt, &migration.UpdatedAt,
+	)
+	if err != nil {
+		log.Printf("err %v", err)
+	}
+	return migration, err
+}
+
+// MigrateEmbeddings makes one pass over the cards and entities that have no
+// vectors from the next embedder yet. Once nothing is left it switches
+// searches over to the new model and reports true. Failures are recorded on
+// the migration and retried on the next pass.
+func MigrateEmbeddings(c *models.LLMClient, db *sql.DB) (bool, error) {
+	next := c.NextEmbedding()
+	if next == nil {
+		return false, nil
+	}
+	migration, err := StartEmbeddingMigration(c, db)
+	if err != nil {
+		return false, err
+	}
+
+	var failures []error
+	cardFailures, err := migrateCardEmbeddings(next, db, migration.ToModel)
+	if err != nil {
+		return false, err
+	}
+	failures = append(failures, cardFailures...)
+	entityFailures, err := migrateEntityEmbeddings(next, db, migration.ToModel)
+	if err != nil {
+		return false, err
+	}
+	failures = append(failures, entityFailures...)
+
+	if len(failures) > 0 {
+		lastError := fmt.Sprintf("%d failed, last error: %v", len(failures), failures[len(failures)-1])
+		_, err := db.Exec(`
+		UPDATE embedding_migrations SET last_error = $2, updated_at = NOW() WHERE id = $1`,
+			migration.ID, lastError)
+		if err != nil {
+			log.Printf("err %v", err)
+		}
+		return false, fmt.Errorf("embedding migration %d: %s", migration.ID, lastError)
+	}
+	return switchEmbeddingModel(c, db, migration)
+}
+
+func migrateCardEmbeddings(next models.Embedder, db *sql.DB, toModel string) ([]error, error) {
+	var failures []error
+	after := 0
+	for {
+		rows, err := db.Query(`
+		SELECT DISTINCT cc.card_pk, cc.user_id`+missingCardsQuery+`
+		AND cc.card_pk > $2
+		ORDER BY cc.card_pk
+		LIMIT $3`, toModel, after, EMBEDDING_MIGRATION_BATCH_SIZE)
+		if err != nil {
+			log.Printf("err %v", err)
+			return failures, err
+		}
+		var cards [][2]int
+		for rows.Next() {
+			var cardPK, userID int
+			if err := rows.Scan(&cardPK, &userID); err != nil {
+				rows.Close()
+				return failures, err
+			}
+			cards = append(cards, [2]int{cardPK, userID})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return failures, err
+		}
+		if len(cards) == 0 {
+			return failures, nil
+		}
+
+		for _, card := range cards {
+			cardPK, userID := card[0], card[1]
+			after = cardPK
+			chunks, err := loadCardChunks(db, userID, cardPK)
+			if err == nil {
+				err = embedCardWith(next, db, userID, cardPK, chunks, false)
+			}
+			if err != nil {
+				log.Printf("failed to migrate embeddings of card %v: %v", cardPK, err)
+				failures = append(failures, fmt.Errorf("card %d: %w", cardPK, err))
+			}
+		}
+	}
+}
+
+func migrateEntityEmbeddings(next models.Embedder, db *sql.DB, toModel string) ([]error, error) {
+	var failures []error
+	after := 0
+	for {
+		rows, err := db.Query(`
+		SELECT id, name, type, description FROM entities
+		WHERE next_embedding_model IS DISTINCT FROM $1 AND id > $2
+		ORDER BY id
+		LIMIT $3`, toModel, after, EMBEDDING_MIGRATION_BATCH_SIZE)
+		if err != nil {
+			log.Printf("err %v", err)
+			return failures, err
+		}
+		var entities []models.Entity
+		for rows.Next() {
+			var entity models.Entity
+			if err := rows.Scan(&entity.ID, &entity.Name, &entity.Type, &entity.Description); err != nil {
+				rows.Close()
+				return failures, err
+			}
+			entities = append(entities, entity)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return failures, err
+		}
+		if len(entities) == 0 {
+			return failures, nil
+		}
+		after = entities[len(entities)-1].ID
+
+		texts := make([]string, len(entities))
+		for i, entity := range entities {
+			texts[i] = entityEmbeddingText(entity)
+		}
+		vectors, err := next.Embed(texts, false)
+		if err == nil && len(vectors) != len(entities) {
+			err = fmt.Errorf("embedder returned %d vectors for %d entities", len(vectors), len(entities))
+		}
+		if err != nil {
+			log.Printf("failed to migrate embeddings of entities up to %v: %v", after, err)
+			failures = append(failures, fmt.Errorf("entities up to %d: %w", after, err))
+			continue
+		}
+		for i, entity := range entities {
+			if err := storeNextEntityEmbedding(db, entity.ID, vectors[i], toModel); err != nil {
+				failures = append(failures, fmt.Errorf("entity %d: %w", entity.ID, err))
+			}
+		}
+	}
+}
+
+func storeNextEntityEmbedding(db *sql.DB, entityID int, embedding pgvector.Vector, model string) error {
+	_, err := db.Exec(`
+	UPDATE entities SET next_embedding = $2, next_embedding_model = $3 WHERE id = $1`,
+		entityID, embedding, model)
+	if err != nil {
+		log.Printf("err %v", err)
+	}
+	return err
+}
+
+// switchEmbeddingModel drops the old model's vectors and moves the entities
+// over to the new ones in one transaction, so searches never see a mix.
+// Cards or entities added since the pass began leave it for the next one.
+func switchEmbeddingModel(c *models.LLMClient, db *sql.DB, migration models.EmbeddingMigration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("err %v", err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var missingCards, missingEntities int
+	err = tx.QueryRow(`SELECT COUNT(DISTINCT cc.card_pk)`+missingCardsQuery, migration.ToModel).Scan(&missingCards)
+	if err != nil {
+		log.Printf("err %v", err)
+		return false, err
+	}
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM entities WHERE next_embedding_model IS DISTINCT FROM $1`,
+		migration.ToModel).Scan(&missingEntities)
+	if err != nil {
+		log.Printf("err %v", err)
+		return false, err
+	}
+	if missingCards > 0 || missingEntities > 0 {
+		return false, nil
+	}
+
+	statements := []string{
+		`DELETE FROM card_embeddings WHERE model <> $1`,
+		`UPDATE entities SET
+			embedding = next_embedding,
+			embedding_model = next_embedding_model,
+			next_embedding = NULL,
+			next_embedding_model = NULL
+		WHERE next_embedding_model = $1`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, migration.ToModel); err != nil {
+			log.Printf("err %v", err)
+			return false, err
+		}
+	}
+	_, err = tx.Exec(`
+	UPDATE embedding_migrations SET status = 'done', last_error = '', finished_at = NOW(), updated_at = NOW()
+	WHERE id = $1`, migration.ID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("err %v", err)
+		return false, err
+	}
+	c.SwitchEmbedder()
+	log.Printf("switched embeddings from %s to %s", migration.FromModel, migration.ToModel)
+	return true, nil
+}
+
+// StartEmbeddingMigrationWorker migrates to the next embedder in the
+// background, making passes until the switch-over is done.
+func StartEmbeddingMigrationWorker(c *models.LLMClient, db *sql.DB) {
+	go func() {
+		for {
+			switched, err := MigrateEmbeddings(c, db)
+			if err != nil {
+				log.Printf("embedding migration error: %v", err)
+			}
+			if switched || c.NextEmbedding() == nil {
+				return
+			}
+			if err != nil {
+				time.Sleep(EMBEDDING_MIGRATION_RETRY)
+			} else {
+				time.Sleep(EMBEDDING_POLL_INTERVAL)
+			}
+		}
+	}()
+}
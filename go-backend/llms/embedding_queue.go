@@ -0,0 +1,301 @@
+package llms
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-backend/models"
+	"log"
+	"time"
+
+	"github.com/pgvector/pgvector-go"
+)
+
+const (
+	EMBEDDING_MAX_ATTEMPTS = 6
+	// EMBEDDING_RETRY_BASE is the wait after the first failure. It doubles
+	// with each attempt up to EMBEDDING_RETRY_MAX.
+	EMBEDDING_RETRY_BASE = 30 * time.Second
+	EMBEDDING_RETRY_MAX  = time.Hour
+	// EMBEDDING_JOB_LEASE is how long a job can stay running before another
+	// worker takes it over, for when the process died part way through.
+	EMBEDDING_JOB_LEASE     = 10 * time.Minute
+	EMBEDDING_POLL_INTERVAL = 10 * time.Second
+)
+
+// EnqueueEmbedding queues a card to have its chunks embedded. A card has one
+// job; queueing it again resets the attempts and makes it due at once.
+func EnqueueEmbedding(db *sql.DB, userID, cardPK int) error {
+	_, err := db.Exec(`
+	INSERT INTO embedding_jobs (user_id, card_pk, status, run_after)
+	VALUES ($1, $2, 'pending', NOW())
+	ON CONFLICT (card_pk) DO UPDATE SET
+		status = 'pending',
+		attempts = 0,
+		last_error = '',
+		generation = embedding_jobs.generation + 1,
+		run_after = NOW(),
+		updated_at = NOW()`, userID, cardPK)
+	if err != nil {
+		log.Printf("err %v", err)
+		return fmt.Errorf("error queueing card %d for embedding: %w", cardPK, err)
+	}
+	return nil
+}
+
+// ClaimEmbeddingJob takes the next due job and marks it running. SKIP LOCKED
+// lets several workers claim at once without taking the same job. Jobs
+// running for longer than EMBEDDING_JOB_LEASE are taken over.
+func ClaimEmbeddingJob(db *sql.DB) (models.EmbeddingJob, bool, error) {
+	var job models.EmbeddingJob
+	err := db.QueryRow(`
+	UPDATE embedding_jobs SET
+		status = 'running',
+		attempts = attempts + 1,
+		locked_at = NOW(),
+		updated_at = NOW()
+	WHERE id = (
+		SELECT id FROM embedding_jobs
+		WHERE (status = 'pending' AND run_after <= NOW())
+		OR (status = 'running' AND locked_at < NOW() - make_interval(secs => $1))
+		ORDER BY run_after
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, user_id, card_pk, status, attempts, last_error, generation, run_after`,
+		EMBEDDING_JOB_LEASE.Seconds(),
+	).Scan(&job.ID, &job.UserID, &job.CardPK, &job.Status, &job.Attempts, &job.LastError, &job.Generation, &job.RunAfter)
+	if err == sql.ErrNoRows {
+		return job, false, nil
+	}
+	if err != nil {
+		log.Printf("err %v", err)
+		return job, false, err
+	}
+	return job, true, nil
+}
+
+// embeddingRetryDelay is the backoff before the next attempt, given how many
+// attempts have been made.
+func embeddingRetryDelay(attempts int) time.Duration {
+	delay := EMBEDDING_RETRY_BASE
+	for i := 1; i < attempts && delay < EMBEDDING_RETRY_MAX; i++ {
+		delay *= 2
+	}
+	if delay > EMBEDDING_RETRY_MAX {
+		delay = EMBEDDING_RETRY_MAX
+	}
+	return delay
+}
+
+// FinishEmbeddingJob records the outcome of a claimed job. A failed job is
+// retried with backoff until it runs out of attempts. Nothing is changed if
+// the card was queued again in the meantime, since that newer job still
+// has to run.
+func FinishEmbeddingJob(db *sql.DB, job models.EmbeddingJob, jobErr error) error {
+	var err error
+	if jobErr == nil {
+		_, err = db.Exec(`
+		UPDATE embedding_jobs SET status = 'done', last_error = '', locked_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND generation = $2`, job.ID, job.Generation)
+	} else if job.Attempts >= EMBEDDING_MAX_ATTEMPTS {
+		_, err = db.Exec(`
+		UPDATE embedding_jobs SET status = 'failed', last_error = $3, locked_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND generation = $2`, job.ID, job.Generation, jobErr.Error())
+	} else {
+		_, err = db.Exec(`
+		UPDATE embedding_jobs SET
+			status = 'pending',
+			last_error = $3,
+			locked_at = NULL,
+			run_after = NOW() + make_interval(secs => $4),
+			updated_at = NOW()
+		WHERE id = $1 AND generation = $2`,
+			job.ID, job.Generation, jobErr.Error(), embeddingRetryDelay(job.Attempts).Seconds())
+	}
+	if err != nil {
+		log.Printf("err %v", err)
+	}
+	return err
+}
+
+// loadCardChunks returns the text and hash of a card's chunks in order.
+func loadCardChunks(db *sql.DB, userID, cardPK int) ([]models.CardChunk, error) {
+	rows, err := db.Query(`
+	SELECT chunk_text, content_hash FROM card_chunks
+	WHERE card_pk = $1 AND user_id = $2
+	ORDER BY chunk_id`, cardPK, userID)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []models.CardChunk
+	for rows.Next() {
+		var chunk models.CardChunk
+		if err := rows.Scan(&chunk.Chunk, &chunk.ContentHash); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// EmbedCard brings a card's stored embeddings up to date with its chunks.
+// Only chunks whose text changed are sent to the embedder. During a migration the card is embedded with the new model too, so that
+// edits made while it runs are not left behind.
+func EmbedCard(c *models.LLMClient, db *sql.DB, userID, cardPK int) error {
+	return embedCard(c, db, userID, cardPK, false)
+}
+
+// ReembedCard embeds every chunk of a card again, even those with a stored
+// vector.
+func ReembedCard(c *models.LLMClient, db *sql.DB, userID, cardPK int) error {
+	return embedCard(c, db, userID, cardPK, true)
+}
+
+func embedCard(c *models.LLMClient, db *sql.DB, userID, cardPK int, all bool) error {
+	chunks, err := loadCardChunks(db, userID, cardPK)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return errors.New("no embedder configured")
+	}
+	embedders := []models.Embedder{c.ActiveEmbedder()}
+	if next := c.NextEmbedding(); next != nil {
+		embedders = append(embedders, next)
+	}
+	for _, embedder := range embedders {
+		if err := embedCardWith(embedder, db, userID, cardPK, chunks, all); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedVector is one of a card's stored embeddings.
+type storedVector struct {
+	chunk       int
+	contentHash string
+	embedding   pgvector.Vector
+}
+
+func loadStoredVectors(db *sql.DB, cardPK int, model string) ([]storedVector, error) {
+	rows, err := db.Query(`
+	SELECT chunk, content_hash, embedding FROM card_embeddings
+	WHERE card_pk = $1 AND model = $2
+	ORDER BY chunk`, cardPK, model)
+	if err != nil {
+		log.Printf("err %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var vectors []storedVector
+	for rows.Next() {
+		var vector storedVector
+		if err := rows.Scan(&vector.chunk, &vector.contentHash, &vector.embedding); err != nil {
+			return nil, err
+		}
+		vectors = append(vectors, vector)
+	}
+	return vectors, rows.Err()
+}
+
+// embedCardWith embeds the chunks that have no vector from the embedder yet
+// and reuses the stored vectors of the rest, matching them by content hash
+// so that chunks which only moved are not embedded again. With all set
+// every chunk is embedded.
+func embedCardWith(embedder models.Embedder, db *sql.DB, userID, cardPK int, chunks []models.CardChunk, all bool) error {
+	if embedder == nil {
+		return errors.New("no embedder configured")
+	}
+	model := models.EmbeddingModelID(embedder)
+	var stored []storedVector
+	if !all {
+		var err error
+		stored, err = loadStoredVectors(db, cardPK, model)
+		if err != nil {
+			return err
+		}
+	}
+
+	unchanged := !all && len(stored) == len(chunks)
+	byHash := make(map[string]pgvector.Vector)
+	for i, vector := range stored {
+		if vector.contentHash != "" {
+			byHash[vector.contentHash] = vector.embedding
+		}
+		if unchanged && (vector.chunk != i || vector.contentHash != chunks[i].ContentHash) {
+			unchanged = false
+		}
+	}
+	if unchanged {
+		return nil
+	}
+
+	var missing []models.CardChunk
+	queued := make(map[string]bool)
+	for _, chunk := range chunks {
+		if _, ok := byHash[chunk.ContentHash]; ok || queued[chunk.ContentHash] {
+			continue
+		}
+		queued[chunk.ContentHash] = true
+		missing = append(missing, chunk)
+	}
+	if len(missing) > 0 {
+		vectors, err := embedChunks(embedder, missing)
+		if err != nil {
+			return err
+		}
+		for i, chunk := range missing {
+			byHash[chunk.ContentHash] = vectors[i][0]
+		}
+	}
+
+	embeddings := make([][]pgvector.Vector, len(chunks))
+	for i, chunk := range chunks {
+		embeddings[i] = []pgvector.Vector{byHash[chunk.ContentHash]}
+	}
+	return StoreEmbeddings(db, userID, cardPK, model, chunks, embeddings)
+}
+
+// RunEmbeddingJobs works through due jobs until none are left and returns
+// how many it ran.
+func RunEmbeddingJobs(c *models.LLMClient) (int, error) {
+	db := c.EmbeddingQueue.DB
+	count := 0
+	for {
+		job, ok, err := ClaimEmbeddingJob(db)
+		if err != nil || !ok {
+			return count, err
+		}
+		jobErr := EmbedCard(c, db, job.UserID, job.CardPK)
+		if jobErr != nil {
+			log.Printf("failed to embed card %v, attempt %v: %v", job.CardPK, job.Attempts, jobErr)
+		}
+		if err := FinishEmbeddingJob(db, job, jobErr); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// StartEmbeddingWorker runs the queue in the background for the life of the
+// process. Jobs left over from before a restart are picked up on the first
+// pass.
+func StartEmbeddingWorker(c *models.LLMClient) {
+	go func() {
+		for {
+			if _, err := RunEmbeddingJobs(c); err != nil {
+				log.Printf("embedding worker error: %v", err)
+			}
+			select {
+			case <-c.EmbeddingQueue.Wake:
+			case <-time.After(EMBEDDING_POLL_INTERVAL):
+			}
+		}
+	}()
+}
@@ -0,0 +1,21 @@
+package llms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEmbeddingRetryDelay(t *testing.T) {
+	expected := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		8:  EMBEDDING_RETRY_MAX,
+		40: EMBEDDING_RETRY_MAX,
+	}
+	for attempts, delay := range expected {
+		if got := embeddingRetryDelay(attempts); got != delay {
+			t.Errorf("wrong delay after %v attempts, got %v want %v", attempts, got, delay)
+		}
+	}
+}
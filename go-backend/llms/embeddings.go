@@ -1,176 +1,102 @@
 package llms
 
 import (
-	"bytes"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"go-backend/models"
 	"log"
-	"net/http"
-	"os"
-	"time"
 
 	"github.com/pgvector/pgvector-go"
 	openai "github.com/sashabaranov/go-openai"
 )
 
-const CHUNK_SIZE = 500
-
-func chunkInput(input string) []string {
-	var chunks []string
-	for i := 0; i < len(input); i += CHUNK_SIZE {
-		end := i + CHUNK_SIZE
-
-		// Ensure the end index does not exceed the string length
-		if end > len(input) {
-			end = len(input)
-		}
-
-		chunks = append(chunks, input[i:end])
+// GetEmbedding generates an embedding vector for a given text string with the
+// client's active embedder.
+func GetEmbedding(c *models.LLMClient, text string, useForQuery bool) (pgvector.Vector, error) {
+	if c == nil || c.ActiveEmbedder() == nil {
+		return pgvector.Vector{}, errors.New("no embedder configured")
 	}
-	return chunks
-}
-
-func StartProcessingQueue(c *models.LLMClient) {
-	log.Printf("start processing")
-	c.EmbeddingQueue.Mu.Lock()
-	if c.EmbeddingQueue.IsProcessing {
-		c.EmbeddingQueue.Mu.Unlock()
-		return
+	vectors, err := c.ActiveEmbedder().Embed([]string{text}, useForQuery)
+	if err != nil {
+		return pgvector.Vector{}, err
 	}
-	c.EmbeddingQueue.IsProcessing = true
-	c.EmbeddingQueue.Mu.Unlock()
-
-	go ProcessQueue(c)
-}
-
-func ProcessQueue(c *models.LLMClient) {
-	for {
-		request, ok := c.EmbeddingQueue.Pop()
-		if !ok {
-			c.EmbeddingQueue.Mu.Lock()
-			c.EmbeddingQueue.IsProcessing = false
-			c.EmbeddingQueue.Mu.Unlock()
-			return
-		}
-		embeddings, err := GenerateChunkEmbeddings(request.Chunk, false)
-		if err != nil {
-			// handle error
-			log.Printf("failed to generate embeddings for %v", request.Chunk.ID)
-			request.Retries += 1
-			if request.Retries < 4 {
-				c.EmbeddingQueue.Push(request)
-			}
-			continue
-		}
-		log.Printf("mainembeddings %v", request.Chunk)
-		err = StoreEmbeddings(
-			c.EmbeddingQueue.DB,
-			request.UserID,
-			request.CardPK,
-			[][]pgvector.Vector{embeddings},
-		)
-		if err != nil {
-			log.Printf("failed to store embed")
-			request.Retries += 1
-			if request.Retries < 4 {
-				c.EmbeddingQueue.Push(request)
-			}
-			continue
-		}
-
-		time.Sleep(1000 * time.Millisecond)
+	if len(vectors) != 1 {
+		return pgvector.Vector{}, fmt.Errorf("embedder returned %d vectors for one text", len(vectors))
 	}
-
+	return vectors[0], nil
 }
 
-// GetEmbedding generates an embedding vector for a given text string
-func GetEmbedding(text string, useForQuery bool) (pgvector.Vector, error) {
-	url := os.Getenv("ZETTEL_EMBEDDING_API")
-	if url == "" {
-		return pgvector.Vector{}, errors.New("no embedding url given - set ZETTEL_EMBEDDING_API")
+// ActiveEmbeddingModel is the model id of the vectors searches compare
+// against.
+func ActiveEmbeddingModel(c *models.LLMClient) string {
+	if c == nil {
+		return ""
 	}
+	return models.EmbeddingModelID(c.ActiveEmbedder())
+}
 
-	prompt := text
-	if useForQuery {
-		prompt = "Represent this sentence for searching relevant passages:" + prompt
+func GenerateChunkEmbeddings(c *models.LLMClient, chunk models.CardChunk, useForQuery bool) ([]pgvector.Vector, error) {
+	embedding, err := GetEmbedding(c, chunk.Chunk, useForQuery)
+	if err != nil {
+		return nil, err
 	}
+	return []pgvector.Vector{embedding}, nil
+}
 
-	payload := map[string]string{
-		"model":  "mxbai-embed-large",
-		"prompt": prompt,
+// GenerateEmbeddingsFromCard embeds all of a card's chunks with the active
+// embedder, in as few requests as it allows.
+func GenerateEmbeddingsFromCard(c *models.LLMClient, chunks []models.CardChunk) ([][]pgvector.Vector, error) {
+	if c == nil {
+		return [][]pgvector.Vector{}, errors.New("no embedder configured")
 	}
+	return embedChunks(c.ActiveEmbedder(), chunks)
+}
 
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return pgvector.Vector{}, fmt.Errorf("error creating JSON payload: %w", err)
+func embedChunks(embedder models.Embedder, chunks []models.CardChunk) ([][]pgvector.Vector, error) {
+	if embedder == nil {
+		return [][]pgvector.Vector{}, errors.New("no embedder configured")
 	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return pgvector.Vector{}, fmt.Errorf("error creating request: %w", err)
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = chunk.Chunk
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	vectors, err := embedder.Embed(texts, false)
 	if err != nil {
-		return pgvector.Vector{}, fmt.Errorf("error communicating with the embedding API: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return pgvector.Vector{}, fmt.Errorf("error generating embeddings: %d - %s", resp.StatusCode, resp.Status)
+		log.Printf("error generating embeddings %v", err)
+		return [][]pgvector.Vector{}, err
 	}
-
-	var response struct {
-		Embedding []float32 `json:"embedding"`
+	if len(vectors) != len(chunks) {
+		return [][]pgvector.Vector{}, fmt.Errorf("embedder returned %d vectors for %d chunks", len(vectors), len(chunks))
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return pgvector.Vector{}, errors.New("error decoding the embedding API response")
+	results := make([][]pgvector.Vector, len(vectors))
+	for i, vector := range vectors {
+		results[i] = []pgvector.Vector{vector}
 	}
-
-	return pgvector.NewVector(response.Embedding), nil
+	return results, nil
 }
 
-func GenerateChunkEmbeddings(chunk models.CardChunk, useForQuery bool) ([]pgvector.Vector, error) {
-	embedding, err := GetEmbedding(chunk.Chunk, useForQuery)
+// StoreEmbeddings replaces the card's vectors from the given model, one
+// for each chunk. Vectors from other models are left alone, so a migration
+// can build up the new model's vectors next to the ones searches still use.
+func StoreEmbeddings(db *sql.DB, userID, cardPK int, model string, chunks []models.CardChunk, embeddings [][]pgvector.Vector) error {
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		log.Printf("error %v", err)
+		return fmt.Errorf("error updating card %d: %w", cardPK, err)
 	}
-	return []pgvector.Vector{embedding}, nil
-}
-
-func GenerateEmbeddingsFromCard(db *sql.DB, chunks []models.CardChunk) ([][]pgvector.Vector, error) {
-	results := [][]pgvector.Vector{}
-	for _, chunk := range chunks {
-		vec, err := GenerateChunkEmbeddings(chunk, false)
-		if err != nil {
-			log.Printf("error generating embeddings %v", err)
-			return [][]pgvector.Vector{}, err
-		}
-		results = append(results, vec)
+	query := `DELETE FROM card_embeddings WHERE card_pk = $1 AND user_id = $2 AND model = $3`
+	_, err = tx.Exec(query, cardPK, userID, model)
+	if err != nil {
+		log.Printf("error %v", err)
+		tx.Rollback()
+		return fmt.Errorf("error updating card %d: %w", cardPK, err)
 	}
-	return results, nil
-}
-
-func StoreEmbeddings(db *sql.DB, userID, cardPK int, embeddings [][]pgvector.Vector) error {
-	tx, err := db.Begin()
-	query := `DELETE FROM card_embeddings WHERE card_pk = $1 AND user_id = $2`
-	_, err = tx.Exec(query, cardPK, userID)
 	for i, vec := range embeddings {
-
-		if err != nil {
-			log.Printf("error %v", err)
-			tx.Rollback()
-			return fmt.Errorf("error updating card %d: %w", cardPK, err)
-		}
 		for _, embedding := range vec {
-			query = `INSERT INTO card_embeddings (card_pk, user_id, chunk, embedding) VALUES ($1, $2, $3, $4)`
+			query = `INSERT INTO card_embeddings (card_pk, user_id, chunk, embedding, model, content_hash) VALUES ($1, $2, $3, $4, $5, $6)`
 
-			_, err = tx.Exec(query, cardPK, userID, i, embedding)
+			_, err = tx.Exec(query, cardPK, userID, i, embedding, model, chunks[i].ContentHash)
 			if err != nil {
 				log.Printf("error %v", err)
 				tx.Rollback()
@@ -179,8 +105,7 @@ func StoreEmbeddings(db *sql.DB, userID, cardPK int, embeddings [][]pgvector.Vec
 
 		}
 	}
-	tx.Commit()
-	return nil
+	return tx.Commit()
 }
 func GenerateSemanticSearchQuery(c *models.LLMClient, userQuery string) ([]pgvector.Vector, error) {
 	// First, let's create a system prompt to help generate a better search query
@@ -195,9 +120,9 @@ func GenerateSemanticSearchQuery(c *models.LLMClient, userQuery string) ([]pgvec
 		},
 	}
 
-	// Generate the optimized search query
-
-	resp, err := ExecuteLLMRequest(c, messages)
+	// Generate the optimized search query. Like routing, this is a short step
+	// before the answer, so it shares the routing model.
+	resp, err := ExecuteLLMRequest(c, models.RoutingTask, messages)
 	if err != nil {
 		return []pgvector.Vector{}, fmt.Errorf("failed to generate optimized search query: %w", err)
 	}
@@ -214,7 +139,7 @@ func GenerateSemanticSearchQuery(c *models.LLMClient, userQuery string) ([]pgvec
 		Chunk: optimizedQuery,
 	}
 
-	embeddings, err := GenerateChunkEmbeddings(chunk, true)
+	embeddings, err := GenerateChunkEmbeddings(c, chunk, true)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate embeddings: %w", err)
 	}
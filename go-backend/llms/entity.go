@@ -66,7 +66,7 @@ Return only valid JSON matching the specified structure.`
 	var jsonErr error
 	for range 3 {
 
-		resp, err := ExecuteLLMRequest(c, messages)
+		resp, err := ExecuteLLMRequest(c, models.EntityTask, messages)
 		if err != nil {
 			log.Printf("error getting completion: %v", err)
 			return []models.Entity{}, err
@@ -87,7 +87,7 @@ Return only valid JSON matching the specified structure.`
 	var results []models.Entity
 	for _, entity := range entities {
 		text := fmt.Sprintf("%v - %v - %v", entity.Name, entity.Type, entity.Description)
-		embedding, err := GetEmbedding(text, false)
+		embedding, err := GetEmbedding(c, text, false)
 		if err != nil {
 			continue
 		}
@@ -152,7 +152,7 @@ Return JSON in this format:
 
 		// Make the API call
 
-		resp, err := ExecuteLLMRequest(c, messages)
+		resp, err := ExecuteLLMRequest(c, models.EntityTask, messages)
 		if err != nil {
 			log.Printf("error getting completion: %v", err)
 			continue
@@ -182,12 +182,15 @@ Return JSON in this format:
 	return entity, nil
 }
 
-func GenerateEntityEmbedding(c *models.LLMClient, entity models.Entity) (pgvector.Vector, error) {
-	// Combine entity fields into a single text for embedding
-	text := fmt.Sprintf("%s - %s - %s", entity.Name, entity.Type, entity.Description)
+// entityEmbeddingText combines the entity fields into a single text for
+// embedding.
+func entityEmbeddingText(entity models.Entity) string {
+	return fmt.Sprintf("%s - %s - %s", entity.Name, entity.Type, entity.Description)
+}
 
+func GenerateEntityEmbedding(c *models.LLMClient, entity models.Entity) (pgvector.Vector, error) {
 	// Generate embedding using existing function
-	embedding, err := GetEmbedding(text, false)
+	embedding, err := GetEmbedding(c, entityEmbeddingText(entity), false)
 	if err != nil {
 		return pgvector.Vector{}, fmt.Errorf("failed to generate embedding: %w", err)
 	}
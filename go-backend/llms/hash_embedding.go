@@ -0,0 +1,62 @@
+package llms
+
+import (
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// EMBEDDING_DIMENSIONS is the default vector size, that of mxbai-embed-large.
+const EMBEDDING_DIMENSIONS = 1024
+
+// HashEmbedding is a deterministic stand-in for an embedding model. Words and
+// their character trigrams are hashed into a vector of the given size, so
+// texts that share words or word stems end up close together. It needs no
+// model or network, which makes it useful for tests and offline evaluation.
+func HashEmbedding(text string, dims int) []float32 {
+	vector := make([]float32, dims)
+	if dims <= 0 {
+		return vector
+	}
+	for _, word := range hashEmbeddingWords(text) {
+		addHashedFeature(vector, "w:"+word, 1)
+		padded := "^" + word + "$"
+		runes := []rune(padded)
+		for i := 0; i+3 <= len(runes); i++ {
+			addHashedFeature(vector, "t:"+string(runes[i:i+3]), 0.5)
+		}
+	}
+
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value) * float64(value)
+	}
+	if norm == 0 {
+		return vector
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+	return vector
+}
+
+func hashEmbeddingWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// addHashedFeature adds weight to the dimension the feature hashes to, with
+// a sign taken from the hash so that collisions tend to cancel out.
+func addHashedFeature(vector []float32, feature string, weight float32) {
+	hash := fnv.New64a()
+	hash.Write([]byte(feature))
+	sum := hash.Sum64()
+	index := int(sum % uint64(len(vector)))
+	if (sum>>63)&1 == 1 {
+		weight = -weight
+	}
+	vector[index] += weight
+}
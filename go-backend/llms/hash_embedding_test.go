@@ -0,0 +1,39 @@
+package llms
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func cosine(a, b []float32) float64 {
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return dot
+}
+
+func TestHashEmbedding(t *testing.T) {
+	first := HashEmbedding("Compost heaps and soil", EMBEDDING_DIMENSIONS)
+	if len(first) != EMBEDDING_DIMENSIONS {
+		t.Fatalf("wrong number of dimensions, got %v want %v", len(first), EMBEDDING_DIMENSIONS)
+	}
+	if !reflect.DeepEqual(first, HashEmbedding("compost heaps and soil", EMBEDDING_DIMENSIONS)) {
+		t.Errorf("embeddings should be deterministic and ignore case")
+	}
+	if norm := cosine(first, first); math.Abs(norm-1) > 1e-5 {
+		t.Errorf("embeddings should be normalized, got a norm of %v", norm)
+	}
+
+	related := cosine(first, HashEmbedding("composting the soil", EMBEDDING_DIMENSIONS))
+	unrelated := cosine(first, HashEmbedding("winston churchill speeches", EMBEDDING_DIMENSIONS))
+	if related <= unrelated {
+		t.Errorf("related text should be closer, got %v for related and %v for unrelated", related, unrelated)
+	}
+
+	empty := HashEmbedding("", 8)
+	if !reflect.DeepEqual(empty, make([]float32, 8)) {
+		t.Errorf("empty text should give a zero vector, got %v", empty)
+	}
+}
@@ -0,0 +1,143 @@
+package llms
+
+import (
+	"go-backend/models"
+	"math"
+	"strings"
+)
+
+// BM25 parameters, at their usual values.
+const (
+	BM25_K1 = 1.2
+	BM25_B  = 0.75
+)
+
+// LocalReranker scores candidates without a model or network. Each score
+// mixes three signals, each scaled to 0-1:
+//
+//   - BM25 of the query words over the candidates, with document frequencies
+//     taken from the candidates themselves
+//   - cosine similarity of hashed embeddings of the query and the candidate,
+//     which also rewards shared word stems
+//   - how much of the query appears in the title
+type LocalReranker struct {
+	BM25Weight   float64
+	CosineWeight float64
+	TitleWeight  float64
+}
+
+func NewLocalReranker() *LocalReranker {
+	return &LocalReranker{BM25Weight: 0.5, CosineWeight: 0.3, TitleWeight: 0.2}
+}
+
+// RelevanceCutoff is 0 since the BM25 part of a score is relative to the
+// best candidate, so a low score does not mean the candidate is unrelated.
+func (r *LocalReranker) RelevanceCutoff() float64 {
+	return 0
+}
+
+func (r *LocalReranker) Rerank(query string, candidates []models.CardChunk) ([]float64, error) {
+	scores := make([]float64, len(candidates))
+	queryWords := uniqueWords(hashEmbeddingWords(query))
+	if len(candidates) == 0 || len(queryWords) == 0 {
+		return scores, nil
+	}
+
+	bm25 := bm25Scores(queryWords, candidates)
+	queryEmbedding := HashEmbedding(query, EMBEDDING_DIMENSIONS)
+	total := r.BM25Weight + r.CosineWeight + r.TitleWeight
+	if total <= 0 {
+		return scores, nil
+	}
+
+	for i, candidate := range candidates {
+		candidateEmbedding := HashEmbedding(candidate.Title+" "+candidate.Chunk, EMBEDDING_DIMENSIONS)
+		cosine := math.Max(0, dot(queryEmbedding, candidateEmbedding))
+		title := titleMatch(query, queryWords, candidate.Title)
+		combined := (r.BM25Weight*bm25[i] + r.CosineWeight*cosine + r.TitleWeight*title) / total
+		scores[i] = math.Round(combined*MAX_RERANK_SCORE*1000) / 1000
+	}
+	return scores, nil
+}
+
+func uniqueWords(words []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			unique = append(unique, word)
+		}
+	}
+	return unique
+}
+
+// bm25Scores scores each candidate's title and text against the query words,
+// divided by the best score so that they run from 0 to 1.
+func bm25Scores(queryWords []string, candidates []models.CardChunk) []float64 {
+	documents := make([][]string, len(candidates))
+	frequencies := make(map[string]int)
+	var totalLength int
+	for i, candidate := range candidates {
+		documents[i] = hashEmbeddingWords(candidate.Title + " " + candidate.Chunk)
+		totalLength += len(documents[i])
+		for _, word := range uniqueWords(documents[i]) {
+			frequencies[word]++
+		}
+	}
+	count := float64(len(candidates))
+	averageLength := math.Max(1, float64(totalLength)/count)
+
+	scores := make([]float64, len(candidates))
+	var best float64
+	for i, document := range documents {
+		termCounts := make(map[string]int)
+		for _, word := range document {
+			termCounts[word]++
+		}
+		for _, word := range queryWords {
+			tf := float64(termCounts[word])
+			if tf == 0 {
+				continue
+			}
+			n := float64(frequencies[word])
+			idf := math.Log(1 + (count-n+0.5)/(n+0.5))
+			norm := BM25_K1 * (1 - BM25_B + BM25_B*float64(len(document))/averageLength)
+			scores[i] += idf * tf * (BM25_K1 + 1) / (tf + norm)
+		}
+		best = math.Max(best, scores[i])
+	}
+	if best > 0 {
+		for i := range scores {
+			scores[i] /= best
+		}
+	}
+	return scores
+}
+
+// titleMatch is 1 when the title is the query and otherwise the share of the
+// query words found in the title.
+func titleMatch(query string, queryWords []string, title string) float64 {
+	if strings.EqualFold(strings.TrimSpace(query), strings.TrimSpace(title)) {
+		return 1
+	}
+	titleWords := make(map[string]bool)
+	for _, word := range hashEmbeddingWords(title) {
+		titleWords[word] = true
+	}
+	found := 0
+	for _, word := range queryWords {
+		if titleWords[word] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(queryWords))
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
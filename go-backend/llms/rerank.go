@@ -1,64 +1,149 @@
 package llms
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go-backend/models"
-	"log"
+	"math"
 	"strconv"
 	"strings"
 
 	openai "github.com/sashabaranov/go-openai"
 )
 
-func RerankResults(c *models.LLMClient, query string, input []models.CardChunk) ([]float64, error) {
-	log.Printf("start")
-	summaries := make([]string, len(input))
-	for i, result := range input {
-		// Create a brief summary of each result
-		summaries[i] = fmt.Sprintf("%s - %s",
-			result.Title,
-			result.Chunk)
-	}
+// Reranker scores search candidates against a query. The scores run from 0
+// to 10 and are returned in the order of the candidates, one per candidate.
+// On error callers should keep their original order.
+type Reranker interface {
+	Rerank(query string, candidates []models.CardChunk) ([]float64, error)
+	// RelevanceCutoff is the score below which a candidate is unrelated to
+	// the query, or 0 when the scores cannot tell.
+	RelevanceCutoff() float64
+}
+
+const MAX_RERANK_SCORE = 10
+
+// LLM_RELEVANCE_CUTOFF leaves out the candidates the model rated 0, which the
+// prompt reserves for unrelated documents.
+const LLM_RELEVANCE_CUTOFF = 1
+
+// LLMReranker asks the chat model to score the candidates. Each candidate is
+// sent with an id and the model answers with a JSON object keyed by those
+// ids, so a skipped or reordered candidate cannot shift the other scores.
+type LLMReranker struct {
+	Client *models.LLMClient
+}
+
+func NewLLMReranker(c *models.LLMClient) *LLMReranker {
+	return &LLMReranker{Client: c}
+}
+
+type rerankDocument struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+// rerankCandidateID is the id a candidate is sent under. Positions are used
+// rather than card ids since one card can appear more than once.
+func rerankCandidateID(index int) string {
+	return strconv.Itoa(index + 1)
+}
 
-	prompt := fmt.Sprintf(`Given the search query "%s", rate the relevance of each document on a scale of 0-10. You are being provided with a number of documents in the form of "title - chunk"
+func rerankPrompt(query string, candidates []models.CardChunk) (string, error) {
+	documents := make([]rerankDocument, len(candidates))
+	for i, candidate := range candidates {
+		documents[i] = rerankDocument{ID: rerankCandidateID(i), Title: candidate.Title, Text: candidate.Chunk}
+	}
+	encoded, err := json.Marshal(documents)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`Given the search query %q, rate the relevance of each document on a scale of 0-10.
 
 Consider how well each document matches the query's intent and content. A "10", or close to it,
 should mean that the document matches the query. A "0", or close to it, means it is unrelated.
 You should weigh the title most heavily. For example, if the query is "Winston Churchill" and one
 of the documents is titled Winston Churchill, that should be the most highly rated card.
-Only respond with numbers separated by commas, like: 8.5,7.2,6.8
 
-Documents to rate:
-%s`, query, strings.Join(summaries, "\n"))
-	resp, err := ExecuteLLMRequest(c, []openai.ChatCompletionMessage{
+Respond with only a JSON object that maps the id of every document to its score, like:
+{"scores": {"1": 8.5, "2": 0}}
+
+Documents to rate, as a JSON array:
+%s`, query, encoded), nil
+}
+
+// parseRerankScores reads the model's answer. It accepts the scores wrapped
+// in {"scores": ...} or bare, with or without a code fence around them, and
+// fails unless every candidate has a score within range.
+func parseRerankScores(response string, count int) ([]float64, error) {
+	start := strings.Index(response, "{")
+	end := strings.LastIndex(response, "}")
+	if start == -1 || end < start {
+		return nil, fmt.Errorf("no JSON object in rerank response %q", response)
+	}
+	raw := []byte(response[start : end+1])
+
+	var wrapped struct {
+		Scores map[string]float64 `json:"scores"`
+	}
+	scoresByID := map[string]float64{}
+	if err := json.Unmarshal(raw, &wrapped); err == nil && wrapped.Scores != nil {
+		scoresByID = wrapped.Scores
+	} else if err := json.Unmarshal(raw, &scoresByID); err != nil {
+		return nil, fmt.Errorf("invalid rerank response: %w", err)
+	}
+
+	scores := make([]float64, count)
+	var missing []string
+	for i := range scores {
+		score, ok := scoresByID[rerankCandidateID(i)]
+		if !ok {
+			missing = append(missing, rerankCandidateID(i))
+			continue
+		}
+		if math.IsNaN(score) || score < 0 || score > MAX_RERANK_SCORE {
+			return nil, fmt.Errorf("rerank score %v for %s is out of range", score, rerankCandidateID(i))
+		}
+		scores[i] = score
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("rerank response is missing scores for %s", strings.Join(missing, ", "))
+	}
+	return scores, nil
+}
+
+func (r *LLMReranker) RelevanceCutoff() float64 {
+	return LLM_RELEVANCE_CUTOFF
+}
+
+func (r *LLMReranker) Rerank(query string, candidates []models.CardChunk) ([]float64, error) {
+	if len(candidates) == 0 {
+		return []float64{}, nil
+	}
+	if r.Client == nil || r.Client.Client == nil {
+		return nil, errors.New("no LLM client configured for reranking")
+	}
+	prompt, err := rerankPrompt(query, candidates)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ExecuteLLMRequest(r.Client, models.RerankingTask, []openai.ChatCompletionMessage{
 		{
 			Role:    "system",
-			Content: "You are a search result scoring assistant. Only respond with comma-separated numbers.",
+			Content: "You are a search result scoring assistant. Only respond with a JSON object.",
 		},
 		{
 			Role:    "user",
 			Content: prompt,
 		},
 	})
-	log.Printf("resp %v", resp)
-	scores := parseScores(resp.Choices[0].Message.Content)
 	if err != nil {
-		return []float64{}, err
+		return nil, err
 	}
-	return scores, nil
-
-}
-func parseScores(response string) []float64 {
-	// Split the response and convert to float64
-	parts := strings.Split(strings.TrimSpace(response), ",")
-	scores := make([]float64, len(parts))
-	for i, part := range parts {
-		score, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
-		if err != nil {
-			scores[i] = 0
-			continue
-		}
-		scores[i] = score
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("no response received from LLM")
 	}
-	return scores
+	return parseRerankScores(resp.Choices[0].Message.Content, len(candidates))
 }
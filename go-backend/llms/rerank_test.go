@@ -0,0 +1,140 @@
+package llms
+
+import (
+	"encoding/json"
+	"go-backend/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestParseRerankScores(t *testing.T) {
+	testCases := []struct {
+		response string
+		expected []float64
+	}{
+		{`{"scores": {"1": 8.5, "2": 0, "3": 10}}`, []float64{8.5, 0, 10}},
+		{`{"2": 3, "1": 4, "3": 5}`, []float64{4, 3, 5}},
+		{"```json\n{\"scores\": {\"3\": 1, \"2\": 2, \"1\": 3}}\n```", []float64{3, 2, 1}},
+		// ids the candidates do not have are ignored
+		{`{"scores": {"1": 1, "2": 2, "3": 3, "9": 9}}`, []float64{1, 2, 3}},
+	}
+	for _, tc := range testCases {
+		scores, err := parseRerankScores(tc.response, 3)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.response, err)
+			continue
+		}
+		if !reflect.DeepEqual(scores, tc.expected) {
+			t.Errorf("wrong scores for %q, got %v want %v", tc.response, scores, tc.expected)
+		}
+	}
+
+	invalid := []string{
+		"8.5,7.2,6.8",
+		`{"scores": {"1": 1, "2": 2}}`,
+		`{"scores": {"1": 1, "2": 2, "3": 11}}`,
+		`{"scores": {"1": "high", "2": 2, "3": 1}}`,
+		`{"scores": {"1": 1, "2": 2, "3": -1}}`,
+	}
+	for _, response := range invalid {
+		if _, err := parseRerankScores(response, 3); err == nil {
+			t.Errorf("expected an error for %q", response)
+		}
+	}
+}
+
+func TestRerankPrompt(t *testing.T) {
+	prompt, err := rerankPrompt(`"quoted" query`, []models.CardChunk{
+		{Title: "First", Chunk: "line one\nline two"},
+		{Title: "Second", Chunk: "text"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(prompt, `query "\"quoted\" query"`) {
+		t.Errorf("query should be quoted, got %v", prompt)
+	}
+	_, documents, _ := strings.Cut(prompt, "Documents to rate, as a JSON array:\n")
+	var parsed []rerankDocument
+	if err := json.Unmarshal([]byte(documents), &parsed); err != nil {
+		t.Fatalf("documents should be a JSON array: %v", err)
+	}
+	if len(parsed) != 2 || parsed[0].ID != "1" || parsed[0].Text != "line one\nline two" || parsed[1].ID != "2" {
+		t.Errorf("wrong documents, got %+v", parsed)
+	}
+}
+
+func newFakeChatServer(t *testing.T, content string) *models.LLMClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{{
+				Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content},
+			}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	config := openai.DefaultConfig("test")
+	config.BaseURL = server.URL
+	return &models.LLMClient{Client: openai.NewClientWithConfig(config), Testing: true}
+}
+
+func TestLLMReranker(t *testing.T) {
+	candidates := []models.CardChunk{{Title: "a"}, {Title: "b"}}
+
+	reranker := NewLLMReranker(newFakeChatServer(t, `{"scores": {"2": 9, "1": 2}}`))
+	scores, err := reranker.Rerank("query", candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(scores, []float64{2, 9}) {
+		t.Errorf("wrong scores, got %v", scores)
+	}
+
+	// a skipped candidate fails the whole rerank instead of shifting scores
+	reranker = NewLLMReranker(newFakeChatServer(t, `{"scores": {"2": 9}}`))
+	if _, err := reranker.Rerank("query", candidates); err == nil {
+		t.Errorf("expected an error when a score is missing")
+	}
+
+	if _, err := NewLLMReranker(&models.LLMClient{Testing: true}).Rerank("query", candidates); err == nil {
+		t.Errorf("expected an error without a client")
+	}
+}
+
+func TestLocalReranker(t *testing.T) {
+	candidates := []models.CardChunk{
+		{Title: "Roman roads", Chunk: "Gravel and paving stones, cambered to drain rain."},
+		{Title: "Churchill's speeches", Chunk: "Winston Churchill spoke to the House of Commons in 1940."},
+		{Title: "Winston Churchill", Chunk: "British prime minister during the Second World War."},
+	}
+	scores, err := NewLocalReranker().Rerank("Winston Churchill", candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != len(candidates) {
+		t.Fatalf("wrong number of scores, got %v want %v", len(scores), len(candidates))
+	}
+	if !(scores[2] > scores[1] && scores[1] > scores[0]) {
+		t.Errorf("expected the exact title first and the unrelated card last, got %v", scores)
+	}
+	for _, score := range scores {
+		if score < 0 || score > MAX_RERANK_SCORE {
+			t.Errorf("score out of range: %v", score)
+		}
+	}
+
+	again, _ := NewLocalReranker().Rerank("Winston Churchill", candidates)
+	if !reflect.DeepEqual(scores, again) {
+		t.Errorf("local reranking should be deterministic")
+	}
+
+	scores, _ = NewLocalReranker().Rerank("", candidates)
+	if !reflect.DeepEqual(scores, []float64{0, 0, 0}) {
+		t.Errorf("an empty query should score nothing, got %v", scores)
+	}
+}
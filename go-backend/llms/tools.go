@@ -0,0 +1,85 @@
+package llms
+
+import (
+	"fmt"
+	"go-backend/models"
+	"log"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// MAX_TOOL_ROUNDS is how many times the model can call tools for one answer.
+// After that it is asked to answer with what it has.
+const MAX_TOOL_ROUNDS = 5
+
+// ToolHandler runs one tool call and returns the result to show the model.
+// Returning pause ends the loop once every call of the round has been
+// handled, such as when a call has to wait for the user to confirm it.
+type ToolHandler func(call openai.ToolCall) (result string, pause bool)
+
+// ToolMessages is the prompt for acting on the zettelkasten with tools: the
+// conversation so far after instructions on how to use them.
+func ToolMessages(pastMessages []models.ChatCompletion) []openai.ChatCompletionMessage {
+	systemPrompt := `
+You are a helpful assistant with access to the user's Zettelkasten (note card) system through tools.
+Cards are identified by their card_id, such as "4", "4/2" or "4/2.3". A card_id is a list of parts joined by separators that alternate between "/" and ".", starting with "/", and a card is filed under the card_id without its last part. So the children of "4" are "4/1", "4/2" and so on, the children of "4/2" are "4/2.1", "4/2.2" and so on, and the children of "4/2.3" are "4/2.3/1" and so on. A card_id with one part, such as "4", is a top level card.
+Rules:
+1. Look things up with the tools instead of guessing
+2. Before creating a card under another one, fetch the parent to see which card_ids its children already use. The parent has to exist
+3. Creating cards and tasks only proposes them, the user confirms them before they are applied
+4. Be brief
+
+Today is %s.`
+	messages := []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: fmt.Sprintf(systemPrompt, time.Now().Format("2006-01-02")),
+		},
+	}
+	return append(messages, ChatMessages(pastMessages)...)
+}
+
+// ToolChatCompletion answers with the answering model, running the tool
+// calls it makes through handle and sending back their results, for at
+// most MAX_TOOL_ROUNDS rounds.
+func ToolChatCompletion(c *models.LLMClient, messages []openai.ChatCompletionMessage, tools []openai.Tool, handle ToolHandler) (models.ChatCompletion, error) {
+	completion := models.ChatCompletion{Role: openai.ChatMessageRoleAssistant}
+	for round := 0; ; round++ {
+		toolChoice := "auto"
+		if round == MAX_TOOL_ROUNDS {
+			toolChoice = "none"
+		}
+		resp, err := ExecuteToolRequest(c, models.AnsweringTask, messages, tools, toolChoice)
+		if err != nil {
+			log.Printf("error getting completion: %v", err)
+			return models.ChatCompletion{}, fmt.Errorf("failed to get AI response: %w", err)
+		}
+		if len(resp.Choices) == 0 {
+			return models.ChatCompletion{}, fmt.Errorf("no response from AI")
+		}
+		completion.Model = responseModel(c, models.AnsweringTask, resp)
+		completion.Tokens += resp.Usage.TotalTokens
+
+		message := resp.Choices[0].Message
+		completion.Content = message.Content
+		if len(message.ToolCalls) == 0 || round == MAX_TOOL_ROUNDS {
+			return completion, nil
+		}
+
+		messages = append(messages, message)
+		paused := false
+		for _, call := range message.ToolCalls {
+			result, pause := handle(call)
+			paused = paused || pause
+			messages = append(messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    result,
+				ToolCallID: call.ID,
+			})
+		}
+		if paused {
+			return completion, nil
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package llms
+
+import (
+	"encoding/json"
+	"go-backend/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeToolServer answers each request with a call to the lookup tool until
+// it has seen answerAfter tool results, and then with a plain answer.
+func fakeToolServer(t *testing.T, answerAfter int) (*httptest.Server, *[]openai.ChatCompletionRequest) {
+	var requests []openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openai.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+
+		results := 0
+		for _, message := range request.Messages {
+			if message.Role == openai.ChatMessageRoleTool {
+				results++
+			}
+		}
+		message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "The answer"}
+		if results < answerAfter && request.ToolChoice != "none" {
+			message = openai.ChatCompletionMessage{
+				Role: openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{{
+					ID:       "call",
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: "lookup", Arguments: `{}`},
+				}},
+			}
+		}
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Model:   request.Model,
+			Choices: []openai.ChatCompletionChoice{{Message: message}},
+			Usage:   openai.Usage{TotalTokens: 10},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func fakeToolClient(server *httptest.Server) *models.LLMClient {
+	config := openai.DefaultConfig("test")
+	config.BaseURL = server.URL
+	return NewClient(nil, config)
+}
+
+var lookupTools = []openai.Tool{{
+	Type:     openai.ToolTypeFunction,
+	Function: &openai.FunctionDefinition{Name: "lookup"},
+}}
+
+func TestToolChatCompletion(t *testing.T) {
+	server, requests := fakeToolServer(t, 2)
+	calls := 0
+	completion, err := ToolChatCompletion(fakeToolClient(server), []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}, lookupTools,
+		func(call openai.ToolCall) (string, bool) {
+			calls++
+			return `{"found": true}`, false
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completion.Content != "The answer" || completion.Tokens != 30 {
+		t.Errorf("wrong completion, got %+v", completion)
+	}
+	if calls != 2 || len(*requests) != 3 {
+		t.Fatalf("wrong number of calls, got %v calls and %v requests", calls, len(*requests))
+	}
+	last := (*requests)[2].Messages
+	result := last[len(last)-1]
+	if result.Role != openai.ChatMessageRoleTool || result.ToolCallID != "call" || result.Content != `{"found": true}` {
+		t.Errorf("the tool result should be sent back, got %+v", result)
+	}
+}
+
+func TestToolChatCompletionIsBounded(t *testing.T) {
+	server, requests := fakeToolServer(t, 100)
+	calls := 0
+	completion, err := ToolChatCompletion(fakeToolClient(server), []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}, lookupTools,
+		func(call openai.ToolCall) (string, bool) {
+			calls++
+			return `{}`, false
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != MAX_TOOL_ROUNDS || len(*requests) != MAX_TOOL_ROUNDS+1 {
+		t.Errorf("wrong number of calls, got %v calls and %v requests", calls, len(*requests))
+	}
+	if (*requests)[MAX_TOOL_ROUNDS].ToolChoice != "none" {
+		t.Errorf("the last request should not allow tool calls")
+	}
+	if completion.Content != "The answer" {
+		t.Errorf("wrong completion, got %+v", completion)
+	}
+}
+
+func TestToolChatCompletionPauses(t *testing.T) {
+	server, requests := fakeToolServer(t, 2)
+	_, err := ToolChatCompletion(fakeToolClient(server), []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}, lookupTools,
+		func(call openai.ToolCall) (string, bool) {
+			return `{"status": "waiting"}`, true
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("the loop should stop after a paused call, got %v requests", len(*requests))
+	}
+}
@@ -4,7 +4,6 @@ import (
 	//	"bytes"
 	"context"
 	//"encoding/json"
-	"fmt"
 	"go-backend/handlers"
 	"go-backend/llms"
 	"go-backend/mail"
@@ -13,7 +12,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/mux"
@@ -133,34 +131,60 @@ func main() {
 	config.BaseURL = os.Getenv("ZETTEL_LLM_ENDPOINT")
 
 	s.LLMClient = llms.NewClient(s.DB, config)
+	s.LLMClient.Models, err = llms.ChatModelsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid chat model configuration: %v", err)
+	}
+	embedderConfig, err := llms.EmbedderConfigFromEnv()
+	if err == nil {
+		s.LLMClient.Embedder, err = llms.NewEmbedder(embedderConfig)
+	}
+	if err != nil {
+		log.Printf("embeddings are disabled: %v", err)
+	}
+	nextConfig, migrating, err := llms.NextEmbedderConfigFromEnv()
+	if err == nil && migrating {
+		var next models.Embedder
+		next, err = llms.NewEmbedder(nextConfig)
+		if err == nil {
+			err = llms.ResolveNextEmbedder(s.LLMClient, s.DB, next)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Invalid next embedding configuration: %v", err)
+	}
+	s.Chunker, err = llms.ChunkerConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid chunking configuration: %v", err)
+	}
+	s.DisableReranking = os.Getenv("ZETTEL_DISABLE_RERANKING") == "true"
+	switch os.Getenv("ZETTEL_RERANKER") {
+	case "local":
+		s.Reranker = llms.NewLocalReranker()
+	case "none":
+		s.Reranker = nil
+	default:
+		s.Reranker = llms.NewLLMReranker(s.LLMClient)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		os.Exit(runReindexCommand(h, os.Args[2:]))
+	}
 
 	go func() {
 		h.SyncStripePlans()
 	}()
 
-	if os.Getenv("ZETTEL_RUN_CHUNKING_EMBEDDING") == "true" {
+	if !s.Testing {
 		go func() {
-			start := time.Now()
-			cards, _ := h.ClassicSearch(1, "")
-			for _, card := range cards {
-				log.Printf("%v - %v", card.CardID, card.Title)
-				err := h.ChunkCard(card)
-				if err != nil {
-					log.Printf("chunking error %v", err)
-					break
-				}
-				err = h.ChunkEmbedCard(1, card.ID)
-				if err != nil {
-					log.Printf("embedding error %v", err)
-					break
-				}
+			if err := h.BackfillFileText(); err != nil {
+				log.Printf("error filling in file text: %v", err)
 			}
-			elapsed := time.Since(start)
-
-			fmt.Printf("Operation took %v\n", elapsed)
-
 		}()
-
+		llms.StartEmbeddingWorker(s.LLMClient)
+		if s.LLMClient.NextEmbedding() != nil {
+			llms.StartEmbeddingMigrationWorker(s.LLMClient, s.DB)
+		}
 	}
 
 	r := mux.NewRouter()
@@ -181,18 +205,45 @@ func main() {
 	addProtectedRoute(r, "/api/cards", h.CreateCardRoute, "POST")
 	addProtectedRoute(r, "/api/cards/next-root-id", h.GetNextRootCardIDRoute, "GET")
 	addProtectedRoute(r, "/api/search", h.SemanticSearchCardsRoute, "GET")
+	addProtectedRoute(r, "/api/search/ranking", h.GetRankingConfigRoute, "GET")
+	addProtectedRoute(r, "/api/search/ranking", h.UpdateRankingConfigRoute, "PUT")
+	addProtectedRoute(r, "/api/autocomplete", h.GetAutocompleteRoute, "GET")
+	addProtectedRoute(r, "/api/embeddings/status", h.GetEmbeddingStatusRoute, "GET")
 	addProtectedRoute(r, "/api/cards/{id}", h.GetCardRoute, "GET")
+	addProtectedRoute(r, "/api/saved-searches", h.GetSavedSearchesRoute, "GET")
+	addProtectedRoute(r, "/api/saved-searches", h.CreateSavedSearchRoute, "POST")
+	addProtectedRoute(r, "/api/saved-searches/{id}", h.GetSavedSearchRoute, "GET")
+	addProtectedRoute(r, "/api/saved-searches/{id}", h.UpdateSavedSearchRoute, "PUT")
+	addProtectedRoute(r, "/api/saved-searches/{id}", h.DeleteSavedSearchRoute, "DELETE")
+	addProtectedRoute(r, "/api/saved-searches/{id}/results", h.ExecuteSavedSearchRoute, "GET")
+	addProtectedRoute(r, "/api/dashboard", h.GetDashboardRoute, "GET")
 	addProtectedRoute(r, "/api/cards/{id}", h.UpdateCardRoute, "PUT")
 	addProtectedRoute(r, "/api/cards/{id}", h.DeleteCardRoute, "DELETE")
 	addProtectedRoute(r, "/api/cards/{id}/related", h.GetRelatedCardsRoute, "GET")
 
+	addProtectedRoute(r, "/api/flashcards", h.GetNextFlashcardRoute, "GET")
+	addProtectedRoute(r, "/api/flashcards", h.ReviewFlashcardRoute, "POST")
+	addProtectedRoute(r, "/api/flashcards/due", h.GetDueFlashcardsRoute, "GET")
+	addProtectedRoute(r, "/api/flashcards/export", h.ExportFlashcardsRoute, "GET")
+	addProtectedRoute(r, "/api/flashcards/{id}/reviews", h.GetFlashcardReviewsRoute, "GET")
+	addProtectedRoute(r, "/api/flashcards/clozes/due", h.GetDueClozeItemsRoute, "GET")
+	addProtectedRoute(r, "/api/flashcards/clozes", h.ReviewClozeItemRoute, "POST")
+	addProtectedRoute(r, "/api/cards/{id}/clozes", h.GetCardClozeItemsRoute, "GET")
+
 	addProtectedRoute(r, "/api/users/{id}", h.GetUserRoute, "GET")
 	addProtectedRoute(r, "/api/users/{id}", h.UpdateUserRoute, "PUT")
 	addProtectedRoute(r, "/api/users", h.GetUsersRoute, "GET")
 	addRoute(r, "/api/users", h.CreateUserRoute, "POST")
 	addProtectedRoute(r, "/api/users/{id}/subscription", h.GetUserSubscriptionRoute, "GET")
+	addProtectedRoute(r, "/api/backup", h.ExportBackupRoute, "GET")
+	addProtectedRoute(r, "/api/backup", h.ImportBackupRoute, "POST")
 	addProtectedRoute(r, "/api/current", h.GetCurrentUserRoute, "GET")
 	addProtectedRoute(r, "/api/admin", h.GetUserAdminRoute, "GET")
+	addProtectedRoute(r, "/api/admin/reindex", h.Admin(h.GetReindexRunsRoute), "GET")
+	addProtectedRoute(r, "/api/admin/reindex", h.Admin(h.CreateReindexRunRoute), "POST")
+	addProtectedRoute(r, "/api/admin/reindex/{id}", h.Admin(h.GetReindexRunRoute), "GET")
+	addProtectedRoute(r, "/api/admin/reindex/{id}/resume", h.Admin(h.ResumeReindexRunRoute), "POST")
+	addProtectedRoute(r, "/api/admin/embedding-migrations", h.Admin(h.GetEmbeddingMigrationsRoute), "GET")
 
 	addProtectedRoute(r, "/api/tasks/{id}", h.GetTaskRoute, "GET")
 	addProtectedRoute(r, "/api/tasks", h.GetTasksRoute, "GET")
@@ -208,6 +259,9 @@ func main() {
 	addProtectedRoute(r, "/api/chat", h.GetUserConversationsRoute, "GET")
 	addProtectedRoute(r, "/api/chat/{id}", h.GetChatConversationRoute, "GET")
 	addProtectedRoute(r, "/api/chat", h.PostChatMessageRoute, "POST")
+	addProtectedRoute(r, "/api/chat/stream", h.PostChatMessageStreamRoute, "POST")
+	addProtectedRoute(r, "/api/chat/actions/{id}/confirm", h.ConfirmChatActionRoute, "POST")
+	addProtectedRoute(r, "/api/chat/actions/{id}/reject", h.RejectChatActionRoute, "POST")
 
 	addRoute(r, "/api/mailing-list", h.AddToMailingListRoute, "POST")
 	addProtectedRoute(r, "/api/mailing-list", h.GetMailingListSubscribersRoute, "GET") // Add this line
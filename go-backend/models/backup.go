@@ -0,0 +1,206 @@
+package models
+
+import (
+	"time"
+)
+
+// BACKUP_VERSION is bumped whenever the archive layout changes in a way
+// that older importers would not understand. Version 2 added the flashcard
+// state, reviews and cloze items, saved searches, the search ranking, chat
+// scopes and proposed chat actions; version 1 archives import without them.
+const BACKUP_VERSION = 2
+
+// Backup is a portable archive of everything a user owns. IDs inside the
+// archive are the IDs from the exporting instance and are remapped on import.
+type Backup struct {
+	Version          int                     `json:"version"`
+	ExportedAt       time.Time               `json:"exported_at"`
+	Settings         BackupSettings          `json:"settings"`
+	Cards            []BackupCard            `json:"cards"`
+	Backlinks        []BackupBacklink        `json:"backlinks"`
+	Tags             []BackupTag             `json:"tags"`
+	CardTags         []CardTag               `json:"card_tags"`
+	Tasks            []BackupTask            `json:"tasks"`
+	TaskTags         []TaskTag               `json:"task_tags"`
+	Entities         []BackupEntity          `json:"entities"`
+	EntityCards      []BackupEntityCard      `json:"entity_cards"`
+	Conversations    []BackupConversation    `json:"chat_conversations"`
+	ChatCompletions  []BackupChatCompletion  `json:"chat_completions"`
+	ChatActions      []BackupChatAction      `json:"chat_actions"`
+	Files            []BackupFile            `json:"files"`
+	FlashcardReviews []BackupFlashcardReview `json:"flashcard_reviews"`
+	ClozeItems       []BackupClozeItem       `json:"cloze_items"`
+	SavedSearches    []BackupSavedSearch     `json:"saved_searches"`
+}
+
+type BackupSettings struct {
+	Username        string `json:"username"`
+	DashboardCardPK int    `json:"dashboard_card_pk"`
+	// SearchRanking is nil when the user never changed the defaults
+	SearchRanking *RankingConfig `json:"search_ranking"`
+}
+
+type BackupCard struct {
+	ID        int       `json:"id"`
+	CardID    string    `json:"card_id"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Link      string    `json:"link"`
+	ParentID  int       `json:"parent_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// the scheduling state of flashcards
+	IsFlashcard         bool       `json:"is_flashcard"`
+	FlashcardState      string     `json:"flashcard_state"`
+	FlashcardReps       int        `json:"flashcard_reps"`
+	FlashcardLapses     int        `json:"flashcard_lapses"`
+	FlashcardLastReview *time.Time `json:"flashcard_last_review"`
+	FlashcardDue        *time.Time `json:"flashcard_due"`
+	FlashcardDifficulty float64    `json:"flashcard_difficulty"`
+	FlashcardStability  float64    `json:"flashcard_stability"`
+}
+
+type BackupBacklink struct {
+	SourcePK  int       `json:"source_pk"`
+	TargetPK  int       `json:"target_pk"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type BackupTag struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+type TaskTag struct {
+	TaskPK int `json:"task_pk"`
+	TagID  int `json:"tag_id"`
+}
+
+type BackupTask struct {
+	ID            int        `json:"id"`
+	CardPK        int        `json:"card_pk"`
+	ScheduledDate *time.Time `json:"scheduled_date"`
+	DueDate       *time.Time `json:"due_date"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	CompletedAt   *time.Time `json:"completed_at"`
+	Title         string     `json:"title"`
+	IsComplete    bool       `json:"is_complete"`
+}
+
+type BackupEntity struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Type        string    `json:"type"`
+	CardPK      *int      `json:"card_pk"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type BackupEntityCard struct {
+	EntityID int `json:"entity_id"`
+	CardPK   int `json:"card_pk"`
+}
+
+type BackupConversation struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	Model        string    `json:"model"`
+	MessageCount int       `json:"message_count"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	ScopeCardPKs []int     `json:"scope_card_pks"`
+	ScopeSubtree string    `json:"scope_subtree"`
+	ScopeTag     string    `json:"scope_tag"`
+}
+
+type BackupChatCompletion struct {
+	ConversationID string    `json:"conversation_id"`
+	SequenceNumber int       `json:"sequence_number"`
+	Role           string    `json:"role"`
+	Content        string    `json:"content"`
+	Refusal        *string   `json:"refusal"`
+	Model          string    `json:"model"`
+	Tokens         int       `json:"tokens"`
+	CreatedAt      time.Time `json:"created_at"`
+	CardPKs        []int     `json:"card_pks"`
+}
+
+// BackupChatAction is an action the chat proposed, with its outcome.
+// Arguments refer to cards by card_id, so they need no remapping.
+type BackupChatAction struct {
+	ConversationID string     `json:"conversation_id"`
+	SequenceNumber int        `json:"sequence_number"`
+	Tool           string     `json:"tool"`
+	Arguments      string     `json:"arguments"`
+	Description    string     `json:"description"`
+	Status         string     `json:"status"`
+	Result         string     `json:"result"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ResolvedAt     *time.Time `json:"resolved_at"`
+}
+
+// BackupFile carries the file metadata and, when available, the file
+// contents. Data is base64 encoded by encoding/json.
+type BackupFile struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Filetype  string    `json:"filetype"`
+	Size      int       `json:"size"`
+	CardPK    int       `json:"card_pk"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Data      []byte    `json:"data"`
+	// ExtractedText is the searchable text of the file, nil in archives made
+	// before files were searchable.
+	ExtractedText *string `json:"extracted_text"`
+}
+
+// BackupFlashcardReview is one entry of the review log. ClozeIndex is set
+// for reviews of a single cloze deletion.
+type BackupFlashcardReview struct {
+	CardPK        int        `json:"card_pk"`
+	ClozeIndex    *int       `json:"cloze_index"`
+	Rating        int        `json:"rating"`
+	State         string     `json:"state"`
+	Stability     float64    `json:"stability"`
+	Difficulty    float64    `json:"difficulty"`
+	ElapsedDays   int        `json:"elapsed_days"`
+	ScheduledDays int        `json:"scheduled_days"`
+	Due           *time.Time `json:"due"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type BackupClozeItem struct {
+	CardPK     int        `json:"card_pk"`
+	ClozeIndex int        `json:"cloze_index"`
+	State      string     `json:"state"`
+	Reps       int        `json:"reps"`
+	Lapses     int        `json:"lapses"`
+	LastReview *time.Time `json:"last_review"`
+	Due        *time.Time `json:"due"`
+	Difficulty float64    `json:"difficulty"`
+	Stability  float64    `json:"stability"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+type BackupSavedSearch struct {
+	Name        string    `json:"name"`
+	SearchTerm  string    `json:"search_term"`
+	SearchType  string    `json:"search_type"`
+	ResultLimit int       `json:"result_limit"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type ImportBackupResponse struct {
+	Message  string `json:"message"`
+	Cards    int    `json:"cards"`
+	Tasks    int    `json:"tasks"`
+	Entities int    `json:"entities"`
+	Files    int    `json:"files"`
+}
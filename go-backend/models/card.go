@@ -9,25 +9,26 @@ import (
 )
 
 type Card struct {
-	ID         int           `json:"id"`
-	CardID     string        `json:"card_id"`
-	UserID     int           `json:"user_id"`
-	Title      string        `json:"title"`
-	Body       string        `json:"body"`
-	Link       string        `json:"link"`
-	IsDeleted  bool          `json:"is_deleted"`
-	CreatedAt  time.Time     `json:"created_at"`
-	UpdatedAt  time.Time     `json:"updated_at"`
-	ParentID   int           `json:"parent_id"`
-	Parent     PartialCard   `json:"parent"`
-	Files      []File        `json:"files"`
-	Children   []PartialCard `json:"children"`
-	References []PartialCard `json:"references"`
-	Keywords   []Keyword     `json:"keywords"`
-	Tags       []Tag         `json:"tags"`
-	Tasks      []Task        `json:"tasks"`
-	Embedding  pgvector.Vector
-	Entities   []Entity `json:"entities"`
+	ID          int           `json:"id"`
+	CardID      string        `json:"card_id"`
+	UserID      int           `json:"user_id"`
+	Title       string        `json:"title"`
+	Body        string        `json:"body"`
+	Link        string        `json:"link"`
+	IsDeleted   bool          `json:"is_deleted"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	ParentID    int           `json:"parent_id"`
+	Parent      PartialCard   `json:"parent"`
+	Files       []File        `json:"files"`
+	Children    []PartialCard `json:"children"`
+	References  []PartialCard `json:"references"`
+	Keywords    []Keyword     `json:"keywords"`
+	Tags        []Tag         `json:"tags"`
+	Tasks       []Task        `json:"tasks"`
+	Embedding   pgvector.Vector
+	Entities    []Entity `json:"entities"`
+	IsFlashcard bool     `json:"is_flashcard"`
 }
 
 func ScanCards(rows *sql.Rows) ([]Card, error) {
@@ -107,6 +108,25 @@ type Flashcard struct {
 	Stability  float64    `json:"stability"`
 }
 
+type FlashcardReviewParams struct {
+	CardPK int `json:"card_pk"`
+	Rating int `json:"rating"`
+}
+
+type FlashcardReview struct {
+	ID            int       `json:"id"`
+	CardPK        int       `json:"card_pk"`
+	Rating        int       `json:"rating"`
+	State         string    `json:"state"`
+	Stability     float64   `json:"stability"`
+	Difficulty    float64   `json:"difficulty"`
+	ElapsedDays   int       `json:"elapsed_days"`
+	ScheduledDays int       `json:"scheduled_days"`
+	Due           time.Time `json:"due"`
+	CreatedAt     time.Time `json:"created_at"`
+	ClozeIndex    *int      `json:"cloze_index,omitempty"`
+}
+
 func ConvertCardToPartialCard(input Card) PartialCard {
 	return PartialCard{
 		ID:        input.ID,
@@ -125,7 +145,7 @@ type EditCardParams struct {
 	Title       string `json:"title"`
 	Body        string `json:"body"`
 	Link        string `json:"link"`
-	IsFlashcard bool   `json:"is_flashcard"`
+	IsFlashcard *bool  `json:"is_flashcard,omitempty"`
 }
 
 type NextIDParams struct {
@@ -144,6 +164,7 @@ type CardChunk struct {
 	UserID           int       `json:"user_id"`
 	Title            string    `json:"title"`
 	Chunk            string    `json:"body"`
+	ContentHash      string    `json:"content_hash,omitempty"`
 	CreatedAt        time.Time `json:"created_at"`
 	UpdatedAt        time.Time `json:"updated_at"`
 	ParentID         int       `json:"parent_id"`
@@ -151,6 +172,8 @@ type CardChunk struct {
 	SharedEntities   int       `json:"shared_entities"`
 	EntitySimilarity float64   `json:"entity_similarity"`
 	CombinedScore    float64   `json:"combined_score"`
+	// Explanation is only set by semantic search
+	Explanation *RankingExplanation `json:"explanation,omitempty"`
 }
 
 func ScanCardChunks(rows *sql.Rows) ([]CardChunk, error) {
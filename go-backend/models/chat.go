@@ -1,71 +1,89 @@
 package models
 
 import (
-	"database/sql"
+	"context"
 	"sync"
 	"time"
 
 	openai "github.com/sashabaranov/go-openai"
 )
 
-type LLMRequest struct {
-	UserID  int
-	Text    string
-	CardPK  int
-	Chunk   CardChunk
-	Retries int
+// ChatProvider is what the chat models are reached through. *openai.Client
+// implements it, and so covers any OpenAI compatible endpoint.
+type ChatProvider interface {
+	CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (*openai.ChatCompletionStream, error)
 }
 
-type LLMRequestQueue struct {
-	Queue        []LLMRequest
-	Mu           sync.Mutex
-	IsProcessing bool
-	DB           *sql.DB
+// ChatTask is a job the chat model is used for. Each task can be given its
+// own model and settings, so that a small model can route and title while a
+// larger one answers.
+type ChatTask string
+
+const (
+	RoutingTask   ChatTask = "routing"
+	AnsweringTask ChatTask = "answering"
+	RerankingTask ChatTask = "reranking"
+	EntityTask    ChatTask = "entities"
+	TitlingTask   ChatTask = "titling"
+)
+
+var CHAT_TASKS = []ChatTask{RoutingTask, AnsweringTask, RerankingTask, EntityTask, TitlingTask}
+
+const DEFAULT_CHAT_MODEL = "gpt-3.5-turbo"
+
+type ChatModelConfig struct {
+	Model string
+	// Temperature and MaxTokens are left to the provider when 0.
+	Temperature float32
+	MaxTokens   int
 }
 
 type LLMClient struct {
-	Client         *openai.Client
+	Client ChatProvider
+	Models map[ChatTask]ChatModelConfig
+	// Embedder and NextEmbedder are set at startup. NextEmbedder is the model
+	// a migration is moving to, and is swapped in once every vector has been
+	// made with it, so read both through ActiveEmbedder and NextEmbedding.
+	Embedder       Embedder
+	NextEmbedder   Embedder
+	embedderMu     sync.RWMutex
 	Testing        bool
-	EmbeddingQueue *LLMRequestQueue
+	EmbeddingQueue *EmbeddingQueue
 }
 
-func NewEmbeddingQueue(db *sql.DB) *LLMRequestQueue {
-	return &LLMRequestQueue{
-		Queue: make([]LLMRequest, 0),
-		DB:    db,
-	}
+// ActiveEmbedder is the embedder searches and stored vectors use.
+func (c *LLMClient) ActiveEmbedder() Embedder {
+	c.embedderMu.RLock()
+	defer c.embedderMu.RUnlock()
+	return c.Embedder
 }
 
-// Push adds an email to the queue
-func (q *LLMRequestQueue) Push(request LLMRequest) {
-	q.Mu.Lock()
-	defer q.Mu.Unlock()
-	q.Queue = append(q.Queue, request)
+// NextEmbedding is the embedder being migrated to, or nil.
+func (c *LLMClient) NextEmbedding() Embedder {
+	c.embedderMu.RLock()
+	defer c.embedderMu.RUnlock()
+	return c.NextEmbedder
 }
 
-// Pop removes and returns the first email from the queue
-// Returns false if queue is empty
-func (q *LLMRequestQueue) Pop() (LLMRequest, bool) {
-	q.Mu.Lock()
-	defer q.Mu.Unlock()
-
-	if len(q.Queue) == 0 {
-		return LLMRequest{}, false
+// SwitchEmbedder makes the migration's embedder the active one.
+func (c *LLMClient) SwitchEmbedder() {
+	c.embedderMu.Lock()
+	defer c.embedderMu.Unlock()
+	if c.NextEmbedder != nil {
+		c.Embedder = c.NextEmbedder
+		c.NextEmbedder = nil
 	}
-
-	// Get the first email
-	request := q.Queue[0]
-	// Remove it from the queue
-	q.Queue = q.Queue[1:]
-
-	return request, true
 }
 
-// Length returns the current size of the queue
-func (eq *LLMRequestQueue) Length() int {
-	eq.Mu.Lock()
-	defer eq.Mu.Unlock()
-	return len(eq.Queue)
+// ModelFor returns the settings for a task, using DEFAULT_CHAT_MODEL when no
+// model is configured.
+func (c *LLMClient) ModelFor(task ChatTask) ChatModelConfig {
+	config := c.Models[task]
+	if config.Model == "" {
+		config.Model = DEFAULT_CHAT_MODEL
+	}
+	return config
 }
 
 type ChatCompletion struct {
@@ -81,14 +99,31 @@ type ChatCompletion struct {
 	CreatedAt         time.Time     `json:"created_at"`
 	ReferencedCardPKs []int         `json:"card_pks"`
 	ReferencedCards   []PartialCard `json:"cards"`
+	Actions           []ChatAction  `json:"actions,omitempty"`
+	// Scope sets which cards the conversation draws on when sent with a
+	// message. Leaving it out keeps the conversation's current scope.
+	Scope *ChatScope `json:"scope,omitempty"`
+}
+
+// ChatScope limits the cards a conversation answers from to the pinned
+// cards, a Folgezettel subtree and the cards with a tag. An empty scope is
+// the whole zettelkasten.
+type ChatScope struct {
+	// CardPKs are pinned cards, which are always given to the model in full.
+	CardPKs []int `json:"card_pks"`
+	// Subtree is the card_id of a card whose descendants are in scope.
+	Subtree string `json:"subtree"`
+	Tag     string `json:"tag"`
+}
+
+func (s ChatScope) IsEmpty() bool {
+	return len(s.CardPKs) == 0 && s.Subtree == "" && s.Tag == ""
 }
 
 type ChatData struct {
 	ChatCompletions []ChatCompletion `json:"chat_completions"`
 }
 
-const MODEL = "gpt-3.5-turbo"
-
 type ConversationSummary struct {
 	ID           string    `json:"id"`
 	MessageCount int       `json:"message_count"`
@@ -97,6 +132,7 @@ type ConversationSummary struct {
 	Model        string    `json:"model"`
 	Title        string    `json:"title"`
 	UserID       int       `json:"user_id"`
+	Scope        ChatScope `json:"scope"`
 }
 
 type ChatOption = string
@@ -105,4 +141,29 @@ const (
 	Chat     ChatOption = "Chat"
 	Cards    ChatOption = "Cards"
 	UserInfo ChatOption = "UserInfo"
+	Tools    ChatOption = "Tools"
 )
+
+const (
+	ChatActionPending  = "pending"
+	ChatActionApplying = "applying"
+	ChatActionApplied  = "applied"
+	ChatActionRejected = "rejected"
+	ChatActionFailed   = "failed"
+)
+
+// ChatAction is a change to the zettelkasten that the assistant proposed
+// with a tool call. It is only applied once the user confirms it.
+type ChatAction struct {
+	ID             int        `json:"id"`
+	UserID         int        `json:"user_id"`
+	ConversationID string     `json:"conversation_id"`
+	SequenceNumber int        `json:"sequence_number"`
+	Tool           string     `json:"tool"`
+	Arguments      string     `json:"arguments"`
+	Description    string     `json:"description"`
+	Status         string     `json:"status"`
+	Result         string     `json:"result"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ResolvedAt     *time.Time `json:"resolved_at"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// ClozeDeletion is a single `{{cN::text}}` or `{{cN::text::hint}}` occurrence
+// in a card body. Several deletions can share an index, in which case they are
+// reviewed together.
+type ClozeDeletion struct {
+	Index int    `json:"index"`
+	Text  string `json:"text"`
+	Hint  string `json:"hint"`
+}
+
+type ClozeItem struct {
+	ID         int        `json:"id"`
+	CardPK     int        `json:"card_pk"`
+	CardID     string     `json:"card_id"`
+	Title      string     `json:"title"`
+	ClozeIndex int        `json:"cloze_index"`
+	Prompt     string     `json:"prompt"`
+	Answer     string     `json:"answer"`
+	State      string     `json:"state"`
+	Reps       int        `json:"reps"`
+	Lapses     int        `json:"lapses"`
+	LastReview *time.Time `json:"last_review,omitempty"`
+	Due        *time.Time `json:"due,omitempty"`
+	Difficulty float64    `json:"difficulty"`
+	Stability  float64    `json:"stability"`
+}
+
+type ClozeReviewParams struct {
+	CardPK     int `json:"card_pk"`
+	ClozeIndex int `json:"cloze_index"`
+	Rating     int `json:"rating"`
+}
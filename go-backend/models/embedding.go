@@ -1,6 +1,10 @@
 package models
 
 import (
+	"database/sql"
+	"fmt"
+	"time"
+
 	"github.com/pgvector/pgvector-go"
 )
 
@@ -10,4 +14,108 @@ type Embedding struct {
 	UserID    int             `json:"user_id"`
 	Chunk     int             `json:"chunk"`
 	Embedding pgvector.Vector `json:"embedding"`
+	Model     string          `json:"model"`
+}
+
+// Embedder turns text into vectors. Retrieval models embed search queries
+// differently from the documents they search, so callers say which they have.
+type Embedder interface {
+	// Embed returns one vector per text, in the same order.
+	Embed(texts []string, forQuery bool) ([]pgvector.Vector, error)
+	// Model names the model, so vectors from different models are not mixed.
+	Model() string
+	Dimensions() int
+}
+
+// EmbeddingModelID identifies the vectors an embedder makes. It is stored
+// with every vector, and vectors are only compared with others of the same
+// id.
+func EmbeddingModelID(e Embedder) string {
+	if e == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s@%d", e.Model(), e.Dimensions())
+}
+
+// EmbeddingMigration re-embeds every card and entity with a new model. The
+// old model keeps serving searches until all of them are done.
+type EmbeddingMigration struct {
+	ID            int        `json:"id"`
+	FromModel     string     `json:"from_model"`
+	ToModel       string     `json:"to_model"`
+	Status        string     `json:"status"`
+	LastError     string     `json:"last_error"`
+	CardsTotal    int        `json:"cards_total"`
+	CardsDone     int        `json:"cards_done"`
+	EntitiesTotal int        `json:"entities_total"`
+	EntitiesDone  int        `json:"entities_done"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	FinishedAt    *time.Time `json:"finished_at"`
+}
+
+// EmbeddingQueue hands cards to the embedding worker. The jobs themselves
+// are kept in the embedding_jobs table so they survive a restart; Wake only
+// spares the worker from waiting for its next poll.
+type EmbeddingQueue struct {
+	DB   *sql.DB
+	Wake chan struct{}
+}
+
+func NewEmbeddingQueue(db *sql.DB) *EmbeddingQueue {
+	return &EmbeddingQueue{
+		DB:   db,
+		Wake: make(chan struct{}, 1),
+	}
+}
+
+// Notify tells the worker there is new work without blocking.
+func (q *EmbeddingQueue) Notify() {
+	if q == nil {
+		return
+	}
+	select {
+	case q.Wake <- struct{}{}:
+	default:
+	}
+}
+
+const (
+	EmbeddingPending = "pending"
+	EmbeddingRunning = "running"
+	EmbeddingDone    = "done"
+	EmbeddingFailed  = "failed"
+	// EmbeddingMissing is shown for cards that were never queued and have
+	// no embeddings, such as cards from before the queue existed.
+	EmbeddingMissing = "missing"
+)
+
+// EmbeddingJob embeds every chunk of one card. Generation goes up each time
+// the card is queued again, so a worker still busy with an older version
+// does not mark the newer one done.
+type EmbeddingJob struct {
+	ID         int
+	UserID     int
+	CardPK     int
+	Status     string
+	Attempts   int
+	LastError  string
+	Generation int
+	RunAfter   time.Time
+}
+
+type CardEmbeddingStatus struct {
+	CardPK      int        `json:"card_pk"`
+	CardID      string     `json:"card_id"`
+	Title       string     `json:"title"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error"`
+	NextAttempt *time.Time `json:"next_attempt"`
+	UpdatedAt   *time.Time `json:"updated_at"`
+}
+
+type EmbeddingStatusResponse struct {
+	Counts map[string]int        `json:"counts"`
+	Cards  []CardEmbeddingStatus `json:"cards"`
 }
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// ReindexRun rebuilds the chunks, embeddings and/or entities of the cards in
+// its scope. Cards are worked through in id order and LastCardPK records how
+// far it got, so an interrupted run can be resumed.
+type ReindexRun struct {
+	ID            int        `json:"id"`
+	RequestedBy   *int       `json:"requested_by"`
+	Scope         string     `json:"scope"`
+	UserID        int        `json:"user_id"`
+	CardPK        int        `json:"card_pk"`
+	Parts         []string   `json:"parts"`
+	Concurrency   int        `json:"concurrency"`
+	Status        string     `json:"status"`
+	Total         int        `json:"total"`
+	Processed     int        `json:"processed"`
+	FailedCardPKs []int      `json:"failed_card_pks"`
+	LastCardPK    int        `json:"last_card_pk"`
+	LastError     string     `json:"last_error"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	FinishedAt    *time.Time `json:"finished_at"`
+}
+
+type ReindexParams struct {
+	Scope       string   `json:"scope"`
+	UserID      int      `json:"user_id"`
+	CardPK      int      `json:"card_pk"`
+	Parts       []string `json:"parts"`
+	Concurrency int      `json:"concurrency"`
+}
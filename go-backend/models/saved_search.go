@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+type SavedSearch struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	Name        string    `json:"name"`
+	SearchTerm  string    `json:"search_term"`
+	SearchType  string    `json:"search_type"`
+	ResultLimit int       `json:"result_limit"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type EditSavedSearchParams struct {
+	Name        string `json:"name"`
+	SearchTerm  string `json:"search_term"`
+	SearchType  string `json:"search_type"`
+	ResultLimit int    `json:"result_limit"`
+}
+
+type SavedSearchResults struct {
+	SavedSearch SavedSearch    `json:"saved_search"`
+	Results     []SearchResult `json:"results"`
+	Error       string         `json:"error,omitempty"`
+}
+
+type Dashboard struct {
+	Card     Card                 `json:"card"`
+	Searches []SavedSearchResults `json:"searches"`
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -30,6 +31,98 @@ func CardChunkToSearchResult(chunk CardChunk) SearchResult {
 			"shared_entities":   chunk.SharedEntities,
 			"entity_similarity": chunk.EntitySimilarity,
 			"semantic_ranking":  chunk.Ranking,
+			"explanation":       chunk.Explanation,
 		},
 	}
 }
+
+const MAX_RANKING_CANDIDATES = 500
+
+// RankingConfig controls how semantic search blends its signals. The combined
+// score of a chunk is
+//
+//	SemanticWeight * (1 - distance)
+//	+ EntityWeight * (1 - entity distance)
+//	+ SharedEntitiesWeight * min(entities / 5, 1)
+//
+// CandidateCount is how many of the closest chunks are scored, or 0 to score
+// every chunk, so that a card with strong entity matches is not cut before
+// its entities are counted. ResultLimit is how many of those are returned.
+type RankingConfig struct {
+	SemanticWeight       float64 `json:"semantic_weight"`
+	EntityWeight         float64 `json:"entity_weight"`
+	SharedEntitiesWeight float64 `json:"shared_entities_weight"`
+	CandidateCount       int     `json:"candidate_count"`
+	ResultLimit          int     `json:"result_limit"`
+}
+
+func DefaultRankingConfig() RankingConfig {
+	return RankingConfig{
+		SemanticWeight:       0.4,
+		EntityWeight:         0.4,
+		SharedEntitiesWeight: 0.2,
+		CandidateCount:       0,
+		ResultLimit:          50,
+	}
+}
+
+func (c RankingConfig) Validate() error {
+	if c.SemanticWeight < 0 || c.EntityWeight < 0 || c.SharedEntitiesWeight < 0 {
+		return fmt.Errorf("weights cannot be negative")
+	}
+	if c.SemanticWeight+c.EntityWeight+c.SharedEntitiesWeight == 0 {
+		return fmt.Errorf("at least one weight must be positive")
+	}
+	if c.CandidateCount < 0 || c.CandidateCount > MAX_RANKING_CANDIDATES {
+		return fmt.Errorf("candidate count must be between 0 and %d", MAX_RANKING_CANDIDATES)
+	}
+	if c.ResultLimit < 1 || (c.CandidateCount > 0 && c.ResultLimit > c.CandidateCount) {
+		return fmt.Errorf("result limit must be between 1 and the candidate count")
+	}
+	return nil
+}
+
+// RankingExplanation records why a chunk was ranked where it was. The scores
+// are the weighted parts of the combined score, so they add up to it.
+type RankingExplanation struct {
+	ChunkID           int      `json:"chunk_id"`
+	Chunk             string   `json:"chunk"`
+	Distance          float64  `json:"distance"`
+	SharedEntities    []string `json:"shared_entities"`
+	EntitySimilarity  float64  `json:"entity_similarity"`
+	SemanticScore     float64  `json:"semantic_score"`
+	EntityScore       float64  `json:"entity_score"`
+	SharedEntityScore float64  `json:"shared_entity_score"`
+	CombinedScore     float64  `json:"combined_score"`
+	RerankerScore     *float64 `json:"reranker_score"`
+}
+
+type AutocompleteSuggestion struct {
+	Kind  string  `json:"kind"`
+	ID    int     `json:"id"`
+	Value string  `json:"value"`
+	Label string  `json:"label"`
+	Score float64 `json:"score"`
+}
+
+// SearchFacet is one value present in a set of results. Filter is the query
+// language expression that narrows a search to it.
+type SearchFacet struct {
+	Value  string `json:"value"`
+	Label  string `json:"label"`
+	Count  int    `json:"count"`
+	Filter string `json:"filter"`
+}
+
+type SearchFacets struct {
+	Tags        []SearchFacet `json:"tags"`
+	Entities    []SearchFacet `json:"entities"`
+	EntityTypes []SearchFacet `json:"entity_types"`
+	Branches    []SearchFacet `json:"branches"`
+	Years       []SearchFacet `json:"years"`
+}
+
+type FacetedSearchResults struct {
+	Results []SearchResult `json:"results"`
+	Facets  SearchFacets   `json:"facets"`
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-backend/handlers"
+	"go-backend/models"
+	"os"
+	"strings"
+)
+
+// runReindexCommand rebuilds chunks, embeddings and entities from the
+// command line, with the same configuration as the server:
+//
+//	go-backend reindex -user 3
+//	go-backend reindex -card 120 -parts chunks,embeddings,entities
+//	go-backend reindex -concurrency 8
+//	go-backend reindex -resume 12
+//
+// Without -user or -card every card is rebuilt. The run is recorded like
+// one started from the admin endpoint, so either can resume it.
+func runReindexCommand(h *handlers.Handler, args []string) int {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	userID := flags.Int("user", 0, "only rebuild this user's cards")
+	cardPK := flags.Int("card", 0, "only rebuild this card")
+	parts := flags.String("parts", strings.Join(handlers.DEFAULT_REINDEX_PARTS, ","), "comma separated parts to rebuild, out of "+strings.Join(handlers.REINDEX_PARTS, ", "))
+	concurrency := flags.Int("concurrency", handlers.DEFAULT_REINDEX_CONCURRENCY, "cards to rebuild at once")
+	resume := flags.Int("resume", 0, "resume the run with this id")
+	flags.Parse(args)
+
+	runID := *resume
+	if runID == 0 {
+		params := models.ReindexParams{
+			Scope:       "all",
+			UserID:      *userID,
+			CardPK:      *cardPK,
+			Parts:       strings.Split(*parts, ","),
+			Concurrency: *concurrency,
+		}
+		if *cardPK != 0 {
+			params.Scope = "card"
+			params.UserID = 0
+		} else if *userID != 0 {
+			params.Scope = "user"
+		}
+		run, err := h.CreateReindexRun(nil, params)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		runID = run.ID
+	}
+	fmt.Printf("reindex run %d\n", runID)
+
+	run, err := h.RunReindex(runID, func(run models.ReindexRun) {
+		fmt.Printf("%d/%d cards, %d failed\n", run.Processed, run.Total, len(run.FailedCardPKs))
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\nresume with: reindex -resume %d\n", err, runID)
+		return 1
+	}
+	fmt.Printf("done: %d cards, %d failed\n", run.Processed, len(run.FailedCardPKs))
+	if len(run.FailedCardPKs) > 0 {
+		fmt.Printf("failed cards: %v\nlast error: %s\n", run.FailedCardPKs, run.LastError)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,9 @@
+CREATE SEQUENCE IF NOT EXISTS flashcard_reviews_id_seq OWNED BY flashcard_reviews.id;
+ALTER TABLE flashcard_reviews ALTER COLUMN id SET DEFAULT nextval('flashcard_reviews_id_seq');
+ALTER TABLE flashcard_reviews ADD COLUMN state text;
+ALTER TABLE flashcard_reviews ADD COLUMN stability real DEFAULT 0;
+ALTER TABLE flashcard_reviews ADD COLUMN difficulty real DEFAULT 0;
+ALTER TABLE flashcard_reviews ADD COLUMN elapsed_days int DEFAULT 0;
+ALTER TABLE flashcard_reviews ADD COLUMN scheduled_days int DEFAULT 0;
+ALTER TABLE flashcard_reviews ADD COLUMN due TIMESTAMP;
+CREATE INDEX IF NOT EXISTS flashcard_reviews_card_pk_idx ON flashcard_reviews (card_pk);
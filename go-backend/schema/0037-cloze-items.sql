@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS cloze_items (
+    id SERIAL PRIMARY KEY,
+    card_pk INT NOT NULL,
+    user_id INT NOT NULL,
+    cloze_index INT NOT NULL,
+    is_deleted BOOLEAN DEFAULT FALSE,
+    state TEXT DEFAULT 'new',
+    reps INT DEFAULT 0,
+    lapses INT DEFAULT 0,
+    last_review TIMESTAMP,
+    due TIMESTAMP,
+    difficulty REAL DEFAULT 0,
+    stability REAL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (card_pk) REFERENCES cards(id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    UNIQUE (card_pk, cloze_index)
+);
+
+ALTER TABLE flashcard_reviews ADD COLUMN cloze_index INT;
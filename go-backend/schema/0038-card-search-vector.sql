@@ -0,0 +1,6 @@
+ALTER TABLE cards ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('english', coalesce(body, '')), 'B')
+) STORED;
+
+CREATE INDEX IF NOT EXISTS cards_search_vector_idx ON cards USING GIN (search_vector);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS saved_searches (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    name TEXT NOT NULL,
+    search_term TEXT NOT NULL DEFAULT '',
+    search_type TEXT NOT NULL DEFAULT 'classic',
+    result_limit INT NOT NULL DEFAULT 20,
+    is_deleted BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS saved_searches_user_name ON saved_searches (user_id, name) WHERE is_deleted = FALSE;
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN search_ranking JSONB;
@@ -0,0 +1,10 @@
+ALTER TABLE files ADD COLUMN extracted_text TEXT;
+
+CREATE INDEX IF NOT EXISTS tasks_search_idx ON tasks
+USING GIN (to_tsvector('english', COALESCE(title, '')));
+
+CREATE INDEX IF NOT EXISTS entities_search_idx ON entities
+USING GIN ((setweight(to_tsvector('english', COALESCE(name, '')), 'A') || setweight(to_tsvector('english', COALESCE(description, '')), 'B')));
+
+CREATE INDEX IF NOT EXISTS files_search_idx ON files
+USING GIN ((setweight(to_tsvector('english', COALESCE(name, '')), 'A') || setweight(to_tsvector('english', COALESCE(extracted_text, '')), 'B')));
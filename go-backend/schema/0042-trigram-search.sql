@@ -0,0 +1,6 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS cards_card_id_trgm_idx ON cards USING GIN (card_id gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS cards_title_trgm_idx ON cards USING GIN (title gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS tags_name_trgm_idx ON tags USING GIN (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS entities_name_trgm_idx ON entities USING GIN (name gin_trgm_ops);
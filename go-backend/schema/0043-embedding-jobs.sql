@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS embedding_jobs (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    card_pk INT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    generation INT NOT NULL DEFAULT 1,
+    run_after TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (card_pk) REFERENCES cards(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS embedding_jobs_card ON embedding_jobs (card_pk);
+CREATE INDEX IF NOT EXISTS embedding_jobs_due ON embedding_jobs (run_after) WHERE status IN ('pending', 'running');
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS reindex_runs (
+    id SERIAL PRIMARY KEY,
+    requested_by INT,
+    scope TEXT NOT NULL,
+    user_id INT NOT NULL DEFAULT 0,
+    card_pk INT NOT NULL DEFAULT 0,
+    parts TEXT[] NOT NULL,
+    concurrency INT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    total INT NOT NULL DEFAULT 0,
+    processed INT NOT NULL DEFAULT 0,
+    failed_card_pks INT[] NOT NULL DEFAULT '{}',
+    last_card_pk INT NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP
+);
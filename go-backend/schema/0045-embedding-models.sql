@@ -0,0 +1,24 @@
+-- Vectors before this migration all came from mxbai-embed-large.
+ALTER TABLE card_embeddings ADD COLUMN model TEXT NOT NULL DEFAULT '';
+UPDATE card_embeddings SET model = 'mxbai-embed-large@1024';
+ALTER TABLE card_embeddings ALTER COLUMN embedding TYPE vector;
+CREATE INDEX IF NOT EXISTS card_embeddings_card_model ON card_embeddings (card_pk, model);
+
+ALTER TABLE entities ADD COLUMN embedding_model TEXT NOT NULL DEFAULT '';
+UPDATE entities SET embedding_model = 'mxbai-embed-large@1024' WHERE embedding IS NOT NULL;
+ALTER TABLE entities ALTER COLUMN embedding TYPE vector;
+-- next_embedding holds the vector from the model being migrated to, until
+-- the switch-over moves it into embedding.
+ALTER TABLE entities ADD COLUMN next_embedding vector;
+ALTER TABLE entities ADD COLUMN next_embedding_model TEXT;
+
+CREATE TABLE IF NOT EXISTS embedding_migrations (
+    id SERIAL PRIMARY KEY,
+    from_model TEXT NOT NULL,
+    to_model TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'running',
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP
+);
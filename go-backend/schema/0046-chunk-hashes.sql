@@ -0,0 +1,9 @@
+-- content_hash is the hex sha256 of the chunk text, see llms.ChunkHash.
+-- A vector is kept for as long as a chunk with the same hash exists.
+ALTER TABLE card_chunks ADD COLUMN content_hash TEXT NOT NULL DEFAULT '';
+UPDATE card_chunks SET content_hash = encode(sha256(convert_to(chunk_text, 'UTF8')), 'hex');
+
+ALTER TABLE card_embeddings ADD COLUMN content_hash TEXT NOT NULL DEFAULT '';
+UPDATE card_embeddings ce SET content_hash = cc.content_hash
+FROM card_chunks cc
+WHERE cc.card_pk = ce.card_pk AND cc.chunk_id = ce.chunk;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS chat_actions (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    conversation_id TEXT NOT NULL,
+    sequence_number INT NOT NULL,
+    tool TEXT NOT NULL,
+    arguments JSONB NOT NULL,
+    description TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    result TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS chat_actions_conversation_idx ON chat_actions (user_id, conversation_id);
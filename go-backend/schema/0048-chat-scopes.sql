@@ -0,0 +1,3 @@
+ALTER TABLE chat_conversations ADD COLUMN IF NOT EXISTS scope_card_pks INT[] NOT NULL DEFAULT '{}';
+ALTER TABLE chat_conversations ADD COLUMN IF NOT EXISTS scope_subtree TEXT NOT NULL DEFAULT '';
+ALTER TABLE chat_conversations ADD COLUMN IF NOT EXISTS scope_tag TEXT NOT NULL DEFAULT '';
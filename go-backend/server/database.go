@@ -48,6 +48,13 @@ func ResetDatabase(S *Server) error {
 			DROP TABLE IF EXISTS chat_conversations CASCADE;
 			DROP TABLE IF EXISTS entities CASCADE;
 			DROP TABLE IF EXISTS entity_card_junction CASCADE;
+			DROP TABLE IF EXISTS flashcard_reviews CASCADE;
+			DROP TABLE IF EXISTS cloze_items CASCADE;
+			DROP TABLE IF EXISTS saved_searches CASCADE;
+			DROP TABLE IF EXISTS embedding_jobs CASCADE;
+			DROP TABLE IF EXISTS reindex_runs CASCADE;
+			DROP TABLE IF EXISTS embedding_migrations CASCADE;
+			DROP TABLE IF EXISTS chat_actions CASCADE;
 
 			CREATE TABLE IF NOT EXISTS migrations (
 				id SERIAL PRIMARY KEY,
@@ -3,6 +3,7 @@ package server
 import (
 	"database/sql"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go-backend/llms"
 	"go-backend/mail"
 	"go-backend/models"
 )
@@ -17,6 +18,12 @@ type Server struct {
 	TestInspector *TestInspector
 	SchemaDir     string
 	LLMClient     *models.LLMClient
+	// Reranker rescores search results; nil leaves them in retrieval order
+	Reranker llms.Reranker
+	// DisableReranking skips the reranking pass on search results
+	DisableReranking bool
+	// Chunker sizes the chunks cards are split into for embedding
+	Chunker llms.ChunkerConfig
 }
 
 type TestInspector struct {
@@ -0,0 +1,253 @@
+// Package srs implements spaced repetition scheduling for flashcards using
+// the FSRS-4.5 algorithm.
+package srs
+
+import (
+	"math"
+	"time"
+)
+
+// Rating follows the numbering used by the frontend, which is one lower
+// than the grades used in the FSRS papers.
+type Rating int
+
+const (
+	Again Rating = iota
+	Hard
+	Good
+	Easy
+)
+
+func (r Rating) Valid() bool {
+	return r >= Again && r <= Easy
+}
+
+// grade converts a rating to the 1-4 scale used by the FSRS formulas.
+func (r Rating) grade() float64 {
+	return float64(r) + 1
+}
+
+type State string
+
+const (
+	New        State = "new"
+	Learning   State = "learning"
+	Review     State = "review"
+	Relearning State = "relearning"
+)
+
+const (
+	DECAY  = -0.5
+	FACTOR = 19.0 / 81.0
+)
+
+// DefaultWeights are the published FSRS-4.5 default parameters.
+var DefaultWeights = [17]float64{
+	0.4872, 1.4003, 3.7145, 13.8206, 5.1618, 1.2298, 0.8975, 0.031,
+	1.6474, 0.1367, 1.0461, 2.1072, 0.0793, 0.3246, 1.587, 0.2272, 2.8755,
+}
+
+type Card struct {
+	State      State
+	Reps       int
+	Lapses     int
+	Stability  float64
+	Difficulty float64
+	Due        time.Time
+	LastReview *time.Time
+}
+
+type ReviewLog struct {
+	Rating        Rating
+	State         State
+	Stability     float64
+	Difficulty    float64
+	ElapsedDays   int
+	ScheduledDays int
+	Due           time.Time
+	Reviewed      time.Time
+}
+
+type Scheduler struct {
+	Weights          [17]float64
+	RequestRetention float64
+	MaximumInterval  int
+}
+
+func NewScheduler() Scheduler {
+	return Scheduler{
+		Weights:          DefaultWeights,
+		RequestRetention: 0.9,
+		MaximumInterval:  36500,
+	}
+}
+
+// Review applies a rating to a card and returns the rescheduled card along
+// with a log entry describing the review.
+func (s Scheduler) Review(card Card, rating Rating, now time.Time) (Card, ReviewLog) {
+	if card.State == "" {
+		card.State = New
+	}
+	elapsedDays := 0.0
+	if card.LastReview != nil && card.State != New {
+		elapsedDays = math.Max(0, now.Sub(*card.LastReview).Hours()/24)
+	}
+
+	next := card
+	next.Reps = card.Reps + 1
+	reviewed := now
+	next.LastReview = &reviewed
+	scheduledDays := 0
+
+	switch card.State {
+	case New:
+		next.Difficulty = s.initDifficulty(rating)
+		next.Stability = s.initStability(rating)
+		switch rating {
+		case Again:
+			next.State = Learning
+			next.Due = now.Add(1 * time.Minute)
+		case Hard:
+			next.State = Learning
+			next.Due = now.Add(5 * time.Minute)
+		case Good:
+			next.State = Learning
+			next.Due = now.Add(10 * time.Minute)
+		case Easy:
+			scheduledDays = s.nextInterval(next.Stability)
+			next.State = Review
+			next.Due = now.AddDate(0, 0, scheduledDays)
+		}
+
+	case Learning, Relearning:
+		next.Difficulty = s.nextDifficulty(card.Difficulty, rating)
+		switch rating {
+		case Again:
+			next.Due = now.Add(5 * time.Minute)
+		case Hard:
+			next.Due = now.Add(10 * time.Minute)
+		case Good:
+			scheduledDays = s.nextInterval(card.Stability)
+			next.State = Review
+			next.Due = now.AddDate(0, 0, scheduledDays)
+		case Easy:
+			// as in py-fsrs, learning steps leave the stability as it is, so
+			// Easy only graduates the card a day later than Good would
+			scheduledDays = s.nextInterval(card.Stability) + 1
+			next.State = Review
+			next.Due = now.AddDate(0, 0, scheduledDays)
+		}
+
+	case Review:
+		retrievability := s.forgettingCurve(elapsedDays, card.Stability)
+		next.Difficulty = s.nextDifficulty(card.Difficulty, rating)
+		if rating == Again {
+			next.Lapses = card.Lapses + 1
+			next.Stability = s.nextForgetStability(card.Difficulty, card.Stability, retrievability)
+			next.State = Relearning
+			next.Due = now.Add(10 * time.Minute)
+			break
+		}
+
+		hardStability := s.nextRecallStability(card.Difficulty, card.Stability, retrievability, Hard)
+		goodStability := s.nextRecallStability(card.Difficulty, card.Stability, retrievability, Good)
+		easyStability := s.nextRecallStability(card.Difficulty, card.Stability, retrievability, Easy)
+
+		hardInterval := s.nextInterval(hardStability)
+		goodInterval := max(s.nextInterval(goodStability), hardInterval+1)
+		easyInterval := max(s.nextInterval(easyStability), goodInterval+1)
+
+		switch rating {
+		case Hard:
+			next.Stability = hardStability
+			scheduledDays = hardInterval
+		case Good:
+			next.Stability = goodStability
+			scheduledDays = goodInterval
+		case Easy:
+			next.Stability = easyStability
+			scheduledDays = easyInterval
+		}
+		next.State = Review
+		next.Due = now.AddDate(0, 0, scheduledDays)
+	}
+
+	log := ReviewLog{
+		Rating:        rating,
+		State:         card.State,
+		Stability:     next.Stability,
+		Difficulty:    next.Difficulty,
+		ElapsedDays:   int(elapsedDays),
+		ScheduledDays: scheduledDays,
+		Due:           next.Due,
+		Reviewed:      now,
+	}
+	return next, log
+}
+
+// Retrievability is the estimated probability of recalling the card now.
+func (s Scheduler) Retrievability(card Card, now time.Time) float64 {
+	if card.State == New || card.State == "" || card.LastReview == nil {
+		return 0
+	}
+	elapsedDays := math.Max(0, now.Sub(*card.LastReview).Hours()/24)
+	return s.forgettingCurve(elapsedDays, card.Stability)
+}
+
+func (s Scheduler) initStability(rating Rating) float64 {
+	return math.Max(s.Weights[rating], 0.1)
+}
+
+func (s Scheduler) initDifficulty(rating Rating) float64 {
+	return clampDifficulty(s.Weights[4] - s.Weights[5]*(rating.grade()-3))
+}
+
+func (s Scheduler) nextDifficulty(difficulty float64, rating Rating) float64 {
+	next := difficulty - s.Weights[6]*(rating.grade()-3)
+	return clampDifficulty(s.meanReversion(s.initDifficulty(Good), next))
+}
+
+func (s Scheduler) meanReversion(init float64, current float64) float64 {
+	return s.Weights[7]*init + (1-s.Weights[7])*current
+}
+
+func (s Scheduler) forgettingCurve(elapsedDays float64, stability float64) float64 {
+	if stability <= 0 {
+		return 0
+	}
+	return math.Pow(1+FACTOR*elapsedDays/stability, DECAY)
+}
+
+func (s Scheduler) nextInterval(stability float64) int {
+	interval := stability / FACTOR * (math.Pow(s.RequestRetention, 1/DECAY) - 1)
+	return min(max(int(math.Round(interval)), 1), s.MaximumInterval)
+}
+
+func (s Scheduler) nextRecallStability(difficulty, stability, retrievability float64, rating Rating) float64 {
+	hardPenalty := 1.0
+	if rating == Hard {
+		hardPenalty = s.Weights[15]
+	}
+	easyBonus := 1.0
+	if rating == Easy {
+		easyBonus = s.Weights[16]
+	}
+	return stability * (1 + math.Exp(s.Weights[8])*
+		(11-difficulty)*
+		math.Pow(stability, -s.Weights[9])*
+		(math.Exp((1-retrievability)*s.Weights[10])-1)*
+		hardPenalty*
+		easyBonus)
+}
+
+func (s Scheduler) nextForgetStability(difficulty, stability, retrievability float64) float64 {
+	next := s.Weights[11] *
+		math.Pow(difficulty, -s.Weights[12]) *
+		(math.Pow(stability+1, s.Weights[13]) - 1) *
+		math.Exp((1-retrievability)*s.Weights[14])
+	return math.Max(math.Min(next, stability), 0.1)
+}
+
+func clampDifficulty(difficulty float64) float64 {
+	return math.Min(math.Max(difficulty, 1), 10)
+}
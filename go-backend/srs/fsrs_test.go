@@ -0,0 +1,118 @@
+package srs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReviewNewCard(t *testing.T) {
+	s := NewScheduler()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	card, log := s.Review(Card{State: New}, Good, now)
+	if card.State != Learning {
+		t.Errorf("wrong state, got %v want %v", card.State, Learning)
+	}
+	if card.Reps != 1 {
+		t.Errorf("wrong reps, got %v want %v", card.Reps, 1)
+	}
+	if card.Stability != DefaultWeights[Good] {
+		t.Errorf("wrong stability, got %v want %v", card.Stability, DefaultWeights[Good])
+	}
+	if card.Difficulty != DefaultWeights[4] {
+		t.Errorf("wrong difficulty, got %v want %v", card.Difficulty, DefaultWeights[4])
+	}
+	if !card.Due.After(now) {
+		t.Errorf("card should be due in the future, got %v", card.Due)
+	}
+	if log.State != New {
+		t.Errorf("log should record the previous state, got %v", log.State)
+	}
+
+	easy, _ := s.Review(Card{State: New}, Easy, now)
+	if easy.State != Review {
+		t.Errorf("easy card should graduate, got %v", easy.State)
+	}
+	if easy.Due.Sub(now) < 24*time.Hour {
+		t.Errorf("easy card should be due in days, got %v", easy.Due.Sub(now))
+	}
+}
+
+func TestReviewGraduatesLearningCard(t *testing.T) {
+	s := NewScheduler()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	card, _ := s.Review(Card{State: New}, Good, now)
+	card, log := s.Review(card, Good, now.Add(10*time.Minute))
+	if card.State != Review {
+		t.Errorf("wrong state, got %v want %v", card.State, Review)
+	}
+	if log.ScheduledDays < 1 {
+		t.Errorf("graduated card should be scheduled at least a day out, got %v", log.ScheduledDays)
+	}
+}
+
+func TestReviewEasyLearningCard(t *testing.T) {
+	s := NewScheduler()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	card, _ := s.Review(Card{State: New}, Good, now)
+	_, goodLog := s.Review(card, Good, now.Add(10*time.Minute))
+	easy, easyLog := s.Review(card, Easy, now.Add(10*time.Minute))
+	if easy.State != Review {
+		t.Errorf("wrong state, got %v want %v", easy.State, Review)
+	}
+	if easyLog.ScheduledDays != goodLog.ScheduledDays+1 {
+		t.Errorf("easy should graduate a day after good, got %v and %v", easyLog.ScheduledDays, goodLog.ScheduledDays)
+	}
+	if easy.Stability != card.Stability {
+		t.Errorf("learning steps should keep the stability, got %v want %v", easy.Stability, card.Stability)
+	}
+}
+
+func TestReviewIntervalsAreOrdered(t *testing.T) {
+	s := NewScheduler()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	last := now.AddDate(0, 0, -10)
+	card := Card{State: Review, Reps: 3, Stability: 10, Difficulty: 5, LastReview: &last}
+
+	hard, _ := s.Review(card, Hard, now)
+	good, _ := s.Review(card, Good, now)
+	easy, _ := s.Review(card, Easy, now)
+	if !hard.Due.Before(good.Due) || !good.Due.Before(easy.Due) {
+		t.Errorf("intervals out of order: hard %v good %v easy %v", hard.Due, good.Due, easy.Due)
+	}
+	if good.Stability <= card.Stability {
+		t.Errorf("successful recall should increase stability, got %v", good.Stability)
+	}
+}
+
+func TestReviewLapse(t *testing.T) {
+	s := NewScheduler()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	last := now.AddDate(0, 0, -10)
+	card := Card{State: Review, Reps: 3, Stability: 10, Difficulty: 5, LastReview: &last}
+
+	again, _ := s.Review(card, Again, now)
+	if again.State != Relearning {
+		t.Errorf("wrong state, got %v want %v", again.State, Relearning)
+	}
+	if again.Lapses != 1 {
+		t.Errorf("wrong lapses, got %v want %v", again.Lapses, 1)
+	}
+	if again.Stability >= card.Stability {
+		t.Errorf("lapse should reduce stability, got %v", again.Stability)
+	}
+	if again.Difficulty <= card.Difficulty {
+		t.Errorf("lapse should increase difficulty, got %v", again.Difficulty)
+	}
+}
+
+func TestRatingValid(t *testing.T) {
+	if Rating(-1).Valid() || Rating(4).Valid() {
+		t.Errorf("out of range ratings should be invalid")
+	}
+	if !Again.Valid() || !Easy.Valid() {
+		t.Errorf("in range ratings should be valid")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"go-backend/llms"
 	"go-backend/mail"
 	"go-backend/models"
 	"go-backend/server"
@@ -52,6 +53,7 @@ func Setup() *server.Server {
 	}
 	S.TestInspector = &server.TestInspector{}
 	S.LLMClient = &models.LLMClient{Testing: true}
+	S.Chunker = llms.DefaultChunkerConfig()
 
 	server.RunMigrations(S)
 	err = importTestData(S)